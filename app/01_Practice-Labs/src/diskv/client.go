@@ -4,7 +4,7 @@ package diskv
 // Tracks shardmaster config, routes to the correct replica group, and
 // retries requests across servers and configurations until they succeed.
 
-import "shardmaster"
+import "distributed-systems/app/01_Practice-Labs/src/shardmaster"
 import "net/rpc"
 import "time"
 import "sync"
@@ -18,6 +18,8 @@ const (
 	ErrNoKey      = "ErrNoKey"
 	ErrWrongGroup = "ErrWrongGroup"
 	ErrNoConfig   = "ErrNoConfig"
+	ErrKilled     = "ErrKilled"
+	ErrTimeout    = "ErrTimeout"
 	Nil           = ""
 )
 
@@ -1,25 +1,30 @@
 package diskv
 
 import "net"
+import "context"
 import "fmt"
 import "net/rpc"
 import "log"
 import "time"
-import "paxos"
+import "distributed-systems/app/01_Practice-Labs/src/paxos"
 import "sync"
 import "sync/atomic"
 import "os"
-import "syscall"
 import "encoding/gob"
 import "encoding/base32"
-import "math/rand"
-import "shardmaster"
+import "distributed-systems/app/01_Practice-Labs/src/shardmaster"
 import "io/ioutil"
 import "strconv"
 import "bytes"
+import "errors"
 
 const Debug = 0
 
+// how long an op may wait for Paxos before the server gives up and
+// lets the client try another server. Paxos stalls for good if a
+// majority of the group lost its state (see paxos/recover.go).
+const WaitTimeout = 10 * time.Second
+
 func DPrintf(format string, a ...interface{}) (n int, err error) {
 	if Debug > 0 {
 		fmt.Printf(format, a...)
@@ -59,11 +64,12 @@ type DisKV struct {
 	gid int64 // my replica group ID
 
 	// Your definitions here.
-	store  map[string]string  // key-value store
-	ret    map[int64]string   // client => lastest_reply in case of crash
-	ids    map[int64]int64    // client => highest_seq for at-most-once semantics
-	seq    int                // highest operation made on the store
-	config shardmaster.Config // our current configuration
+	store    map[string]string  // key-value store
+	ret      map[int64]string   // client => lastest_reply in case of crash
+	ids      map[int64]int64    // client => highest_seq for at-most-once semantics
+	seq      int                // highest operation made on the store
+	config   shardmaster.Config // our current configuration
+	restores int                // snapshots installed so far
 }
 
 // For shard re-alignment RPC's
@@ -119,30 +125,50 @@ func (kv *DisKV) decodeKey(filename string) (string, error) {
 	return string(key), err
 }
 
+// write data to fullname with a header recording its format
+// version and checksum, so that a damaged file is noticed.
+// uses rename() to make the replacement atomic with respect
+// to crashes.
+func (kv *DisKV) writeFile(fullname string, tempname string, data []byte) error {
+	if err := ioutil.WriteFile(tempname, paxos.EncodeFile(data), 0666); err != nil {
+		return err
+	}
+	if err := os.Rename(tempname, fullname); err != nil {
+		return err
+	}
+	return nil
+}
+
+// read a file written by writeFile. the error wraps
+// paxos.ErrCorrupt if the file is damaged.
+func (kv *DisKV) readFile(fullname string) ([]byte, error) {
+	content, err := ioutil.ReadFile(fullname)
+	if err != nil {
+		return nil, err
+	}
+	data, err := paxos.DecodeFile(content)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", fullname, err)
+	}
+	return data, nil
+}
+
 // read the content of a key's file.
 func (kv *DisKV) fileGet(shard int, key string) (string, error) {
 	fullname := kv.shardDir(shard) + "/key-" + kv.encodeKey(key)
-	content, err := ioutil.ReadFile(fullname)
+	content, err := kv.readFile(fullname)
 	return string(content), err
 }
 
 // replace the content of a key's file.
-// uses rename() to make the replacement atomic with
-// respect to crashes.
 func (kv *DisKV) filePut(shard int, key string, content string) error {
 	fullname := kv.shardDir(shard) + "/key-" + kv.encodeKey(key)
 	tempname := kv.shardDir(shard) + "/temp-" + kv.encodeKey(key)
-	if err := ioutil.WriteFile(tempname, []byte(content), 0666); err != nil {
-		return err
-	}
-	if err := os.Rename(tempname, fullname); err != nil {
-		return err
-	}
-	return nil
+	return kv.writeFile(fullname, tempname, []byte(content))
 }
 
 // return content of every key file in a given shard.
-func (kv *DisKV) fileReadShard(shard int) map[string]string {
+func (kv *DisKV) fileReadShard(shard int) (map[string]string, error) {
 	m := map[string]string{}
 	d := kv.shardDir(shard)
 	files, err := ioutil.ReadDir(d)
@@ -158,12 +184,12 @@ func (kv *DisKV) fileReadShard(shard int) map[string]string {
 			}
 			content, err := kv.fileGet(shard, key)
 			if err != nil {
-				log.Fatalf("fileReadShard fileGet failed for %v: %v", key, err)
+				return nil, err
 			}
 			m[key] = content
 		}
 	}
-	return m
+	return m, nil
 }
 
 // replace an entire shard directory.
@@ -178,10 +204,7 @@ func (kv *DisKV) fileReplaceShard(shard int, m map[string]string) {
 func (kv *DisKV) fileIncrementSeq(seq int) error {
 	fullname := kv.dir + "/seq"
 	tempname := kv.dir + "/seq-temp"
-	if err := ioutil.WriteFile(tempname, []byte(strconv.Itoa(seq)), 0666); err != nil {
-		return err
-	}
-	if err := os.Rename(tempname, fullname); err != nil {
+	if err := kv.writeFile(fullname, tempname, []byte(strconv.Itoa(seq))); err != nil {
 		return err
 	}
 
@@ -203,13 +226,7 @@ func (kv *DisKV) fileIncrementSeq(seq int) error {
 func (kv *DisKV) fileIncrementConfig(config int) error {
 	fullname := kv.dir + "/config"
 	tempname := kv.dir + "/config-temp"
-	if err := ioutil.WriteFile(tempname, []byte(strconv.Itoa(config)), 0666); err != nil {
-		return err
-	}
-	if err := os.Rename(tempname, fullname); err != nil {
-		return err
-	}
-	return nil
+	return kv.writeFile(fullname, tempname, []byte(strconv.Itoa(config)))
 }
 
 // Logs the current op while it is being done; so that recovery doesn't have to wait on Paxos
@@ -222,57 +239,55 @@ func (kv *DisKV) fileLogOp(op Op, seq int) error {
 
 	e.Encode(op)
 
-	if err := ioutil.WriteFile(tempname, w.Bytes(), 0666); err != nil {
-		return err
-	}
-	if err := os.Rename(tempname, fullname); err != nil {
-		return err
-	}
-	return nil
+	return kv.writeFile(fullname, tempname, w.Bytes())
 }
 
 // Retrieves the current op
 func (kv *DisKV) fileRetrieveOp(seq int) (Op, error) {
 	fullname := kv.dir + "/op-" + strconv.Itoa(seq)
 
-	content, err := ioutil.ReadFile(fullname)
+	var op Op
+	content, err := kv.readFile(fullname)
+	if err != nil {
+		return op, err
+	}
 	buf := bytes.NewBuffer(content)
 	d := gob.NewDecoder(buf)
-
-	var op Op
 	d.Decode(&op)
 
-	return op, err
+	return op, nil
 }
 
-// Recovers the sequence and config numbers
-func (kv *DisKV) fileRecoverPaxosInfo() (int, int) {
-	file_seq := kv.dir + "/seq"
-	s, _ := ioutil.ReadFile(file_seq)
-	file_config := kv.dir + "/config"
-	c, _ := ioutil.ReadFile(file_config)
-	seq, _ := strconv.Atoi(string(s))
-	config, _ := strconv.Atoi(string(c))
-	return seq, config
+// Recovers the sequence and config numbers; 0 for a file
+// that was never written
+func (kv *DisKV) fileRecoverPaxosInfo() (int, int, error) {
+	nums := []int{0, 0}
+	for i, name := range []string{"/seq", "/config"} {
+		content, err := kv.readFile(kv.dir + name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		if nums[i], err = strconv.Atoi(string(content)); err != nil {
+			return 0, 0, err
+		}
+	}
+	return nums[0], nums[1], nil
 }
 
 // Stores information about an append operation in progress
 func (kv *DisKV) fileTempAppend(seq int, content string) error {
 	fullname := kv.dir + "/append-" + strconv.Itoa(seq)
 	tempname := kv.dir + "/temp-append-" + strconv.Itoa(seq)
-	if err := ioutil.WriteFile(tempname, []byte(content), 0666); err != nil {
-		return err
-	}
-	if err := os.Rename(tempname, fullname); err != nil {
-		return err
-	}
-	return nil
+	return kv.writeFile(fullname, tempname, []byte(content))
 }
 
 // Gets information about an append operation that was in progress during a crash
 func (kv *DisKV) fileGetTempAppend(seq int) (string, error) {
 	fullname := kv.dir + "/append-" + strconv.Itoa(seq)
-	content, err := ioutil.ReadFile(fullname)
+	content, err := kv.readFile(fullname)
 	return string(content), err
 }
 
@@ -280,19 +295,13 @@ func (kv *DisKV) fileGetTempAppend(seq int) (string, error) {
 func (kv *DisKV) fileSetClientInfo(client int64, id int64, ret string) error {
 	fullname_id := kv.dir + "/ids/" + "client-" + strconv.Itoa(int(client))
 	tempname_id := kv.dir + "/ids/" + "temp-" + strconv.Itoa(int(client))
-	if err := ioutil.WriteFile(tempname_id, []byte(strconv.Itoa(int(id))), 0666); err != nil {
-		return err
-	}
-	if err := os.Rename(tempname_id, fullname_id); err != nil {
+	if err := kv.writeFile(fullname_id, tempname_id, []byte(strconv.Itoa(int(id)))); err != nil {
 		return err
 	}
 
 	fullname_res := kv.dir + "/results/" + "client-" + strconv.Itoa(int(client))
 	tempname_res := kv.dir + "/results/" + "temp-" + strconv.Itoa(int(client))
-	if err := ioutil.WriteFile(tempname_res, []byte(ret), 0666); err != nil {
-		return err
-	}
-	if err := os.Rename(tempname_res, fullname_res); err != nil {
+	if err := kv.writeFile(fullname_res, tempname_res, []byte(ret)); err != nil {
 		return err
 	}
 
@@ -300,14 +309,14 @@ func (kv *DisKV) fileSetClientInfo(client int64, id int64, ret string) error {
 }
 
 // Recovers client info from disk 
-func (kv *DisKV) fileRecoverClientInfo() (map[int64]int64, map[int64]string) {
+func (kv *DisKV) fileRecoverClientInfo() (map[int64]int64, map[int64]string, error) {
 	id := map[int64]int64{}
 	res := map[int64]string{}
 	d_id := kv.dir + "/ids/"
 	d_res := kv.dir + "/results/"
 	files, err := ioutil.ReadDir(d_id)
 	if err != nil {
-		log.Fatalf("fileRecoverClientInfo could not read %v: %v", d_id, err)
+		return nil, nil, err
 	}
 	for _, fi := range files {
 		n1 := fi.Name()
@@ -317,9 +326,9 @@ func (kv *DisKV) fileRecoverClientInfo() (map[int64]int64, map[int64]string) {
 				log.Fatalf("fileRecoverClientInfo-ids bad file name %v: %v", n1, err)
 			}
 			fullname := kv.dir + "/ids/" + n1
-			content, err := ioutil.ReadFile(fullname)
+			content, err := kv.readFile(fullname)
 			if err != nil {
-				log.Fatalf("fileRecoverClientInfo-ids fileGet failed for %v: %v", key, err)
+				return nil, nil, err
 			}
 			v, _ := strconv.Atoi(string(content))
 			k := int64(key)
@@ -329,7 +338,7 @@ func (kv *DisKV) fileRecoverClientInfo() (map[int64]int64, map[int64]string) {
 
 	files, err = ioutil.ReadDir(d_res)
 	if err != nil {
-		log.Fatalf("fileRecoverClientInfo could not read %v: %v", d_res, err)
+		return nil, nil, err
 	}
 	for _, fi := range files {
 		n1 := fi.Name()
@@ -339,14 +348,80 @@ func (kv *DisKV) fileRecoverClientInfo() (map[int64]int64, map[int64]string) {
 				log.Fatalf("fileRecoverClientInfo-results bad file name %v: %v", n1, err)
 			}
 			fullname := kv.dir + "/results/" + n1
-			content, err := ioutil.ReadFile(fullname)
+			content, err := kv.readFile(fullname)
 			if err != nil {
-				log.Fatalf("fileRecoverClientInfo-results fileGet failed for %v: %v", key, err)
+				return nil, nil, err
 			}
 			res[int64(key)] = string(content)
 		}
 	}
-	return id, res
+	return id, res, nil
+}
+
+// Recovers everything the server keeps on disk, returning an
+// error if any of it is damaged or was being replaced by a
+// snapshot during a crash
+func (kv *DisKV) fileRecover() error {
+	if _, err := os.Stat(kv.dir + "/restoring"); err == nil {
+		return fmt.Errorf("crashed while installing a snapshot")
+	}
+
+	// Recover client and operational info from disk
+	ids, ret, err := kv.fileRecoverClientInfo()
+	if err != nil {
+		return err
+	}
+	knownSeq, knownConfig, err := kv.fileRecoverPaxosInfo()
+	if err != nil {
+		return err
+	}
+
+	// Recover configuration by querying shardmaster
+	config := kv.sm.Query(knownConfig)
+
+	// load the key value store from disk
+	store := map[string]string{}
+	for shard, group := range config.Shards {
+		if group != kv.gid {
+			continue
+		}
+		shard_store, err := kv.fileReadShard(shard)
+		if err != nil {
+			return err
+		}
+		for k, v := range shard_store {
+			store[k] = v
+		}
+	}
+
+	kv.ids, kv.ret, kv.seq, kv.config, kv.store = ids, ret, knownSeq, config, store
+	return nil
+}
+
+// Throws away everything the server keeps on disk apart from
+// the Paxos log, and starts over from an empty state; the server
+// then catches up from the Paxos log and its peers like a new one
+func (kv *DisKV) fileReset() {
+	files, err := ioutil.ReadDir(kv.dir)
+	if err != nil {
+		log.Fatalf("fileReset could not read %v: %v", kv.dir, err)
+	}
+	for _, fi := range files {
+		if fi.Name() != "state" {
+			os.RemoveAll(kv.dir + "/" + fi.Name())
+		}
+	}
+	for _, d := range []string{"/ids/", "/results/"} {
+		if err := os.Mkdir(kv.dir+d, 0777); err != nil {
+			log.Fatalf("Mkdir(%v): %v", kv.dir+d, err)
+		}
+	}
+
+	kv.store = map[string]string{}
+	kv.ids = map[int64]int64{}
+	kv.ret = map[int64]string{}
+	kv.seq = 0
+	kv.config = shardmaster.Config{Num: -1}
 }
 
 // RPC handler for client Get requests
@@ -387,7 +462,10 @@ func (kv *DisKV) Inquire(args *InquireArgs, reply *InquireReply) error {
 
 	// mark this op in the log
 	op := Op{Inquire, uuid(), nil}
-	kv.execute(op)
+	if err, _ := kv.execute(op); err != OK {
+		reply.Err = err
+		return nil
+	}
 
 	reply.Store = map[string]string{}
 	reply.Seen = map[int64]int64{}
@@ -445,20 +523,43 @@ func (kv *DisKV) Reconfigure(config shardmaster.Config) bool {
 
 	args := ReconfigArgs{config, state}
 	op := Op{Reconfigure, uuid(), args}
-	kv.execute(op)
+	if err, _ := kv.execute(op); err != OK {
+		return false
+	}
 
 	return true
 }
 
-// wait for Paxos to decide on a sequence number for this op - blocking
-func (kv *DisKV) waitForPaxos(seq int) Op {
-	for to := 10 * time.Millisecond; ; {
-		if decided, val := kv.px.Status(seq); decided {
-			return val.(Op)
+// wait for Paxos to decide on a sequence number for this op - blocking.
+// ErrKilled if the server is killed first, ErrTimeout if nothing is
+// decided within WaitTimeout.
+func (kv *DisKV) waitForPaxos(seq int) (Op, Err) {
+	ctx, cancel := context.WithTimeout(context.Background(), WaitTimeout)
+	defer cancel()
+	for {
+		val, err := kv.px.Wait(ctx, seq)
+		if err == paxos.ErrKilled {
+			return Op{Nil, -1, nil}, ErrKilled
+		}
+		if err == context.DeadlineExceeded {
+			return Op{Nil, -1, nil}, ErrTimeout
+		}
+		if err != paxos.ErrForgotten {
+			return val.(Op), OK
+		}
+		// the rest of the group has moved past seq without us, as
+		// after we lost our state; fetch it, or install a snapshot,
+		// which advances kv.seq. retry until one succeeds or
+		// time is up.
+		restores := kv.restores
+		kv.px.CatchUp(seq, seq)
+		if kv.restores != restores {
+			return Op{Nil, -1, nil}, OK
 		}
-		if time.Sleep(to); to < 10*time.Second {
-			to *= 2
+		if ctx.Err() != nil {
+			return Op{Nil, -1, nil}, ErrTimeout
 		}
+		time.Sleep(10 * time.Millisecond)
 	}
 }
 
@@ -572,7 +673,17 @@ func (kv *DisKV) execute(op Op) (Err, string) {
 			res = t.(Op)
 		} else {
 			kv.px.Start(kv.seq, op)
-			res = kv.waitForPaxos(kv.seq)
+			var err Err
+			if res, err = kv.waitForPaxos(kv.seq); err != OK {
+				// leave kv.seq for the next op to try again
+				kv.seq--
+				kv.fileIncrementSeq(kv.seq)
+				return err, ""
+			}
+			if res.Name == Nil {
+				// a snapshot replaced everything up to kv.seq
+				continue
+			}
 		}
 
 		kv.fileLogOp(res, kv.seq)
@@ -594,6 +705,12 @@ func (kv *DisKV) restore() bool {
 	DPrintf("Restore: %d on server %d-%d.\n", kv.seq, kv.me, kv.gid)
 
 	res, err := kv.fileRetrieveOp(kv.seq)
+	if errors.Is(err, paxos.ErrCorrupt) {
+		// we may be part way through the op, with no way to tell
+		fmt.Printf("DisKV(%v-%v) %v; recovering state from peers\n", kv.gid, kv.me, err)
+		kv.fileReset()
+		return false
+	}
 	if err != nil {
 		DPrintf("Restore: %d did not reach log-op checkpoint; will resolve through Paxos; server %d-%d.\n", kv.seq, kv.me, kv.gid)
 		// decrement the local sequencing to be before the Paxos check
@@ -615,6 +732,11 @@ func (kv *DisKV) restore() bool {
 		} else {
 			DPrintf("Restoring Put-Append() on server %d-%d.\n", kv.me, kv.gid)
 			val, err := kv.fileGetTempAppend(kv.seq)
+			if errors.Is(err, paxos.ErrCorrupt) {
+				fmt.Printf("DisKV(%v-%v) %v; recovering state from peers\n", kv.gid, kv.me, err)
+				kv.fileReset()
+				return false
+			}
 			if err != nil {
 				DPrintf("Restoring Put-Append(); err = %s; server %d-%d.\n", err, kv.me, kv.gid)
 				DPrintf("Restoring Put-Append(); did not find temp file; redoing; server %d-%d.\n", kv.me, kv.gid)
@@ -630,12 +752,84 @@ func (kv *DisKV) restore() bool {
 	case Reconfigure:
 		kv.do(res)
 		return true
+	case Nop:
+		// nothing to redo; also marks the seq of an installed snapshot
+		return true
 	}
 
 	kv.seq--
 	return false
 }
 
+// diskvSnapshot is the state a lagging replica installs in place
+// of the operations it can no longer fetch.
+type diskvSnapshot struct {
+	Store  map[string]string
+	Ids    map[int64]int64
+	Ret    map[int64]string
+	Config shardmaster.Config
+}
+
+// Snapshot returns the replica's state after every op up to and
+// including the returned seq. Paxos calls it on behalf of a
+// replica that lost its state.
+func (kv *DisKV) Snapshot() (int, []byte) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	w := new(bytes.Buffer)
+	snap := diskvSnapshot{Store: kv.store, Ids: kv.ids, Ret: kv.ret, Config: kv.config}
+	if err := gob.NewEncoder(w).Encode(snap); err != nil {
+		log.Fatalf("snapshot encode failed: %v", err)
+	}
+	return kv.seq, w.Bytes()
+}
+
+// Restore replaces the replica's state, in memory and on disk,
+// with a snapshot taken at seq. Paxos calls it from execute's
+// CatchUp, so kv.mu is already held. A crash part way through
+// leaves the restoring file behind, and the replica starts over.
+func (kv *DisKV) Restore(seq int, data []byte) {
+	snap := diskvSnapshot{
+		Store: map[string]string{},
+		Ids:   map[int64]int64{},
+		Ret:   map[int64]string{},
+	}
+	if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&snap); err != nil {
+		log.Fatalf("snapshot decode failed: %v", err)
+	}
+
+	kv.fileReset()
+	marker := kv.dir + "/restoring"
+	if err := ioutil.WriteFile(marker, nil, 0666); err != nil {
+		log.Fatalf("Restore could not create %v: %v", marker, err)
+	}
+	shards := make([]map[string]string, shardmaster.NShards)
+	for shard := range shards {
+		shards[shard] = map[string]string{}
+	}
+	for k, v := range snap.Store {
+		shards[key2shard(k)][k] = v
+	}
+	for shard, m := range shards {
+		kv.fileReplaceShard(shard, m)
+	}
+	for client, id := range snap.Ids {
+		kv.fileSetClientInfo(client, id, snap.Ret[client])
+	}
+	kv.fileIncrementConfig(snap.Config.Num)
+	kv.fileLogOp(Op{Nop, -1, nil}, seq)
+	kv.fileIncrementSeq(seq)
+	os.Remove(marker)
+
+	kv.store = snap.Store
+	kv.ids = snap.Ids
+	kv.ret = snap.Ret
+	kv.config = snap.Config
+	kv.seq = seq
+	kv.restores++
+}
+
 //
 // Ask the shardmaster if there's a new configuration;
 // if so, re-configure.
@@ -738,27 +932,13 @@ func StartServer(gid int64, shardmasters []string,
 			log.Fatalf("Mkdir(%v): %v", paxosdir, err)
 		}
 
-	} else {
-		// Recover client and operational info from client
-		kv.ids, kv.ret = kv.fileRecoverClientInfo()
-		knownSeq, knownConfig := kv.fileRecoverPaxosInfo()
-		kv.seq = knownSeq
-
-		// Recover configuration by querying shardmaster
-		kv.config = kv.sm.Query(knownConfig)
-
-		// load the key value store from disk
-		kv.store = map[string]string{}
-		for shard, group := range kv.config.Shards {
-			if group != gid {
-				continue
-			}
-			shard_store := kv.fileReadShard(shard)
-			for k, v := range shard_store {
-				kv.store[k] = v
-			}
-		}
+	} else if err := kv.fileRecover(); err != nil {
+		// a damaged file: start over, and get the state back
+		// from the Paxos log or, through a snapshot, from peers
+		fmt.Printf("DisKV(%v-%v) %v; recovering state from peers\n", gid, me, err)
+		kv.fileReset()
 
+	} else {
 		// restore the paxos op in progress - we don't know whether or not it completed either partially or wholly
 		kv.restore()
 
@@ -774,9 +954,14 @@ func StartServer(gid int64, shardmasters []string,
 
 	// Parameters added to paxos in order to store paxos state on disk - only store if the middle flag is "true"
 	kv.px = paxos.Make(servers, me, rpcs, true, paxosdir, restart)
+	kv.px.SetSnapshotter(kv)
 
-	os.Remove(servers[me])
-	l, e := net.Listen("unix", servers[me])
+	// drop some connections while the unreliable flag is set
+	listener := &paxos.UnreliableTransport{
+		Transport:  paxos.UnixTransport{},
+		Unreliable: kv.isunreliable,
+	}
+	l, e := listener.Listen(servers[me])
 	if e != nil {
 		log.Fatal("listen error: ", e)
 	}
@@ -789,21 +974,7 @@ func StartServer(gid int64, shardmasters []string,
 		for kv.isdead() == false {
 			conn, err := kv.l.Accept()
 			if err == nil && kv.isdead() == false {
-				if kv.isunreliable() && (rand.Int63()%1000) < 100 {
-					// discard the request.
-					conn.Close()
-				} else if kv.isunreliable() && (rand.Int63()%1000) < 200 {
-					// process the request but force discard of reply.
-					c1 := conn.(*net.UnixConn)
-					f, _ := c1.File()
-					err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
-					if err != nil {
-						fmt.Printf("shutdown: %v\n", err)
-					}
-					go rpcs.ServeConn(conn)
-				} else {
-					go rpcs.ServeConn(conn)
-				}
+				go rpcs.ServeConn(conn)
 			} else if err == nil {
 				conn.Close()
 			}
@@ -1,7 +1,7 @@
 package diskv
 
 import "testing"
-import "shardmaster"
+import "distributed-systems/app/01_Practice-Labs/src/shardmaster"
 import "runtime"
 import "strconv"
 import "strings"
@@ -15,6 +15,7 @@ import "log"
 import "math/rand"
 import crand "crypto/rand"
 import "encoding/base64"
+import "encoding/base32"
 import "path/filepath"
 import "sync/atomic"
 
@@ -305,7 +306,7 @@ func Test4Move(t *testing.T) {
 
 	// insert one key per shard
 	for i := 0; i < shardmaster.NShards; i++ {
-		ck.Put(string('0'+i), string('0'+i))
+		ck.Put(string(rune('0'+i)), string(rune('0'+i)))
 	}
 
 	// add group 1.
@@ -314,7 +315,7 @@ func Test4Move(t *testing.T) {
 
 	// check that keys are still there.
 	for i := 0; i < shardmaster.NShards; i++ {
-		if ck.Get(string('0'+i)) != string('0'+i) {
+		if ck.Get(string(rune('0'+i))) != string(rune('0'+i)) {
 			t.Fatalf("missing key/value")
 		}
 	}
@@ -329,8 +330,8 @@ func Test4Move(t *testing.T) {
 	for i := 0; i < shardmaster.NShards; i++ {
 		go func(me int) {
 			myck := tc.clerk()
-			v := myck.Get(string('0' + me))
-			if v == string('0'+me) {
+			v := myck.Get(string(rune('0'+me)))
+			if v == string(rune('0'+me)) {
 				mu.Lock()
 				atomic.AddInt32(&count, 1)
 				mu.Unlock()
@@ -593,6 +594,86 @@ func Test5OneRestart(t *testing.T) {
 	fmt.Printf("  ... Passed\n")
 }
 
+// flip a bit in byte i of a file, or in its last byte if i < 0.
+func flipbit(t *testing.T, name string, i int) {
+	content, err := ioutil.ReadFile(name)
+	if err != nil || len(content) == 0 {
+		t.Fatalf("ReadFile(%v): %v", name, err)
+	}
+	if i < 0 {
+		i = len(content) - 1
+	}
+	content[i] ^= 1
+	if err := ioutil.WriteFile(name, content, 0666); err != nil {
+		t.Fatalf("WriteFile(%v): %v", name, err)
+	}
+}
+
+//
+// if a server's files are damaged, does it get its state back
+// from the others instead of crashing?
+//
+func Test5CorruptFiles(t *testing.T) {
+	tc := setup(t, "corrupt", 1, 3, false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Damaged files are recovered from peers ...\n")
+
+	tc.join(0)
+	ck := tc.clerk()
+	g0 := tc.groups[0]
+
+	k := randstring(10)
+	v := randstring(10)
+	ck.Put(k, v)
+	for i := 0; i < 10; i++ {
+		z := randstring(10)
+		v += z
+		ck.Append(k, z)
+	}
+	time.Sleep(2 * time.Second)
+
+	// server 0: damaged key file and Paxos log, so it lost all its
+	// state. Paxos cannot recover if a majority loses its log, so
+	// only one server does.
+	tc.kill1(0, 0, false)
+	keyfile := "/shard-" + strconv.Itoa(key2shard(k)) + "/key-" +
+		base32.StdEncoding.EncodeToString([]byte(k))
+	flipbit(t, g0.servers[0].dir+keyfile, -1)
+	segments, _ := filepath.Glob(g0.servers[0].dir + "/state/wal-*")
+	if len(segments) == 0 {
+		t.Fatalf("no Paxos log in %v", g0.servers[0].dir)
+	}
+	flipbit(t, segments[0], 0)
+
+	// server 1: damaged key file only; its Paxos log is intact.
+	tc.kill1(0, 1, false)
+	flipbit(t, g0.servers[1].dir+keyfile, -1)
+
+	tc.start1(0, 0)
+	tc.start1(0, 1)
+	time.Sleep(3 * time.Second)
+
+	z := randstring(10)
+	v += z
+	ck.Append(k, z)
+	time.Sleep(2 * time.Second)
+
+	// only the recovered servers are left to answer.
+	tc.kill1(0, 2, false)
+	if x := ck.Get(k); x != v {
+		t.Fatalf("wrong value %v after recovery; expected %v", x, v)
+	}
+	z = randstring(10)
+	v += z
+	ck.Append(k, z)
+	if x := ck.Get(k); x != v {
+		t.Fatalf("wrong value %v after recovery; expected %v", x, v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
 //
 // check that the persistent state isn't too big.
 //
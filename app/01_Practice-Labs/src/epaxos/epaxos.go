@@ -0,0 +1,667 @@
+// Package epaxos implements leaderless agreement in the style of Egalitarian
+// Paxos. Every peer owns a row of instances and proposes commands only in its
+// own row, so peers never compete for an instance. Instead of agreeing on a
+// global order, the peers agree on each command's dependencies: the
+// conflicting commands it must be executed after, as defined by an
+// application-supplied Conflict function. Commands that do not conflict with
+// anything in flight commit after one round trip to a fast quorum of peers
+// and are never ordered against each other; the others take a second,
+// Paxos-style Accept round through a majority.
+//
+// The fast quorum is every peer but one in a group of 2F+1, as in basic
+// EPaxos, so the fast path survives one failed peer and recovery can still
+// tell which attributes it may have chosen: a peer that finds a dependency
+// stuck because its proposer failed takes the instance over with a higher
+// ballot, and either finishes the proposer's work or commits a no-op in its
+// place (see recover.go).
+//
+// The application interface:
+//
+//	ep = epaxos.Make(peers []string, me int, rpcs *rpc.Server, conflict Conflict, opts ...Option)
+//	ep.Start(seq int, v interface{}) -- propose v as instance seq of this peer's row
+//	ep.Status(id ID) (committed bool, v interface{}) -- get info about an instance
+//	ep.Executed(ctx context.Context, from int) <-chan Decision -- committed commands in execution order
+//	ep.Done(id ID) -- ok to forget instances of id.Replica's row <= id.Seq
+//	ep.Min(replica int) int -- instances of the row before this seq have been forgotten
+//
+// MakeLog puts the same peer behind the Start/Status/Done interface of
+// package paxos (see log.go).
+//
+// Conflicting commands are executed in the same order on every peer;
+// commands that do not conflict may be executed in different orders.
+package epaxos
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-systems/app/01_Practice-Labs/src/paxos"
+)
+
+// Debug controls whether debug output is printed
+const Debug = 0
+
+// DPrintf prints debug output if Debug is enabled
+func DPrintf(format string, a ...interface{}) (n int, err error) {
+	if Debug > 0 {
+		log.Printf(format, a...)
+	}
+	return
+}
+
+// RecoverTimeout is how long a peer waits for a dependency to be committed
+// before taking over the instance itself.
+const RecoverTimeout = 500 * time.Millisecond
+
+// ID names the Seq'th instance of peer Replica's row.
+type ID struct {
+	Replica int
+	Seq     int
+}
+
+// Conflict reports whether two commands must be executed in the same order
+// on every peer. A nil command is a no-op and conflicts with nothing.
+type Conflict func(a interface{}, b interface{}) bool
+
+// Instance status
+const (
+	None        = iota // Nothing known but possibly a promise
+	PreAccepted        // Command and tentative attributes known
+	Accepted           // Attributes accepted under ABallot
+	Committed          // Attributes final
+)
+
+// Instance is one peer's state for one instance.
+type Instance struct {
+	Cmd     interface{}  // Proposed command, nil for a no-op
+	Seq     int          // Orders the instance within a cycle of dependencies
+	Deps    []int        // Conflicting instances of row r up to Deps[r] are dependencies
+	Status  int          // None, PreAccepted, Accepted or Committed
+	Ballot  paxos.Ballot // Highest ballot promised
+	ABallot paxos.Ballot // Ballot Seq and Deps were pre-accepted or accepted under
+
+	executed bool // Whether this peer has executed the command
+}
+
+// EPaxos is one peer of a leaderless group.
+type EPaxos struct {
+	mu         sync.Mutex      // Protects the fields below
+	l          net.Listener    // Network listener for RPC connections
+	dead       bool            // Flag indicating if peer should shut down
+	unreliable bool            // Flag for unreliable network simulation (testing)
+	rpcCount   int             // Counter for RPC calls (testing)
+	peers      []string        // Addresses of the peers
+	me         int             // Index of this peer in peers
+	transport  paxos.Transport // How peers reach each other
+	conflict   Conflict        // Application's conflict relation
+
+	rows       []map[int]*Instance // rows[r][seq] is instance {r, seq}
+	max        []int               // Highest instance known per row
+	floor      []int               // Every instance of row r <= floor[r] has been executed
+	forgotten  []int               // Every instance of row r <= forgotten[r] has been forgotten
+	done       [][]int             // done[p][r] is the highest instance of row r peer p is done with
+	order      []Decision          // Executed commands in execution order
+	changed    chan struct{}       // Closed when an instance is committed or executed
+	blocked    map[ID]time.Time    // When an uncommitted instance was last seen making progress
+	recovering map[ID]bool         // Instances this peer is taking over
+}
+
+// Option configures optional behaviour of a peer at construction time.
+type Option func(ep *EPaxos)
+
+// WithTransport makes the peer listen and dial through t instead of
+// unix-domain sockets.
+func WithTransport(t paxos.Transport) Option {
+	return func(ep *EPaxos) {
+		ep.transport = t
+	}
+}
+
+// PreAcceptArgs proposes a command and its attributes for an instance.
+type PreAcceptArgs struct {
+	ID     ID
+	Ballot paxos.Ballot
+	Cmd    interface{}
+	Seq    int
+	Deps   []int
+}
+
+// PreAcceptReply carries the attributes merged with the receiver's own.
+type PreAcceptReply struct {
+	OK        bool         // Whether the ballot was accepted
+	Ballot    paxos.Ballot // Promised ballot (set on reject)
+	Committed bool         // Whether the instance is already committed
+	Seq       int          // Merged attributes
+	Deps      []int
+	Done      []int // Receiver's Done values per row
+}
+
+// AcceptArgs asks a peer to accept final attributes for an instance.
+type AcceptArgs struct {
+	ID     ID
+	Ballot paxos.Ballot
+	Cmd    interface{}
+	Seq    int
+	Deps   []int
+}
+
+// AcceptReply contains the response to an accept request.
+type AcceptReply struct {
+	OK     bool         // Whether the attributes were accepted
+	Ballot paxos.Ballot // Promised ballot (set on reject)
+	Done   []int        // Receiver's Done values per row
+}
+
+// CommitArgs announces the final attributes of an instance.
+type CommitArgs struct {
+	ID   ID
+	Cmd  interface{}
+	Seq  int
+	Deps []int
+	From int   // Sender
+	Done []int // Sender's Done values per row
+}
+
+// CommitReply contains the response to a commit.
+type CommitReply struct {
+}
+
+// Make creates a peer. peers contains the addresses of all peers (including
+// this one) and me is this peer's index. rpcs is the RPC server to register
+// with, or nil to listen on peers[me] through the transport. conflict
+// defines which commands must be ordered against each other.
+func Make(peers []string, me int, rpcs *rpc.Server, conflict Conflict, opts ...Option) *EPaxos {
+	n := len(peers)
+	ep := &EPaxos{
+		peers:      peers,
+		me:         me,
+		transport:  paxos.UnixTransport{},
+		conflict:   conflict,
+		rows:       make([]map[int]*Instance, n),
+		max:        make([]int, n),
+		floor:      make([]int, n),
+		forgotten:  make([]int, n),
+		done:       make([][]int, n),
+		changed:    make(chan struct{}),
+		blocked:    make(map[ID]time.Time),
+		recovering: make(map[ID]bool),
+	}
+	for _, opt := range opts {
+		opt(ep)
+	}
+	for r := 0; r < n; r++ {
+		ep.rows[r] = make(map[int]*Instance)
+		ep.max[r], ep.floor[r], ep.forgotten[r] = -1, -1, -1
+		ep.done[r] = make([]int, n)
+		for i := range ep.done[r] {
+			ep.done[r][i] = -1
+		}
+	}
+
+	// Set up RPC server
+	if rpcs != nil {
+		// Caller will create socket and handle connections
+		rpcs.Register(ep)
+	} else {
+		rpcs = rpc.NewServer()
+		rpcs.Register(ep)
+
+		// Prepare to receive connections from clients, dropping
+		// some of them while the unreliable flag is set
+		listener := &paxos.UnreliableTransport{
+			Transport:  ep.transport,
+			Unreliable: func() bool { return ep.unreliable },
+			Served:     func() { ep.rpcCount++ },
+		}
+		l, err := listener.Listen(peers[me])
+		if err != nil {
+			log.Fatal("listen error: ", err)
+		}
+		ep.l = l
+
+		// Create a thread to accept RPC connections
+		go func() {
+			for !ep.dead {
+				conn, err := ep.l.Accept()
+				if err == nil && !ep.dead {
+					go rpcs.ServeConn(conn)
+				} else if err == nil {
+					conn.Close()
+				}
+				if err != nil && !ep.dead {
+					fmt.Printf("EPaxos(%v) accept: %v\n", me, err.Error())
+				}
+			}
+		}()
+	}
+
+	go ep.executor()
+
+	return ep
+}
+
+// Start proposes v as instance seq of this peer's row and returns at once.
+// Each seq should be started once, in order from 0: a skipped instance that
+// other commands depend on is eventually committed as a no-op. Status
+// reports whether v or, if this peer was presumed failed, a no-op was
+// committed.
+func (ep *EPaxos) Start(seq int, v interface{}) {
+	go ep.propose(seq, v)
+}
+
+// Status reports whether instance id is committed here, and its command.
+func (ep *EPaxos) Status(id ID) (bool, interface{}) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if inst, ok := ep.rows[id.Replica][id.Seq]; ok && inst.Status == Committed {
+		return true, inst.Cmd
+	}
+	return false, nil
+}
+
+// Done tells the peer the application no longer needs instances of row
+// id.Replica up to and including id.Seq. They are forgotten once every peer
+// has said so and executed them.
+func (ep *EPaxos) Done(id ID) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if id.Seq > ep.done[ep.me][id.Replica] {
+		ep.done[ep.me][id.Replica] = id.Seq
+	}
+}
+
+// Min returns one more than the highest forgotten instance of replica's row.
+func (ep *EPaxos) Min(replica int) int {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	return ep.forgotten[replica] + 1
+}
+
+// Kill tells the peer to shut itself down.
+func (ep *EPaxos) Kill() {
+	ep.dead = true
+	if ep.l != nil {
+		ep.l.Close()
+	}
+}
+
+// instance returns the state of id, creating it if unknown. It returns nil
+// if id has been forgotten. Caller must hold ep.mu.
+func (ep *EPaxos) instance(id ID) *Instance {
+	if id.Seq <= ep.forgotten[id.Replica] {
+		return nil
+	}
+	inst, ok := ep.rows[id.Replica][id.Seq]
+	if !ok {
+		inst = &Instance{Ballot: paxos.NoBallot, ABallot: paxos.NoBallot}
+		ep.rows[id.Replica][id.Seq] = inst
+		if id.Seq > ep.max[id.Replica] {
+			ep.max[id.Replica] = id.Seq
+		}
+	}
+	return inst
+}
+
+// attributes returns the sequence number and dependencies of cmd as instance
+// id given the conflicting instances this peer knows. Caller must hold ep.mu.
+func (ep *EPaxos) attributes(id ID, cmd interface{}) (int, []int) {
+	seq := 0
+	deps := make([]int, len(ep.peers))
+	for r := range deps {
+		deps[r] = -1
+		for j := ep.max[r]; j > ep.forgotten[r]; j-- {
+			inst, ok := ep.rows[r][j]
+			if !ok || inst.Status == None || (ID{r, j}) == id {
+				continue
+			}
+			if cmd == nil || inst.Cmd == nil || !ep.conflict(cmd, inst.Cmd) {
+				continue
+			}
+			if deps[r] < j {
+				deps[r] = j
+			}
+			if inst.Seq >= seq {
+				seq = inst.Seq + 1
+			}
+		}
+	}
+	return seq, deps
+}
+
+// merge returns the union of two sets of dependencies.
+func merge(a []int, b []int) []int {
+	deps := append([]int(nil), a...)
+	for r := range deps {
+		if r < len(b) && b[r] > deps[r] {
+			deps[r] = b[r]
+		}
+	}
+	return deps
+}
+
+// sameDeps reports whether two sets of dependencies are equal.
+func sameDeps(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for r := range a {
+		if a[r] != b[r] {
+			return false
+		}
+	}
+	return true
+}
+
+// noDeps returns an empty set of dependencies.
+func (ep *EPaxos) noDeps() []int {
+	deps := make([]int, len(ep.peers))
+	for r := range deps {
+		deps[r] = -1
+	}
+	return deps
+}
+
+// fastQuorum returns how many peers, the proposer included, must report a
+// command's attributes unchanged for it to commit on the fast path: 2F of
+// 2F+1 peers, and never less than a majority.
+func (ep *EPaxos) fastQuorum() int {
+	n := len(ep.peers)
+	if q := 2 * ((n - 1) / 2); q > n/2 {
+		return q
+	}
+	return n/2 + 1
+}
+
+// initialBallot returns the ballot the proposer of a row's instances uses.
+// Every other ballot is higher.
+func initialBallot(replica int) paxos.Ballot {
+	return paxos.NoBallot.Next(replica)
+}
+
+// propose runs the command leader's side of instance {me, seq}.
+func (ep *EPaxos) propose(seq int, v interface{}) {
+	id := ID{ep.me, seq}
+	b := initialBallot(ep.me)
+
+	ep.mu.Lock()
+	inst := ep.instance(id)
+	if inst == nil || inst.Status != None || b.Less(inst.Ballot) {
+		// Already started, or taken over by a peer that presumed us failed
+		ep.mu.Unlock()
+		return
+	}
+	s, deps := ep.attributes(id, v)
+	ep.mu.Unlock()
+
+	ep.lead(id, b, v, s, deps, true)
+}
+
+// lead drives instance id to a commit under ballot b, starting from the
+// given attributes. The fast path is only allowed for the proposer's initial
+// ballot; a peer taking the instance over always runs the Accept phase.
+func (ep *EPaxos) lead(id ID, b paxos.Ballot, cmd interface{}, seq int, deps []int, fast bool) {
+	for !ep.dead && !ep.isCommitted(id) {
+		useq, udeps, n, same, ok := ep.preAccept(id, b, cmd, seq, deps)
+		if !ok {
+			// Another peer took the instance over
+			return
+		}
+		if fast && same >= ep.fastQuorum() {
+			if ep.claim(id, b, cmd, seq, deps) {
+				DPrintf("EPaxos(%d) %v fast commit", ep.me, id)
+				ep.commit(id, cmd, seq, deps)
+			}
+			return
+		}
+		if n <= len(ep.peers)/2 {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		// The attributes are fixed from here on: a ballot never accepts
+		// two different values
+		ep.accept(id, b, cmd, useq, udeps)
+		return
+	}
+}
+
+// preAccept sends the PreAccept phase to every peer and returns the merged
+// attributes, the number of peers that replied, and how many of them
+// reported the attributes unchanged. ok is false if the ballot was refused.
+func (ep *EPaxos) preAccept(id ID, b paxos.Ballot, cmd interface{}, seq int, deps []int) (int, []int, int, int, bool) {
+	useq, udeps := seq, deps
+	n, same := 0, 0
+	for peer := range ep.peers {
+		args := PreAcceptArgs{ID: id, Ballot: b, Cmd: cmd, Seq: seq, Deps: deps}
+		var reply PreAcceptReply
+		if !ep.send(peer, "EPaxos.PreAccept", args, &reply) {
+			continue
+		}
+		ep.learnDone(peer, reply.Done)
+		if reply.Committed {
+			return 0, nil, 0, 0, false
+		}
+		if !reply.OK {
+			return 0, nil, 0, 0, false
+		}
+		n++
+		if reply.Seq == seq && sameDeps(reply.Deps, deps) {
+			same++
+		}
+		if reply.Seq > useq {
+			useq = reply.Seq
+		}
+		udeps = merge(udeps, reply.Deps)
+	}
+	return useq, udeps, n, same, true
+}
+
+// accept runs the Accept phase under ballot b until a majority accepts or
+// the ballot is refused, and commits on success.
+func (ep *EPaxos) accept(id ID, b paxos.Ballot, cmd interface{}, seq int, deps []int) bool {
+	for !ep.dead && !ep.isCommitted(id) {
+		n := 0
+		for peer := range ep.peers {
+			args := AcceptArgs{ID: id, Ballot: b, Cmd: cmd, Seq: seq, Deps: deps}
+			var reply AcceptReply
+			if !ep.send(peer, "EPaxos.Accept", args, &reply) {
+				continue
+			}
+			ep.learnDone(peer, reply.Done)
+			if !reply.OK {
+				return false
+			}
+			n++
+		}
+		if n > len(ep.peers)/2 {
+			DPrintf("EPaxos(%d) %v slow commit", ep.me, id)
+			ep.commit(id, cmd, seq, deps)
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// claim commits id here with the attributes a fast quorum reported, unless
+// a peer has taken it over since. A peer taking an instance over asks this
+// one too, so once claim succeeds, recovery finds the instance committed or
+// this peer unreachable; it then picks the same attributes from the others.
+func (ep *EPaxos) claim(id ID, b paxos.Ballot, cmd interface{}, seq int, deps []int) bool {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	inst := ep.instance(id)
+	if inst == nil || inst.Status == Committed || inst.Ballot != b {
+		return false
+	}
+	inst.Cmd, inst.Seq, inst.Deps = cmd, seq, deps
+	inst.Status = Committed
+	ep.notifyLocked()
+	return true
+}
+
+// commit announces the final attributes of id to every peer.
+func (ep *EPaxos) commit(id ID, cmd interface{}, seq int, deps []int) {
+	ep.mu.Lock()
+	done := append([]int(nil), ep.done[ep.me]...)
+	ep.mu.Unlock()
+	for peer := range ep.peers {
+		args := CommitArgs{ID: id, Cmd: cmd, Seq: seq, Deps: deps, From: ep.me, Done: done}
+		var reply CommitReply
+		ep.send(peer, "EPaxos.Commit", args, &reply)
+	}
+}
+
+// isCommitted reports whether id is committed or forgotten here.
+func (ep *EPaxos) isCommitted(id ID) bool {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	inst := ep.instance(id)
+	return inst == nil || inst.Status == Committed
+}
+
+// learnDone records the Done values piggybacked by a peer.
+func (ep *EPaxos) learnDone(peer int, done []int) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	for r := range done {
+		if r < len(ep.done[peer]) && done[r] > ep.done[peer][r] {
+			ep.done[peer][r] = done[r]
+		}
+	}
+}
+
+// PreAccept handles a proposed command: the receiver adds the conflicting
+// instances it knows to the attributes and remembers the result. A peer
+// that has seen the instance before only merges, so it reports the same
+// attributes to a peer taking the instance over as to the proposer.
+func (ep *EPaxos) PreAccept(args PreAcceptArgs, reply *PreAcceptReply) error {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	reply.Done = append([]int(nil), ep.done[ep.me]...)
+
+	inst := ep.instance(args.ID)
+	if inst == nil || inst.Status == Committed {
+		reply.Committed = true
+		return nil
+	}
+	if args.Ballot.Less(inst.Ballot) {
+		reply.Ballot = inst.Ballot
+		return nil
+	}
+
+	inst.Ballot = args.Ballot
+	delete(ep.blocked, args.ID)
+	seq, deps := inst.Seq, inst.Deps
+	if inst.Status == None {
+		seq, deps = ep.attributes(args.ID, args.Cmd)
+	}
+	if args.Seq > seq {
+		seq = args.Seq
+	}
+	deps = merge(args.Deps, deps)
+	if inst.Status != Accepted {
+		// Accepted attributes stay as they are until a new Accept
+		inst.Cmd, inst.Seq, inst.Deps = args.Cmd, seq, deps
+		inst.Status = PreAccepted
+		inst.ABallot = args.Ballot
+	}
+
+	reply.OK = true
+	reply.Seq = seq
+	reply.Deps = append([]int(nil), deps...)
+	return nil
+}
+
+// Accept handles the Accept phase for an instance.
+func (ep *EPaxos) Accept(args AcceptArgs, reply *AcceptReply) error {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	reply.Done = append([]int(nil), ep.done[ep.me]...)
+
+	inst := ep.instance(args.ID)
+	if inst == nil || inst.Status == Committed {
+		reply.OK = true
+		return nil
+	}
+	if args.Ballot.Less(inst.Ballot) {
+		reply.Ballot = inst.Ballot
+		return nil
+	}
+	delete(ep.blocked, args.ID)
+	inst.Cmd, inst.Seq, inst.Deps = args.Cmd, args.Seq, args.Deps
+	inst.Status = Accepted
+	inst.Ballot, inst.ABallot = args.Ballot, args.Ballot
+	reply.OK = true
+	return nil
+}
+
+// Commit handles the final attributes of an instance.
+func (ep *EPaxos) Commit(args CommitArgs, reply *CommitReply) error {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	for r := range args.Done {
+		if args.Done[r] > ep.done[args.From][r] {
+			ep.done[args.From][r] = args.Done[r]
+		}
+	}
+
+	inst := ep.instance(args.ID)
+	if inst == nil || inst.Status == Committed {
+		return nil
+	}
+	inst.Cmd, inst.Seq, inst.Deps = args.Cmd, args.Seq, args.Deps
+	inst.Status = Committed
+	ep.notifyLocked()
+	return nil
+}
+
+// notifyLocked wakes the executor and everyone waiting on it. Caller must
+// hold ep.mu.
+func (ep *EPaxos) notifyLocked() {
+	close(ep.changed)
+	ep.changed = make(chan struct{})
+}
+
+// send sends an RPC to peer, calling the handler directly for this peer.
+func (ep *EPaxos) send(peer int, name string, args interface{}, reply interface{}) bool {
+	if peer != ep.me {
+		return call(ep.transport, ep.peers[peer], name, args, reply)
+	}
+	switch strings.TrimPrefix(name, "EPaxos.") {
+	case "PreAccept":
+		ep.PreAccept(args.(PreAcceptArgs), reply.(*PreAcceptReply))
+	case "Accept":
+		ep.Accept(args.(AcceptArgs), reply.(*AcceptReply))
+	case "Commit":
+		ep.Commit(args.(CommitArgs), reply.(*CommitReply))
+	case "Prepare":
+		ep.Prepare(args.(PrepareArgs), reply.(*PrepareReply))
+	default:
+		return false
+	}
+	return true
+}
+
+// call sends an RPC to the peer at srv and waits for the reply. It returns
+// false if the peer could not be reached or did not answer.
+func call(t paxos.Transport, srv string, name string, args interface{}, reply interface{}) bool {
+	conn, err := t.Dial(srv)
+	if err != nil {
+		return false
+	}
+	c := rpc.NewClient(conn)
+	defer c.Close()
+
+	err = c.Call(name, args, reply)
+	if err == nil {
+		return true
+	}
+
+	DPrintf("epaxos call %v: %v", name, err)
+	return false
+}
@@ -0,0 +1,233 @@
+package epaxos
+
+// Execution.
+//
+// A committed instance is executed once everything it depends on is
+// committed. Dependencies may form cycles, so the executor finds the
+// strongly connected components of the dependency graph (Tarjan's
+// algorithm) and executes them in dependency order, each one sorted by
+// sequence number and then ID. Every peer agrees on the attributes, so every
+// peer orders conflicting commands the same way.
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// Decision is a command in execution order.
+type Decision struct {
+	ID    ID          // Instance the command was committed in
+	Value interface{} // The command, or nil for a no-op
+}
+
+// Executed returns a channel that delivers this peer's executed commands in
+// execution order, starting with the from'th. The channel is closed when ctx
+// is done.
+func (ep *EPaxos) Executed(ctx context.Context, from int) <-chan Decision {
+	ch := make(chan Decision)
+	go func() {
+		defer close(ch)
+		for i := from; ; i++ {
+			ep.mu.Lock()
+			for i >= len(ep.order) {
+				changed := ep.changed
+				ep.mu.Unlock()
+				select {
+				case <-changed:
+				case <-ctx.Done():
+					return
+				}
+				ep.mu.Lock()
+			}
+			d := ep.order[i]
+			ep.mu.Unlock()
+
+			select {
+			case ch <- d:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// executor executes committed instances as their dependencies allow, takes
+// over instances that stay uncommitted for too long, and forgets executed
+// instances every peer is done with.
+func (ep *EPaxos) executor() {
+	for !ep.dead {
+		ep.mu.Lock()
+		for r := range ep.rows {
+			for j := ep.floor[r] + 1; j <= ep.max[r]; j++ {
+				inst, ok := ep.rows[r][j]
+				switch {
+				case !ok || inst.executed:
+				case inst.Status == Committed:
+					ep.execute(ID{r, j})
+				default:
+					// Perhaps only the Commit message was lost
+					ep.waitFor(ID{r, j})
+				}
+			}
+		}
+		ep.forget()
+		changed := ep.changed
+		ep.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-time.After(RecoverTimeout / 5):
+		}
+	}
+}
+
+// tarjan is the state of one search for strongly connected components.
+type tarjan struct {
+	index   map[ID]int
+	low     map[ID]int
+	stack   []ID
+	onStack map[ID]bool
+	next    int
+}
+
+// execute executes id and everything it depends on, if all of that is
+// committed. Caller must hold ep.mu.
+func (ep *EPaxos) execute(id ID) {
+	t := &tarjan{index: map[ID]int{}, low: map[ID]int{}, onStack: map[ID]bool{}}
+	ep.connect(t, id)
+}
+
+// connect visits v in Tarjan's algorithm, executing every component it
+// completes. It returns false if an uncommitted dependency stops the search.
+// Caller must hold ep.mu.
+func (ep *EPaxos) connect(t *tarjan, v ID) bool {
+	t.index[v], t.low[v] = t.next, t.next
+	t.next++
+	t.stack = append(t.stack, v)
+	t.onStack[v] = true
+
+	deps, ok := ep.dependencies(v)
+	if !ok {
+		return false
+	}
+	for _, w := range deps {
+		if _, visited := t.index[w]; !visited {
+			if !ep.connect(t, w) {
+				return false
+			}
+			if t.low[w] < t.low[v] {
+				t.low[v] = t.low[w]
+			}
+		} else if t.onStack[w] && t.index[w] < t.low[v] {
+			t.low[v] = t.index[w]
+		}
+	}
+
+	if t.low[v] == t.index[v] {
+		var scc []ID
+		for {
+			w := t.stack[len(t.stack)-1]
+			t.stack = t.stack[:len(t.stack)-1]
+			t.onStack[w] = false
+			scc = append(scc, w)
+			if w == v {
+				break
+			}
+		}
+		sort.Slice(scc, func(i, j int) bool {
+			a, b := ep.rows[scc[i].Replica][scc[i].Seq], ep.rows[scc[j].Replica][scc[j].Seq]
+			if a.Seq != b.Seq {
+				return a.Seq < b.Seq
+			}
+			if scc[i].Replica != scc[j].Replica {
+				return scc[i].Replica < scc[j].Replica
+			}
+			return scc[i].Seq < scc[j].Seq
+		})
+		for _, w := range scc {
+			ep.executed(w)
+		}
+	}
+	return true
+}
+
+// dependencies returns the unexecuted instances v must be executed after.
+// If one of the instances its attributes cover is not committed yet, it
+// returns false, and takes that instance over once it has waited too long.
+// Caller must hold ep.mu.
+func (ep *EPaxos) dependencies(v ID) ([]ID, bool) {
+	inst := ep.rows[v.Replica][v.Seq]
+	var deps []ID
+	for r, top := range inst.Deps {
+		for j := top; j > ep.floor[r]; j-- {
+			w := ID{r, j}
+			if w == v {
+				continue
+			}
+			dep, ok := ep.rows[r][j]
+			if !ok || dep.Status != Committed {
+				ep.waitFor(w)
+				return nil, false
+			}
+			if dep.executed || inst.Cmd == nil || dep.Cmd == nil || !ep.conflict(inst.Cmd, dep.Cmd) {
+				continue
+			}
+			deps = append(deps, w)
+		}
+	}
+	return deps, true
+}
+
+// waitFor notes that execution waits for w, and takes w over if nothing has
+// happened to it for too long. This peer's own instances are left to their
+// proposer, and the peers after the proposer wait in turn, so that usually
+// one peer recovers an instance. Caller must hold ep.mu.
+func (ep *EPaxos) waitFor(w ID) {
+	turn := (ep.me - w.Replica + len(ep.peers)) % len(ep.peers)
+	if turn == 0 {
+		return
+	}
+	since, ok := ep.blocked[w]
+	if !ok {
+		ep.blocked[w] = time.Now()
+	} else if time.Since(since) > time.Duration(turn)*RecoverTimeout {
+		ep.startRecovery(w)
+	}
+}
+
+// executed records that w has been executed. Caller must hold ep.mu.
+func (ep *EPaxos) executed(w ID) {
+	inst := ep.rows[w.Replica][w.Seq]
+	inst.executed = true
+	delete(ep.blocked, w)
+	ep.order = append(ep.order, Decision{ID: w, Value: inst.Cmd})
+	for {
+		next, ok := ep.rows[w.Replica][ep.floor[w.Replica]+1]
+		if !ok || !next.executed {
+			break
+		}
+		ep.floor[w.Replica]++
+	}
+	ep.notifyLocked()
+}
+
+// forget drops executed instances every peer is done with. Caller must
+// hold ep.mu.
+func (ep *EPaxos) forget() {
+	for r := range ep.rows {
+		min := ep.floor[r]
+		for p := range ep.peers {
+			if ep.done[p][r] < min {
+				min = ep.done[p][r]
+			}
+		}
+		for j := ep.forgotten[r] + 1; j <= min; j++ {
+			delete(ep.rows[r], j)
+		}
+		if min > ep.forgotten[r] {
+			ep.forgotten[r] = min
+		}
+	}
+}
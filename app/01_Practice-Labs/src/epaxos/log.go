@@ -0,0 +1,163 @@
+package epaxos
+
+// The Paxos interface.
+//
+// A Log puts a peer behind the Start/Status/Done interface of package paxos,
+// so that code written against a Paxos log can run on EPaxos. Instance seq
+// of a Log is the seq'th command this peer executed. Peers execute
+// conflicting commands in the same order, so they agree on the instances of
+// conflicting commands, relative to each other; commands that do not
+// conflict may hold different instances on different peers. An application
+// whose state only depends on the order of conflicting commands, such as a
+// key/value store with a conflict per key, ends up in the same state on
+// every peer.
+//
+// Start proposes its value in this peer's own row whatever seq it is given.
+// A caller that finds another value in instance seq and starts its value
+// again at seq+1 would propose it twice, so Start ignores a value equal to
+// one it is still waiting to see executed. No-ops hold no instance.
+
+import (
+	"context"
+	"net/rpc"
+	"reflect"
+	"sync"
+)
+
+// Log is a peer seen through the interface of package paxos.
+type Log struct {
+	ep     *EPaxos            // The peer
+	cancel context.CancelFunc // Stops the feed of executed commands
+
+	mu       sync.Mutex          // Protects the fields below
+	order    []interface{}       // order[i] is the value of instance min+i
+	min      int                 // Instances below min have been released by Done
+	max      int                 // Highest instance started, or -1
+	next     int                 // Next instance of this peer's row to propose
+	pending  map[int]interface{} // Values proposed in this peer's row and not yet executed
+	ids      []ID                // ids[i] is the EPaxos instance holding order[i]
+	released []map[int]bool      // Instances of each row released, beyond done
+	done     []int               // Every instance of row r <= done[r] has been released
+}
+
+// MakeLog creates a peer like Make and returns it behind the Paxos
+// interface.
+func MakeLog(peers []string, me int, rpcs *rpc.Server, conflict Conflict, opts ...Option) *Log {
+	lg := &Log{
+		ep:       Make(peers, me, rpcs, conflict, opts...),
+		max:      -1,
+		pending:  make(map[int]interface{}),
+		released: make([]map[int]bool, len(peers)),
+		done:     make([]int, len(peers)),
+	}
+	for r := range lg.done {
+		lg.released[r] = make(map[int]bool)
+		lg.done[r] = -1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	lg.cancel = cancel
+	go func() {
+		for d := range lg.ep.Executed(ctx, 0) {
+			lg.executed(d)
+		}
+	}()
+	return lg
+}
+
+// executed gives d the next instance, unless it is a no-op.
+func (lg *Log) executed(d Decision) {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	if d.ID.Replica == lg.ep.me {
+		delete(lg.pending, d.ID.Seq)
+	}
+	if d.Value == nil {
+		lg.release(d.ID)
+		return
+	}
+	lg.order = append(lg.order, d.Value)
+	lg.ids = append(lg.ids, d.ID)
+}
+
+// Start proposes v, unless instance seq is known to be decided here or v is
+// still waiting to be executed.
+func (lg *Log) Start(seq int, v interface{}) {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	if seq > lg.max {
+		lg.max = seq
+	}
+	if seq < lg.min+len(lg.order) {
+		return
+	}
+	for _, pv := range lg.pending {
+		if reflect.DeepEqual(pv, v) {
+			return
+		}
+	}
+	lg.pending[lg.next] = v
+	lg.ep.Start(lg.next, v)
+	lg.next++
+}
+
+// Status reports whether instance seq is decided here, and its value.
+func (lg *Log) Status(seq int) (bool, interface{}) {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	if seq < lg.min || seq >= lg.min+len(lg.order) {
+		return false, nil
+	}
+	return true, lg.order[seq-lg.min]
+}
+
+// Done tells the peer the application no longer needs instances <= seq.
+func (lg *Log) Done(seq int) {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	for lg.min <= seq && len(lg.order) > 0 {
+		lg.release(lg.ids[0])
+		lg.order, lg.ids = lg.order[1:], lg.ids[1:]
+		lg.min++
+	}
+}
+
+// release passes on to the peer that the application is done with id. The
+// peer forgets a row's instances up to a point, so the Done it is told
+// stops before the first instance of the row not yet released. Caller must
+// hold lg.mu.
+func (lg *Log) release(id ID) {
+	r := id.Replica
+	lg.released[r][id.Seq] = true
+	advanced := false
+	for lg.released[r][lg.done[r]+1] {
+		delete(lg.released[r], lg.done[r]+1)
+		lg.done[r]++
+		advanced = true
+	}
+	if advanced {
+		lg.ep.Done(ID{r, lg.done[r]})
+	}
+}
+
+// Max returns the highest instance started or decided here, or -1.
+func (lg *Log) Max() int {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	if last := lg.min + len(lg.order) - 1; last > lg.max {
+		return last
+	}
+	return lg.max
+}
+
+// Min returns one more than the highest instance released by Done.
+func (lg *Log) Min() int {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	return lg.min
+}
+
+// Kill tells the peer to shut itself down.
+func (lg *Log) Kill() {
+	lg.cancel()
+	lg.ep.Kill()
+}
@@ -0,0 +1,213 @@
+package epaxos
+
+// Recovery.
+//
+// A peer that has known of an instance for a while without seeing it
+// committed, say because execution waits on it, takes the instance over with
+// a ballot above any it has seen, as in Paxos phase 1. The k'th peer after
+// the proposer waits k*RecoverTimeout, so peers rarely compete to recover the
+// same instance. From the replies of a majority it then:
+//
+//   - learns the commit, if any peer has committed the instance;
+//   - re-runs the Accept phase with the attributes accepted under the highest
+//     ballot, if any peer has accepted the instance;
+//   - re-runs the Accept phase with the attributes at least F peers other
+//     than the proposer pre-accepted under its initial ballot, if there are
+//     such. The proposer may have taken the fast path with them: its fast
+//     quorum leaves out one peer, so it includes F of any majority without
+//     the proposer. Every peer only adds to the proposer's attributes, so of
+//     several such sets the smallest is the one it may have chosen;
+//   - re-runs PreAccept and then Accept for the command, if any peer has seen
+//     it. The fast path did not succeed, and the proposer, if it replied,
+//     has promised not to try it again;
+//   - commits a no-op otherwise. The proposer cannot have committed anything,
+//     and the promises it collected stop it from trying later.
+
+import (
+	"time"
+
+	"distributed-systems/app/01_Practice-Labs/src/paxos"
+)
+
+// PrepareArgs asks a peer to promise a ballot for an instance.
+type PrepareArgs struct {
+	ID     ID
+	Ballot paxos.Ballot
+}
+
+// PrepareReply carries a peer's state for the instance.
+type PrepareReply struct {
+	OK       bool         // Whether the ballot was promised
+	Ballot   paxos.Ballot // Promised ballot (set on reject)
+	Instance Instance     // The peer's state for the instance
+	Done     []int        // Receiver's Done values per row
+}
+
+// Prepare handles a peer taking an instance over.
+func (ep *EPaxos) Prepare(args PrepareArgs, reply *PrepareReply) error {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	reply.Done = append([]int(nil), ep.done[ep.me]...)
+
+	inst := ep.instance(args.ID)
+	if inst == nil {
+		// Forgotten instances were committed and executed everywhere
+		return nil
+	}
+	if inst.Status != Committed && args.Ballot.Less(inst.Ballot) {
+		reply.Ballot = inst.Ballot
+		return nil
+	}
+	if inst.Ballot.Less(args.Ballot) {
+		inst.Ballot = args.Ballot
+	}
+	delete(ep.blocked, args.ID)
+	reply.OK = true
+	reply.Instance = *inst
+	reply.Instance.Deps = append([]int(nil), inst.Deps...)
+	return nil
+}
+
+// startRecovery takes id over in the background unless this peer is
+// already doing so. Caller must hold ep.mu.
+func (ep *EPaxos) startRecovery(id ID) {
+	if ep.recovering[id] {
+		return
+	}
+	ep.recovering[id] = true
+	go func() {
+		ep.recover(id)
+		ep.mu.Lock()
+		delete(ep.recovering, id)
+		ep.mu.Unlock()
+	}()
+}
+
+// recover drives id to a commit on behalf of its failed proposer. It gives
+// up if another peer turns out to be recovering id; the executor takes id
+// over again if that peer fails too.
+func (ep *EPaxos) recover(id ID) {
+	ep.mu.Lock()
+	inst := ep.instance(id)
+	if inst == nil {
+		ep.mu.Unlock()
+		return
+	}
+	// Round 0 is reserved for the proposer
+	b := maxBallot(inst.Ballot, paxos.Ballot{Round: 0, ID: len(ep.peers)}).Next(ep.me)
+	ep.mu.Unlock()
+
+	for !ep.dead && !ep.isCommitted(id) {
+		DPrintf("EPaxos(%d) recovering %v with ballot %v", ep.me, id, b)
+		var replies []Instance
+		var from []int
+		outbid := false
+		for peer := range ep.peers {
+			args := PrepareArgs{ID: id, Ballot: b}
+			var reply PrepareReply
+			if !ep.send(peer, "EPaxos.Prepare", args, &reply) {
+				continue
+			}
+			ep.learnDone(peer, reply.Done)
+			if reply.OK {
+				replies = append(replies, reply.Instance)
+				from = append(from, peer)
+			} else {
+				outbid = true
+			}
+		}
+		if outbid {
+			return
+		}
+		if len(replies) <= len(ep.peers)/2 {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+
+		var committed, accepted, seen *Instance
+		for i := range replies {
+			r := &replies[i]
+			switch {
+			case r.Status == Committed:
+				committed = r
+			case r.Status == Accepted && (accepted == nil || accepted.ABallot.Less(r.ABallot)):
+				accepted = r
+			case r.Status == PreAccepted && seen == nil:
+				seen = r
+			}
+		}
+		fast := ep.fastAttributes(id, replies, from)
+		switch {
+		case committed != nil:
+			ep.commit(id, committed.Cmd, committed.Seq, committed.Deps)
+		case accepted != nil:
+			ep.accept(id, b, accepted.Cmd, accepted.Seq, accepted.Deps)
+		case fast != nil:
+			ep.accept(id, b, fast.Cmd, fast.Seq, fast.Deps)
+		case seen != nil:
+			seq, deps := seen.Seq, seen.Deps
+			for _, r := range replies {
+				if r.Status == PreAccepted {
+					if r.Seq > seq {
+						seq = r.Seq
+					}
+					deps = merge(deps, r.Deps)
+				}
+			}
+			ep.lead(id, b, seen.Cmd, seq, deps, false)
+		default:
+			ep.accept(id, b, nil, 0, ep.noDeps())
+		}
+		return
+	}
+}
+
+// fastAttributes returns the smallest attributes at least F peers other than
+// id's proposer pre-accepted under its initial ballot, or nil if there are
+// none. replies[i] is the Prepare reply of peer from[i].
+func (ep *EPaxos) fastAttributes(id ID, replies []Instance, from []int) *Instance {
+	f := (len(ep.peers) - 1) / 2
+	if f == 0 {
+		// Too few peers to leave one out of the fast quorum
+		return nil
+	}
+	preAccepted := func(i int) bool {
+		r := replies[i]
+		return from[i] != id.Replica && r.Status == PreAccepted && r.ABallot == initialBallot(id.Replica)
+	}
+	var fast *Instance
+	for i := range replies {
+		if !preAccepted(i) {
+			continue
+		}
+		r := &replies[i]
+		same := 0
+		for j := range replies {
+			if preAccepted(j) && replies[j].Seq == r.Seq && sameDeps(replies[j].Deps, r.Deps) {
+				same++
+			}
+		}
+		if same >= f && (fast == nil || (r.Seq <= fast.Seq && covers(fast.Deps, r.Deps))) {
+			fast = r
+		}
+	}
+	return fast
+}
+
+// covers reports whether deps a include every dependency in b.
+func covers(a []int, b []int) bool {
+	for r := range b {
+		if r >= len(a) || a[r] < b[r] {
+			return false
+		}
+	}
+	return true
+}
+
+// maxBallot returns the higher of a and b.
+func maxBallot(a paxos.Ballot, b paxos.Ballot) paxos.Ballot {
+	if a.Less(b) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,552 @@
+package epaxos
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"distributed-systems/app/01_Practice-Labs/src/paxos"
+)
+
+// port generates a unique Unix socket path for testing.
+func port(tag string, host int) string {
+	s := "/var/tmp/824-"
+	s += strconv.Itoa(os.Getuid()) + "/"
+	os.Mkdir(s, 0777)
+	s += "ep-"
+	s += strconv.Itoa(os.Getpid()) + "-"
+	s += tag + "-"
+	s += strconv.Itoa(host)
+	return s
+}
+
+// sameKey makes commands of the form "key=value" conflict when their keys
+// are equal.
+func sameKey(a interface{}, b interface{}) bool {
+	return key(a) == key(b)
+}
+
+// key returns the key of a "key=value" command.
+func key(v interface{}) string {
+	return strings.SplitN(v.(string), "=", 2)[0]
+}
+
+// start makes n peers with the given tag.
+func start(tag string, n int) []*EPaxos {
+	eph := make([]string, n)
+	for i := 0; i < n; i++ {
+		eph[i] = port(tag, i)
+	}
+	epa := make([]*EPaxos, n)
+	for i := 0; i < n; i++ {
+		epa[i] = Make(eph, i, nil, sameKey)
+	}
+	return epa
+}
+
+// cleanup kills all peers in the given slice.
+func cleanup(epa []*EPaxos) {
+	for i := 0; i < len(epa); i++ {
+		if epa[i] != nil {
+			epa[i].Kill()
+		}
+	}
+}
+
+// ncommitted counts how many peers have committed id, and verifies that they
+// agree on its command.
+func ncommitted(t *testing.T, epa []*EPaxos, id ID) int {
+	count := 0
+	var v interface{}
+	for i := 0; i < len(epa); i++ {
+		if epa[i] != nil && !epa[i].dead {
+			committed, v1 := epa[i].Status(id)
+			if committed {
+				if count > 0 && v != v1 {
+					t.Fatalf("committed values do not match; id=%v i=%v v=%v v1=%v",
+						id, i, v, v1)
+				}
+				count++
+				v = v1
+			}
+		}
+	}
+	return count
+}
+
+// waitn waits for at least wanted peers to commit id.
+func waitn(t *testing.T, epa []*EPaxos, id ID, wanted int) {
+	to := 10 * time.Millisecond
+	for iters := 0; iters < 30; iters++ {
+		if ncommitted(t, epa, id) >= wanted {
+			break
+		}
+		time.Sleep(to)
+		if to < time.Second {
+			to *= 2
+		}
+	}
+	nc := ncommitted(t, epa, id)
+	if nc < wanted {
+		t.Fatalf("too few committed; id=%v ncommitted=%v wanted=%v", id, nc, wanted)
+	}
+}
+
+// executed returns what each live peer has executed once every one of them
+// has executed n commands.
+func executed(t *testing.T, epa []*EPaxos, n int) [][]Decision {
+	orders := make([][]Decision, len(epa))
+	for i, ep := range epa {
+		if ep == nil || ep.dead {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		for d := range ep.Executed(ctx, 0) {
+			orders[i] = append(orders[i], d)
+			if len(orders[i]) == n {
+				break
+			}
+		}
+		cancel()
+		if len(orders[i]) < n {
+			t.Fatalf("peer %v executed %v commands, wanted %v", i, len(orders[i]), n)
+		}
+	}
+	return orders
+}
+
+// checkOrder verifies that every peer executed each instance once, and the
+// commands of each key in the same order.
+func checkOrder(t *testing.T, orders [][]Decision) {
+	var first map[string][]ID
+	for i, order := range orders {
+		if order == nil {
+			continue
+		}
+		seen := make(map[ID]bool)
+		keys := make(map[string][]ID)
+		for _, d := range order {
+			if seen[d.ID] {
+				t.Fatalf("peer %v executed %v twice", i, d.ID)
+			}
+			seen[d.ID] = true
+			if d.Value != nil {
+				k := key(d.Value)
+				keys[k] = append(keys[k], d.ID)
+			}
+		}
+		if first == nil {
+			first = keys
+			continue
+		}
+		for k, ids := range first {
+			if fmt.Sprint(keys[k]) != fmt.Sprint(ids) {
+				t.Fatalf("peer %v executed key %v as %v, another peer as %v", i, k, keys[k], ids)
+			}
+		}
+	}
+}
+
+// rpcs returns the number of RPCs the peers have served.
+func rpcs(epa []*EPaxos) int {
+	n := 0
+	for _, ep := range epa {
+		ep.mu.Lock()
+		n += ep.rpcCount
+		ep.mu.Unlock()
+	}
+	return n
+}
+
+func TestBasic(t *testing.T) {
+	const n = 3
+	epa := start("basic", n)
+	defer cleanup(epa)
+
+	fmt.Printf("Test: Single proposer ...\n")
+
+	epa[0].Start(0, "a=hello")
+	waitn(t, epa, ID{0, 0}, n)
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Every peer proposes ...\n")
+
+	for i := 1; i < n; i++ {
+		epa[i].Start(0, "k"+strconv.Itoa(i)+"="+strconv.Itoa(i))
+	}
+	for i := 1; i < n; i++ {
+		waitn(t, epa, ID{i, 0}, n)
+	}
+	for i := 0; i < n; i++ {
+		epa[i].Start(1, "a="+strconv.Itoa(i))
+	}
+	for i := 0; i < n; i++ {
+		waitn(t, epa, ID{i, 1}, n)
+	}
+	checkOrder(t, executed(t, epa, 2*n))
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestFastPath(t *testing.T) {
+	const n = 3
+	epa := start("fast", n)
+	defer cleanup(epa)
+
+	fmt.Printf("Test: Non-conflicting commands commit in one round trip ...\n")
+
+	// One PreAccept and one Commit to each other peer
+	const ncmds = 10
+	before := rpcs(epa)
+	for i := 0; i < ncmds; i++ {
+		epa[i%n].Start(i/n, "k"+strconv.Itoa(i)+"=x")
+		waitn(t, epa, ID{i % n, i / n}, n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got, want := rpcs(epa)-before, ncmds*2*(n-1); got != want {
+		t.Fatalf("%v RPCs for %v commands, wanted %v", got, ncmds, want)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Conflicting commands commit after one another ...\n")
+
+	// Once a conflicting command is committed everywhere, every peer
+	// reports the same dependency, so the fast path still applies
+	before = rpcs(epa)
+	epa[0].Start(4, "a=1")
+	waitn(t, epa, ID{0, 4}, n)
+	epa[1].Start(3, "a=2")
+	waitn(t, epa, ID{1, 3}, n)
+	time.Sleep(100 * time.Millisecond)
+	if got, want := rpcs(epa)-before, 2*2*(n-1); got != want {
+		t.Fatalf("%v RPCs for 2 commands, wanted %v", got, want)
+	}
+	orders := executed(t, epa, ncmds+2)
+	checkOrder(t, orders)
+	if last := orders[2][ncmds+1]; last.ID != (ID{1, 3}) {
+		t.Fatalf("executed %v last, wanted %v", last.ID, ID{1, 3})
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Fast path with a peer down ...\n")
+
+	// The fast quorum leaves one peer out, so there is no Accept round
+	epa[2].Kill()
+	before = rpcs(epa)
+	next := []int{5, 4}
+	for i := 0; i < ncmds; i++ {
+		p := i % 2
+		epa[p].Start(next[p], "f"+strconv.Itoa(i)+"=x")
+		waitn(t, epa, ID{p, next[p]}, n-1)
+		next[p]++
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got, want := rpcs(epa)-before, ncmds*2*(n-2); got != want {
+		t.Fatalf("%v RPCs for %v commands, wanted %v", got, ncmds, want)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestConcurrent(t *testing.T) {
+	const n = 5
+	epa := start("conc", n)
+	defer cleanup(epa)
+
+	fmt.Printf("Test: Concurrent conflicting commands execute in one order ...\n")
+
+	const per = 20
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			for seq := 0; seq < per; seq++ {
+				epa[i].Start(seq, "k"+strconv.Itoa(rand.Int()%3)+"="+strconv.Itoa(i))
+				time.Sleep(time.Duration(rand.Int63()%5) * time.Millisecond)
+			}
+		}(i)
+	}
+	checkOrder(t, executed(t, epa, n*per))
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestSlowPath(t *testing.T) {
+	const n = 5
+	epa := start("slow", n)
+	defer cleanup(epa)
+
+	fmt.Printf("Test: Commit with a minority of peers dead ...\n")
+
+	epa[3].Kill()
+	epa[4].Kill()
+
+	for i := 0; i < 3; i++ {
+		epa[i].Start(0, "a="+strconv.Itoa(i))
+	}
+	for i := 0; i < 3; i++ {
+		waitn(t, epa, ID{i, 0}, 3)
+	}
+	checkOrder(t, executed(t, epa, 3))
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: No commit with a majority of peers dead ...\n")
+
+	epa[2].Kill()
+	epa[0].Start(1, "a=x")
+	time.Sleep(2 * RecoverTimeout)
+	if nc := ncommitted(t, epa, ID{0, 1}); nc > 0 {
+		t.Fatalf("%v peers committed without a majority", nc)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestRecovery(t *testing.T) {
+	const n = 3
+	epa := start("recover", n)
+	defer cleanup(epa)
+
+	fmt.Printf("Test: Peers finish a failed proposer's command ...\n")
+
+	// Peer 2 fails after its PreAccept reached peer 0 only
+	epa[2].Kill()
+	args := PreAcceptArgs{ID: ID{2, 0}, Ballot: paxos.NoBallot.Next(2), Cmd: "a=lost", Seq: 0, Deps: epa[0].noDeps()}
+	var reply PreAcceptReply
+	epa[0].PreAccept(args, &reply)
+
+	// Peer 0's conflicting command depends on it, so execution waits
+	// until peer 0 or 1 takes it over
+	epa[0].Start(0, "a=x")
+	waitn(t, epa, ID{0, 0}, 2)
+	waitn(t, epa, ID{2, 0}, 2)
+	if _, v := epa[1].Status(ID{2, 0}); v != "a=lost" {
+		t.Fatalf("recovered %v, wanted a=lost", v)
+	}
+	checkOrder(t, executed(t, epa, 2))
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Peers commit a no-op for an unknown command ...\n")
+
+	// An instance only peer 2 knew of is recovered as a no-op once a
+	// peer has reason to wait on it
+	epa[1].mu.Lock()
+	epa[1].instance(ID{2, 1})
+	epa[1].mu.Unlock()
+	waitn(t, epa, ID{2, 1}, 2)
+	if _, v := epa[0].Status(ID{2, 1}); v != nil {
+		t.Fatalf("recovered %v, wanted a no-op", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Recovery keeps what the fast path may have committed ...\n")
+
+	// Peer 1 knows a conflicting command peer 0 does not, so only peer 0
+	// reports peer 2's attributes unchanged. That is a fast quorum of
+	// three, so peer 2 may have committed them before it failed.
+	epa[1].mu.Lock()
+	inst := epa[1].instance(ID{1, 9})
+	inst.Cmd, inst.Status, inst.Deps = "b=y", PreAccepted, epa[1].noDeps()
+	epa[1].mu.Unlock()
+	args = PreAcceptArgs{ID: ID{2, 2}, Ballot: initialBallot(2), Cmd: "b=lost", Seq: 0, Deps: epa[0].noDeps()}
+	for i := 0; i < 2; i++ {
+		reply = PreAcceptReply{}
+		epa[i].PreAccept(args, &reply)
+	}
+	waitn(t, epa, ID{2, 2}, 2)
+	for i := 0; i < 2; i++ {
+		epa[i].mu.Lock()
+		deps := epa[i].rows[2][2].Deps
+		epa[i].mu.Unlock()
+		if !sameDeps(deps, args.Deps) {
+			t.Fatalf("peer %v recovered dependencies %v, wanted %v", i, deps, args.Deps)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestUnreliable(t *testing.T) {
+	const n = 5
+	epa := start("unrel", n)
+	defer cleanup(epa)
+
+	fmt.Printf("Test: Concurrent commands with an unreliable network ...\n")
+
+	for i := 1; i < n; i++ {
+		epa[i].unreliable = true
+	}
+
+	const per = 10
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for seq := 0; seq < per; seq++ {
+				epa[i].Start(seq, "k"+strconv.Itoa(rand.Int()%2)+"="+strconv.Itoa(i))
+				time.Sleep(time.Duration(rand.Int63()%20) * time.Millisecond)
+			}
+		}(i)
+	}
+	wg.Wait()
+	checkOrder(t, executed(t, epa, n*per))
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestForget(t *testing.T) {
+	const n = 3
+	epa := start("forget", n)
+	defer cleanup(epa)
+
+	fmt.Printf("Test: Forgetting ...\n")
+
+	for seq := 0; seq < 5; seq++ {
+		epa[0].Start(seq, "a="+strconv.Itoa(seq))
+	}
+	executed(t, epa, 5)
+	for i := 0; i < n; i++ {
+		if m := epa[i].Min(0); m != 0 {
+			t.Fatalf("wrong initial Min() %v", m)
+		}
+	}
+
+	// Done values travel on later messages
+	for i := 0; i < n; i++ {
+		epa[i].Done(ID{0, 2})
+	}
+	for i := 0; i < n; i++ {
+		epa[i].Start(5, "b="+strconv.Itoa(i))
+	}
+	executed(t, epa, 5+n)
+	for i := 0; i < n; i++ {
+		epa[i].Start(6, "c="+strconv.Itoa(i))
+	}
+	executed(t, epa, 5+2*n)
+	time.Sleep(RecoverTimeout)
+
+	for i := 0; i < n; i++ {
+		if m := epa[i].Min(0); m != 3 {
+			t.Fatalf("peer %v Min() is %v, wanted 3", i, m)
+		}
+		if committed, _ := epa[i].Status(ID{0, 1}); committed {
+			t.Fatalf("peer %v still has forgotten instance", i)
+		}
+		if committed, _ := epa[i].Status(ID{0, 4}); !committed {
+			t.Fatalf("peer %v forgot instance it was not done with", i)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestLog(t *testing.T) {
+	const n = 3
+	lh := make([]string, n)
+	for i := 0; i < n; i++ {
+		lh[i] = port("log", i)
+	}
+	logs := make([]*Log, n)
+	for i := 0; i < n; i++ {
+		logs[i] = MakeLog(lh, i, nil, sameKey)
+	}
+	defer func() {
+		for _, lg := range logs {
+			lg.Kill()
+		}
+	}()
+
+	// decided waits for every log to decide its instances up to seq and
+	// returns their values
+	decided := func(seq int) [][]string {
+		vals := make([][]string, n)
+		for i, lg := range logs {
+			for s := lg.Min(); s <= seq; s++ {
+				for iters := 0; ; iters++ {
+					if ok, v := lg.Status(s); ok {
+						vals[i] = append(vals[i], v.(string))
+						break
+					}
+					if iters == 300 {
+						t.Fatalf("log %v did not decide instance %v", i, s)
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+		}
+		return vals
+	}
+
+	fmt.Printf("Test: Log orders conflicting values alike everywhere ...\n")
+
+	// Start at the first instance not yet decided, as on a Paxos log
+	const nvals = 12
+	for i := 0; i < nvals; i++ {
+		lg := logs[i%n]
+		seq := 0
+		for ok := true; ok; seq++ {
+			ok, _ = lg.Status(seq)
+		}
+		lg.Start(seq-1, "k"+strconv.Itoa(i%3)+"="+strconv.Itoa(i))
+	}
+	vals := decided(nvals - 1)
+	for k := 0; k < 3; k++ {
+		var first string
+		for i := range vals {
+			var got []string
+			for _, v := range vals[i] {
+				if key(v) == "k"+strconv.Itoa(k) {
+					got = append(got, v)
+				}
+			}
+			if i == 0 {
+				first = fmt.Sprint(got)
+			} else if fmt.Sprint(got) != first {
+				t.Fatalf("log %v decided %v, log 0 %v", i, got, first)
+			}
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Log proposes a retried value once ...\n")
+
+	logs[0].Start(nvals, "r=1")
+	logs[0].Start(nvals+1, "r=1")
+	decided(nvals)
+	time.Sleep(100 * time.Millisecond)
+	for i, lg := range logs {
+		if ok, v := lg.Status(nvals + 1); ok {
+			t.Fatalf("log %v decided %v after the last value", i, v)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Log forgets ...\n")
+
+	for _, lg := range logs {
+		lg.Done(nvals)
+	}
+	for i, lg := range logs {
+		if m := lg.Min(); m != nvals+1 {
+			t.Fatalf("log %v Min() is %v, wanted %v", i, m, nvals+1)
+		}
+		if ok, _ := lg.Status(0); ok {
+			t.Fatalf("log %v still has forgotten instance", i)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
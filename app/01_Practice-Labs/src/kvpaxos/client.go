@@ -2,40 +2,137 @@ package kvpaxos
 
 import (
 	"bytes"
-	"crypto/rand"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"net/rpc"
+	"sync"
 	"time"
+
+	"distributed-systems/app/01_Practice-Labs/src/paxos"
 )
 
 // Clerk represents a client for the Paxos-based key-value service.
 // It maintains a connection to multiple server replicas and handles
 // client operations with automatic retry logic and server failover.
+// Its methods may be called concurrently; writes share one session.
 type Clerk struct {
-	servers []string // List of available server addresses
-	me      uint64   // Stable client identifier for all RPC calls
+	mu      sync.Mutex
+	servers []string        // List of available server addresses
+	me      uint64          // Session identifier, or 0 before the clerk registers
+	env     paxos.Env       // How to reach the servers, wait and draw IDs
+	timeout time.Duration   // How long the servers keep an idle session
+	seq     uint64          // Sequence number of the latest write
+	pending map[uint64]bool // Writes of the session not yet answered
 }
 
 // MakeClerk creates a new client for the Paxos-based key-value service.
 // servers is a list of server addresses that the client can connect to.
-func MakeClerk(servers []string) *Clerk {
-	ck := &Clerk{
+// opts are the paxos options the servers were started with, so that the
+// client dials through the same transport and waits on the same clock.
+func MakeClerk(servers []string, opts ...paxos.Option) *Clerk {
+	return &Clerk{
 		servers: servers,
-		me:      0, // Will be set by uuid()
+		me:      0, // Set by register before the first write
+		env:     paxos.Environment(opts...),
+		timeout: DefaultSessionTimeout,
+		pending: make(map[uint64]bool),
+	}
+}
+
+// SetSessionTimeout sets how long the servers keep the clerk's session
+// without a write or KeepAlive. It applies from the next registration.
+func (ck *Clerk) SetSessionTimeout(timeout time.Duration) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	ck.timeout = timeout
+}
+
+// register opens a new session. Caller must hold ck.mu.
+func (ck *Clerk) register() {
+	args := RegisterArgs{Timeout: ck.timeout}
+	var reply RegisterReply
+	for i := 0; !call(ck.env.Transport, ck.servers[i%len(ck.servers)], "KVPaxos.RegisterClient", args, &reply); i++ {
+		ck.env.Clock.Sleep(100 * time.Millisecond)
+	}
+	DPrintf("Client registered session %d\n", reply.Client)
+	ck.me = reply.Client
+	ck.pending = make(map[uint64]bool)
+}
+
+// begin numbers a new write, registering a session first if the clerk has
+// none. It returns the session, the write's sequence number and the lowest
+// sequence number still waiting for an answer.
+func (ck *Clerk) begin() (uint64, uint64, uint64) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	if ck.me == 0 {
+		ck.register()
+	}
+	ck.seq++
+	ck.pending[ck.seq] = true
+	acked := ck.seq
+	for seq := range ck.pending {
+		if seq < acked {
+			acked = seq
+		}
+	}
+	return ck.me, ck.seq, acked
+}
+
+// end records the answer to write seq of session client. If the session
+// has expired, the next write registers a new one.
+func (ck *Clerk) end(client uint64, seq uint64, err Err) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	if client != ck.me {
+		return
+	}
+	delete(ck.pending, seq)
+	if err == ErrNoSession {
+		ck.me = 0
+	}
+}
+
+// write performs a request that changes the store under the clerk's
+// session, and returns the error the servers answered with. try sends it,
+// with the given session, sequence number and acknowledgement, to one
+// server, and reports whether the server answered and with what error.
+//
+// A write whose session has expired is retried under a new one only if
+// the first server it was sent to answered: the write was then never
+// applied. Once a request went unanswered, the write may have been applied
+// before the session expired, and retrying it could apply it twice, so
+// ErrNoSession is returned instead; the next write opens a new session.
+func (ck *Clerk) write(try func(srv string, client uint64, seq uint64, acked uint64) (bool, Err)) Err {
+	for {
+		client, seq, acked := ck.begin()
+		var err Err
+		i := 0
+		for ; true; i++ {
+			ok, e := try(ck.servers[i%len(ck.servers)], client, seq, acked)
+			if ok {
+				err = e
+				break
+			}
+			ck.env.Clock.Sleep(100 * time.Millisecond)
+		}
+		ck.end(client, seq, err)
+		if err != ErrNoSession || i > 0 {
+			return err
+		}
 	}
-	ck.me = ck.uuid()
-	return ck
 }
 
 // uuid generates a 64-bit unique identifier for client identification.
-// It uses cryptographically secure random number generation to ensure uniqueness.
+// It uses cryptographically secure random number generation to ensure uniqueness,
+// unless the clerk was given another source of randomness.
 func (ck *Clerk) uuid() uint64 {
 	// Generate 8 random bytes
 	rbytes := make([]byte, 8)
-	n, err := rand.Read(rbytes)
+	n, err := io.ReadFull(ck.env.Rand, rbytes)
 	for n < 8 || err != nil {
-		n, err = rand.Read(rbytes)
+		n, err = io.ReadFull(ck.env.Rand, rbytes)
 	}
 
 	// Convert bytes to uint64 using little-endian encoding
@@ -48,12 +145,13 @@ func (ck *Clerk) uuid() uint64 {
 // call sends an RPC to the specified server and waits for a reply.
 // It returns true if the server responded successfully, false otherwise.
 // The reply argument should be a pointer to a reply structure.
-// This function handles connection establishment, RPC call, and cleanup.
-func call(srv string, rpcname string, args interface{}, reply interface{}) bool {
-	c, err := rpc.Dial("unix", srv)
+// This function handles connection establishment through t, RPC call, and cleanup.
+func call(t paxos.Transport, srv string, rpcname string, args interface{}, reply interface{}) bool {
+	conn, err := t.Dial(srv)
 	if err != nil {
 		return false
 	}
+	c := rpc.NewClient(conn)
 	defer c.Close()
 
 	err = c.Call(rpcname, args, reply)
@@ -65,47 +163,53 @@ func call(srv string, rpcname string, args interface{}, reply interface{}) bool
 	return false
 }
 
-// Get retrieves the value associated with the given key.
-// Returns an empty string if the key does not exist.
+// GetExt retrieves the value associated with the given key.
+// Returns ErrNoKey if the key does not exist, OK otherwise.
 // Keeps trying different servers until one responds successfully.
-func (ck *Clerk) Get(key string) string {
+func (ck *Clerk) GetExt(key string) (string, Err) {
 	DPrintf("Client Get(%s)\n", key)
-	args := GetArgs{Key: key, Client: ck.me, OpId: ck.uuid()}
+	args := GetArgs{Key: key, OpId: ck.uuid()}
 	var reply GetReply
 
 	// Try different servers until one responds
 	for i := 0; true; i++ {
-		ok := call(ck.servers[i%len(ck.servers)], "KVPaxos.Get", args, &reply)
+		ok := call(ck.env.Transport, ck.servers[i%len(ck.servers)], "KVPaxos.Get", args, &reply)
 		if ok {
-			return reply.Value
+			return reply.Value, reply.Err
 		}
-		time.Sleep(100 * time.Millisecond)
+		ck.env.Clock.Sleep(100 * time.Millisecond)
 	}
 	// This should never be reached, but Go requires a return statement
-	return ""
+	return "", ""
+}
+
+// Get retrieves the value associated with the given key.
+// Returns an empty string if the key does not exist.
+func (ck *Clerk) Get(key string) string {
+	value, _ := ck.GetExt(key)
+	return value
 }
 
 // PutExt performs a Put or PutHash operation on the key-value store.
 // It keeps trying different servers until one responds successfully.
 // dohash determines whether to perform a PutHash operation (hash previous + new value).
-// Returns the previous value (for PutHash operations).
-func (ck *Clerk) PutExt(key string, value string, dohash bool) string {
-	args := PutArgs{Key: key, Value: value, DoHash: dohash, Client: ck.me, OpId: ck.uuid()}
+// Returns the previous value (for PutHash operations), and ErrNoSession if
+// the session expired while the write may already have been applied.
+func (ck *Clerk) PutExt(key string, value string, dohash bool) (string, Err) {
 	var reply PutReply
-
-	for i := 0; true; i++ {
-		ok := call(ck.servers[i%len(ck.servers)], "KVPaxos.Put", args, &reply)
-		if ok {
-			return reply.PreviousValue
-		}
-		time.Sleep(100 * time.Millisecond)
-	}
-	// This should never be reached, but Go requires a return statement
-	return ""
+	err := ck.write(func(srv string, client uint64, seq uint64, acked uint64) (bool, Err) {
+		args := PutArgs{Key: key, Value: value, DoHash: dohash, Client: client, OpId: seq, Acked: acked}
+		reply = PutReply{}
+		ok := call(ck.env.Transport, srv, "KVPaxos.Put", args, &reply)
+		return ok, reply.Err
+	})
+	return reply.PreviousValue, err
 }
 
 // Put stores a key-value pair in the key-value store.
-// It will keep trying until the operation succeeds.
+// It will keep trying until the operation succeeds. If the session expires
+// after the write may have taken effect, Put returns without knowing
+// whether it did; PutExt reports that as ErrNoSession.
 func (ck *Clerk) Put(key string, value string) {
 	DPrintf("Client Put(%s, %s)\n", key, value)
 	ck.PutExt(key, value, false)
@@ -116,5 +220,154 @@ func (ck *Clerk) Put(key string, value string) {
 // Returns the previous value before the hash operation.
 func (ck *Clerk) PutHash(key string, value string) string {
 	DPrintf("Client PutHash(%s, %s)\n", key, value)
-	return ck.PutExt(key, value, true)
+	prev, _ := ck.PutExt(key, value, true)
+	return prev
+}
+
+// PutTTL stores a key-value pair that expires ttl after the Put takes
+// effect. Once the servers have applied an op stamped after that, Get
+// reports the key missing; if no write comes along, a server proposes one
+// shortly after the deadline. Returns OK, or ErrNoSession like PutExt.
+func (ck *Clerk) PutTTL(key string, value string, ttl time.Duration) Err {
+	DPrintf("Client PutTTL(%s, %s, %v)\n", key, value, ttl)
+	return ck.write(func(srv string, client uint64, seq uint64, acked uint64) (bool, Err) {
+		args := PutArgs{Key: key, Value: value, TTL: ttl, Client: client, OpId: seq, Acked: acked}
+		var reply PutReply
+		ok := call(ck.env.Transport, srv, "KVPaxos.Put", args, &reply)
+		return ok, reply.Err
+	})
+}
+
+// Append adds value to the end of the key's value.
+// A key that does not exist is treated as empty.
+func (ck *Clerk) Append(key string, value string) {
+	DPrintf("Client Append(%s, %s)\n", key, value)
+	ck.AppendExt(key, value)
+}
+
+// AppendExt performs an Append and returns OK, or ErrNoSession like PutExt.
+func (ck *Clerk) AppendExt(key string, value string) Err {
+	return ck.write(func(srv string, client uint64, seq uint64, acked uint64) (bool, Err) {
+		args := AppendArgs{Key: key, Value: value, Client: client, OpId: seq, Acked: acked}
+		var reply AppendReply
+		ok := call(ck.env.Transport, srv, "KVPaxos.Append", args, &reply)
+		return ok, reply.Err
+	})
+}
+
+// Delete removes the key from the key-value store.
+// Returns false if the key did not exist, or on ErrNoSession like PutExt.
+func (ck *Clerk) Delete(key string) bool {
+	DPrintf("Client Delete(%s)\n", key)
+	var reply DeleteReply
+	ck.write(func(srv string, client uint64, seq uint64, acked uint64) (bool, Err) {
+		args := DeleteArgs{Key: key, Client: client, OpId: seq, Acked: acked}
+		reply = DeleteReply{}
+		ok := call(ck.env.Transport, srv, "KVPaxos.Delete", args, &reply)
+		return ok, reply.Err
+	})
+	return reply.Err == OK
+}
+
+// CompareAndSwap atomically sets the key to value if it currently holds
+// expected; an expected value of "" also matches a key that does not exist.
+// Returns whether the value was swapped; false on ErrNoSession like PutExt.
+func (ck *Clerk) CompareAndSwap(key string, expected string, value string) bool {
+	DPrintf("Client CompareAndSwap(%s, %s, %s)\n", key, expected, value)
+	var reply CompareAndSwapReply
+	ck.write(func(srv string, client uint64, seq uint64, acked uint64) (bool, Err) {
+		args := CompareAndSwapArgs{Key: key, Expected: expected, Value: value, Client: client, OpId: seq, Acked: acked}
+		reply = CompareAndSwapReply{}
+		ok := call(ck.env.Transport, srv, "KVPaxos.CompareAndSwap", args, &reply)
+		return ok, reply.Err
+	})
+	return reply.Err == OK
+}
+
+// Scan returns the key/value pairs with startKey <= key < endKey, ordered by
+// key, as of a single point in the log. An empty endKey means no upper bound.
+// At most limit pairs are returned, or all of them if limit is 0; the second
+// result reports whether more pairs lie past the last one returned.
+func (ck *Clerk) Scan(startKey string, endKey string, limit int) ([]KeyValue, bool) {
+	DPrintf("Client Scan(%s, %s, %d)\n", startKey, endKey, limit)
+	args := ScanArgs{Start: startKey, End: endKey, Limit: limit, OpId: ck.uuid()}
+	var reply ScanReply
+
+	for i := 0; true; i++ {
+		ok := call(ck.env.Transport, ck.servers[i%len(ck.servers)], "KVPaxos.Scan", args, &reply)
+		if ok {
+			return reply.Pairs, reply.More
+		}
+		ck.env.Clock.Sleep(100 * time.Millisecond)
+	}
+	// This should never be reached, but Go requires a return statement
+	return nil, false
+}
+
+// Txn atomically tests every check and, only if all of them hold, makes
+// the writes in order. A check with Absent set holds if its key does not
+// exist; any other holds if its key exists with the given value.
+// Returns whether the writes were made, and whether each check held; false
+// and no results on ErrNoSession like PutExt.
+func (ck *Clerk) Txn(checks []Check, writes []Write) (bool, []bool) {
+	DPrintf("Client Txn(%v, %v)\n", checks, writes)
+	var reply TxnReply
+	ck.write(func(srv string, client uint64, seq uint64, acked uint64) (bool, Err) {
+		args := TxnArgs{Checks: checks, Writes: writes, Client: client, OpId: seq, Acked: acked}
+		reply = TxnReply{}
+		ok := call(ck.env.Transport, srv, "KVPaxos.Txn", args, &reply)
+		return ok, reply.Err
+	})
+	return reply.Err == OK, reply.Results
+}
+
+// KeepAlive keeps the clerk's session from expiring for another timeout
+// without changing the store. A clerk that has not written yet has no
+// session to keep alive.
+func (ck *Clerk) KeepAlive() {
+	ck.mu.Lock()
+	registered := ck.me != 0
+	ck.mu.Unlock()
+	if !registered {
+		return
+	}
+	DPrintf("Client KeepAlive\n")
+	ck.write(func(srv string, client uint64, seq uint64, acked uint64) (bool, Err) {
+		args := KeepAliveArgs{Client: client, OpId: seq, Acked: acked}
+		var reply KeepAliveReply
+		ok := call(ck.env.Transport, srv, "KVPaxos.KeepAlive", args, &reply)
+		return ok, reply.Err
+	})
+}
+
+// Watch blocks until key changes after sequence number fromSeq, and returns
+// the earliest such change. Passing each returned Event.Seq back as fromSeq
+// delivers every later change. A fromSeq of -1 returns the key's current
+// value right away if it exists. Returns ErrCompacted if changes since
+// fromSeq are no longer known and the caller must read the key afresh.
+func (ck *Clerk) Watch(key string, fromSeq int) (Event, Err) {
+	return ck.watch(WatchArgs{Key: key, FromSeq: fromSeq})
+}
+
+// WatchPrefix is like Watch for every key that starts with prefix.
+func (ck *Clerk) WatchPrefix(prefix string, fromSeq int) (Event, Err) {
+	return ck.watch(WatchArgs{Key: prefix, Prefix: true, FromSeq: fromSeq})
+}
+
+// watch sends a Watch RPC until a server reports a change.
+func (ck *Clerk) watch(args WatchArgs) (Event, Err) {
+	DPrintf("Client Watch(%s, %d)\n", args.Key, args.FromSeq)
+	for i := 0; true; {
+		var reply WatchReply
+		ok := call(ck.env.Transport, ck.servers[i%len(ck.servers)], "KVPaxos.Watch", args, &reply)
+		if ok && reply.Err != ErrNoChange {
+			return reply.Event, reply.Err
+		}
+		if !ok {
+			i++
+			ck.env.Clock.Sleep(100 * time.Millisecond)
+		}
+	}
+	// This should never be reached, but Go requires a return statement
+	return Event{}, ""
 }
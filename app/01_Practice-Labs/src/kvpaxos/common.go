@@ -3,7 +3,10 @@
 // Multiple replicas maintain identical state through Paxos agreement on operation ordering.
 package kvpaxos
 
-import "hash/fnv"
+import (
+	"hash/fnv"
+	"time"
+)
 
 // Error constants for the key-value service
 const (
@@ -11,6 +14,14 @@ const (
 	OK = "OK"
 	// ErrNoKey indicates the requested key does not exist
 	ErrNoKey = "ErrNoKey"
+	// ErrMismatch indicates a CompareAndSwap found a different value
+	ErrMismatch = "ErrMismatch"
+	// ErrCompacted indicates a Watch's FromSeq is too old to tell what changed since
+	ErrCompacted = "ErrCompacted"
+	// ErrNoChange indicates nothing a Watch matches changed before it timed out
+	ErrNoChange = "ErrNoChange"
+	// ErrNoSession indicates the request's client session has expired or never existed
+	ErrNoSession = "ErrNoSession"
 )
 
 // Err represents an error type for the key-value service
@@ -18,11 +29,13 @@ type Err string
 
 // PutArgs contains the arguments for a Put or PutHash operation
 type PutArgs struct {
-	Key    string // The key to store the value under
-	Value  string // The value to store
-	DoHash bool   // If true, perform PutHash operation (hash previous value + new value)
-	Client uint64 // Client identifier for duplicate detection
-	OpId   uint64 // Unique operation ID for duplicate detection
+	Key    string        // The key to store the value under
+	Value  string        // The value to store
+	DoHash bool          // If true, perform PutHash operation (hash previous value + new value)
+	TTL    time.Duration // If positive, the key expires this long after the Put
+	Client uint64        // Session the request belongs to
+	OpId   uint64        // Sequence number of the request within the session
+	Acked  uint64        // Every request of the session below this one has been answered
 }
 
 // PutReply contains the response for a Put or PutHash operation
@@ -33,9 +46,8 @@ type PutReply struct {
 
 // GetArgs contains the arguments for a Get operation
 type GetArgs struct {
-	Key    string // The key to retrieve
-	Client uint64 // Client identifier for duplicate detection
-	OpId   uint64 // Unique operation ID for duplicate detection
+	Key  string // The key to retrieve
+	OpId uint64 // Unique operation ID, for debugging
 }
 
 // GetReply contains the response for a Get operation
@@ -44,6 +56,143 @@ type GetReply struct {
 	Value string // The retrieved value (empty if key doesn't exist)
 }
 
+// AppendArgs contains the arguments for an Append operation
+type AppendArgs struct {
+	Key    string // The key whose value to extend
+	Value  string // The string to add to the end of the value
+	Client uint64 // Session the request belongs to
+	OpId   uint64 // Sequence number of the request within the session
+	Acked  uint64 // Every request of the session below this one has been answered
+}
+
+// AppendReply contains the response for an Append operation
+type AppendReply struct {
+	Err Err // Error status of the operation
+}
+
+// DeleteArgs contains the arguments for a Delete operation
+type DeleteArgs struct {
+	Key    string // The key to remove
+	Client uint64 // Session the request belongs to
+	OpId   uint64 // Sequence number of the request within the session
+	Acked  uint64 // Every request of the session below this one has been answered
+}
+
+// DeleteReply contains the response for a Delete operation
+type DeleteReply struct {
+	Err Err // ErrNoKey if the key did not exist
+}
+
+// CompareAndSwapArgs contains the arguments for a CompareAndSwap operation
+type CompareAndSwapArgs struct {
+	Key      string // The key to update
+	Expected string // The value the key must hold; "" also matches a missing key
+	Value    string // The value to store if it does
+	Client   uint64 // Session the request belongs to
+	OpId     uint64 // Sequence number of the request within the session
+	Acked    uint64 // Every request of the session below this one has been answered
+}
+
+// CompareAndSwapReply contains the response for a CompareAndSwap operation
+type CompareAndSwapReply struct {
+	Err   Err    // OK if the value was swapped, ErrMismatch if not
+	Value string // The value the key held before the operation
+}
+
+// KeyValue is one key and its value, as returned by Scan
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// ScanArgs contains the arguments for a Scan operation
+type ScanArgs struct {
+	Start string // The first key of the range
+	End   string // The key after the range; "" for no upper bound
+	Limit int    // The most pairs to return; 0 for no limit
+	OpId  uint64 // Unique operation ID, for debugging
+}
+
+// ScanReply contains the response for a Scan operation
+type ScanReply struct {
+	Err   Err        // Error status of the operation
+	Pairs []KeyValue // The pairs in the range, ordered by key
+	More  bool       // If true, Limit cut the page short
+}
+
+// Check is a condition a Txn tests before it writes
+type Check struct {
+	Key    string // The key to test
+	Absent bool   // If true, the key must not exist
+	Value  string // Otherwise, the value the key must hold
+}
+
+// Write is one change a Txn makes
+type Write struct {
+	Key    string // The key to change
+	Value  string // The value to store
+	Delete bool   // If true, remove the key instead
+}
+
+// TxnArgs contains the arguments for a Txn operation
+type TxnArgs struct {
+	Checks []Check // Conditions that must all hold for the writes to happen
+	Writes []Write // Changes made, in order, if they do
+	Client uint64  // Session the request belongs to
+	OpId   uint64  // Sequence number of the request within the session
+	Acked  uint64  // Every request of the session below this one has been answered
+}
+
+// TxnReply contains the response for a Txn operation
+type TxnReply struct {
+	Err     Err    // OK if every check held and the writes were made, ErrMismatch if not
+	Results []bool // Whether each check held, in the order of TxnArgs.Checks
+}
+
+// Event is a change to a key, as returned by Watch
+type Event struct {
+	Key     string // The key that changed
+	Value   string // Its new value
+	Deleted bool   // If true, the key was deleted or expired
+	Seq     int    // The Paxos sequence number of the change
+}
+
+// WatchArgs contains the arguments for a Watch operation
+type WatchArgs struct {
+	Key     string // The key, or key prefix, to watch
+	Prefix  bool   // If true, watch every key starting with Key
+	FromSeq int    // Only report changes after this sequence number; -1 for all
+}
+
+// WatchReply contains the response for a Watch operation
+type WatchReply struct {
+	Err   Err   // OK, ErrCompacted, or ErrNoChange if the server timed out
+	Event Event // The earliest matching change after FromSeq
+}
+
+// RegisterArgs contains the arguments for a RegisterClient operation
+type RegisterArgs struct {
+	Timeout time.Duration // How long the session may go without a request before it expires
+}
+
+// RegisterReply contains the response for a RegisterClient operation
+type RegisterReply struct {
+	Err    Err    // Error status of the operation
+	Client uint64 // The new session's identifier
+}
+
+// KeepAliveArgs contains the arguments for a KeepAlive operation
+type KeepAliveArgs struct {
+	Client uint64 // Session to keep alive
+	OpId   uint64 // Sequence number of the request within the session
+	Acked  uint64 // Every request of the session below this one has been answered
+}
+
+// KeepAliveReply contains the response for a KeepAlive operation
+type KeepAliveReply struct {
+	Err Err // OK, or ErrNoSession if the session already expired
+}
+
 // hash computes a 32-bit hash of the input string using FNV-1a algorithm.
 // This function is used by PutHash to generate deterministic hash values.
 func hash(s string) uint32 {
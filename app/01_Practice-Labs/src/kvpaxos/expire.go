@@ -0,0 +1,133 @@
+package kvpaxos
+
+// Key expiry.
+//
+// A Put may give its key a time to live. Every write is stamped with the
+// time its server proposed it (Op.Time), so the deadline, the Put's stamp
+// plus its TTL, is part of the log. Expired keys leave the store only at
+// points in the log every server agrees on. Servers stamp ops by their own
+// clocks, so the time the log has reached is the latest stamp of any op
+// applied so far (kv.stamp). A write first drops any key it touches whose
+// deadline is at or before that, and an Expire op, proposed once some
+// deadline has passed, drops every such key. Reads change nothing, so they
+// just skip such keys; like the store, what they see depends on the log
+// alone, never on a server's clock.
+//
+// Servers wait longer before proposing an Expire the higher their number,
+// so normally only the lowest-numbered live server proposes it. Expire ops
+// also end idle client sessions (see session.go).
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// ExpireInterval is how often a server with keys to expire checks whether
+// any deadline has passed, and how much longer each server waits than the
+// one numbered before it.
+const ExpireInterval = 250 * time.Millisecond
+
+// expired reports whether key has a deadline at or before now.
+func (kv *KVPaxos) expired(key string, now int64) bool {
+	deadline, ok := kv.expires[key]
+	return ok && deadline <= now
+}
+
+// setDeadline gives key the deadline ttl after the write stamped now, or
+// none if ttl is not positive.
+func (kv *KVPaxos) setDeadline(key string, now int64, ttl time.Duration) {
+	if ttl <= 0 {
+		delete(kv.expires, key)
+		return
+	}
+	kv.expires[key] = now + int64(ttl)
+	kv.startSweep()
+}
+
+// remove drops key from the store, the index and the deadlines as of seq.
+func (kv *KVPaxos) remove(key string, seq int) {
+	if _, ok := kv.store[key]; !ok {
+		return
+	}
+	delete(kv.store, key)
+	delete(kv.expires, key)
+	kv.index.remove(key)
+	kv.deleted(key, seq)
+}
+
+// expireKeys drops the keys a write touches that have expired by the
+// latest stamp, or for an Expire every key that has.
+func (kv *KVPaxos) expireKeys(op Op, seq int) {
+	if op.Put == OpExpire {
+		for key, deadline := range kv.expires {
+			if deadline <= kv.stamp {
+				kv.remove(key, seq)
+			}
+		}
+		return
+	}
+	keys := []string{op.Key}
+	for _, c := range op.Checks {
+		keys = append(keys, c.Key)
+	}
+	for _, w := range op.Writes {
+		keys = append(keys, w.Key)
+	}
+	for _, key := range keys {
+		if kv.expired(key, kv.stamp) {
+			kv.remove(key, seq)
+		}
+	}
+}
+
+// startSweep starts sweep unless it is running already.
+func (kv *KVPaxos) startSweep() {
+	if !kv.sweeping {
+		kv.sweeping = true
+		go kv.sweep()
+	}
+}
+
+// sweep proposes an Expire whenever a deadline has passed or a session has
+// been idle for its timeout, waiting ExpireInterval longer for each server
+// numbered below this one. It runs from the first Put with a TTL or the
+// first session until the server is killed.
+func (kv *KVPaxos) sweep() {
+	wait := time.Duration(kv.me) * ExpireInterval
+	for !kv.dead {
+		kv.env.Clock.Sleep(ExpireInterval)
+
+		kv.mu.Lock()
+		if _, err := kv.doGet(Nop, kv.seqTried-1); err != nil {
+			kv.mu.Unlock()
+			return
+		}
+		due := kv.env.Clock.Now().Add(-wait).UnixNano()
+		if kv.overdue(due) || kv.idle(due) {
+			DPrintf("Server %d proposes Expire", kv.me)
+			kv.submit(Op{Client: 0, OpId: kv.opId(), Put: OpExpire})
+		}
+		kv.mu.Unlock()
+	}
+}
+
+// overdue reports whether some key's deadline is at or before now.
+func (kv *KVPaxos) overdue(now int64) bool {
+	for _, deadline := range kv.expires {
+		if deadline <= now {
+			return true
+		}
+	}
+	return false
+}
+
+// opId draws a random ID for an operation the server proposes itself.
+func (kv *KVPaxos) opId() uint64 {
+	b := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(kv.env.Rand, b); err == nil {
+			return binary.LittleEndian.Uint64(b)
+		}
+	}
+}
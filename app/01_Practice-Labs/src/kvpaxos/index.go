@@ -0,0 +1,59 @@
+package kvpaxos
+
+import "sort"
+
+// keyIndex holds the store's keys in sorted order beside the store, so a
+// Scan can walk a key range without sorting every key in the store.
+// Like the store it changes only as operations are applied.
+type keyIndex struct {
+	keys []string // Sorted, without duplicates
+}
+
+// makeKeyIndex returns an index of the keys in store.
+func makeKeyIndex(store map[string]string) *keyIndex {
+	ix := &keyIndex{keys: make([]string, 0, len(store))}
+	for key := range store {
+		ix.keys = append(ix.keys, key)
+	}
+	sort.Strings(ix.keys)
+	return ix
+}
+
+// insert adds key to the index if it is not there already.
+func (ix *keyIndex) insert(key string) {
+	i := sort.SearchStrings(ix.keys, key)
+	if i < len(ix.keys) && ix.keys[i] == key {
+		return
+	}
+	ix.keys = append(ix.keys, "")
+	copy(ix.keys[i+1:], ix.keys[i:])
+	ix.keys[i] = key
+}
+
+// remove drops key from the index if it is there.
+func (ix *keyIndex) remove(key string) {
+	i := sort.SearchStrings(ix.keys, key)
+	if i < len(ix.keys) && ix.keys[i] == key {
+		ix.keys = append(ix.keys[:i], ix.keys[i+1:]...)
+	}
+}
+
+// scan returns up to limit keys k with start <= k < end for which keep(k)
+// is true, in order, and whether more such keys lie in the range. An empty
+// end means no upper bound and a limit of zero or less means no limit.
+func (ix *keyIndex) scan(start string, end string, limit int, keep func(string) bool) ([]string, bool) {
+	keys := []string{}
+	for i := sort.SearchStrings(ix.keys, start); i < len(ix.keys); i++ {
+		if end != "" && ix.keys[i] >= end {
+			break
+		}
+		if !keep(ix.keys[i]) {
+			continue
+		}
+		if limit > 0 && len(keys) == limit {
+			return keys, true
+		}
+		keys = append(keys, ix.keys[i])
+	}
+	return keys, false
+}
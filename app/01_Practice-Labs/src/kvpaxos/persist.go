@@ -0,0 +1,104 @@
+package kvpaxos
+
+// Persistence.
+//
+// A server started with StartPersistentServer keeps its Paxos log in
+// dir/paxos and, every SaveInterval instances it applies, writes its state
+// (what Snapshot hands a lagging peer: the store, deadlines, change records
+// and sessions) to dir/state. It calls Done only through the last instance
+// it saved, so its log keeps every instance applied since. A restarted
+// server loads the saved state and replays the rest of the log as it
+// catches up, like any server that fell behind.
+//
+// A missing or damaged state file, or a lost Paxos log (see
+// paxos/recover.go), leaves the server to start from an empty state; it
+// then gets the state back from the log and, for instances its peers have
+// forgotten, from their snapshots.
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"distributed-systems/app/01_Practice-Labs/src/paxos"
+)
+
+// SaveInterval is how many instances a persistent server applies between
+// writes of its state to disk.
+const SaveInterval = 100
+
+// savedState is the content of a persistent server's state file.
+type savedState struct {
+	Seq  int    // Last instance reflected in Data
+	Data []byte // The state, encoded as for Snapshot
+}
+
+// done tells Paxos that the server no longer needs the instances it has
+// applied. A persistent server first saves its state, once every
+// SaveInterval instances, and needs the instances it applied since.
+func (kv *KVPaxos) done() {
+	if kv.dir == "" {
+		kv.px.Done(kv.seqDone)
+		return
+	}
+	if kv.seqDone-kv.saved >= SaveInterval {
+		kv.save()
+		kv.px.Done(kv.saved)
+	}
+}
+
+// save writes the state through seqDone to dir/state. The file is written
+// in full under another name and renamed over the old one, so a crash
+// leaves one copy or the other. A killed server writes nothing, so that it
+// cannot overwrite the state of a server restarted in its place.
+func (kv *KVPaxos) save() {
+	if kv.dead {
+		return
+	}
+	w := new(bytes.Buffer)
+	if err := gob.NewEncoder(w).Encode(savedState{Seq: kv.seqDone, Data: kv.encode()}); err != nil {
+		log.Fatalf("save encode failed on server %d: %v", kv.me, err)
+	}
+	name := kv.dir + "/state"
+	temp := kv.dir + "/state-temp"
+	f, err := os.Create(temp)
+	if err != nil {
+		log.Fatalf("save could not create %v: %v", temp, err)
+	}
+	if _, err := f.Write(paxos.EncodeFile(w.Bytes())); err != nil {
+		log.Fatalf("save could not write %v: %v", temp, err)
+	}
+	if err := f.Sync(); err != nil {
+		log.Fatalf("save could not sync %v: %v", temp, err)
+	}
+	f.Close()
+	if err := os.Rename(temp, name); err != nil {
+		log.Fatalf("save could not rename %v: %v", temp, err)
+	}
+	DPrintf("Server %d saved state through Seq(%d)", kv.me, kv.seqDone)
+	kv.saved = kv.seqDone
+}
+
+// load installs the state saved in dir/state. It returns an error if
+// there is none or it is damaged, leaving the server state as it was.
+func (kv *KVPaxos) load() error {
+	name := kv.dir + "/state"
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	data, err := paxos.DecodeFile(content)
+	if err != nil {
+		return fmt.Errorf("%v: %w", name, err)
+	}
+	var saved savedState
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&saved); err != nil {
+		return fmt.Errorf("%v: %v", name, err)
+	}
+	kv.Restore(saved.Seq, saved.Data)
+	kv.saved = saved.Seq
+	return nil
+}
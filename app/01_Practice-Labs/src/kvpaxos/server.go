@@ -1,16 +1,16 @@
 package kvpaxos
 
 import (
+	"bytes"
+	"context"
 	"encoding/gob"
 	"fmt"
 	"log"
-	"math/rand"
 	"net"
 	"net/rpc"
 	"os"
 	"strconv"
 	"sync"
-	"syscall"
 	"time"
 
 	"distributed-systems/app/01_Practice-Labs/src/paxos"
@@ -30,22 +30,55 @@ func DPrintf(format string, a ...interface{}) (n int, err error) {
 // Nop represents a no-operation used to fill holes in the Paxos log
 var Nop = Op{Client: 0, OpId: 0, Put: 0, Key: "", Value: ""}
 
+// Operation types, as carried in Op.Put. OpGet and OpScan leave the state
+// unchanged; OpRegister and OpKeepAlive change only the sessions.
+const (
+	OpGet            = 0
+	OpPut            = 1
+	OpPutHash        = 2
+	OpAppend         = 3
+	OpDelete         = 4
+	OpCompareAndSwap = 5
+	OpScan           = 6
+	OpTxn            = 7
+	OpExpire         = 8
+	OpRegister       = 9
+	OpKeepAlive      = 10
+)
+
 // Op represents an operation that can be agreed upon through Paxos.
 // It contains all the information needed to execute a key-value operation.
 type Op struct {
-	Client uint64 // Client identifier for duplicate detection
-	OpId   uint64 // Unique operation ID for duplicate detection
-	Put    int    // Operation type: 0 = Get, 1 = Put, 2 = PutHash
-	Key    string // The key for the operation
-	Value  string // The value for Put operations (empty for Gets)
+	Client   uint64        // Session of a client's write; 0 for reads and ops servers propose
+	OpId     uint64        // Sequence number of the write within its session, or a random ID
+	Acked    uint64        // Every write of the session below this one has been answered
+	Put      int           // Operation type: OpGet, OpPut, OpPutHash, ...
+	Key      string        // The key for the operation
+	Value    string        // The value for Put operations (empty for Gets)
+	Expected string        // The value CompareAndSwap expects to find
+	End      string        // The key after a Scan's range (Key is the first)
+	Limit    int           // The most pairs a Scan returns
+	Checks   []Check       // The conditions of a Txn
+	Writes   []Write       // The writes of a Txn
+	TTL      time.Duration // How long after it the key of a Put expires, or a session may idle
+	Time     int64         // When a write was proposed, in Unix nanoseconds (see expire.go)
+}
+
+// readOnly reports whether op leaves the store unchanged.
+func (op Op) readOnly() bool {
+	return op.Put == OpGet || op.Put == OpScan
 }
 
 // OpResult represents the result of executing an operation.
 // It stores the operation, its result, and the Paxos sequence number.
 type OpResult struct {
-	Op     Op     // The operation that was executed
-	Result string // Result value (for Get) or previous value (for PutHash)
-	Seq    int    // Paxos sequence number where this operation was agreed upon
+	Op     Op         // The operation that was executed
+	Result string     // Result value (for Get) or previous value (for PutHash, CompareAndSwap)
+	Err    Err        // ErrNoKey for a missing key, ErrMismatch for a failed CompareAndSwap
+	Pairs  []KeyValue // The page a Scan returns
+	Checks []bool     // Whether each of a Txn's checks held
+	More   bool       // Whether a Scan's limit cut its page short
+	Seq    int        // Paxos sequence number where this operation was agreed upon
 }
 
 // KVPaxos represents a Paxos-based key-value server.
@@ -58,81 +91,190 @@ type KVPaxos struct {
 	dead       bool              // Flag indicating if server should shut down (for testing)
 	unreliable bool              // Flag for unreliable network simulation (for testing)
 	px         *paxos.Paxos      // Paxos peer for consensus
+	env        paxos.Env         // The transport, clock and randomness Paxos runs on
+	dir        string            // Where a persistent server keeps its state, or "" (see persist.go)
 
 	// Key-value store state
 	store    map[string]string           // Replicated key-value store
-	opLog    map[uint64]map[int]OpResult // Operation log per client per sequence number
-	idLog    map[uint64]bool             // Set of completed operation IDs for duplicate detection
+	index    *keyIndex                   // The store's keys in order, for Scan
+	expires  map[string]int64            // Deadline of each key with a TTL, in Unix nanoseconds
+	stamp    int64                       // Latest stamp of an applied op, in Unix nanoseconds
+	sweeping bool                        // Whether sweep is running
+	changes  map[string]int              // Seq at which each key in the store last changed, for Watch
+	tombs    map[string]int              // Seq at which each recently deleted key was removed
+	floor    int                         // Highest seq of a tombstone dropped from tombs
+	sessions map[uint64]*session         // Duplicate detection state of each client session
 	seqTried int                         // Hint for next sequence number to try
-	seqDone  int                         // Last sequence number for which Done() was called
+	seqDone  int                         // Last sequence number applied
+	saved    int                         // Last sequence number in the state saved to disk
 }
 
 // waitForPaxos waits for a Paxos instance to be decided.
-// It uses exponential backoff to avoid busy waiting.
-// Returns true if the instance was decided, false if it was already done.
-func (kv *KVPaxos) waitForPaxos(seq int) bool {
-	to := 10 * time.Millisecond
-	for {
-		decided, _ := kv.px.Status(seq)
-		if decided {
-			return true
+// Returns paxos.ErrKilled if the server is killed first, and nil otherwise,
+// also when the instance was already forgotten.
+func (kv *KVPaxos) waitForPaxos(seq int) error {
+	_, err := kv.px.Wait(context.Background(), seq)
+	if err == paxos.ErrKilled {
+		return err
+	}
+	if err != nil {
+		DPrintf("Seq(%d) is already done, through %d. Stop waiting on server %d.", seq, kv.seqDone, kv.me)
+	}
+	return nil
+}
+
+// apply executes a decided operation on the store and logs its result.
+// This is a non-locking internal helper function.
+// Put returns an empty result; PutHash, Append, Delete and CompareAndSwap
+// return the previous value.
+func (kv *KVPaxos) apply(op Op, seq int) OpResult {
+	if op.readOnly() {
+		return kv.applyRead(op, seq)
+	}
+	if op.Time > kv.stamp {
+		kv.stamp = op.Time
+	}
+
+	// A client that retries at another server while the first is still
+	// proposing may get the same operation decided twice; apply it once
+	record, ok := kv.checkLog(op)
+	if ok {
+		DPrintf("Server %d skips duplicate Seq(%d) of ID = %d, applied at Seq(%d)", kv.me, seq, op.OpId, record.Seq)
+		return record
+	}
+	if record.Err == ErrNoSession {
+		record.Seq = seq
+		return record
+	}
+
+	kv.expireKeys(op, seq)
+	prev, exists := kv.store[op.Key]
+	res := OpResult{Op: op, Result: prev, Err: OK, Seq: seq}
+	switch op.Put {
+	case OpPut:
+		kv.set(op.Key, op.Value, seq)
+		kv.setDeadline(op.Key, op.Time, op.TTL)
+		res.Result = ""
+	case OpPutHash:
+		// Compute hash of previous value + new value
+		kv.set(op.Key, strconv.Itoa(int(hash(prev+op.Value))), seq)
+	case OpAppend:
+		kv.set(op.Key, prev+op.Value, seq)
+	case OpDelete:
+		if !exists {
+			res.Err = ErrNoKey
 		}
-		time.Sleep(to)
-		if to < 10*time.Second {
-			to *= 2
+		kv.remove(op.Key, seq)
+	case OpCompareAndSwap:
+		// A missing key holds the empty string as far as CompareAndSwap goes
+		if prev == op.Expected {
+			// Like a Put without a TTL, the new value is permanent
+			kv.set(op.Key, op.Value, seq)
+			kv.setDeadline(op.Key, op.Time, 0)
 		} else {
-			DPrintf("Waiting for Paxos seq(%d) on server %d", seq, kv.me)
+			res.Err = ErrMismatch
 		}
-		if seq < kv.seqDone {
-			DPrintf("Seq(%d) is already done, through %d. Stop waiting on server %d.", seq, kv.seqDone, kv.me)
-			return false
+	case OpTxn:
+		res.Result = ""
+		res.Checks, res.Err = kv.applyTxn(op, seq)
+	case OpExpire:
+		res.Result = ""
+		kv.endSessions(op.Time)
+	case OpRegister:
+		res.Result = ""
+		kv.openSession(op, seq)
+	case OpKeepAlive:
+		res.Result = ""
+	}
+	kv.logResult(res)
+	return res
+}
+
+// applyRead executes a Get or Scan. Keys whose deadline is at or before
+// the latest stamp in the log are missing, though they stay in the store
+// until an op expires them, so every server reads the same at the same point.
+func (kv *KVPaxos) applyRead(op Op, seq int) OpResult {
+	if op.Put == OpScan {
+		live := func(key string) bool { return !kv.expired(key, kv.stamp) }
+		keys, more := kv.index.scan(op.Key, op.End, op.Limit, live)
+		res := OpResult{Op: op, Err: OK, Pairs: make([]KeyValue, len(keys)), More: more, Seq: seq}
+		for i, key := range keys {
+			res.Pairs[i] = KeyValue{Key: key, Value: kv.store[key]}
 		}
+		return res
 	}
+	value, exists := kv.store[op.Key]
+	if !exists || kv.expired(op.Key, kv.stamp) {
+		return OpResult{Op: op, Err: ErrNoKey, Seq: seq}
+	}
+	return OpResult{Op: op, Result: value, Err: OK, Seq: seq}
 }
 
-// doPut executes a Put or PutHash operation on the key-value store.
-// This is a non-locking internal helper function.
-// For PutHash operations, it computes the hash of (previous value + new value).
-// Returns the previous value (for PutHash) or empty string (for Put).
-func (kv *KVPaxos) doPut(op Op, seq int, forceLog bool) string {
-	if op.Put > 1 { // PutHash operation
-		prevValue, ok := kv.store[op.Key]
-		if !ok {
-			prevValue = ""
+// applyTxn tests every check of a Txn against the store and, if all of
+// them hold, makes its writes. It returns whether each check held, and OK
+// or ErrMismatch.
+func (kv *KVPaxos) applyTxn(op Op, seq int) ([]bool, Err) {
+	held := make([]bool, len(op.Checks))
+	var err Err = OK
+	for i, c := range op.Checks {
+		value, exists := kv.store[c.Key]
+		if c.Absent {
+			held[i] = !exists
+		} else {
+			held[i] = exists && value == c.Value
+		}
+		if !held[i] {
+			err = ErrMismatch
 		}
-		// Compute hash of previous value + new value
-		value := strconv.Itoa(int(hash(prevValue + op.Value)))
-		kv.store[op.Key] = value
-		kv.logResult(OpResult{Op: op, Result: prevValue, Seq: seq})
-		return prevValue
-	} else { // Regular Put operation
-		kv.store[op.Key] = op.Value
-		kv.logResult(OpResult{Op: op, Result: "", Seq: seq})
-		return ""
 	}
+	if err != OK {
+		return held, err
+	}
+	for _, w := range op.Writes {
+		if w.Delete {
+			kv.remove(w.Key, seq)
+		} else {
+			kv.set(w.Key, w.Value, seq)
+			kv.setDeadline(w.Key, op.Time, 0)
+		}
+	}
+	return held, OK
+}
+
+// set stores value under key as of seq, adding the key to the index if it
+// is new.
+func (kv *KVPaxos) set(key string, value string, seq int) {
+	if _, ok := kv.store[key]; !ok {
+		kv.index.insert(key)
+	}
+	kv.store[key] = value
+	kv.changed(key, seq)
 }
 
 // doGet executes all operations up to and including the given sequence number.
 // This is a non-locking internal function. Callers are responsible for locking.
 // It ensures the server is caught up with the Paxos log and executes the requested operation.
-// Returns the result of the operation (value for Get, previous value for PutHash).
-func (kv *KVPaxos) doGet(req Op, seqEnd int) string {
-	if req != Nop {
+// Returns the result of the operation (value for Get, previous value for PutHash),
+// or paxos.ErrKilled if the server is killed first.
+func (kv *KVPaxos) doGet(req Op, seqEnd int) (OpResult, error) {
+	if req.OpId != Nop.OpId {
 		DPrintf("DoGet(%d) with Done = %d on server %d", seqEnd, kv.seqDone, kv.me)
 	}
 
+	// Fetch decisions we missed from the other servers. If they have been
+	// forgotten this installs a snapshot, which may move seqDone to seqEnd
+	// or past it
+	kv.px.CatchUp(kv.seqDone+1, seqEnd)
+
 	// If we've already processed this sequence, look up the result in the log
 	if seqEnd <= kv.seqDone {
-		record, ok := kv.checkLog(req)
-		if ok {
-			return record.Result
-		}
-		return ""
+		record, _ := kv.checkLog(req)
+		return record, nil
 	}
 
 	// Jump-start decisions for sequences we need to catch up on
 	// This is essential to avoid deadlock when servers fall behind
-	for seq := kv.seqDone + 1; seq < seqEnd; seq++ {
+	for seq := kv.seqDone + 1; seq <= seqEnd; seq++ {
 		decided, _ := kv.px.Status(seq)
 		if !decided {
 			// Submit a no-op to force agreement on this sequence
@@ -140,111 +282,60 @@ func (kv *KVPaxos) doGet(req Op, seqEnd int) string {
 		}
 	}
 
-	// Execute all operations from seqDone+1 to seqEnd-1
-	for seq := kv.seqDone + 1; seq < seqEnd; seq++ {
-		decided, val := kv.px.Status(seq)
-		if !decided {
-			kv.waitForPaxos(seq)
-			decided, val = kv.px.Status(seq)
-		}
-		op := val.(Op)
-		var res string
-		if op.Put > 0 {
-			res = kv.doPut(op, seq, false)
-		} else {
-			res = kv.store[op.Key]
-			kv.logResult(OpResult{Op: op, Result: res, Seq: seq})
-		}
-		DPrintf("Server %d has caught up with Seq(%d): Get/Put(%s) ID = %d: %s", kv.me, seq, op.Key, op.OpId, res)
-	}
-
-	// Execute the requested operation at seqEnd
-	decided, val := kv.px.Status(seqEnd)
-	for !decided {
-		kv.px.Start(seqEnd, Nop)
-		kv.waitForPaxos(seqEnd)
-		decided, val = kv.px.Status(seqEnd)
-	}
-
-	op := val.(Op)
-	var value string
-	if op.Put > 0 {
-		value = kv.doPut(op, seqEnd, true)
-	} else {
-		if v, ok := kv.store[op.Key]; ok {
-			value = v
-		} else {
-			value = ""
-		}
-		kv.logResult(OpResult{Op: op, Result: value, Seq: seqEnd})
+	// Execute all operations from seqDone+1 to seqEnd as they are decided
+	res, err := kv.applyThrough(context.Background(), req, seqEnd)
+	if err != nil {
+		return OpResult{}, err
 	}
 
 	// Tell Paxos we are finished with this operation and all previous ones
-	kv.px.Done(seqEnd)
-	kv.seqDone = seqEnd
-	return value
+	kv.done()
+	return res, nil
 }
 
-// logResult logs the result of a Put or PutHash operation for duplicate detection.
-// Get operations are not logged as they don't need duplicate detection.
-func (kv *KVPaxos) logResult(op OpResult) {
-	if op.Op.Put == 0 {
-		return // Don't need to log Get operations
-	}
-	if kv.opLog[op.Op.Client] == nil {
-		kv.opLog[op.Op.Client] = make(map[int]OpResult)
-	}
-	kv.opLog[op.Op.Client][op.Seq] = op
-}
-
-// checkLog checks if an operation has already been executed by looking in the operation log.
-// Returns the operation result and true if found, false otherwise.
-func (kv *KVPaxos) checkLog(op Op) (OpResult, bool) {
-	records, ok := kv.opLog[op.Client]
-	if !ok {
-		return OpResult{Op: Nop, Result: "", Seq: -1}, false
-	}
-	for _, record := range records {
-		if record.Op.OpId == op.OpId {
-			return record, true
+// applyThrough executes every operation from seqDone+1 through seqEnd in
+// order, as the Decisions stream delivers them, and returns the result of
+// the one at seqEnd. It proposes nothing, so each instance waits for
+// whoever proposed it. If the other servers have forgotten an instance it
+// installs their snapshot, and looks up the result of req in the log.
+// Returns paxos.ErrKilled if the server is killed first, or ctx.Err().
+// Caller must hold kv.mu.
+func (kv *KVPaxos) applyThrough(ctx context.Context, req Op, seqEnd int) (OpResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for kv.seqDone < seqEnd {
+		for d := range kv.px.Decisions(ctx, kv.seqDone+1) {
+			op := d.Value.(Op)
+			res := kv.apply(op, d.Seq)
+			kv.seqDone = d.Seq
+			DPrintf("Server %d has caught up with Seq(%d): Get/Put(%s) ID = %d: %s", kv.me, d.Seq, op.Key, op.OpId, res.Result)
+			if d.Seq == seqEnd {
+				return res, nil
+			}
 		}
-	}
-	return OpResult{Op: Nop, Result: "", Seq: -1}, false
-}
 
-// clearLog clears old operation log entries to prevent memory growth.
-// It keeps operations at and ahead of the given sequence, plus 8 operations behind it.
-func (kv *KVPaxos) clearLog(client uint64, seq int) {
-	records, ok := kv.opLog[client]
-	if !ok {
-		return
-	}
-	prev := make(map[int]bool)
-	prevMin := -1
-	for _, record := range records {
-		if record.Seq < prevMin {
-			delete(records, record.Seq)
-		} else if record.Seq < seq {
-			prev[record.Seq] = true
-			if len(prev) > 6 {
-				delete(records, prevMin)
-				prevMin = seq
-				for key := range prev {
-					if prevMin < key {
-						prevMin = key
-					}
-				}
-				delete(prev, prevMin)
+		// The stream stopped short; ask why
+		_, err := kv.px.Wait(ctx, kv.seqDone+1)
+		if err == paxos.ErrForgotten {
+			seqDone := kv.seqDone
+			kv.px.CatchUp(seqDone+1, seqEnd)
+			if kv.seqDone == seqDone {
+				kv.env.Clock.Sleep(10 * time.Millisecond)
 			}
+		} else if err != nil {
+			return OpResult{}, err
 		}
 	}
-	kv.opLog[client] = records
+	record, _ := kv.checkLog(req)
+	return record, nil
 }
 
 // decideSeq attempts to assign a Paxos sequence number to the given operation.
 // It tries different sequence numbers until it successfully gets agreement on the operation.
-// Returns the sequence number where the operation was agreed upon.
-func (kv *KVPaxos) decideSeq(op Op) int {
+// Returns the sequence number where the operation was agreed upon, or
+// paxos.ErrKilled if the server is killed first.
+func (kv *KVPaxos) decideSeq(op Op) (int, error) {
+	op.Time = kv.env.Clock.Now().UnixNano()
 	for {
 		seq := kv.seqTried
 
@@ -255,10 +346,12 @@ func (kv *KVPaxos) decideSeq(op Op) int {
 		}
 
 		// Check if the operation has already been processed
-		kv.doGet(Nop, seq-1)
+		if _, err := kv.doGet(Nop, seq-1); err != nil {
+			return -1, err
+		}
 		record, ok := kv.checkLog(op)
 		if ok {
-			return record.Seq
+			return record.Seq, nil
 		}
 
 		DPrintf("OpID=%d not found in log on server %d. Attempting Paxos seq=%d", op.OpId, kv.me, seq)
@@ -267,47 +360,76 @@ func (kv *KVPaxos) decideSeq(op Op) int {
 
 		// Try to get agreement on this sequence with our operation
 		kv.px.Start(seq, op)
-		kv.waitForPaxos(seq)
+		if err := kv.waitForPaxos(seq); err != nil {
+			return -1, err
+		}
 		decided, val := kv.px.Status(seq)
-		if decided && val != nil && (op.OpId == val.(Op).OpId) {
-			return seq
+		if decided && val != nil && val.(Op).Client == op.Client && val.(Op).OpId == op.OpId {
+			return seq, nil
 		}
 	}
 }
 
+// submit gets op agreed upon through Paxos, unless this server already
+// executed it, and returns its result. It fails only if the server is
+// killed first. Caller must hold kv.mu.
+func (kv *KVPaxos) submit(op Op) (OpResult, error) {
+	// First, check if this operation has already been processed
+	if _, err := kv.doGet(Nop, kv.seqTried-1); err != nil {
+		return OpResult{}, err
+	}
+	if record, ok := kv.checkLog(op); ok {
+		DPrintf("OpID=%d to server %d found in log\n", op.OpId, kv.me)
+		return record, nil
+	}
+
+	// Try to get agreement on a Paxos sequence for this operation
+	seq, err := kv.decideSeq(op)
+	if err != nil {
+		return OpResult{}, err
+	}
+	DPrintf("OpID=%d on server %d decided for Seq(%d)", op.OpId, kv.me, seq)
+
+	// Execute the operation and get the result
+	return kv.doGet(op, seq)
+}
+
+// read executes a Get or Scan without agreeing on it through Paxos. It asks
+// Paxos for an instance at or above every instance decided before the call,
+// applies the log through it, and reads from the store, so the result
+// reflects every operation that completed before the read began. It fails
+// only if the server is killed first. Caller must hold kv.mu.
+func (kv *KVPaxos) read(op Op) (OpResult, error) {
+	index, err := kv.px.ReadIndex(context.Background())
+	if err != nil {
+		return OpResult{}, err
+	}
+	if _, err := kv.doGet(Nop, index); err != nil {
+		return OpResult{}, err
+	}
+	if kv.seqTried <= index {
+		kv.seqTried = index + 1
+	}
+	return kv.apply(op, index), nil
+}
+
 // Get handles Get RPC requests from clients.
-// It ensures the operation is agreed upon through Paxos and returns the current value.
+// It returns the current value without consuming a Paxos instance (see read).
 func (kv *KVPaxos) Get(args *GetArgs, reply *GetReply) error {
 	DPrintf("Server Get(%s), ID=%d, to server %d\n", args.Key, args.OpId, kv.me)
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
 
-	op := Op{Client: args.Client, OpId: args.OpId, Put: 0, Key: args.Key, Value: ""}
+	op := Op{OpId: args.OpId, Put: OpGet, Key: args.Key}
 
-	// First, check if this operation has already been processed
-	kv.doGet(Nop, kv.seqTried-1)
-
-	record, ok := kv.checkLog(op)
-	if ok && record.Op.OpId == args.OpId {
-		DPrintf("Server Get(%s) to server %d found in log\n", args.Key, kv.me)
-		reply.Value = record.Result
-		reply.Err = ""
-		return nil
+	res, err := kv.read(op)
+	if err != nil {
+		return err
 	}
+	reply.Value = res.Result
+	reply.Err = res.Err
 
-	// Try to get agreement on a Paxos sequence for this operation
-	seq := kv.decideSeq(op)
-
-	DPrintf("Server Get(%s) on server %d decided for Seq(%d)", args.Key, kv.me, seq)
-
-	// Execute the operation and get the result
-	reply.Value = kv.doGet(op, seq)
-	reply.Err = ""
-
-	// Clean up old log entries for this client
-	kv.clearLog(args.Client, seq)
-
-	DPrintf("Server Get(%s), ID = %d, on server %d, Seq(%d) returns value %s", args.Key, args.OpId, kv.me, seq, reply.Value)
+	DPrintf("Server Get(%s), ID = %d, on server %d, Seq(%d) returns value %s", args.Key, args.OpId, kv.me, res.Seq, reply.Value)
 
 	return nil
 }
@@ -319,49 +441,185 @@ func (kv *KVPaxos) Put(args *PutArgs, reply *PutReply) error {
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
 
-	// Determine operation type: 1 = Put, 2 = PutHash
-	put := 1
+	put := OpPut
 	if args.DoHash {
-		put = 2
+		put = OpPutHash
 	}
-	op := Op{Client: args.Client, OpId: args.OpId, Put: put, Key: args.Key, Value: args.Value}
+	op := Op{Client: args.Client, OpId: args.OpId, Acked: args.Acked, Put: put,
+		Key: args.Key, Value: args.Value, TTL: args.TTL}
 
-	// First, check if this operation has already been processed
-	kv.doGet(Nop, kv.seqTried-1)
-	record, ok := kv.checkLog(op)
-	if ok && record.Op.OpId == args.OpId {
-		DPrintf("Server Put(%s) to server %d found in log.\n", args.Key, kv.me)
-		reply.PreviousValue = record.Result
-		reply.Err = ""
-		return nil
+	res, err := kv.submit(op)
+	if err != nil {
+		return err
 	}
+	reply.Err = res.Err
+	reply.PreviousValue = res.Result
+
+	DPrintf("Server Put(%s, %s) ID=%d on server %d, Seq(%d) returns value %s", args.Key, args.Value, args.OpId, kv.me, res.Seq, reply.PreviousValue)
+	return nil
+}
+
+// Append handles Append RPC requests from clients.
+// It adds args.Value to the end of the key's value, a missing key counting as empty.
+func (kv *KVPaxos) Append(args *AppendArgs, reply *AppendReply) error {
+	DPrintf("Server Append(%s), ID=%d, to server %d\n", args.Key, args.OpId, kv.me)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
 
-	// Check if we've seen this operation ID before (old request)
-	if kv.idLog[args.OpId] {
-		reply.PreviousValue = ""
-		return nil
+	op := Op{Client: args.Client, OpId: args.OpId, Acked: args.Acked, Put: OpAppend, Key: args.Key, Value: args.Value}
+	res, err := kv.submit(op)
+	if err != nil {
+		return err
 	}
+	reply.Err = res.Err
+	return nil
+}
 
-	// Try to get agreement on a Paxos sequence for this operation
-	seq := kv.decideSeq(op)
+// Delete handles Delete RPC requests from clients.
+// Later Gets of the key return ErrNoKey until it is written again.
+func (kv *KVPaxos) Delete(args *DeleteArgs, reply *DeleteReply) error {
+	DPrintf("Server Delete(%s), ID=%d, to server %d\n", args.Key, args.OpId, kv.me)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
 
-	DPrintf("Server Put(%s) on server %d decided on Seq(%d)", args.Key, kv.me, seq)
+	op := Op{Client: args.Client, OpId: args.OpId, Acked: args.Acked, Put: OpDelete, Key: args.Key}
+	res, err := kv.submit(op)
+	if err != nil {
+		return err
+	}
+	reply.Err = res.Err
+	return nil
+}
 
-	// Execute the operation and get the result
-	if args.DoHash {
-		reply.PreviousValue = kv.doGet(op, seq)
-	} else {
-		reply.PreviousValue = ""
+// CompareAndSwap handles CompareAndSwap RPC requests from clients.
+// It sets the key to args.Value only if it holds args.Expected.
+func (kv *KVPaxos) CompareAndSwap(args *CompareAndSwapArgs, reply *CompareAndSwapReply) error {
+	DPrintf("Server CompareAndSwap(%s), ID=%d, to server %d\n", args.Key, args.OpId, kv.me)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	op := Op{Client: args.Client, OpId: args.OpId, Acked: args.Acked, Put: OpCompareAndSwap,
+		Key: args.Key, Value: args.Value, Expected: args.Expected}
+	res, err := kv.submit(op)
+	if err != nil {
+		return err
 	}
+	reply.Err = res.Err
+	reply.Value = res.Result
+	return nil
+}
 
-	reply.Err = ""
-	kv.clearLog(args.Client, seq)
-	kv.idLog[args.OpId] = true
+// Txn handles Txn RPC requests from clients.
+// Its checks and writes are agreed upon as one operation, so no other
+// operation comes between them.
+func (kv *KVPaxos) Txn(args *TxnArgs, reply *TxnReply) error {
+	DPrintf("Server Txn, ID=%d, to server %d\n", args.OpId, kv.me)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
 
-	DPrintf("Server Put(%s, %s) ID=%d on server %d, Seq(%d) returns value %s", args.Key, args.Value, args.OpId, kv.me, seq, reply.PreviousValue)
+	op := Op{Client: args.Client, OpId: args.OpId, Acked: args.Acked, Put: OpTxn,
+		Checks: args.Checks, Writes: args.Writes}
+	res, err := kv.submit(op)
+	if err != nil {
+		return err
+	}
+	reply.Err = res.Err
+	reply.Results = res.Checks
 	return nil
 }
 
+// Scan handles Scan RPC requests from clients.
+// Like Get it is served through read, so the page it returns is the store's
+// contents at one point in the log.
+func (kv *KVPaxos) Scan(args *ScanArgs, reply *ScanReply) error {
+	DPrintf("Server Scan(%s, %s), ID=%d, to server %d\n", args.Start, args.End, args.OpId, kv.me)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	op := Op{OpId: args.OpId, Put: OpScan,
+		Key: args.Start, End: args.End, Limit: args.Limit}
+	res, err := kv.read(op)
+	if err != nil {
+		return err
+	}
+	reply.Err = res.Err
+	reply.Pairs = res.Pairs
+	reply.More = res.More
+	return nil
+}
+
+// kvSnapshot is the state a lagging server installs in place of the
+// operations it can no longer fetch.
+type kvSnapshot struct {
+	Store    map[string]string
+	Expires  map[string]int64
+	Stamp    int64
+	Changes  map[string]int
+	Tombs    map[string]int
+	Floor    int
+	Sessions map[uint64]*session
+}
+
+// Snapshot returns the store and duplicate detection state after every
+// operation up to and including the returned sequence number.
+// It is called by Paxos on behalf of a lagging server.
+func (kv *KVPaxos) Snapshot() (int, []byte) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.seqDone, kv.encode()
+}
+
+// encode returns the state Snapshot hands out. Caller must hold kv.mu.
+func (kv *KVPaxos) encode() []byte {
+	w := new(bytes.Buffer)
+	e := gob.NewEncoder(w)
+	if err := e.Encode(kvSnapshot{
+		Store:    kv.store,
+		Expires:  kv.expires,
+		Stamp:    kv.stamp,
+		Changes:  kv.changes,
+		Tombs:    kv.tombs,
+		Floor:    kv.floor,
+		Sessions: kv.sessions,
+	}); err != nil {
+		log.Fatalf("Snapshot encode failed on server %d: %v", kv.me, err)
+	}
+	return w.Bytes()
+}
+
+// Restore replaces the server state with a snapshot taken at seq.
+// Paxos calls it from doGet's CatchUp, so kv.mu is already held; load
+// calls it before the server starts.
+func (kv *KVPaxos) Restore(seq int, data []byte) {
+	snap := kvSnapshot{
+		Store:    make(map[string]string),
+		Expires:  make(map[string]int64),
+		Changes:  make(map[string]int),
+		Tombs:    make(map[string]int),
+		Floor:    -1,
+		Sessions: make(map[uint64]*session),
+	}
+	if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&snap); err != nil {
+		log.Fatalf("Restore decode failed on server %d: %v", kv.me, err)
+	}
+	DPrintf("Server %d restored snapshot through Seq(%d)", kv.me, seq)
+	kv.store = snap.Store
+	kv.index = makeKeyIndex(snap.Store)
+	kv.expires = snap.Expires
+	kv.stamp = snap.Stamp
+	kv.changes = snap.Changes
+	kv.tombs = snap.Tombs
+	kv.floor = snap.Floor
+	kv.sessions = snap.Sessions
+	if len(kv.expires) > 0 || len(kv.sessions) > 0 {
+		kv.startSweep()
+	}
+	kv.seqDone = seq
+	if kv.seqTried <= seq {
+		kv.seqTried = seq + 1
+	}
+}
+
 // Kill tells the server to shut itself down.
 // This method is used for testing and graceful shutdown.
 func (kv *KVPaxos) Kill() {
@@ -371,10 +629,22 @@ func (kv *KVPaxos) Kill() {
 	kv.px.Kill()
 }
 
-// StartServer creates and starts a new KVPaxos server.
+// StartServer creates and starts a new KVPaxos server that keeps its state
+// in memory only.
 // servers contains the ports of all servers that will cooperate via Paxos.
 // me is the index of the current server in the servers array.
-func StartServer(servers []string, me int) *KVPaxos {
+// opts are passed on to Paxos, e.g. paxos.WithLearners to attach replicas
+// that serve reads without voting.
+func StartServer(servers []string, me int, opts ...paxos.Option) *KVPaxos {
+	return StartPersistentServer(servers, me, "", false, opts...)
+}
+
+// StartPersistentServer creates and starts a KVPaxos server that keeps its
+// state and Paxos log in dir, so that it survives a crash (see persist.go).
+// restart indicates whether the server is restarting from what an earlier
+// server left in dir; otherwise dir should be empty. An empty dir keeps the
+// state in memory only, as StartServer does.
+func StartPersistentServer(servers []string, me int, dir string, restart bool, opts ...paxos.Option) *KVPaxos {
 	// Register Op struct for RPC marshalling/unmarshalling
 	gob.Register(Op{})
 
@@ -383,18 +653,52 @@ func StartServer(servers []string, me int) *KVPaxos {
 		seqTried:   0,
 		seqDone:    -1,
 		store:      make(map[string]string),
-		opLog:      make(map[uint64]map[int]OpResult),
-		idLog:      make(map[uint64]bool),
+		index:      &keyIndex{},
+		expires:    make(map[string]int64),
+		changes:    make(map[string]int),
+		tombs:      make(map[string]int),
+		floor:      -1,
+		env:        paxos.Environment(opts...),
+		sessions:   make(map[uint64]*session),
+		dir:        dir,
+		saved:      -1,
+	}
+
+	if dir != "" && !restart {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			log.Fatalf("Mkdir(%v): %v", dir, err)
+		}
+		os.Remove(dir + "/state")
 	}
 
 	rpcs := rpc.NewServer()
 	rpcs.Register(kv)
 
-	kv.px = paxos.Make(servers, me, rpcs, false, "", false)
+	paxosdir := ""
+	if dir != "" {
+		paxosdir = dir + "/paxos"
+	}
+	kv.px = paxos.Make(servers, me, rpcs, dir != "", paxosdir, restart, opts...)
+	kv.px.SetSnapshotter(kv)
+
+	// Pick up where the server left off, if it saved its state
+	if dir != "" && restart {
+		if err := kv.load(); os.IsNotExist(err) {
+			DPrintf("Server %d has no saved state; replaying the log", me)
+		} else if err != nil {
+			// Start over, and get the state back from the Paxos
+			// log or, through a snapshot, from peers
+			fmt.Printf("KVPaxos(%v) %v; recovering state from peers\n", me, err)
+		}
+	}
 
-	// Set up Unix socket listener
-	os.Remove(servers[me])
-	l, err := net.Listen("unix", servers[me])
+	// Listen the same way the Paxos peer does, dropping some
+	// connections while the unreliable flag is set
+	listener := &paxos.UnreliableTransport{
+		Transport:  kv.env.Transport,
+		Unreliable: func() bool { return kv.unreliable },
+	}
+	l, err := listener.Listen(servers[me])
 	if err != nil {
 		log.Fatal("listen error: ", err)
 	}
@@ -405,22 +709,7 @@ func StartServer(servers []string, me int) *KVPaxos {
 		for !kv.dead {
 			conn, err := kv.l.Accept()
 			if err == nil && !kv.dead {
-				if kv.unreliable && (rand.Int63()%1000) < 100 {
-					// Discard the request (simulate network failure)
-					conn.Close()
-				} else if kv.unreliable && (rand.Int63()%1000) < 200 {
-					// Process the request but force discard of reply
-					c1 := conn.(*net.UnixConn)
-					f, _ := c1.File()
-					err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
-					if err != nil {
-						fmt.Printf("shutdown: %v\n", err)
-					}
-					go rpcs.ServeConn(conn)
-				} else {
-					// Normal processing
-					go rpcs.ServeConn(conn)
-				}
+				go rpcs.ServeConn(conn)
 			} else if err == nil {
 				conn.Close()
 			}
@@ -0,0 +1,161 @@
+package kvpaxos
+
+// Client sessions.
+//
+// A clerk registers a session before its first write; the session's
+// identifier is one more than the sequence number of the Paxos instance
+// that registered it, so every server assigns the same one and 0 is left
+// for operations servers propose themselves. The clerk numbers its writes
+// 1, 2, 3, ... within the session and tells the servers, with each one, the
+// lowest number it is still waiting on (Acked). Servers keep the result of
+// every applied write of the session from Acked up: a write that is decided
+// again, or retried, returns the kept result, and one below Acked is one
+// whose answer the clerk no longer needs, so it is skipped. A clerk may thus
+// have any number of writes outstanding, and the servers keep a result only
+// for as long as it might be asked for.
+//
+// Like keys with a TTL, a session expires at points in the log every server
+// agrees on: each write stamps the session as active, and an Expire op
+// ends every session idle for its timeout as of its own stamp, dropping the
+// kept results with it. A write for a session that has ended fails with
+// ErrNoSession and is not applied. If the clerk knows the write was never
+// applied, because the first server it asked refused it, it registers again
+// and retries; otherwise an earlier attempt may have been applied before the
+// session ended, and the clerk returns ErrNoSession to its caller rather
+// than risk applying the write twice. A clerk that may be cut off from the
+// servers for longer than its timeout should choose a longer one.
+
+import (
+	"time"
+)
+
+// DefaultSessionTimeout is how long a session may go without a write or
+// KeepAlive before it expires, unless the clerk asks for another timeout.
+const DefaultSessionTimeout = time.Minute
+
+// session is the duplicate detection state of one client session.
+type session struct {
+	Timeout time.Duration       // How long the session may stay idle
+	Active  int64               // Stamp of the session's latest write, in Unix nanoseconds
+	Acked   uint64              // The clerk has the answer to every write below this one
+	Results map[uint64]OpResult // Result of each applied write from Acked up
+}
+
+// openSession starts the session registered by the op decided at seq.
+func (kv *KVPaxos) openSession(op Op, seq int) uint64 {
+	client := uint64(seq) + 1
+	kv.sessions[client] = &session{
+		Timeout: op.TTL,
+		Active:  op.Time,
+		Results: make(map[uint64]OpResult),
+	}
+	kv.startSweep()
+	return client
+}
+
+// idle reports whether some session has been idle for its timeout at now.
+func (kv *KVPaxos) idle(now int64) bool {
+	for _, s := range kv.sessions {
+		if s.Active+int64(s.Timeout) <= now {
+			return true
+		}
+	}
+	return false
+}
+
+// endSessions drops every session idle for its timeout at now, with its
+// kept results.
+func (kv *KVPaxos) endSessions(now int64) {
+	for client, s := range kv.sessions {
+		if s.Active+int64(s.Timeout) <= now {
+			DPrintf("Server %d ends session %d", kv.me, client)
+			delete(kv.sessions, client)
+		}
+	}
+}
+
+// logResult keeps the result of a write for duplicate detection, marks its
+// session active and drops the results its clerk has acknowledged.
+func (kv *KVPaxos) logResult(res OpResult) {
+	op := res.Op
+	s, ok := kv.sessions[op.Client]
+	if op.readOnly() || op.Client == 0 || !ok {
+		return
+	}
+	if op.Time > s.Active {
+		s.Active = op.Time
+	}
+	if op.Acked > s.Acked {
+		s.Acked = op.Acked
+		for id := range s.Results {
+			if id < s.Acked {
+				delete(s.Results, id)
+			}
+		}
+	}
+	s.Results[op.OpId] = res
+}
+
+// checkLog checks whether a write has already been applied. It returns its
+// kept result and true if it has, or true and an empty result if the clerk
+// already acknowledged it. A write of a session that does not exist yields
+// ErrNoSession and false; operations servers propose themselves (Client 0)
+// are never duplicates.
+func (kv *KVPaxos) checkLog(op Op) (OpResult, bool) {
+	if op.Client == 0 {
+		return OpResult{Op: Nop, Seq: -1}, false
+	}
+	s, ok := kv.sessions[op.Client]
+	if !ok {
+		return OpResult{Op: op, Err: ErrNoSession, Seq: -1}, false
+	}
+	if record, ok := s.Results[op.OpId]; ok {
+		return record, true
+	}
+	if op.OpId < s.Acked {
+		return OpResult{Op: op, Err: OK, Seq: -1}, true
+	}
+	return OpResult{Op: Nop, Seq: -1}, false
+}
+
+// RegisterClient handles RegisterClient RPC requests from clients.
+// It opens a session through Paxos and returns its identifier.
+func (kv *KVPaxos) RegisterClient(args *RegisterArgs, reply *RegisterReply) error {
+	DPrintf("Server RegisterClient(%v) to server %d\n", args.Timeout, kv.me)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	timeout := args.Timeout
+	if timeout <= 0 {
+		timeout = DefaultSessionTimeout
+	}
+	// The identifier comes from the instance the register op was decided
+	// in, not from its result: if catching up installs a snapshot taken
+	// after that instance, the op is never applied here and has no result
+	seq, err := kv.decideSeq(Op{Client: 0, OpId: kv.opId(), Put: OpRegister, TTL: timeout})
+	if err != nil {
+		return err
+	}
+	if _, err := kv.doGet(Nop, seq); err != nil {
+		return err
+	}
+	reply.Err = OK
+	reply.Client = uint64(seq) + 1
+	return nil
+}
+
+// KeepAlive handles KeepAlive RPC requests from clients.
+// It marks the session active through Paxos without changing the store.
+func (kv *KVPaxos) KeepAlive(args *KeepAliveArgs, reply *KeepAliveReply) error {
+	DPrintf("Server KeepAlive(%d), ID=%d, to server %d\n", args.Client, args.OpId, kv.me)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	op := Op{Client: args.Client, OpId: args.OpId, Acked: args.Acked, Put: OpKeepAlive}
+	res, err := kv.submit(op)
+	if err != nil {
+		return err
+	}
+	reply.Err = res.Err
+	return nil
+}
@@ -10,8 +10,14 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"distributed-systems/app/01_Practice-Labs/src/linearizability"
+	"distributed-systems/app/01_Practice-Labs/src/paxos"
+	"distributed-systems/app/01_Practice-Labs/src/sim"
 )
 
 // check verifies that a Get operation returns the expected value.
@@ -97,6 +103,7 @@ func TestBasic(t *testing.T) {
 
 	fmt.Printf("Test: Concurrent clients ...\n")
 
+	h := linearizability.NewHistory()
 	for iters := 0; iters < 20; iters++ {
 		const npara = 15
 		var ca [npara]chan bool
@@ -105,7 +112,7 @@ func TestBasic(t *testing.T) {
 			go func(me int) {
 				defer func() { ca[me] <- true }()
 				ci := (rand.Int() % nservers)
-				myck := MakeClerk([]string{kvh[ci]})
+				myck := h.KV(me, MakeClerk([]string{kvh[ci]}))
 				if (rand.Int() % 1000) < 500 {
 					myck.Put("b", strconv.Itoa(rand.Int()))
 				} else {
@@ -118,12 +125,15 @@ func TestBasic(t *testing.T) {
 		}
 		var va [nservers]string
 		for i := 0; i < nservers; i++ {
-			va[i] = cka[i].Get("b")
+			va[i] = h.KV(npara+i, cka[i]).Get("b")
 			if va[i] != va[0] {
 				t.Fatalf("mismatch")
 			}
 		}
 	}
+	if res := linearizability.Check(linearizability.KVModel, h.Operations()); !res.Ok {
+		t.Fatalf("history is not linearizable:\n%v", res)
+	}
 
 	fmt.Printf("  ... Passed\n")
 
@@ -440,6 +450,7 @@ func TestUnreliable(t *testing.T) {
 
 	fmt.Printf("Test: Concurrent clients, unreliable ...\n")
 
+	h := linearizability.NewHistory()
 	for iters := 0; iters < 20; iters++ {
 		const ncli = 15
 		var ca [ncli]chan bool
@@ -453,7 +464,7 @@ func TestUnreliable(t *testing.T) {
 					j := rand.Intn(i + 1)
 					sa[i], sa[j] = sa[j], sa[i]
 				}
-				myck := MakeClerk(sa)
+				myck := h.KV(me, MakeClerk(sa))
 				if (rand.Int() % 1000) < 500 {
 					myck.Put("b", strconv.Itoa(rand.Int()))
 				} else {
@@ -467,216 +478,1339 @@ func TestUnreliable(t *testing.T) {
 
 		var va [nservers]string
 		for i := 0; i < nservers; i++ {
-			va[i] = cka[i].Get("b")
+			va[i] = h.KV(ncli+i, cka[i]).Get("b")
 			if va[i] != va[0] {
 				t.Fatalf("mismatch; 0 got %v, %v got %v", va[0], i, va[i])
 			}
 		}
 	}
+	if res := linearizability.Check(linearizability.KVModel, h.Operations()); !res.Ok {
+		t.Fatalf("history is not linearizable:\n%v", res)
+	}
 
 	fmt.Printf("  ... Passed\n")
 
 	time.Sleep(1 * time.Second)
 }
 
-// TestHole tests the system's behavior when servers fall behind and need to catch up.
-// It verifies that servers can recover from gaps in the operation log.
-func TestHole(t *testing.T) {
+// TestAppendDeleteCAS tests Append, Delete and CompareAndSwap, including
+// that retried operations take effect at most once on an unreliable network.
+func TestAppendDeleteCAS(t *testing.T) {
 	runtime.GOMAXPROCS(4)
 
-	fmt.Printf("Test: Tolerates holes in paxos sequence ...\n")
-
-	tag := "hole"
-	const nservers = 5
-	var kva []*KVPaxos = make([]*KVPaxos, nservers)
+	const nservers = 3
+	kva := make([]*KVPaxos, nservers)
+	kvh := make([]string, nservers)
 	defer cleanup(kva)
-	defer cleanpp(tag, nservers)
 
 	for i := 0; i < nservers; i++ {
-		kvh := make([]string, nservers)
-		for j := 0; j < nservers; j++ {
-			if j == i {
-				kvh[j] = port(tag, i)
-			} else {
-				kvh[j] = pp(tag, i, j)
-			}
-		}
+		kvh[i] = port("adc", i)
+	}
+	for i := 0; i < nservers; i++ {
 		kva[i] = StartServer(kvh, i)
 	}
-	defer part(t, tag, nservers, []int{}, []int{}, []int{})
 
-	for iters := 0; iters < 5; iters++ {
-		part(t, tag, nservers, []int{0, 1, 2, 3, 4}, []int{}, []int{})
+	ck := MakeClerk(kvh)
+	var cka [nservers]*Clerk
+	for i := 0; i < nservers; i++ {
+		cka[i] = MakeClerk([]string{kvh[i]})
+	}
 
-		ck2 := MakeClerk([]string{port(tag, 2)})
-		ck2.Put("q", "q")
+	fmt.Printf("Test: Basic append/delete/compare-and-swap ...\n")
 
-		done := false
-		const nclients = 10
-		var ca [nclients]chan bool
-		for xcli := 0; xcli < nclients; xcli++ {
-			ca[xcli] = make(chan bool)
-			go func(cli int) {
-				ok := false
-				defer func() { ca[cli] <- ok }()
-				var cka [nservers]*Clerk
-				for i := 0; i < nservers; i++ {
-					cka[i] = MakeClerk([]string{port(tag, i)})
-				}
-				key := strconv.Itoa(cli)
-				last := ""
-				cka[0].Put(key, last)
-				for done == false {
-					ci := (rand.Int() % 2)
-					if (rand.Int() % 1000) < 500 {
-						nv := strconv.Itoa(rand.Int())
-						cka[ci].Put(key, nv)
-						last = nv
-					} else {
-						v := cka[ci].Get(key)
-						if v != last {
-							t.Fatalf("%v: wrong value, key %v, wanted %v, got %v",
-								cli, key, last, v)
-						}
-					}
-				}
-				ok = true
-			}(xcli)
-		}
+	if _, err := ck.GetExt("a"); err != ErrNoKey {
+		t.Fatalf("Get of missing key returned %v, expected %v", err, ErrNoKey)
+	}
+	ck.Append("a", "x")
+	cka[1].Append("a", "y")
+	check(t, cka[2], "a", "xy")
 
-		time.Sleep(3 * time.Second)
+	if !cka[0].CompareAndSwap("a", "xy", "z") {
+		t.Fatalf("CompareAndSwap with the current value failed")
+	}
+	if cka[1].CompareAndSwap("a", "xy", "w") {
+		t.Fatalf("CompareAndSwap with a stale value succeeded")
+	}
+	check(t, ck, "a", "z")
 
-		part(t, tag, nservers, []int{2, 3, 4}, []int{0, 1}, []int{})
+	if !cka[2].Delete("a") {
+		t.Fatalf("Delete of existing key reported it missing")
+	}
+	if cka[0].Delete("a") {
+		t.Fatalf("Delete of missing key reported it present")
+	}
+	if v, err := cka[1].GetExt("a"); err != ErrNoKey || v != "" {
+		t.Fatalf("Get after Delete returned %v, %v; expected %v", v, err, ErrNoKey)
+	}
+	if !ck.CompareAndSwap("a", "", "new") {
+		t.Fatalf("CompareAndSwap of missing key with empty expected value failed")
+	}
+	check(t, ck, "a", "new")
 
-		// can majority partition make progress even though
-		// minority servers were interrupted in the middle of
-		// paxos agreements?
-		check(t, ck2, "q", "q")
-		ck2.Put("q", "qq")
-		check(t, ck2, "q", "qq")
+	fmt.Printf("  ... Passed\n")
 
-		// restore network, wait for all threads to exit.
-		part(t, tag, nservers, []int{0, 1, 2, 3, 4}, []int{}, []int{})
-		done = true
-		ok := true
-		for i := 0; i < nclients; i++ {
-			z := <-ca[i]
-			ok = ok && z
+	fmt.Printf("Test: Concurrent appends and compare-and-swaps, unreliable ...\n")
+
+	for i := 0; i < nservers; i++ {
+		kva[i].unreliable = true
+	}
+
+	const ncli = 5
+	const nops = 10
+	h := linearizability.NewHistory()
+	var ca [ncli]chan bool
+	for cli := 0; cli < ncli; cli++ {
+		ca[cli] = make(chan bool)
+		go func(me int) {
+			ok := false
+			defer func() { ca[me] <- ok }()
+			sa := make([]string, len(kvh))
+			copy(sa, kvh)
+			for i := range sa {
+				j := rand.Intn(i + 1)
+				sa[i], sa[j] = sa[j], sa[i]
+			}
+			myck := MakeClerk(sa)
+			rec := h.KV(me, myck)
+			key := strconv.Itoa(me)
+			for i := 0; i < nops; i++ {
+				rec.Append(key, "("+strconv.Itoa(i)+")")
+				// Increment a shared counter; a swap that took effect
+				// twice would skip a number
+				for {
+					v := myck.Get("counter")
+					n, _ := strconv.Atoi(v)
+					if myck.CompareAndSwap("counter", v, strconv.Itoa(n+1)) {
+						break
+					}
+				}
+			}
+			ok = true
+		}(cli)
+	}
+	for cli := 0; cli < ncli; cli++ {
+		if !<-ca[cli] {
+			t.Fatalf("failure")
 		}
-		if ok == false {
-			t.Fatal("something is wrong")
+	}
+
+	for cli := 0; cli < ncli; cli++ {
+		expected := ""
+		for i := 0; i < nops; i++ {
+			expected += "(" + strconv.Itoa(i) + ")"
 		}
-		check(t, ck2, "q", "qq")
+		check(t, ck, strconv.Itoa(cli), expected)
+	}
+	check(t, ck, "counter", strconv.Itoa(ncli*nops))
+	if res := linearizability.Check(linearizability.KVModel, h.Operations()); !res.Ok {
+		t.Fatalf("history is not linearizable:\n%v", res)
 	}
 
 	fmt.Printf("  ... Passed\n")
+
+	time.Sleep(1 * time.Second)
 }
 
-// TestManyPartition tests the system's behavior under multiple network partitions.
-// It verifies that the system can handle complex partition scenarios and maintain consistency.
-func TestManyPartition(t *testing.T) {
-	runtime.GOMAXPROCS(4)
+// checkScan verifies that a Scan returns the expected keys, each holding
+// the value "v" + key, and the expected More flag.
+func checkScan(t *testing.T, ck *Clerk, start string, end string, limit int, keys []string, more bool) {
+	pairs, m := ck.Scan(start, end, limit)
+	if len(pairs) != len(keys) || m != more {
+		t.Fatalf("Scan(%v, %v, %v) -> %v %v, expected keys %v %v", start, end, limit, pairs, m, keys, more)
+	}
+	for i, kv := range pairs {
+		if kv.Key != keys[i] || kv.Value != "v"+keys[i] {
+			t.Fatalf("Scan(%v, %v, %v) -> %v, expected keys %v", start, end, limit, pairs, keys)
+		}
+	}
+}
 
-	fmt.Printf("Test: Many clients, changing partitions ...\n")
+// TestScan tests ordered range scans, paging through a range, and that a
+// Scan sees the store at a single point in the log.
+func TestScan(t *testing.T) {
+	runtime.GOMAXPROCS(4)
 
-	tag := "many"
-	const nservers = 5
-	var kva []*KVPaxos = make([]*KVPaxos, nservers)
+	const nservers = 3
+	kva := make([]*KVPaxos, nservers)
+	kvh := make([]string, nservers)
 	defer cleanup(kva)
-	defer cleanpp(tag, nservers)
 
 	for i := 0; i < nservers; i++ {
-		kvh := make([]string, nservers)
-		for j := 0; j < nservers; j++ {
-			if j == i {
-				kvh[j] = port(tag, i)
-			} else {
-				kvh[j] = pp(tag, i, j)
-			}
-		}
+		kvh[i] = port("scan", i)
+	}
+	for i := 0; i < nservers; i++ {
 		kva[i] = StartServer(kvh, i)
-		kva[i].unreliable = true
 	}
-	defer part(t, tag, nservers, []int{}, []int{}, []int{})
-	part(t, tag, nservers, []int{0, 1, 2, 3, 4}, []int{}, []int{})
 
-	done := false
+	ck := MakeClerk(kvh)
+	var cka [nservers]*Clerk
+	for i := 0; i < nservers; i++ {
+		cka[i] = MakeClerk([]string{kvh[i]})
+	}
 
-	// re-partition periodically
-	ch1 := make(chan bool)
+	fmt.Printf("Test: Basic scan ...\n")
+
+	checkScan(t, ck, "", "", 0, []string{}, false)
+	for _, key := range []string{"d", "b", "e", "a", "c"} {
+		cka[rand.Intn(nservers)].Put(key, "v"+key)
+	}
+	checkScan(t, cka[0], "", "", 0, []string{"a", "b", "c", "d", "e"}, false)
+	checkScan(t, cka[1], "b", "d", 0, []string{"b", "c"}, false)
+	checkScan(t, cka[2], "bb", "", 2, []string{"c", "d"}, true)
+	checkScan(t, ck, "c", "", 3, []string{"c", "d", "e"}, false)
+	checkScan(t, ck, "f", "", 0, []string{}, false)
+
+	cka[1].Delete("c")
+	cka[2].Append("f", "vf")
+	checkScan(t, cka[0], "b", "", 0, []string{"b", "d", "e", "f"}, false)
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Paging through a range ...\n")
+
+	const nkeys = 50
+	want := []string{}
+	for i := 0; i < nkeys; i++ {
+		key := fmt.Sprintf("p%03d", i)
+		want = append(want, key)
+		ck.Put(key, "v"+key)
+	}
+	got := []string{}
+	start := "p"
+	for {
+		pairs, more := cka[len(got)%nservers].Scan(start, "q", 7)
+		for _, kv := range pairs {
+			got = append(got, kv.Key)
+		}
+		if !more {
+			break
+		}
+		start = pairs[len(pairs)-1].Key + "\x00"
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("paged Scan returned %v, expected %v", got, want)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Scans are consistent with concurrent writes ...\n")
+
+	// The writer creates keys in order, so every Scan must see a prefix of them
+	const nwrites = 30
+	done := make(chan bool)
 	go func() {
-		defer func() { ch1 <- true }()
-		for done == false {
-			var a [nservers]int
-			for i := 0; i < nservers; i++ {
-				a[i] = (rand.Int() % 3)
-			}
-			pa := make([][]int, 3)
-			for i := 0; i < 3; i++ {
-				pa[i] = make([]int, 0)
-				for j := 0; j < nservers; j++ {
-					if a[j] == i {
-						pa[i] = append(pa[i], j)
-					}
-				}
-			}
-			part(t, tag, nservers, pa[0], pa[1], pa[2])
-			time.Sleep(time.Duration(rand.Int63()%200) * time.Millisecond)
+		for i := 0; i < nwrites; i++ {
+			cka[i%nservers].Put(fmt.Sprintf("w%03d", i), "x")
 		}
+		done <- true
 	}()
-
-	const nclients = 10
-	var ca [nclients]chan bool
-	for xcli := 0; xcli < nclients; xcli++ {
-		ca[xcli] = make(chan bool)
-		go func(cli int) {
-			ok := false
-			defer func() { ca[cli] <- ok }()
-			sa := make([]string, nservers)
-			for i := 0; i < nservers; i++ {
-				sa[i] = port(tag, i)
-			}
-			for i := range sa {
-				j := rand.Intn(i + 1)
-				sa[i], sa[j] = sa[j], sa[i]
-			}
-			myck := MakeClerk(sa)
-			key := strconv.Itoa(cli)
-			last := ""
-			myck.Put(key, last)
-			for done == false {
-				if (rand.Int() % 1000) < 500 {
-					nv := strconv.Itoa(rand.Int())
-					v := myck.PutHash(key, nv)
-					if v != last {
-						t.Fatalf("%v: puthash wrong value, key %v, wanted %v, got %v",
-							cli, key, last, v)
-					}
-					last = NextValue(last, nv)
-				} else {
-					v := myck.Get(key)
-					if v != last {
-						t.Fatalf("%v: get wrong value, key %v, wanted %v, got %v",
-							cli, key, last, v)
-					}
-				}
+	for writing := true; writing; {
+		select {
+		case <-done:
+			writing = false
+		default:
+		}
+		pairs, _ := cka[rand.Intn(nservers)].Scan("w", "x", 0)
+		for i, kv := range pairs {
+			if kv.Key != fmt.Sprintf("w%03d", i) {
+				t.Fatalf("Scan saw %v without all earlier writes", kv.Key)
 			}
-			ok = true
-		}(xcli)
+		}
+	}
+	if pairs, _ := ck.Scan("w", "x", 0); len(pairs) != nwrites {
+		t.Fatalf("Scan after writes returned %v pairs, expected %v", len(pairs), nwrites)
 	}
 
-	time.Sleep(20 * time.Second)
-	done = true
-	<-ch1
-	part(t, tag, nservers, []int{0, 1, 2, 3, 4}, []int{}, []int{})
+	fmt.Printf("  ... Passed\n")
 
-	ok := true
-	for i := 0; i < nclients; i++ {
-		z := <-ca[i]
-		ok = ok && z
+	time.Sleep(1 * time.Second)
+}
+
+// maxSeq returns the highest Paxos instance any live server knows of.
+func maxSeq(kva []*KVPaxos) int {
+	max := -1
+	for _, kv := range kva {
+		if kv != nil && !kv.dead && kv.px.Max() > max {
+			max = kv.px.Max()
+		}
 	}
+	return max
+}
+
+// TestReadIndex tests that Gets and Scans see every completed write without
+// consuming Paxos instances.
+func TestReadIndex(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const nservers = 3
+	kva := make([]*KVPaxos, nservers)
+	kvh := make([]string, nservers)
+	defer cleanup(kva)
+
+	for i := 0; i < nservers; i++ {
+		kvh[i] = port("readindex", i)
+	}
+	for i := 0; i < nservers; i++ {
+		kva[i] = StartServer(kvh, i)
+	}
+
+	var cka [nservers]*Clerk
+	for i := 0; i < nservers; i++ {
+		cka[i] = MakeClerk([]string{kvh[i]})
+	}
+
+	fmt.Printf("Test: Gets do not grow the log ...\n")
+
+	for i := 0; i < 10; i++ {
+		cka[i%nservers].Put("a", strconv.Itoa(i))
+		// A write through one server is seen by a read through any other
+		check(t, cka[(i+1)%nservers], "a", strconv.Itoa(i))
+	}
+	max := maxSeq(kva)
+	for i := 0; i < 30; i++ {
+		check(t, cka[i%nservers], "a", "9")
+		cka[i%nservers].Scan("", "", 0)
+	}
+	if m := maxSeq(kva); m != max {
+		t.Fatalf("reads grew the log from %v to %v", max, m)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Reads with a server down ...\n")
+
+	kva[0].Kill()
+	cka[1].Put("a", "b")
+	check(t, cka[2], "a", "b")
+	cka[2].Append("a", "c")
+	check(t, cka[1], "a", "bc")
+
+	fmt.Printf("  ... Passed\n")
+
+	time.Sleep(1 * time.Second)
+}
+
+// TestTxn tests multi-key transactions: that a failed check prevents every
+// write, and that concurrent transfers between accounts neither lose nor
+// duplicate money on an unreliable network.
+func TestTxn(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const nservers = 3
+	kva := make([]*KVPaxos, nservers)
+	kvh := make([]string, nservers)
+	defer cleanup(kva)
+
+	for i := 0; i < nservers; i++ {
+		kvh[i] = port("txn", i)
+	}
+	for i := 0; i < nservers; i++ {
+		kva[i] = StartServer(kvh, i)
+	}
+
+	ck := MakeClerk(kvh)
+
+	fmt.Printf("Test: Basic transactions ...\n")
+
+	ok, held := ck.Txn([]Check{{Key: "a", Absent: true}, {Key: "b", Absent: true}},
+		[]Write{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}})
+	if !ok || fmt.Sprint(held) != "[true true]" {
+		t.Fatalf("Txn on absent keys returned %v %v", ok, held)
+	}
+	check(t, ck, "a", "1")
+	check(t, ck, "b", "2")
+
+	ok, held = ck.Txn([]Check{{Key: "a", Value: "1"}, {Key: "b", Value: "3"}, {Key: "c", Absent: true}},
+		[]Write{{Key: "a", Value: "x"}, {Key: "c", Value: "y"}})
+	if ok || fmt.Sprint(held) != "[true false true]" {
+		t.Fatalf("Txn with a failed check returned %v %v", ok, held)
+	}
+	check(t, ck, "a", "1")
+	if _, err := ck.GetExt("c"); err != ErrNoKey {
+		t.Fatalf("failed Txn wrote c")
+	}
+
+	ok, _ = ck.Txn([]Check{{Key: "b", Value: "2"}}, []Write{{Key: "a", Delete: true}, {Key: "c", Value: "3"}})
+	if !ok {
+		t.Fatalf("Txn with held check failed")
+	}
+	if _, err := ck.GetExt("a"); err != ErrNoKey {
+		t.Fatalf("Txn did not delete a")
+	}
+	check(t, ck, "c", "3")
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Concurrent transfers, unreliable ...\n")
+
+	for i := 0; i < nservers; i++ {
+		kva[i].unreliable = true
+	}
+
+	const naccounts = 4
+	const total = 100
+	ck.Put("acct0", strconv.Itoa(total))
+	for i := 1; i < naccounts; i++ {
+		ck.Put("acct"+strconv.Itoa(i), "0")
+	}
+
+	const ncli = 5
+	const ntransfers = 5
+	var ca [ncli]chan bool
+	for cli := 0; cli < ncli; cli++ {
+		ca[cli] = make(chan bool)
+		go func(me int) {
+			ok := false
+			defer func() { ca[me] <- ok }()
+			myck := MakeClerk(kvh)
+			for i := 0; i < ntransfers; i++ {
+				from := "acct" + strconv.Itoa(rand.Intn(naccounts))
+				to := "acct" + strconv.Itoa(rand.Intn(naccounts))
+				if from == to {
+					continue
+				}
+				for {
+					fv, tv := myck.Get(from), myck.Get(to)
+					f, _ := strconv.Atoi(fv)
+					n, _ := strconv.Atoi(tv)
+					if f == 0 {
+						break
+					}
+					done, _ := myck.Txn([]Check{{Key: from, Value: fv}, {Key: to, Value: tv}},
+						[]Write{{Key: from, Value: strconv.Itoa(f - 1)}, {Key: to, Value: strconv.Itoa(n + 1)}})
+					if done {
+						break
+					}
+				}
+			}
+			ok = true
+		}(cli)
+	}
+	for cli := 0; cli < ncli; cli++ {
+		if !<-ca[cli] {
+			t.Fatalf("failure")
+		}
+	}
+
+	sum := 0
+	for i := 0; i < naccounts; i++ {
+		n, _ := strconv.Atoi(ck.Get("acct" + strconv.Itoa(i)))
+		sum += n
+	}
+	if sum != total {
+		t.Fatalf("accounts hold %v in total, expected %v", sum, total)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	time.Sleep(1 * time.Second)
+}
+
+// stored reports whether server kv still holds key in its store, expired
+// or not.
+func stored(kv *KVPaxos, key string) bool {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	_, ok := kv.store[key]
+	return ok
+}
+
+// TestExpiry tests keys with a time to live: that reads stop seeing them
+// once they expire, and that every server drops them through the log.
+func TestExpiry(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const nservers = 3
+	kva := make([]*KVPaxos, nservers)
+	kvh := make([]string, nservers)
+	defer cleanup(kva)
+
+	for i := 0; i < nservers; i++ {
+		kvh[i] = port("expiry", i)
+	}
+	for i := 0; i < nservers; i++ {
+		kva[i] = StartServer(kvh, i)
+	}
+
+	ck := MakeClerk(kvh)
+	var cka [nservers]*Clerk
+	for i := 0; i < nservers; i++ {
+		cka[i] = MakeClerk([]string{kvh[i]})
+	}
+
+	fmt.Printf("Test: Keys expire ...\n")
+
+	ck.PutTTL("s", "vs", 1*time.Second)
+	ck.Put("p", "vp")
+	check(t, cka[1], "s", "vs")
+	checkScan(t, cka[2], "", "", 0, []string{"p", "s"}, false)
+	ck.Put("s2", "vs2")
+	checkScan(t, cka[2], "s", "", 0, []string{"s", "s2"}, false)
+
+	time.Sleep(1500 * time.Millisecond)
+	for i := 0; i < nservers; i++ {
+		if v, err := cka[i].GetExt("s"); err != ErrNoKey {
+			t.Fatalf("Get of expired key from server %v returned %v, %v", i, v, err)
+		}
+	}
+	checkScan(t, ck, "s", "", 0, []string{"s2"}, false)
+	check(t, ck, "p", "vp")
+
+	// An Expire has been agreed on by now, and every server applies it
+	time.Sleep(2 * ExpireInterval)
+	ck.Put("sync", "x")
+	for i := 0; i < nservers; i++ {
+		check(t, cka[i], "sync", "x")
+		if stored(kva[i], "s") {
+			t.Fatalf("server %v still stores expired key", i)
+		}
+		if !stored(kva[i], "p") {
+			t.Fatalf("server %v dropped a key without a TTL", i)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Writes and expiry ...\n")
+
+	// A Put without a TTL makes the key permanent again
+	ck.PutTTL("t", "1", 500*time.Millisecond)
+	ck.Put("t", "2")
+	// So do CompareAndSwap and a Txn write
+	ck.PutTTL("w", "1", 300*time.Millisecond)
+	if !ck.CompareAndSwap("w", "1", "2") {
+		t.Fatalf("CompareAndSwap of a key with a TTL failed")
+	}
+	ck.PutTTL("x", "1", 300*time.Millisecond)
+	if ok, _ := ck.Txn(nil, []Write{{Key: "x", Value: "2"}}); !ok {
+		t.Fatalf("Txn write of a key with a TTL failed")
+	}
+	// A write to an expired key finds it missing
+	ck.PutTTL("u", "a", 300*time.Millisecond)
+	time.Sleep(1 * time.Second)
+	check(t, ck, "t", "2")
+	check(t, ck, "w", "2")
+	check(t, ck, "x", "2")
+	ck.Append("u", "b")
+	check(t, ck, "u", "b")
+	if ck.CompareAndSwap("t", "", "3") {
+		t.Fatalf("CompareAndSwap treated a key without a TTL as expired")
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Reads go by the log's time ...\n")
+
+	// A key whose deadline the log has reached is missing even while it is
+	// stored; one whose deadline only the server's clock has passed is not
+	kv := kva[1]
+	kv.mu.Lock()
+	kv.store["r"] = "1"
+	kv.index.insert("r")
+	for _, d := range []int64{0, 1} {
+		kv.expires["r"] = kv.stamp + d
+		get := kv.applyRead(Op{Put: OpGet, Key: "r"}, kv.seqDone)
+		scan := kv.applyRead(Op{Put: OpScan, Key: "r", End: "s"}, kv.seqDone)
+		if live := d > 0; (get.Err == OK) != live || (len(scan.Pairs) == 1) != live {
+			kv.mu.Unlock()
+			t.Fatalf("deadline %v past the log's time: Get %v, Scan %v", d, get.Err, scan.Pairs)
+		}
+	}
+	delete(kv.store, "r")
+	delete(kv.expires, "r")
+	kv.index.remove("r")
+	kv.mu.Unlock()
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Another server expires keys when the first is down ...\n")
+
+	kva[0].Kill()
+	cka[1].PutTTL("v", "gone", 300*time.Millisecond)
+	time.Sleep(300*time.Millisecond + 4*ExpireInterval)
+	cka[2].Put("sync", "y")
+	for i := 1; i < nservers; i++ {
+		check(t, cka[i], "sync", "y")
+		if stored(kva[i], "v") {
+			t.Fatalf("server %v still stores expired key", i)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	time.Sleep(1 * time.Second)
+}
+
+// TestWatch tests that Watch reports changes to a key or prefix in log
+// order, and that a watcher that fell too far behind is told to start over.
+func TestWatch(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const nservers = 3
+	kva := make([]*KVPaxos, nservers)
+	kvh := make([]string, nservers)
+	defer cleanup(kva)
+
+	for i := 0; i < nservers; i++ {
+		kvh[i] = port("watch", i)
+	}
+	for i := 0; i < nservers; i++ {
+		kva[i] = StartServer(kvh, i)
+	}
+
+	ck := MakeClerk(kvh)
+	var cka [nservers]*Clerk
+	for i := 0; i < nservers; i++ {
+		cka[i] = MakeClerk([]string{kvh[i]})
+	}
+
+	fmt.Printf("Test: Watch a key ...\n")
+
+	// Watch blocks until the key is written
+	evc := make(chan Event)
+	go func() {
+		ev, _ := cka[1].Watch("a", -1)
+		evc <- ev
+	}()
+	time.Sleep(500 * time.Millisecond)
+	select {
+	case ev := <-evc:
+		t.Fatalf("Watch of missing key returned %v", ev)
+	default:
+	}
+	ck.Put("b", "other")
+	ck.Put("a", "1")
+	ev := <-evc
+	if ev.Key != "a" || ev.Value != "1" || ev.Deleted {
+		t.Fatalf("Watch returned %v; expected a=1", ev)
+	}
+
+	go func() {
+		ev, _ := cka[2].Watch("a", ev.Seq)
+		evc <- ev
+	}()
+	ck.Append("a", "2")
+	next := <-evc
+	if next.Value != "12" || next.Seq <= ev.Seq {
+		t.Fatalf("Watch returned %v after %v; expected a=12", next, ev)
+	}
+
+	ck.Delete("a")
+	if ev, err := cka[0].Watch("a", next.Seq); err != OK || !ev.Deleted {
+		t.Fatalf("Watch after Delete returned %v %v", ev, err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Watch a prefix ...\n")
+
+	ck.Put("cfg/x", "1")
+	ck.Put("cfg/y", "2")
+	ck.Put("cfgz", "3")
+	ck.Put("cfg/x", "4")
+
+	// Starting from -1 lists every key's latest value in log order
+	got := []string{}
+	seq := -1
+	for len(got) < 3 {
+		ev, err := cka[len(got)%nservers].WatchPrefix("cfg", seq)
+		if err != OK {
+			t.Fatalf("WatchPrefix returned %v", err)
+		}
+		got = append(got, ev.Key+"="+ev.Value)
+		seq = ev.Seq
+	}
+	if fmt.Sprint(got) != "[cfg/y=2 cfgz=3 cfg/x=4]" {
+		t.Fatalf("WatchPrefix returned %v", got)
+	}
+	go func() {
+		ev, _ := ck.WatchPrefix("cfg/", seq)
+		evc <- ev
+	}()
+	ck.Put("other", "5")
+	ck.Delete("cfg/y")
+	if ev := <-evc; ev.Key != "cfg/y" || !ev.Deleted {
+		t.Fatalf("WatchPrefix returned %v; expected cfg/y deleted", ev)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Watch from a forgotten seq ...\n")
+
+	writes := []Write{}
+	deletes := []Write{}
+	for i := 0; i <= maxTombstones; i++ {
+		writes = append(writes, Write{Key: "tmp" + strconv.Itoa(i), Value: "x"})
+		deletes = append(deletes, Write{Key: "tmp" + strconv.Itoa(i), Delete: true})
+	}
+	ck.Txn(nil, writes)
+	ck.Txn(nil, deletes)
+	if _, err := ck.WatchPrefix("tmp", seq); err != ErrCompacted {
+		t.Fatalf("WatchPrefix from before dropped tombstones returned %v", err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	time.Sleep(1 * time.Second)
+}
+
+// results returns how many write results server kv keeps for session
+// client, and whether it has the session at all.
+func results(kv *KVPaxos, client uint64) (int, bool) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	s, ok := kv.sessions[client]
+	if !ok {
+		return 0, false
+	}
+	return len(s.Results), true
+}
+
+// TestSessions tests at-most-once writes from a clerk with many requests
+// outstanding, and that sessions, with their duplicate detection state,
+// expire unless kept alive.
+func TestSessions(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const nservers = 3
+	kva := make([]*KVPaxos, nservers)
+	kvh := make([]string, nservers)
+	defer cleanup(kva)
+
+	for i := 0; i < nservers; i++ {
+		kvh[i] = port("sessions", i)
+	}
+	for i := 0; i < nservers; i++ {
+		kva[i] = StartServer(kvh, i)
+	}
+
+	ck := MakeClerk(kvh)
+	var cka [nservers]*Clerk
+	for i := 0; i < nservers; i++ {
+		cka[i] = MakeClerk([]string{kvh[i]})
+	}
+
+	fmt.Printf("Test: Concurrent writes from one clerk, unreliable ...\n")
+
+	for i := 0; i < nservers; i++ {
+		kva[i].unreliable = true
+	}
+	const nwrites = 20
+	var done [nwrites]chan bool
+	for i := 0; i < nwrites; i++ {
+		done[i] = make(chan bool)
+		go func(i int) {
+			ck.Append("a", "x "+strconv.Itoa(i)+" y")
+			done[i] <- true
+		}(i)
+	}
+	for i := 0; i < nwrites; i++ {
+		<-done[i]
+	}
+	for i := 0; i < nservers; i++ {
+		kva[i].unreliable = false
+	}
+
+	v := ck.Get("a")
+	for i := 0; i < nwrites; i++ {
+		if n := strings.Count(v, "x "+strconv.Itoa(i)+" y"); n != 1 {
+			t.Fatalf("Append %v applied %v times; value %v", i, n, v)
+		}
+	}
+	if len(v) != len(strings.Repeat("x 0 y", 10))+len(strings.Repeat("x 10 y", 10)) {
+		t.Fatalf("wrong length %v of value %v", len(v), v)
+	}
+
+	// Once every earlier write is answered, the next one acknowledges them
+	ck.Put("b", "1")
+	for i := 0; i < nservers; i++ {
+		check(t, cka[i], "b", "1")
+		if n, ok := results(kva[i], ck.me); !ok || n != 1 {
+			t.Fatalf("server %v keeps %v results for the session (%v)", i, n, ok)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Idle sessions expire ...\n")
+
+	cke := MakeClerk(kvh)
+	cke.SetSessionTimeout(500 * time.Millisecond)
+	cke.Put("e", "1")
+	old := cke.me
+
+	time.Sleep(500*time.Millisecond + 4*ExpireInterval)
+	ck.Put("sync", "x")
+	for i := 0; i < nservers; i++ {
+		check(t, cka[i], "sync", "x")
+		if _, ok := results(kva[i], old); ok {
+			t.Fatalf("server %v still has an expired session", i)
+		}
+		if _, ok := results(kva[i], ck.me); !ok {
+			t.Fatalf("server %v dropped an active session", i)
+		}
+	}
+
+	// A write of the expired session is refused
+	args := PutArgs{Key: "e", Value: "stale", Client: old, OpId: 2, Acked: 2}
+	var reply PutReply
+	if !call(ck.env.Transport, kvh[1], "KVPaxos.Put", args, &reply) || reply.Err != ErrNoSession {
+		t.Fatalf("write of expired session returned %v", reply.Err)
+	}
+	check(t, ck, "e", "1")
+
+	// The clerk opens a new session for its next write
+	if _, err := cke.PutExt("e", "2", false); err != OK {
+		t.Fatalf("write after session expired returned %v", err)
+	}
+	check(t, ck, "e", "2")
+	if cke.me == old || cke.me == 0 {
+		t.Fatalf("clerk kept session %v after it expired", cke.me)
+	}
+
+	// A write that went unanswered before it was refused may have been
+	// applied, so it is not retried
+	old = cke.me
+	time.Sleep(500*time.Millisecond + 4*ExpireInterval)
+	ck.Put("sync", "z")
+	check(t, ck, "sync", "z")
+	cke.servers = append([]string{port("sessions", 99)}, kvh...)
+	if _, err := cke.PutExt("e", "3", false); err != ErrNoSession {
+		t.Fatalf("write of expired session after a lost request returned %v", err)
+	}
+	check(t, ck, "e", "2")
+	if _, err := cke.PutExt("e", "4", false); err != OK || cke.me == old || cke.me == 0 {
+		t.Fatalf("next write returned %v in session %v", err, cke.me)
+	}
+	check(t, ck, "e", "4")
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: KeepAlive keeps a session ...\n")
+
+	ckk := MakeClerk(kvh)
+	ckk.SetSessionTimeout(1 * time.Second)
+	ckk.Put("k", "1")
+	id := ckk.me
+	for i := 0; i < 6; i++ {
+		time.Sleep(400 * time.Millisecond)
+		ckk.KeepAlive()
+	}
+	ck.Put("sync", "y")
+	for i := 0; i < nservers; i++ {
+		check(t, cka[i], "sync", "y")
+		if _, ok := results(kva[i], id); !ok {
+			t.Fatalf("server %v expired a session that was kept alive", i)
+		}
+	}
+	if ckk.me != id {
+		t.Fatalf("clerk had to register again")
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	time.Sleep(1 * time.Second)
+}
+
+// kvdir returns an empty directory for a persistent server to keep its
+// state in.
+func kvdir(tag string, host int) string {
+	dir := port(tag, host) + "-dir"
+	os.RemoveAll(dir)
+	os.Mkdir(dir, 0777)
+	return dir
+}
+
+// TestPersistence tests that persistent servers get their state back after
+// crashing, from what they saved, their Paxos logs and, if they lost
+// everything, their peers.
+func TestPersistence(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const nservers = 3
+	kva := make([]*KVPaxos, nservers)
+	kvh := make([]string, nservers)
+	dirs := make([]string, nservers)
+	defer cleanup(kva)
+
+	for i := 0; i < nservers; i++ {
+		kvh[i] = port("persist", i)
+		dirs[i] = kvdir("persist", i)
+		defer os.RemoveAll(dirs[i])
+	}
+	for i := 0; i < nservers; i++ {
+		kva[i] = StartPersistentServer(kvh, i, dirs[i], false)
+	}
+
+	ck := MakeClerk(kvh)
+	var cka [nservers]*Clerk
+	for i := 0; i < nservers; i++ {
+		cka[i] = MakeClerk([]string{kvh[i]})
+	}
+
+	fmt.Printf("Test: Basic persistence ...\n")
+
+	ck.Append("a", "x")
+	ck.Append("a", "y")
+	// Enough writes that every server saves its state and trims its log
+	for i := 0; i < 2*SaveInterval; i++ {
+		ck.Put("k"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	check(t, ck, "a", "xy")
+
+	for i := 0; i < nservers; i++ {
+		kva[i].Kill()
+	}
+	time.Sleep(1 * time.Second)
+	for i := 0; i < nservers; i++ {
+		kva[i] = StartPersistentServer(kvh, i, dirs[i], true)
+	}
+
+	// The clerk's session survived too, so it carries on with it
+	ck.Append("a", "z")
+	for i := 0; i < nservers; i++ {
+		check(t, cka[i], "a", "xyz")
+		check(t, cka[i], "k0", "0")
+		check(t, cka[i], "k"+strconv.Itoa(2*SaveInterval-1), strconv.Itoa(2*SaveInterval-1))
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: One server restarts ...\n")
+
+	k1v := "1"
+	ck.Append("r1", "1")
+	k2v := "2"
+	ck.Put("r2", k2v)
+	for i := 0; i < nservers; i++ {
+		check(t, ck, "r1", k1v)
+		check(t, ck, "r2", k2v)
+
+		kva[i].Kill()
+		time.Sleep(1 * time.Second)
+
+		z := strconv.Itoa(rand.Int() % 1000)
+		k1v += z
+		ck.Append("r1", z)
+		k2v = strconv.Itoa(rand.Int())
+		ck.Put("r2", k2v)
+
+		kva[i] = StartPersistentServer(kvh, i, dirs[i], true)
+		time.Sleep(2 * time.Second)
+	}
+	for i := 0; i < nservers; i++ {
+		check(t, cka[i], "r1", k1v)
+		check(t, cka[i], "r2", k2v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: A server that lost its disk recovers from peers ...\n")
+
+	kva[2].Kill()
+	os.RemoveAll(dirs[2])
+	os.Mkdir(dirs[2], 0777)
+	for i := 0; i < 2*SaveInterval; i++ {
+		cka[i%2].Put("l"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	kva[2] = StartPersistentServer(kvh, 2, dirs[2], true)
+	check(t, cka[2], "a", "xyz")
+	check(t, cka[2], "r1", k1v)
+	check(t, cka[2], "l0", "0")
+	check(t, cka[2], "l"+strconv.Itoa(2*SaveInterval-1), strconv.Itoa(2*SaveInterval-1))
+	cka[2].Put("m", "1")
+	check(t, cka[0], "m", "1")
+
+	fmt.Printf("  ... Passed\n")
+
+	time.Sleep(1 * time.Second)
+}
+
+// TestHole tests the system's behavior when servers fall behind and need to catch up.
+// It verifies that servers can recover from gaps in the operation log.
+func TestHole(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Tolerates holes in paxos sequence ...\n")
+
+	tag := "hole"
+	const nservers = 5
+	var kva []*KVPaxos = make([]*KVPaxos, nservers)
+	defer cleanup(kva)
+	defer cleanpp(tag, nservers)
+
+	for i := 0; i < nservers; i++ {
+		kvh := make([]string, nservers)
+		for j := 0; j < nservers; j++ {
+			if j == i {
+				kvh[j] = port(tag, i)
+			} else {
+				kvh[j] = pp(tag, i, j)
+			}
+		}
+		kva[i] = StartServer(kvh, i)
+	}
+	defer part(t, tag, nservers, []int{}, []int{}, []int{})
+
+	for iters := 0; iters < 5; iters++ {
+		part(t, tag, nservers, []int{0, 1, 2, 3, 4}, []int{}, []int{})
+
+		ck2 := MakeClerk([]string{port(tag, 2)})
+		ck2.Put("q", "q")
+
+		done := false
+		const nclients = 10
+		var ca [nclients]chan bool
+		for xcli := 0; xcli < nclients; xcli++ {
+			ca[xcli] = make(chan bool)
+			go func(cli int) {
+				ok := false
+				defer func() { ca[cli] <- ok }()
+				var cka [nservers]*Clerk
+				for i := 0; i < nservers; i++ {
+					cka[i] = MakeClerk([]string{port(tag, i)})
+				}
+				key := strconv.Itoa(cli)
+				last := ""
+				cka[0].Put(key, last)
+				for done == false {
+					ci := (rand.Int() % 2)
+					if (rand.Int() % 1000) < 500 {
+						nv := strconv.Itoa(rand.Int())
+						cka[ci].Put(key, nv)
+						last = nv
+					} else {
+						v := cka[ci].Get(key)
+						if v != last {
+							t.Fatalf("%v: wrong value, key %v, wanted %v, got %v",
+								cli, key, last, v)
+						}
+					}
+				}
+				ok = true
+			}(xcli)
+		}
+
+		time.Sleep(3 * time.Second)
+
+		part(t, tag, nservers, []int{2, 3, 4}, []int{0, 1}, []int{})
+
+		// can majority partition make progress even though
+		// minority servers were interrupted in the middle of
+		// paxos agreements?
+		check(t, ck2, "q", "q")
+		ck2.Put("q", "qq")
+		check(t, ck2, "q", "qq")
+
+		// restore network, wait for all threads to exit.
+		part(t, tag, nservers, []int{0, 1, 2, 3, 4}, []int{}, []int{})
+		done = true
+		ok := true
+		for i := 0; i < nclients; i++ {
+			z := <-ca[i]
+			ok = ok && z
+		}
+		if ok == false {
+			t.Fatal("something is wrong")
+		}
+		check(t, ck2, "q", "qq")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// TestManyPartition tests the system's behavior under multiple network partitions.
+// It verifies that the system can handle complex partition scenarios and maintain consistency.
+func TestManyPartition(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Many clients, changing partitions ...\n")
+
+	tag := "many"
+	const nservers = 5
+	var kva []*KVPaxos = make([]*KVPaxos, nservers)
+	defer cleanup(kva)
+	defer cleanpp(tag, nservers)
+
+	for i := 0; i < nservers; i++ {
+		kvh := make([]string, nservers)
+		for j := 0; j < nservers; j++ {
+			if j == i {
+				kvh[j] = port(tag, i)
+			} else {
+				kvh[j] = pp(tag, i, j)
+			}
+		}
+		kva[i] = StartServer(kvh, i)
+		kva[i].unreliable = true
+	}
+	defer part(t, tag, nservers, []int{}, []int{}, []int{})
+	part(t, tag, nservers, []int{0, 1, 2, 3, 4}, []int{}, []int{})
+
+	done := false
+
+	// re-partition periodically
+	ch1 := make(chan bool)
+	go func() {
+		defer func() { ch1 <- true }()
+		for done == false {
+			var a [nservers]int
+			for i := 0; i < nservers; i++ {
+				a[i] = (rand.Int() % 3)
+			}
+			pa := make([][]int, 3)
+			for i := 0; i < 3; i++ {
+				pa[i] = make([]int, 0)
+				for j := 0; j < nservers; j++ {
+					if a[j] == i {
+						pa[i] = append(pa[i], j)
+					}
+				}
+			}
+			part(t, tag, nservers, pa[0], pa[1], pa[2])
+			time.Sleep(time.Duration(rand.Int63()%200) * time.Millisecond)
+		}
+	}()
+
+	const nclients = 10
+	var ca [nclients]chan bool
+	for xcli := 0; xcli < nclients; xcli++ {
+		ca[xcli] = make(chan bool)
+		go func(cli int) {
+			ok := false
+			defer func() { ca[cli] <- ok }()
+			sa := make([]string, nservers)
+			for i := 0; i < nservers; i++ {
+				sa[i] = port(tag, i)
+			}
+			for i := range sa {
+				j := rand.Intn(i + 1)
+				sa[i], sa[j] = sa[j], sa[i]
+			}
+			myck := MakeClerk(sa)
+			key := strconv.Itoa(cli)
+			last := ""
+			myck.Put(key, last)
+			for done == false {
+				if (rand.Int() % 1000) < 500 {
+					nv := strconv.Itoa(rand.Int())
+					v := myck.PutHash(key, nv)
+					if v != last {
+						t.Fatalf("%v: puthash wrong value, key %v, wanted %v, got %v",
+							cli, key, last, v)
+					}
+					last = NextValue(last, nv)
+				} else {
+					v := myck.Get(key)
+					if v != last {
+						t.Fatalf("%v: get wrong value, key %v, wanted %v, got %v",
+							cli, key, last, v)
+					}
+				}
+			}
+			ok = true
+		}(xcli)
+	}
+
+	time.Sleep(20 * time.Second)
+	done = true
+	<-ch1
+	part(t, tag, nservers, []int{0, 1, 2, 3, 4}, []int{}, []int{})
+
+	ok := true
+	for i := 0; i < nclients; i++ {
+		z := <-ca[i]
+		ok = ok && z
+	}
+
+	if ok {
+		fmt.Printf("  ... Passed\n")
+	}
+}
+
+// TestSnapshot restarts a server with empty state after the others have
+// forgotten the operations it needs, so it must install a snapshot.
+func TestSnapshot(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const nservers = 3
+	kva := make([]*KVPaxos, nservers)
+	kvh := make([]string, nservers)
+	defer cleanup(kva)
+
+	for i := 0; i < nservers; i++ {
+		kvh[i] = port("snapshot", i)
+	}
+	for i := 0; i < nservers; i++ {
+		kva[i] = StartServer(kvh, i)
+	}
+	var cka [nservers]*Clerk
+	for i := 0; i < nservers; i++ {
+		cka[i] = MakeClerk([]string{kvh[i]})
+	}
+
+	fmt.Printf("Test: Restarted server recovers from a snapshot ...\n")
+
+	const nkeys = 10
+	for i := 0; i < nkeys; i++ {
+		cka[i%nservers].Put(strconv.Itoa(i), "x"+strconv.Itoa(i))
+	}
+	// every server applies everything, so Done covers it all
+	for i := 0; i < nservers; i++ {
+		check(t, cka[i], "0", "x0")
+	}
+	cka[0].PutHash("h", "1")
+	cka[1].PutHash("h", "2")
+	time.Sleep(2 * time.Second)
+	if kva[0].px.Min() == 0 {
+		t.Fatalf("nothing was forgotten")
+	}
+
+	kva[2].Kill()
+	kva[2] = StartServer(kvh, 2)
+
+	for i := 0; i < nkeys; i++ {
+		check(t, cka[2], strconv.Itoa(i), "x"+strconv.Itoa(i))
+	}
+	check(t, cka[2], "h", NextValue(NextValue("", "1"), "2"))
+	cka[2].Put("a", "b")
+	check(t, cka[0], "a", "b")
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestLearner(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const nservers = 4
+	kva := make([]*KVPaxos, nservers)
+	kvh := make([]string, nservers)
+	defer cleanup(kva)
+
+	for i := 0; i < nservers; i++ {
+		kvh[i] = port("learner", i)
+	}
+	for i := 0; i < nservers; i++ {
+		kva[i] = StartServer(kvh, i, paxos.WithLearners(3))
+	}
+	ck := MakeClerk(kvh[:3])
+	ckl := MakeClerk([]string{kvh[3]})
+
+	fmt.Printf("Test: Learner serves reads ...\n")
+
+	ck.Put("a", "1")
+	check(t, ckl, "a", "1")
+	ckl.Put("b", "2")
+	check(t, ck, "b", "2")
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Writes do not wait for the learner ...\n")
+
+	// two of three voters still make a quorum
+	kva[3].Kill()
+	kva[2].Kill()
+	ck.Put("a", "3")
+	check(t, ck, "a", "3")
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// simOptions runs a server or clerk on simulated host h.
+func simOptions(h *sim.Host) []paxos.Option {
+	return []paxos.Option{paxos.WithTransport(h), paxos.WithClock(h), paxos.WithRand(h)}
+}
+
+// simClients runs clients against servers in a simulated World that loses
+// messages and partitions the servers at random, checks the values they
+// leave behind, and returns the World's trace.
+func simClients(t *testing.T, seed int64) (int, uint64) {
+	const nservers = 3
+	const nclients = 3
+	const nops = 10
+
+	w := sim.New(seed)
+	defer w.Stop()
+	w.SetLoss(0.05)
+	r := w.Rand()
+
+	kvh := make([]string, nservers)
+	for i := range kvh {
+		kvh[i] = "kv" + strconv.Itoa(i)
+	}
+	kva := make([]*KVPaxos, nservers)
+	defer cleanup(kva)
+	for i := range kva {
+		kva[i] = StartServer(kvh, i, simOptions(w.Host(kvh[i]))...)
+	}
+
+	// Each client hashes a chain of values into its own key, so the
+	// outcome is known whatever order the clients run in
+	var wg sync.WaitGroup
+	want := make([]string, nclients)
+	for c := 0; c < nclients; c++ {
+		ck := MakeClerk(kvh, simOptions(w.Host("ck"+strconv.Itoa(c)))...)
+		cr := w.Rand()
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			key := "k" + strconv.Itoa(c)
+			prev := ""
+			for i := 0; i < nops; i++ {
+				v := strconv.Itoa(cr.Int())
+				if pv := ck.PutHash(key, v); pv != prev {
+					t.Errorf("PutHash(%v) returned %v, expected %v", key, pv, prev)
+				}
+				prev = NextValue(prev, v)
+				if cr.Intn(2) == 0 {
+					if got := ck.Get(key); got != prev {
+						t.Errorf("Get(%v) -> %v, expected %v", key, got, prev)
+					}
+				}
+			}
+			want[c] = prev
+		}(c)
+	}
+
+	for i := 0; i < 10; i++ {
+		switch r.Intn(3) {
+		case 0:
+			p := r.Perm(nservers)
+			w.Partition([]string{kvh[p[0]]}, []string{kvh[p[1]], kvh[p[2]]})
+		case 1:
+			w.Heal()
+		}
+		w.Sleep(time.Duration(r.Intn(500)) * time.Millisecond)
+	}
+	w.Heal()
+	wg.Wait()
+
+	ck := MakeClerk(kvh, simOptions(w.Host("ck"))...)
+	for c := 0; c < nclients; c++ {
+		check(t, ck, "k"+strconv.Itoa(c), want[c])
+	}
+	return w.Trace()
+}
+
+// simSeeds are the seeds TestSimulation runs unless SIM_SEED names another.
+var simSeeds = []int64{1, 2, 3, 1792230899926069591}
+
+func TestSimulation(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	for _, seed := range sim.Seeds(simSeeds...) {
+		fmt.Printf("Test: Simulated clients, partitions and lost messages, seed %v ...\n", seed)
+
+		var steps [2]int
+		var trace [2]uint64
+		for run := range steps {
+			steps[run], trace[run] = simClients(t, seed)
+		}
+		if steps[0] != steps[1] || trace[0] != trace[1] {
+			t.Fatalf("seed %v took %v steps (trace %x), then %v steps (trace %x)",
+				seed, steps[0], trace[0], steps[1], trace[1])
+		}
 
-	if ok {
 		fmt.Printf("  ... Passed\n")
 	}
 }
@@ -0,0 +1,140 @@
+package kvpaxos
+
+// Change notification.
+//
+// Every server records the sequence number at which each key last changed:
+// for a key in the store, when it was last written, and for a key that was
+// deleted or expired, when it was removed (a tombstone). Since they are set
+// as operations are applied, every server records the same numbers. Watch
+// returns the matching key that changed earliest after the caller's fromSeq,
+// so a client that passes the sequence number of each change it receives
+// back to Watch sees the latest value of every matching key, in log order.
+//
+// Tombstones are dropped, oldest first, once there are more than
+// maxTombstones of them. A client whose fromSeq is older than the newest
+// dropped tombstone may have missed a deletion and is told to start over.
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxTombstones is how many deleted keys a server remembers for Watch.
+const maxTombstones = 1000
+
+// WatchTimeout is how long a Watch RPC waits for a change before the
+// server replies ErrNoChange and the clerk asks again.
+const WatchTimeout = 5 * time.Second
+
+// WatchInterval is how long a Watch waits for the next instance to be
+// decided before checking the log again itself.
+const WatchInterval = 250 * time.Millisecond
+
+// changed records that key was written at seq.
+func (kv *KVPaxos) changed(key string, seq int) {
+	delete(kv.tombs, key)
+	kv.changes[key] = seq
+}
+
+// deleted records that key was removed at seq, dropping the oldest
+// tombstones if there are too many.
+func (kv *KVPaxos) deleted(key string, seq int) {
+	delete(kv.changes, key)
+	kv.tombs[key] = seq
+	if len(kv.tombs) <= maxTombstones {
+		return
+	}
+	seqs := make([]int, 0, len(kv.tombs))
+	for _, s := range kv.tombs {
+		seqs = append(seqs, s)
+	}
+	sort.Ints(seqs)
+	floor := seqs[len(seqs)/2]
+	for k, s := range kv.tombs {
+		if s <= floor {
+			delete(kv.tombs, k)
+		}
+	}
+	kv.floor = floor
+}
+
+// nextChange returns the key matching args that changed earliest after
+// args.FromSeq, and whether there is one. Caller must hold kv.mu.
+func (kv *KVPaxos) nextChange(args *WatchArgs) (Event, bool) {
+	match := func(key string) bool {
+		if args.Prefix {
+			return strings.HasPrefix(key, args.Key)
+		}
+		return key == args.Key
+	}
+	ev := Event{Seq: -1}
+	for key, seq := range kv.changes {
+		if seq > args.FromSeq && match(key) && (ev.Seq < 0 || seq < ev.Seq) {
+			ev = Event{Key: key, Value: kv.store[key], Seq: seq}
+		}
+	}
+	for key, seq := range kv.tombs {
+		if seq > args.FromSeq && match(key) && (ev.Seq < 0 || seq < ev.Seq) {
+			ev = Event{Key: key, Deleted: true, Seq: seq}
+		}
+	}
+	return ev, ev.Seq >= 0
+}
+
+// Watch handles Watch RPC requests from clients.
+// It blocks until a key matching args changes after args.FromSeq and
+// returns the change, or replies ErrNoChange after WatchTimeout.
+func (kv *KVPaxos) Watch(args *WatchArgs, reply *WatchReply) error {
+	DPrintf("Server Watch(%s, %d) to server %d\n", args.Key, args.FromSeq, kv.me)
+	deadline := kv.env.Clock.Now().Add(WatchTimeout)
+	for !kv.dead {
+		kv.mu.Lock()
+		// Apply every instance decided before the Watch, as a read would
+		index, err := kv.px.ReadIndex(context.Background())
+		if err != nil {
+			kv.mu.Unlock()
+			return err
+		}
+		if _, err := kv.doGet(Nop, index); err != nil {
+			kv.mu.Unlock()
+			return err
+		}
+		if kv.seqTried <= kv.seqDone {
+			kv.seqTried = kv.seqDone + 1
+		}
+		if args.FromSeq >= 0 && args.FromSeq < kv.floor {
+			kv.mu.Unlock()
+			reply.Err = ErrCompacted
+			return nil
+		}
+		ev, ok := kv.nextChange(args)
+		next := kv.seqDone + 1
+		kv.mu.Unlock()
+
+		if ok {
+			reply.Err = OK
+			reply.Event = ev
+			return nil
+		}
+		if !kv.env.Clock.Now().Before(deadline) {
+			reply.Err = ErrNoChange
+			return nil
+		}
+
+		// Wait for the next instance, or a while in case nobody proposes it
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-kv.env.Clock.After(WatchInterval):
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		kv.px.Wait(ctx, next)
+		cancel()
+	}
+	reply.Err = ErrNoChange
+	return nil
+}
@@ -0,0 +1,110 @@
+package linearizability
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// History records the operations clients make, with when each was called
+// and when it returned. It is safe for concurrent use.
+type History struct {
+	mu    sync.Mutex
+	start time.Time
+	ops   []Operation
+}
+
+func NewHistory() *History {
+	return &History{start: time.Now()}
+}
+
+// now reads the monotonic clock under h.mu, so that times are ordered the
+// same way as the Call and Return calls that read them.
+func (h *History) now() int64 {
+	return int64(time.Since(h.start))
+}
+
+// Call records that client called input, and returns the index of the new
+// operation for Return. Until Return is called the operation is pending.
+func (h *History) Call(client int, input interface{}) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ops = append(h.ops, Operation{
+		Client: client,
+		Input:  input,
+		Call:   h.now(),
+		Return: Pending,
+	})
+	return len(h.ops) - 1
+}
+
+// Return records that operation i returned output.
+func (h *History) Return(i int, output interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ops[i].Output = output
+	h.ops[i].Return = h.now()
+}
+
+// Operations returns a copy of the operations recorded so far.
+func (h *History) Operations() []Operation {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Operation(nil), h.ops...)
+}
+
+// KVClerk is the Clerk of kvpaxos, pbservice and shardkv.
+type KVClerk interface {
+	Get(key string) string
+	Put(key string, value string)
+	PutHash(key string, value string) string
+}
+
+// appender is a KVClerk that also has Append.
+type appender interface {
+	Append(key string, value string)
+}
+
+// KVRecorder is a KVClerk that records what it does in a History for
+// checking against KVModel.
+type KVRecorder struct {
+	h      *History
+	client int
+	ck     KVClerk
+}
+
+// KV wraps ck so that its operations are recorded in h as client's.
+func (h *History) KV(client int, ck KVClerk) *KVRecorder {
+	return &KVRecorder{h: h, client: client, ck: ck}
+}
+
+func (r *KVRecorder) Get(key string) string {
+	i := r.h.Call(r.client, KVInput{Op: Get, Key: key})
+	v := r.ck.Get(key)
+	r.h.Return(i, KVOutput{v})
+	return v
+}
+
+func (r *KVRecorder) Put(key string, value string) {
+	i := r.h.Call(r.client, KVInput{Op: Put, Key: key, Value: value})
+	r.ck.Put(key, value)
+	r.h.Return(i, KVOutput{})
+}
+
+func (r *KVRecorder) PutHash(key string, value string) string {
+	i := r.h.Call(r.client, KVInput{Op: PutHash, Key: key, Value: value})
+	v := r.ck.PutHash(key, value)
+	r.h.Return(i, KVOutput{v})
+	return v
+}
+
+// Append needs a clerk with an Append method.
+func (r *KVRecorder) Append(key string, value string) {
+	a, ok := r.ck.(appender)
+	if !ok {
+		log.Fatalf("linearizability: %T has no Append", r.ck)
+	}
+	i := r.h.Call(r.client, KVInput{Op: Append, Key: key, Value: value})
+	a.Append(key, value)
+	r.h.Return(i, KVOutput{})
+}
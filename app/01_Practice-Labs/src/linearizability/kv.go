@@ -0,0 +1,119 @@
+package linearizability
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// KVOp is the kind of a key/value operation.
+type KVOp int
+
+const (
+	Get KVOp = iota
+	Put
+	PutHash
+	Append
+)
+
+func (op KVOp) String() string {
+	switch op {
+	case Get:
+		return "Get"
+	case Put:
+		return "Put"
+	case PutHash:
+		return "PutHash"
+	case Append:
+		return "Append"
+	}
+	return fmt.Sprintf("KVOp(%d)", int(op))
+}
+
+// KVInput is the Input of a key/value Operation.
+type KVInput struct {
+	Op    KVOp
+	Key   string
+	Value string // Unused by Get
+}
+
+// KVOutput is the Output of a key/value Operation: the value for Get, the
+// previous value for PutHash, and nothing for Put and Append.
+type KVOutput struct {
+	Value string
+}
+
+func hash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// NextValue is the value PutHash stores, as the services compute it.
+func NextValue(prev string, val string) string {
+	h := hash(prev + val)
+	return strconv.Itoa(int(h))
+}
+
+// KVModel is a key/value service whose keys start out as "", as kvpaxos,
+// pbservice and shardkv are. Its state is the value of one key, since
+// histories are checked one key at a time.
+var KVModel = Model{
+	Partition: partitionByKey,
+	Init:      func() interface{} { return "" },
+	Step: func(state interface{}, input interface{}, output interface{}) (bool, interface{}) {
+		value := state.(string)
+		in := input.(KVInput)
+		out, returned := output.(KVOutput)
+		switch in.Op {
+		case Get:
+			return !returned || out.Value == value, value
+		case Put:
+			return true, in.Value
+		case PutHash:
+			return !returned || out.Value == value, NextValue(value, in.Value)
+		case Append:
+			return true, value + in.Value
+		}
+		return false, value
+	},
+	ReadOnly: func(input interface{}) bool {
+		return input.(KVInput).Op == Get
+	},
+	Describe: func(input interface{}, output interface{}) string {
+		in := input.(KVInput)
+		s := fmt.Sprintf("%v(%q, %q)", in.Op, in.Key, in.Value)
+		if in.Op == Get {
+			s = fmt.Sprintf("Get(%q)", in.Key)
+		}
+		if in.Op == Get || in.Op == PutHash {
+			if out, ok := output.(KVOutput); ok {
+				s += fmt.Sprintf(" -> %q", out.Value)
+			} else {
+				s += " -> ?"
+			}
+		}
+		return s
+	},
+}
+
+// partitionByKey splits a key/value history into one history per key, in
+// key order.
+func partitionByKey(ops []Operation) [][]Operation {
+	byKey := make(map[string][]Operation)
+	var keys []string
+	for _, op := range ops {
+		k := op.Input.(KVInput).Key
+		if _, ok := byKey[k]; !ok {
+			keys = append(keys, k)
+		}
+		byKey[k] = append(byKey[k], op)
+	}
+	sort.Strings(keys)
+	parts := make([][]Operation, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, byKey[k])
+	}
+	return parts
+}
@@ -0,0 +1,346 @@
+// Package linearizability checks that a history of operations on a
+// replicated service could have happened one at a time, on a single copy of
+// the service, in an order consistent with when each operation was called
+// and when it returned.
+//
+// Tests record a History around their clerks, then check it against a
+// Model of the service:
+//
+//	h := linearizability.NewHistory()
+//	ck := h.KV(0, kvpaxos.MakeClerk(servers))
+//	ck.Put("a", "x")
+//	...
+//	if res := linearizability.Check(linearizability.KVModel, h.Operations()); !res.Ok {
+//		t.Fatalf("history is not linearizable:\n%v", res)
+//	}
+//
+// The checker works like Porcupine: it searches for a linearization with
+// the algorithm of Wing and Gong as improved by Lowe, remembering which
+// states it has already reached with a given set of operations linearized,
+// and it checks each part of a partitioned history (each key, for KVModel)
+// on its own. When a history fails, Check shrinks the failing part to a
+// smaller history that still fails, so the counterexample is short enough
+// to read.
+package linearizability
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Pending is the Return time of an operation that never returned. It may or
+// may not have taken effect.
+const Pending = math.MaxInt64
+
+// Operation is one call a client made, with what it returned.
+type Operation struct {
+	Client int         // Who made the call
+	Input  interface{} // What the call asked for
+	Call   int64       // When it was called, in nanoseconds
+	Output interface{} // What it returned, or nil if it never returned
+	Return int64       // When it returned, or Pending
+}
+
+// Model describes the service a history ran against.
+type Model struct {
+	// Partition splits a history into histories that can be checked on
+	// their own. If nil, the history is checked whole.
+	Partition func(ops []Operation) [][]Operation
+	// Init returns the state of the service before any operation.
+	Init func() interface{}
+	// Step reports whether input could have returned output in state,
+	// and returns the state after it. output is nil if the operation never
+	// returned.
+	Step func(state interface{}, input interface{}, output interface{}) (bool, interface{})
+	// Equal reports whether two states are the same. If nil, == is used.
+	Equal func(a, b interface{}) bool
+	// ReadOnly reports whether input never changes the state, which lets
+	// Check drop it while shrinking a counterexample. If nil, no input is.
+	ReadOnly func(input interface{}) bool
+	// Describe formats an operation for a counterexample. If nil, %v is used.
+	Describe func(input interface{}, output interface{}) string
+}
+
+// Result is the verdict of Check.
+type Result struct {
+	Ok bool
+	// Counterexample is, when Ok is false, a part of the history that
+	// cannot be linearized: the history of one partition up to when it
+	// failed, with operations that had not returned by then pending, and
+	// without the read-only operations it can fail without. It is sorted
+	// by call time.
+	Counterexample []Operation
+	// Longest is the longest linearization of a prefix of the
+	// counterexample that the checker found, as indexes into it.
+	Longest []int
+
+	model Model
+}
+
+// String describes a counterexample, one operation per line with its call
+// and return times, followed by the longest order in which part of it could
+// have happened.
+func (r Result) String() string {
+	if r.Ok {
+		return "linearizable"
+	}
+	var b strings.Builder
+	start := r.Counterexample[0].Call
+	for i, op := range r.Counterexample {
+		ret := "pending"
+		if op.Return != Pending {
+			ret = fmt.Sprintf("%.3fms", float64(op.Return-start)/1e6)
+		}
+		fmt.Fprintf(&b, "  %2d client %v [%.3fms, %v] %v\n", i, op.Client,
+			float64(op.Call-start)/1e6, ret, r.model.describe(op))
+	}
+	var order []string
+	for _, i := range r.Longest {
+		order = append(order, fmt.Sprint(i))
+	}
+	fmt.Fprintf(&b, "  at most [%v] can be linearized", strings.Join(order, " "))
+	return b.String()
+}
+
+func (m Model) describe(op Operation) string {
+	if m.Describe != nil {
+		return m.Describe(op.Input, op.Output)
+	}
+	return fmt.Sprintf("%v -> %v", op.Input, op.Output)
+}
+
+func (m Model) equal(a, b interface{}) bool {
+	if m.Equal != nil {
+		return m.Equal(a, b)
+	}
+	return a == b
+}
+
+// Check reports whether ops is linearizable with respect to m.
+func Check(m Model, ops []Operation) Result {
+	parts := [][]Operation{ops}
+	if m.Partition != nil {
+		parts = m.Partition(ops)
+	}
+	for _, part := range parts {
+		if ok, _ := check(m, part); !ok {
+			cex := shrink(m, part)
+			_, longest := check(m, cex)
+			return Result{Counterexample: cex, Longest: longest, model: m}
+		}
+	}
+	return Result{Ok: true, model: m}
+}
+
+// shrink cuts a non-linearizable history off at the earliest time by which
+// it had already failed, then drops the read-only operations that are not
+// needed to make it fail. Neither can turn a history that is not
+// linearizable into one that is, so what is left is still a counterexample.
+// Writes are kept: dropping one could leave a read of a value nobody wrote.
+func shrink(m Model, ops []Operation) []Operation {
+	ops = append([]Operation(nil), ops...)
+	sort.SliceStable(ops, func(i, j int) bool { return ops[i].Call < ops[j].Call })
+
+	var times []int64
+	for _, op := range ops {
+		if op.Return != Pending {
+			times = append(times, op.Return)
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	i := sort.Search(len(times), func(i int) bool {
+		ok, _ := check(m, prefix(ops, times[i]))
+		return !ok
+	})
+	if i < len(times) {
+		ops = prefix(ops, times[i])
+	}
+
+	if m.ReadOnly == nil {
+		return ops
+	}
+	for i := len(ops) - 1; i >= 0; i-- {
+		if !m.ReadOnly(ops[i].Input) {
+			continue
+		}
+		fewer := append(append([]Operation(nil), ops[:i]...), ops[i+1:]...)
+		if ok, _ := check(m, fewer); !ok {
+			ops = fewer
+		}
+	}
+	return ops
+}
+
+// prefix returns what ops, sorted by call time, looked like at time t: the
+// operations called by then, with those that had not yet returned pending.
+func prefix(ops []Operation, t int64) []Operation {
+	var p []Operation
+	for _, op := range ops {
+		if op.Call > t {
+			break
+		}
+		if op.Return > t {
+			op.Output = nil
+			op.Return = Pending
+		}
+		p = append(p, op)
+	}
+	return p
+}
+
+// node is a call or return event in the doubly linked list the search
+// works on. Linearizing an operation lifts its call and return out of the
+// list; backtracking puts them back.
+type node struct {
+	id    int   // Index of the operation
+	call  bool  // Call event, or return event
+	match *node // The return event of a call
+	prev  *node
+	next  *node
+}
+
+func lift(n *node) {
+	n.prev.next = n.next
+	n.next.prev = n.prev
+	r := n.match
+	r.prev.next = r.next
+	if r.next != nil {
+		r.next.prev = r.prev
+	}
+}
+
+func unlift(n *node) {
+	r := n.match
+	r.prev.next = r
+	if r.next != nil {
+		r.next.prev = r
+	}
+	n.prev.next = n
+	n.next.prev = n
+}
+
+// events builds the list of call and return events of ops in time order,
+// calls first among events at the same time, and returns its head.
+func events(ops []Operation) *node {
+	type event struct {
+		time int64
+		n    *node
+	}
+	var evs []event
+	for i, op := range ops {
+		ret := &node{id: i}
+		call := &node{id: i, call: true, match: ret}
+		evs = append(evs, event{op.Call, call}, event{op.Return, ret})
+	}
+	sort.SliceStable(evs, func(i, j int) bool {
+		if evs[i].time != evs[j].time {
+			return evs[i].time < evs[j].time
+		}
+		return evs[i].n.call && !evs[j].n.call
+	})
+	head := &node{id: -1}
+	prev := head
+	for _, e := range evs {
+		prev.next = e.n
+		e.n.prev = prev
+		prev = e.n
+	}
+	return head
+}
+
+// bitset is the set of operations linearized so far.
+type bitset []uint64
+
+func (b bitset) set(i int)   { b[i/64] |= 1 << uint(i%64) }
+func (b bitset) clear(i int) { b[i/64] &^= 1 << uint(i%64) }
+
+func (b bitset) hash() uint64 {
+	h := uint64(14695981039346656037)
+	for _, w := range b {
+		h = (h ^ w) * 1099511628211
+	}
+	return h
+}
+
+func (b bitset) equal(c bitset) bool {
+	for i := range b {
+		if b[i] != c[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// check searches for a linearization of ops. If there is none, it also
+// returns the longest partial one it found.
+func check(m Model, ops []Operation) (bool, []int) {
+	type entry struct {
+		linearized bitset
+		state      interface{}
+	}
+	type frame struct {
+		n     *node
+		state interface{}
+	}
+
+	head := events(ops)
+	linearized := make(bitset, (len(ops)+63)/64)
+	cache := make(map[uint64][]entry)
+	var stack []frame
+	var longest []int
+	state := m.Init()
+
+	n := head.next
+	for n != nil {
+		if !n.call {
+			if ops[n.id].Return == Pending {
+				// Every operation that returned has been linearized;
+				// the rest may never have happened.
+				return true, nil
+			}
+			if len(stack) == 0 {
+				return false, longest
+			}
+			// Operation n.id had to happen by now but can't: undo the
+			// last choice and try the operation after it instead.
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			state = top.state
+			linearized.clear(top.n.id)
+			unlift(top.n)
+			n = top.n.next
+			continue
+		}
+		ok, next := m.Step(state, ops[n.id].Input, ops[n.id].Output)
+		if ok {
+			linearized.set(n.id)
+			h := linearized.hash()
+			seen := false
+			for _, e := range cache[h] {
+				if e.linearized.equal(linearized) && m.equal(e.state, next) {
+					seen = true
+					break
+				}
+			}
+			if !seen {
+				cache[h] = append(cache[h], entry{append(bitset(nil), linearized...), next})
+				stack = append(stack, frame{n, state})
+				state = next
+				lift(n)
+				if len(stack) > len(longest) {
+					longest = longest[:0]
+					for _, f := range stack {
+						longest = append(longest, f.n.id)
+					}
+				}
+				n = head.next
+				continue
+			}
+			linearized.clear(n.id)
+		}
+		n = n.next
+	}
+	return true, nil
+}
@@ -0,0 +1,208 @@
+package linearizability
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// op builds a key/value operation called at call and returned at ret.
+func op(client int, kind KVOp, key string, value string, out string, call int64, ret int64) Operation {
+	o := Operation{Client: client, Input: KVInput{kind, key, value}, Call: call, Return: ret}
+	if ret != Pending {
+		o.Output = KVOutput{out}
+	}
+	return o
+}
+
+func TestHistories(t *testing.T) {
+	fmt.Printf("Test: Hand-built histories ...\n")
+
+	tests := []struct {
+		name string
+		ops  []Operation
+		ok   bool
+	}{
+		{"sequential", []Operation{
+			op(0, Put, "a", "1", "", 0, 1),
+			op(0, Get, "a", "", "1", 2, 3),
+			op(0, Append, "a", "2", "", 4, 5),
+			op(0, Get, "a", "", "12", 6, 7),
+		}, true},
+		{"concurrent puts, either wins", []Operation{
+			op(0, Put, "a", "1", "", 0, 10),
+			op(1, Put, "a", "2", "", 0, 10),
+			op(2, Get, "a", "", "1", 11, 12),
+		}, true},
+		{"read of a value never written", []Operation{
+			op(0, Put, "a", "1", "", 0, 10),
+			op(1, Put, "a", "2", "", 0, 10),
+			op(2, Get, "a", "", "3", 11, 12),
+		}, false},
+		{"stale read", []Operation{
+			op(0, Put, "a", "1", "", 0, 1),
+			op(1, Get, "a", "", "", 2, 3),
+		}, false},
+		{"reads go back in time", []Operation{
+			op(0, Put, "a", "1", "", 0, 10),
+			op(1, Get, "a", "", "1", 1, 2),
+			op(2, Get, "a", "", "", 3, 4),
+		}, false},
+		{"pending put took effect late", []Operation{
+			op(0, Put, "a", "1", "", 0, Pending),
+			op(1, Get, "a", "", "", 1, 2),
+			op(1, Get, "a", "", "1", 3, 4),
+		}, true},
+		{"pending put never took effect", []Operation{
+			op(0, Put, "a", "1", "", 0, Pending),
+			op(1, Get, "a", "", "", 1, 2),
+		}, true},
+		{"pending put undone", []Operation{
+			op(0, Put, "a", "1", "", 0, Pending),
+			op(1, Get, "a", "", "1", 1, 2),
+			op(1, Get, "a", "", "", 3, 4),
+		}, false},
+		{"PutHash chain", []Operation{
+			op(0, PutHash, "a", "x", "", 0, 1),
+			op(1, PutHash, "a", "y", NextValue("", "x"), 2, 3),
+			op(0, Get, "a", "", NextValue(NextValue("", "x"), "y"), 4, 5),
+		}, true},
+		{"PutHash applied twice", []Operation{
+			op(0, PutHash, "a", "x", "", 0, 1),
+			op(0, Get, "a", "", NextValue(NextValue("", "x"), "x"), 2, 3),
+		}, false},
+		{"keys are independent", []Operation{
+			op(0, Put, "a", "1", "", 0, 10),
+			op(1, Put, "b", "2", "", 0, 10),
+			op(0, Get, "b", "", "2", 11, 12),
+			op(1, Get, "a", "", "1", 11, 12),
+		}, true},
+	}
+	for _, tt := range tests {
+		res := Check(KVModel, tt.ops)
+		if res.Ok != tt.ok {
+			t.Fatalf("%v: expected ok=%v, got\n%v", tt.name, tt.ok, res)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestCounterexample(t *testing.T) {
+	fmt.Printf("Test: Counterexamples are small ...\n")
+
+	// Key "a" is fine. On key "b" one read out of many misses a write,
+	// and more writes follow.
+	var ops []Operation
+	for i := int64(0); i < 20; i++ {
+		ops = append(ops, op(0, Put, "a", strconv.Itoa(int(i)), "", 10*i, 10*i+5))
+		ops = append(ops, op(1, Get, "b", "", "", 10*i, 10*i+1))
+	}
+	ops = append(ops, op(2, Put, "b", "x", "", 200, 201))
+	for i := int64(0); i < 10; i++ {
+		ops = append(ops, op(1, Get, "b", "", "x", 210+10*i, 211+10*i))
+	}
+	ops = append(ops, op(3, Get, "b", "", "", 400, 401))
+	for i := int64(0); i < 10; i++ {
+		ops = append(ops, op(2, Put, "b", strconv.Itoa(int(i)), "", 410+10*i, 411+10*i))
+	}
+
+	res := Check(KVModel, ops)
+	if res.Ok {
+		t.Fatalf("stale read not found")
+	}
+	cex := res.Counterexample
+	if len(cex) != 2 || cex[0].Input.(KVInput).Op != Put || cex[1].Client != 3 {
+		t.Fatalf("counterexample should be the put and the stale read:\n%v", res)
+	}
+	if len(res.Longest) != 1 {
+		t.Fatalf("expected only the put to be linearizable:\n%v", res)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// memKV is an in-memory KVClerk. If stale, it serves reads from a cache
+// that is only refreshed by its own writes.
+type memKV struct {
+	mu    *sync.Mutex
+	data  map[string]string
+	stale bool
+	cache map[string]string
+}
+
+func (kv *memKV) Get(key string) string {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if v, ok := kv.cache[key]; ok && kv.stale {
+		return v
+	}
+	kv.cache[key] = kv.data[key]
+	return kv.data[key]
+}
+
+func (kv *memKV) Put(key string, value string) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.data[key] = value
+	kv.cache[key] = value
+}
+
+func (kv *memKV) PutHash(key string, value string) string {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	prev := kv.data[key]
+	kv.data[key] = NextValue(prev, value)
+	kv.cache[key] = kv.data[key]
+	return prev
+}
+
+func (kv *memKV) Append(key string, value string) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.data[key] += value
+	kv.cache[key] = kv.data[key]
+}
+
+// record has clients take turns doing operations on a few keys through
+// clerks that share one store, and returns what happened.
+func record(stale bool) []Operation {
+	h := NewHistory()
+	var mu sync.Mutex
+	data := make(map[string]string)
+	var cka []*KVRecorder
+	for c := 0; c < 5; c++ {
+		cka = append(cka, h.KV(c, &memKV{&mu, data, stale, make(map[string]string)}))
+	}
+	for i := 0; i < 50; i++ {
+		for c, ck := range cka {
+			key := strconv.Itoa((c + i) % 3)
+			value := fmt.Sprint(c, ".", i, " ")
+			switch (c + i) % 5 {
+			case 0:
+				ck.Put(key, value)
+			case 1:
+				ck.PutHash(key, value)
+			case 2:
+				ck.Append(key, value)
+			default:
+				ck.Get(key)
+			}
+		}
+	}
+	return h.Operations()
+}
+
+func TestRecorder(t *testing.T) {
+	fmt.Printf("Test: Recorded histories ...\n")
+
+	if res := Check(KVModel, record(false)); !res.Ok {
+		t.Fatalf("history of a single copy is not linearizable:\n%v", res)
+	}
+	if res := Check(KVModel, record(true)); res.Ok {
+		t.Fatalf("history with stale reads is linearizable")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
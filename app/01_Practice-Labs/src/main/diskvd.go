@@ -16,7 +16,7 @@ package main
 //   -r restart
 
 import "time"
-import "diskv"
+import "distributed-systems/app/01_Practice-Labs/src/diskv"
 import "os"
 import "fmt"
 import "strconv"
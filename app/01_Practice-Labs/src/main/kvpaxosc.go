@@ -0,0 +1,133 @@
+package main
+
+//
+// talk to a kvpaxos cluster started with kvpaxosd.
+//
+// go build kvpaxosc.go
+// ./kvpaxosc -s addr1 -s addr2 -s addr3 [-n tcp] command args...
+// ./kvpaxosc -c config.json command args...
+//
+// arguments:
+//   -c config file, as for kvpaxosd; only Net and Servers are used
+//   -s replica address, once per replica
+//   -n network: unix (the default) or tcp
+//
+// commands:
+//   get key                  print the key's value
+//   put key value            store value under key
+//   puthash key value        store hash(old value + value); print the old value
+//   append key value         add value to the end of the key's value
+//   scan start [end [limit]] print the keys from start up to but not
+//                            including end, in order, one key and value
+//                            per line; "" for end means no upper bound
+//
+// get exits with status 1 if the key does not exist. scan prints
+// "..." after the last pair if limit cut the list short.
+//
+
+import "distributed-systems/app/01_Practice-Labs/src/kvpaxos"
+import "distributed-systems/app/01_Practice-Labs/src/paxos"
+import "encoding/json"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "strconv"
+import "strings"
+import "time"
+
+// Config is the content of a config file.
+type Config struct {
+	Net     string   // unix or tcp
+	Servers []string // Addresses of all replicas
+}
+
+func usage() {
+	fmt.Printf("Usage: kvpaxosc [-c config] -s server... [-n unix|tcp] command args...\n")
+	fmt.Printf("  get key | put key value | puthash key value | append key value | scan start [end [limit]]\n")
+	os.Exit(1)
+}
+
+// readConfig reads the config file name into c.
+func readConfig(name string, c *Config) {
+	content, err := ioutil.ReadFile(name)
+	if err == nil {
+		err = json.Unmarshal(content, c)
+	}
+	if err != nil {
+		fmt.Printf("kvpaxosc: config %v: %v\n", name, err)
+		os.Exit(1)
+	}
+}
+
+func main() {
+	c := Config{Net: "unix"}
+	servers := []string{}
+
+	i := 1
+	for ; i+1 < len(os.Args) && strings.HasPrefix(os.Args[i], "-"); i += 2 {
+		a0 := os.Args[i]
+		a1 := os.Args[i+1]
+		if a0 == "-c" {
+			readConfig(a1, &c)
+		} else if a0 == "-s" {
+			servers = append(servers, a1)
+		} else if a0 == "-n" {
+			c.Net = a1
+		} else {
+			usage()
+		}
+	}
+	if len(servers) > 0 {
+		c.Servers = servers
+	}
+	if len(c.Servers) == 0 || (c.Net != "unix" && c.Net != "tcp") || i >= len(os.Args) {
+		usage()
+	}
+	cmd := os.Args[i]
+	args := os.Args[i+1:]
+
+	var opts []paxos.Option
+	if c.Net == "tcp" {
+		opts = append(opts, paxos.WithTransport(paxos.TCPTransport{}))
+	}
+	ck := kvpaxos.MakeClerk(c.Servers, opts...)
+	// each run writes at most once, so its session need not outlive it by much
+	ck.SetSessionTimeout(10 * time.Second)
+
+	switch {
+	case cmd == "get" && len(args) == 1:
+		v, err := ck.GetExt(args[0])
+		if err == kvpaxos.ErrNoKey {
+			fmt.Printf("kvpaxosc: no key %v\n", args[0])
+			os.Exit(1)
+		}
+		fmt.Println(v)
+	case cmd == "put" && len(args) == 2:
+		ck.Put(args[0], args[1])
+	case cmd == "puthash" && len(args) == 2:
+		fmt.Println(ck.PutHash(args[0], args[1]))
+	case cmd == "append" && len(args) == 2:
+		ck.Append(args[0], args[1])
+	case cmd == "scan" && len(args) >= 1 && len(args) <= 3:
+		end := ""
+		if len(args) > 1 {
+			end = args[1]
+		}
+		limit := 0
+		if len(args) > 2 {
+			var err error
+			if limit, err = strconv.Atoi(args[2]); err != nil || limit < 0 {
+				usage()
+			}
+		}
+		pairs, more := ck.Scan(args[0], end, limit)
+		for _, kv := range pairs {
+			fmt.Printf("%v\t%v\n", kv.Key, kv.Value)
+		}
+		if more {
+			fmt.Println("...")
+		}
+	default:
+		usage()
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+//
+// start a kvpaxosd server, one replica of a kvpaxos cluster.
+// every replica is started with the same list of replica
+// addresses and its own index in it; a replica serves both
+// Paxos and client RPCs at its address.
+//
+// go build kvpaxosd.go
+// ./kvpaxosd -s addr1 -s addr2 -s addr3 -i 0 [-n tcp] [-d dir] [-r restart]
+// ./kvpaxosd -c config.json [-i 0]
+//
+// arguments:
+//   -c config file
+//   -s replica address, once per replica, in the same order everywhere
+//   -i my-index-in-replica-list
+//   -n network: unix (the default; addresses are socket paths)
+//      or tcp (addresses are host:port)
+//   -d directory to keep state in across restarts; without it
+//      the replica keeps everything in memory
+//   -r restart from what an earlier run left in the directory;
+//      by default, whenever the directory holds a Paxos log
+//
+// the config file is JSON with the same settings, e.g.
+//
+//   {"Net": "tcp", "Servers": ["a:7000", "b:7000", "c:7000"], "Me": 0, "Dir": "/var/lib/kvpaxos"}
+//
+// flags given after -c override it. the replica runs until it
+// gets SIGINT or SIGTERM.
+//
+
+import "distributed-systems/app/01_Practice-Labs/src/kvpaxos"
+import "distributed-systems/app/01_Practice-Labs/src/paxos"
+import "encoding/json"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "os/signal"
+import "runtime"
+import "strconv"
+import "syscall"
+
+// Config is the content of a config file.
+type Config struct {
+	Net     string   // unix or tcp
+	Servers []string // Addresses of all replicas
+	Me      int      // This replica's index in Servers
+	Dir     string   // Where to keep state, or "" for memory only
+}
+
+func usage() {
+	fmt.Printf("Usage: kvpaxosd [-c config] -s server... -i my-index [-n unix|tcp] [-d dir] [-r restart]\n")
+	os.Exit(1)
+}
+
+// readConfig reads the config file name into c.
+func readConfig(name string, c *Config) {
+	content, err := ioutil.ReadFile(name)
+	if err == nil {
+		err = json.Unmarshal(content, c)
+	}
+	if err != nil {
+		fmt.Printf("kvpaxosd: config %v: %v\n", name, err)
+		os.Exit(1)
+	}
+}
+
+func main() {
+	c := Config{Net: "unix", Me: -1}
+	restart := ""
+	servers := []string{}
+
+	for i := 1; i+1 < len(os.Args); i += 2 {
+		a0 := os.Args[i]
+		a1 := os.Args[i+1]
+		if a0 == "-c" {
+			readConfig(a1, &c)
+		} else if a0 == "-s" {
+			servers = append(servers, a1)
+		} else if a0 == "-i" {
+			c.Me, _ = strconv.Atoi(a1)
+		} else if a0 == "-n" {
+			c.Net = a1
+		} else if a0 == "-d" {
+			c.Dir = a1
+		} else if a0 == "-r" {
+			restart = a1
+		} else {
+			usage()
+		}
+	}
+	if len(os.Args)%2 == 0 {
+		usage()
+	}
+	if len(servers) > 0 {
+		c.Servers = servers
+	}
+
+	if c.Me < 0 || c.Me >= len(c.Servers) || (c.Net != "unix" && c.Net != "tcp") {
+		usage()
+	}
+
+	var opts []paxos.Option
+	if c.Net == "tcp" {
+		opts = append(opts, paxos.WithTransport(paxos.TCPTransport{}))
+	}
+
+	// unless told otherwise, restart if the directory holds a
+	// log from an earlier run
+	r := false
+	if c.Dir != "" {
+		_, err := os.Stat(c.Dir + "/paxos")
+		r = err == nil
+	}
+	if restart != "" {
+		var err error
+		if r, err = strconv.ParseBool(restart); err != nil {
+			usage()
+		}
+	}
+
+	runtime.GOMAXPROCS(4)
+
+	kv := kvpaxos.StartPersistentServer(c.Servers, c.Me, c.Dir, r, opts...)
+	fmt.Printf("kvpaxosd %v of %v serving at %v (%v, restart %v)\n", c.Me, len(c.Servers), c.Servers[c.Me], c.Net, r)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	kv.Kill()
+}
@@ -0,0 +1,313 @@
+package main
+
+//
+// print the Paxos state that peers left on disk, e.g. to see why
+// a diskv replica won't come back after a crash.
+//
+// go build paxosinspect.go
+// ./paxosinspect [-json] dir...
+//
+// each dir is a Paxos peer's log directory, or a diskv server's
+// directory (whose log is in state/). for each peer it prints
+// every instance's N_p, N_a, whether it is decided, and its value,
+// decoding the Ops of kvpaxos, shardmaster, shardkv and diskv, and
+// lists the instances the peer has no record of (gaps). given more
+// than one dir it also compares the peers: instances one peer holds
+// undecided but another has decided, and disagreements, where peers hold
+// different values that Paxos says must be the same. it exits with
+// status 1 if it finds a disagreement.
+//
+// -json prints the same report as JSON.
+//
+
+import "distributed-systems/app/01_Practice-Labs/src/paxos"
+import "distributed-systems/app/01_Practice-Labs/src/kvpaxos"
+import "distributed-systems/app/01_Practice-Labs/src/shardmaster"
+import "distributed-systems/app/01_Practice-Labs/src/shardkv"
+import "distributed-systems/app/01_Practice-Labs/src/diskv"
+import "encoding/gob"
+import "encoding/json"
+import "fmt"
+import "os"
+import "reflect"
+import "sort"
+import "strings"
+import "text/tabwriter"
+
+func usage() {
+	fmt.Printf("Usage: paxosinspect [-json] dir...\n")
+	os.Exit(1)
+}
+
+// Instance is one instance of one peer.
+type Instance struct {
+	Seq     int
+	N_p     string
+	N_a     string
+	Decided bool
+	Type    string // Go type of Value
+	Value   interface{}
+}
+
+// Span is a range of instances, From through To.
+type Span struct {
+	From int
+	To   int
+}
+
+func (s Span) String() string {
+	if s.From == s.To {
+		return fmt.Sprint(s.From)
+	}
+	return fmt.Sprintf("%v-%v", s.From, s.To)
+}
+
+// Peer is the report on one directory.
+type Peer struct {
+	Dir       string
+	Segments  int
+	Promised  string
+	Forgotten int      // Instances below this were forgotten
+	Fence     string   // Fence of a peer that lost its state: none, recovering, or a seq
+	Problems  []string // Where reading the log stopped early
+	Instances []Instance
+	Gaps      []Span // Instances with no record, up to the highest any peer has
+	Undecided []Span // Instances recorded but not decided here, that another peer decided
+}
+
+// Report is what paxosinspect prints.
+type Report struct {
+	Peers         []Peer
+	Disagreements []string
+}
+
+func register() {
+	gob.Register(kvpaxos.Op{})
+	gob.Register(shardmaster.Op{})
+	gob.Register(shardkv.Op{})
+	gob.Register(shardkv.GetArgs{})
+	gob.Register(shardkv.PutArgs{})
+	gob.Register(shardkv.ReconfigArgs{})
+	gob.Register(diskv.Op{})
+	gob.Register(diskv.GetArgs{})
+	gob.Register(diskv.PutAppendArgs{})
+	gob.Register(diskv.ReconfigArgs{})
+}
+
+// load reads the log in dir, or in dir/state if that exists.
+func load(dir string) (string, paxos.State) {
+	if fi, err := os.Stat(dir + "/state"); err == nil && fi.IsDir() {
+		dir = dir + "/state"
+	}
+	st, err := paxos.ReadState(dir)
+	if err != nil {
+		fmt.Printf("paxosinspect: %v\n", err)
+		os.Exit(1)
+	}
+	return dir, st
+}
+
+// spans collapses sorted seqs into ranges.
+func spans(seqs []int) []Span {
+	var out []Span
+	for _, seq := range seqs {
+		if n := len(out); n > 0 && out[n-1].To == seq-1 {
+			out[n-1].To = seq
+		} else {
+			out = append(out, Span{seq, seq})
+		}
+	}
+	return out
+}
+
+func describe(v interface{}) string {
+	if v == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%T %+v", v, v)
+}
+
+// disagree compares what peers a and b hold for instance seq. Once a
+// value is decided under some ballot, every acceptance at or above that
+// ballot is of the same value; and no two acceptances under one ballot
+// differ, decided or not.
+func disagree(seq int, a string, x paxos.PaxosInstance, b string, y paxos.PaxosInstance) string {
+	if x.N_a == paxos.NoBallot || y.N_a == paxos.NoBallot || reflect.DeepEqual(x.V_a, y.V_a) {
+		return ""
+	}
+	if !x.Decided && y.Decided {
+		a, x, b, y = b, y, a, x
+	}
+	switch {
+	case x.Decided && y.Decided:
+		return fmt.Sprintf("seq %v: %v decided %v, %v decided %v",
+			seq, a, describe(x.V_a), b, describe(y.V_a))
+	case x.Decided && !y.N_a.Less(x.N_a):
+		return fmt.Sprintf("seq %v: %v decided %v under %v, %v accepted %v under %v",
+			seq, a, describe(x.V_a), x.N_a, b, describe(y.V_a), y.N_a)
+	case x.N_a == y.N_a:
+		return fmt.Sprintf("seq %v: %v and %v accepted %v and %v under %v",
+			seq, a, b, describe(x.V_a), describe(y.V_a), x.N_a)
+	}
+	return ""
+}
+
+func analyze(dirs []string) Report {
+	var rep Report
+	states := make([]paxos.State, len(dirs))
+	max := -1
+	for i := range dirs {
+		dirs[i], states[i] = load(dirs[i])
+		for seq := range states[i].Instances {
+			if seq > max {
+				max = seq
+			}
+		}
+	}
+
+	for i, st := range states {
+		p := Peer{
+			Dir:       dirs[i],
+			Segments:  len(st.Segments),
+			Promised:  "none",
+			Forgotten: st.Forgotten,
+			Fence:     "none",
+			Problems:  st.Problems,
+		}
+		if !st.Recovered {
+			p.Fence = "recovering"
+		} else if st.Fence >= 0 {
+			p.Fence = fmt.Sprint(st.Fence)
+		}
+		if st.Promised != paxos.NoBallot {
+			p.Promised = st.Promised.String()
+		}
+		var gaps, undecided []int
+		for seq := st.Forgotten; seq <= max; seq++ {
+			inst, ok := st.Instances[seq]
+			if !ok {
+				gaps = append(gaps, seq)
+				continue
+			}
+			if inst.Decided {
+				continue
+			}
+			for j := range states {
+				if other, ok := states[j].Instances[seq]; ok && other.Decided {
+					undecided = append(undecided, seq)
+					break
+				}
+			}
+		}
+		p.Gaps = spans(gaps)
+		p.Undecided = spans(undecided)
+
+		seqs := make([]int, 0, len(st.Instances))
+		for seq := range st.Instances {
+			seqs = append(seqs, seq)
+		}
+		sort.Ints(seqs)
+		for _, seq := range seqs {
+			inst := st.Instances[seq]
+			p.Instances = append(p.Instances, Instance{
+				Seq:     seq,
+				N_p:     inst.N_p.String(),
+				N_a:     inst.N_a.String(),
+				Decided: inst.Decided,
+				Type:    fmt.Sprintf("%T", inst.V_a),
+				Value:   inst.V_a,
+			})
+		}
+		rep.Peers = append(rep.Peers, p)
+	}
+
+	for seq := 0; seq <= max; seq++ {
+		for i := range states {
+			for j := i + 1; j < len(states); j++ {
+				x, xok := states[i].Instances[seq]
+				y, yok := states[j].Instances[seq]
+				if !xok || !yok {
+					continue
+				}
+				if d := disagree(seq, dirs[i], x, dirs[j], y); d != "" {
+					rep.Disagreements = append(rep.Disagreements, d)
+				}
+			}
+		}
+	}
+	return rep
+}
+
+func joinSpans(ss []Span) string {
+	var parts []string
+	for _, s := range ss {
+		parts = append(parts, s.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+func printText(rep Report) {
+	for _, p := range rep.Peers {
+		fmt.Printf("== %v: %v instances in %v segments, promised %v, forgotten below %v, fence %v\n",
+			p.Dir, len(p.Instances), p.Segments, p.Promised, p.Forgotten, p.Fence)
+		for _, problem := range p.Problems {
+			fmt.Printf("log stopped early: %v\n", problem)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(w, "seq\tN_p\tN_a\tdecided\tvalue\n")
+		for _, inst := range p.Instances {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n",
+				inst.Seq, inst.N_p, inst.N_a, inst.Decided, describe(inst.Value))
+		}
+		w.Flush()
+		if len(p.Gaps) > 0 {
+			fmt.Printf("gaps: %v\n", joinSpans(p.Gaps))
+		}
+		if len(p.Undecided) > 0 {
+			fmt.Printf("decided elsewhere but not here: %v\n", joinSpans(p.Undecided))
+		}
+		fmt.Printf("\n")
+	}
+	if len(rep.Peers) > 1 {
+		if len(rep.Disagreements) == 0 {
+			fmt.Printf("no disagreements\n")
+		}
+		for _, d := range rep.Disagreements {
+			fmt.Printf("DISAGREEMENT %v\n", d)
+		}
+	}
+}
+
+func main() {
+	asJSON := false
+	dirs := []string{}
+	for _, a := range os.Args[1:] {
+		if a == "-json" {
+			asJSON = true
+		} else if strings.HasPrefix(a, "-") {
+			usage()
+		} else {
+			dirs = append(dirs, a)
+		}
+	}
+	if len(dirs) == 0 {
+		usage()
+	}
+
+	register()
+	rep := analyze(dirs)
+
+	if asJSON {
+		out, err := json.MarshalIndent(rep, "", "  ")
+		if err != nil {
+			fmt.Printf("paxosinspect: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s\n", out)
+	} else {
+		printText(rep)
+	}
+	if len(rep.Disagreements) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,57 @@
+package paxos
+
+// Ballots.
+//
+// A ballot pairs a round with the peer number of the proposer. Ballots are
+// ordered by round and then by peer, so no two peers ever propose under the
+// same ballot and any peer can outbid any other by moving to a higher round.
+// Peer numbers never change (see membership.go), so neither does a peer's
+// share of the ballots. A proposer starts above every ballot its own
+// acceptor has seen for the instance, which the write-ahead log preserves
+// across restarts, so it never reuses a ballot it proposed under before.
+
+import (
+	"fmt"
+	"log"
+	"math"
+)
+
+// Ballot is a totally ordered proposal number.
+type Ballot struct {
+	Round int // Raised to outbid other proposers
+	ID    int // Peer number of the proposer
+}
+
+// NoBallot is lower than every ballot a peer can propose under.
+var NoBallot = Ballot{Round: -1, ID: -1}
+
+// Less reports whether b is ordered before o.
+func (b Ballot) Less(o Ballot) bool {
+	return b.Round < o.Round || (b.Round == o.Round && b.ID < o.ID)
+}
+
+// Next returns the lowest ballot owned by peer id that is higher than b.
+func (b Ballot) Next(id int) Ballot {
+	if b.Round < 0 {
+		return Ballot{Round: 0, ID: id}
+	}
+	if id > b.ID {
+		return Ballot{Round: b.Round, ID: id}
+	}
+	if b.Round == math.MaxInt64 {
+		log.Fatalf("paxos: ballot round overflow after %v", b)
+	}
+	return Ballot{Round: b.Round + 1, ID: id}
+}
+
+// maxBallot returns the higher of a and b.
+func maxBallot(a Ballot, b Ballot) Ballot {
+	if a.Less(b) {
+		return b
+	}
+	return a
+}
+
+func (b Ballot) String() string {
+	return fmt.Sprintf("%d.%d", b.Round, b.ID)
+}
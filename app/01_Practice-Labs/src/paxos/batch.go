@@ -0,0 +1,160 @@
+package paxos
+
+// Batching and pipelining of proposals.
+//
+// Every instance costs a full round of RPCs, each on a fresh connection, no
+// matter how small its value. Under concurrent load a Batcher packs the
+// values submitted while one batch is being agreed on into the next
+// instance, so the cost of a round is shared by many values. Independently,
+// WithPipeline bounds how many proposals run at once, so a burst of Start()s
+// keeps a fixed number of instances in flight instead of one goroutine and
+// set of connections per instance.
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// WithPipeline limits the peer to window concurrent proposals. Further
+// Start()s wait for a slot before proposing.
+func WithPipeline(window int) Option {
+	return func(px *Paxos) {
+		px.window = make(chan struct{}, window)
+	}
+}
+
+// pipelined proposes v for seq once one of the pipeline's slots is free.
+// Waiting for the instances a proposal depends on does not take a slot, so
+// they cannot be starved by the proposals waiting on them.
+func (px *Paxos) pipelined(seq int, v interface{}) {
+	if !px.awaitConfig(seq) {
+		return
+	}
+	px.window <- struct{}{}
+	defer func() { <-px.window }()
+	if px.leaderMode {
+		px.leaderPropose(seq, v)
+	} else {
+		px.propose(seq, v)
+	}
+}
+
+// Batch is the value of an instance agreed on through a Batcher.
+type Batch struct {
+	ID     uint64        // Identifies the proposing Batcher's attempt
+	Values []interface{} // Values in submission order
+}
+
+// Batcher proposes values submitted concurrently in batches, one instance
+// per batch. It assumes it is the only proposer of new instances on its peer,
+// though Batchers on other peers may compete for the same instances.
+type Batcher struct {
+	px       *Paxos
+	max      int           // Most values in one batch
+	mu       sync.Mutex    // Protects the fields below
+	seq      int           // Next instance to try
+	pending  []*batchEntry // Values waiting for the next batch
+	flushing bool          // Whether a goroutine is agreeing on batches
+}
+
+// batchEntry is a value waiting to be agreed on.
+type batchEntry struct {
+	v     interface{}
+	seq   int
+	index int
+	done  chan bool
+}
+
+// NewBatcher creates a Batcher that proposes batches of at most max values
+// from instance seq onwards.
+func NewBatcher(px *Paxos, seq int, max int) *Batcher {
+	return &Batcher{px: px, seq: seq, max: max}
+}
+
+// Propose submits v and blocks until the batch holding it is decided. It
+// returns the instance and the position within the Batch where v landed.
+// ok is false if the peer was killed first.
+func (b *Batcher) Propose(v interface{}) (seq int, index int, ok bool) {
+	e := &batchEntry{v: v, done: make(chan bool, 1)}
+	b.mu.Lock()
+	b.pending = append(b.pending, e)
+	if !b.flushing {
+		b.flushing = true
+		go b.flush()
+	}
+	b.mu.Unlock()
+
+	ok = <-e.done
+	return e.seq, e.index, ok
+}
+
+// flush agrees on batches of pending values until none are left.
+func (b *Batcher) flush() {
+	for {
+		b.mu.Lock()
+		n := len(b.pending)
+		if n == 0 || b.px.dead {
+			for _, e := range b.pending {
+				e.done <- false
+			}
+			b.pending = nil
+			b.flushing = false
+			b.mu.Unlock()
+			return
+		}
+		if n > b.max {
+			n = b.max
+		}
+		entries := b.pending[:n]
+		b.pending = b.pending[n:]
+		seq := b.seq
+		b.mu.Unlock()
+
+		batch := Batch{ID: b.batchID(), Values: make([]interface{}, n)}
+		for i, e := range entries {
+			batch.Values[i] = e.v
+		}
+		seq, ok := b.agree(seq, batch)
+		for i, e := range entries {
+			e.seq, e.index = seq, i
+			e.done <- ok
+		}
+
+		b.mu.Lock()
+		b.seq = seq + 1
+		b.mu.Unlock()
+	}
+}
+
+// agree proposes batch at the first instance from seq on that it can win,
+// and returns that instance.
+func (b *Batcher) agree(seq int, batch Batch) (int, bool) {
+	started := -1
+	for !b.px.dead {
+		if decided, _ := b.px.Status(seq); !decided && started != seq {
+			b.px.Start(seq, batch)
+			started = seq
+		}
+		ctx, cancel := withTimeout(b.px.clock, time.Second)
+		v, err := b.px.Wait(ctx, seq)
+		cancel()
+		switch {
+		case err == context.DeadlineExceeded:
+			continue
+		case err == nil:
+			if won, isBatch := v.(Batch); isBatch && won.ID == batch.ID {
+				return seq, true
+			}
+		}
+		// Someone else got this instance, or it was forgotten
+		seq++
+	}
+	return seq, false
+}
+
+// batchID returns a random identifier for a batch, drawn from the peer's
+// source of randomness so that a simulation picks the same ones each run.
+func (b *Batcher) batchID() uint64 {
+	return uint64(Int63(b.px.random))
+}
@@ -0,0 +1,161 @@
+package paxos
+
+// Catch-up for lagging peers.
+//
+// A peer that missed Decided messages, say because it was partitioned, would
+// otherwise only learn those values when someone proposes on the instances
+// again. CatchUp instead asks the other peers directly for the decided values
+// in a range, FetchBatch instances per RPC. Instances a peer has already
+// forgotten below its Min() cannot be fetched; the reply says so, and CatchUp
+// installs a snapshot from that peer if the application registered a
+// Snapshotter (see snapshot.go).
+
+import (
+	"errors"
+)
+
+// FetchBatch is the largest number of instances returned by one Fetch.
+const FetchBatch = 256
+
+// ErrSnapshotNeeded is returned by CatchUp when part of the requested range
+// has been forgotten by the other peers.
+var ErrSnapshotNeeded = errors.New("paxos: snapshot needed")
+
+// FetchArgs asks a peer for the decided instances in [From, To].
+type FetchArgs struct {
+	From int // First instance wanted
+	To   int // Last instance wanted
+	Peer int // Index of the requesting peer
+	Done int // Highest Done() value from the requester
+}
+
+// FetchReply carries the decided instances a peer knows of in a range.
+type FetchReply struct {
+	Decided        map[int]PaxosInstance // Decided instances in the range
+	Next           int                   // First instance not covered by this reply
+	SnapshotNeeded bool                  // Whether instances in the range were forgotten
+	Min            int                   // The peer's Min()
+	Done           int                   // Highest Done() value from this peer
+}
+
+// CatchUp asks the other peers for the decided values of the instances in
+// [from, to] that this peer does not know yet, and records them as decided.
+// Instances no peer knows to be decided are left alone; the application can
+// Start() a no-op for them. Missing instances the peers have forgotten are
+// replaced by a snapshot if a Snapshotter is registered; otherwise CatchUp
+// returns ErrSnapshotNeeded.
+func (px *Paxos) CatchUp(from int, to int) error {
+	return px.catchUp(from, to, true)
+}
+
+// catchUp fetches the decided instances in [from, to], installing a snapshot
+// for forgotten ones only if install is set: the Snapshotter expects Restore
+// to run in the goroutine the application called CatchUp from.
+func (px *Paxos) catchUp(from int, to int, install bool) error {
+	forgotten := -1
+	px.mu.Lock()
+	peers := px.latestConfig()
+	px.mu.Unlock()
+	for peer, addr := range peers {
+		if peer == px.me || addr == "" || px.dead {
+			continue
+		}
+		for seq := px.firstUnknown(from, to); seq <= to; {
+			px.mu.Lock()
+			args := FetchArgs{From: seq, To: to, Peer: px.me, Done: px.done[px.me]}
+			px.mu.Unlock()
+			var reply FetchReply
+			if !px.send(peer, "Paxos.Fetch", args, &reply) {
+				break
+			}
+			px.learn(peer, reply)
+			next := reply.Next
+			if reply.SnapshotNeeded && px.firstUnknown(from, to) < reply.Min {
+				n, ok := 0, false
+				if install {
+					n, ok = px.installSnapshot(peer, reply.Min)
+				}
+				if ok {
+					from = n + 1
+					if from > next {
+						next = from
+					}
+				} else if reply.Min > forgotten {
+					forgotten = reply.Min
+				}
+			}
+			seq = px.firstUnknown(next, to)
+		}
+	}
+
+	if px.firstUnknown(from, to) < forgotten {
+		return ErrSnapshotNeeded
+	}
+	return nil
+}
+
+// firstUnknown returns the lowest instance in [from, to] this peer does not
+// know to be decided, or to+1 if it knows them all.
+func (px *Paxos) firstUnknown(from int, to int) int {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	for seq := from; seq <= to; seq++ {
+		if pi, ok := px.instances[seq]; !ok || !pi.Decided {
+			return seq
+		}
+	}
+	return to + 1
+}
+
+// learn records the decided instances in a Fetch reply.
+func (px *Paxos) learn(peer int, reply FetchReply) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if reply.Done > px.done[peer] {
+		px.done[peer] = reply.Done
+		px.notifyLocked()
+	}
+	if reply.Min > px.groupMin {
+		px.groupMin = reply.Min
+		px.notifyLocked()
+	}
+	for seq, pi := range reply.Decided {
+		if !px.instances[seq].Decided {
+			px.updatePaxos(seq, pi)
+		}
+	}
+}
+
+// Fetch handles a lagging peer's request for decided instances. At most
+// FetchBatch instances are covered; the requester continues from reply.Next.
+func (px *Paxos) Fetch(args FetchArgs, reply *FetchReply) error {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	if args.Done > px.done[args.Peer] {
+		px.done[args.Peer] = args.Done
+		px.notifyLocked()
+	}
+
+	min := px.minLocked()
+	reply.Min = min
+	reply.Done = px.done[px.me]
+	reply.Decided = make(map[int]PaxosInstance)
+
+	from := args.From
+	if from < min {
+		reply.SnapshotNeeded = true
+		from = min
+	}
+	to := args.To
+	if to >= from+FetchBatch {
+		to = from + FetchBatch - 1
+	}
+	for seq := from; seq <= to; seq++ {
+		if pi, ok := px.instances[seq]; ok && pi.Decided {
+			reply.Decided[seq] = pi
+		}
+	}
+	reply.Next = to + 1
+	return nil
+}
@@ -0,0 +1,115 @@
+package paxos
+
+// Clocks tell peers the time.
+//
+// Every timeout, retry delay and liveness check of a peer reads its Clock, so
+// a simulation can run peers on virtual time (see the sim package) while real
+// deployments use the wall clock. Likewise every random choice starts from
+// the peer's source of randomness. Services built on Paxos pick up the same
+// Transport, Clock and randomness through Environment, so their clients and
+// servers live in the same world as the peers underneath them.
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Clock abstracts the passage of time.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// Sleep blocks for d.
+	Sleep(d time.Duration)
+	// After returns a channel that receives the time once d has passed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// WithClock makes the peer wait and time out on c instead of the wall clock.
+func WithClock(c Clock) Option {
+	return func(px *Paxos) {
+		px.clock = c
+	}
+}
+
+// RealClock is the wall clock.
+type RealClock struct{}
+
+// Now returns time.Now().
+func (RealClock) Now() time.Time { return time.Now() }
+
+// Sleep calls time.Sleep.
+func (RealClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// After calls time.After.
+func (RealClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// WithRand makes the peer draw its random numbers from r instead of
+// crypto/rand.
+func WithRand(r io.Reader) Option {
+	return func(px *Paxos) {
+		px.random = r
+	}
+}
+
+// Env is how a peer reaches the world outside: the network, the time and a
+// source of randomness.
+type Env struct {
+	Transport Transport
+	Clock     Clock
+	Rand      io.Reader
+}
+
+// Environment returns the Env a peer made with opts would use, so that a
+// service can serve and call its own RPCs, wait and draw IDs the same way.
+func Environment(opts ...Option) Env {
+	px := &Paxos{transport: UnixTransport{}, clock: RealClock{}, random: crand.Reader}
+	for _, opt := range opts {
+		opt(px)
+	}
+	return Env{Transport: px.transport, Clock: px.clock, Rand: px.random}
+}
+
+// Int63 draws a non-negative random number from r, retrying until r yields.
+func Int63(r io.Reader) int64 {
+	var b [8]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err == nil {
+			return int64(binary.LittleEndian.Uint64(b[:]) >> 1)
+		}
+	}
+}
+
+// withTimeout is context.WithTimeout on clock c.
+func withTimeout(c Clock, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := c.(RealClock); ok {
+		return context.WithTimeout(context.Background(), d)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	tc := &timeoutCtx{Context: ctx}
+	go func() {
+		select {
+		case <-c.After(d):
+			tc.expired.Store(true)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return tc, cancel
+}
+
+// timeoutCtx is a context cancelled when a Clock's timer expires.
+type timeoutCtx struct {
+	context.Context
+	expired atomic.Bool
+}
+
+func (tc *timeoutCtx) Err() error {
+	if tc.expired.Load() {
+		return context.DeadlineExceeded
+	}
+	return tc.Context.Err()
+}
@@ -0,0 +1,89 @@
+package paxos
+
+// On-disk format.
+//
+// Everything Paxos and the services built on it persist is versioned and
+// checksummed, so that a torn or corrupted file is noticed instead of being
+// decoded into garbage. A log segment (see wal.go) starts with an 8-byte
+// header, the magic number "PXWL" and the format version, and frames each
+// record after it with its own length and CRC-32C. A file written through
+// EncodeFile starts with a 16-byte header: the magic number "PXFL", the
+// format version, the length of the data and its CRC-32C. Integers are
+// little-endian.
+//
+// A reader that finds the wrong magic number, a version it does not know or
+// a checksum that does not match treats what the file held as lost, and
+// gets it back from the other peers: Paxos as described in recover.go, the
+// services through CatchUp and their Snapshotter.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// formatVersion is the version of the on-disk format written.
+const formatVersion = 1
+
+var (
+	walMagic  = []byte("PXWL")
+	fileMagic = []byte("PXFL")
+)
+
+const fileHeaderSize = 16
+
+// ErrCorrupt is returned by DecodeFile for content that is not a complete,
+// intact file of a known version.
+var ErrCorrupt = errors.New("paxos: corrupt file")
+
+// segmentHeader returns the header a log segment starts with.
+func segmentHeader() []byte {
+	h := make([]byte, walHeaderSize)
+	copy(h, walMagic)
+	binary.LittleEndian.PutUint32(h[4:8], formatVersion)
+	return h
+}
+
+// checkSegmentHeader checks the header of a log segment.
+func checkSegmentHeader(h []byte) error {
+	if !bytes.Equal(h[0:4], walMagic) {
+		return fmt.Errorf("not a log segment")
+	}
+	if v := binary.LittleEndian.Uint32(h[4:8]); v != formatVersion {
+		return fmt.Errorf("log format version %v, expected %v", v, formatVersion)
+	}
+	return nil
+}
+
+// EncodeFile returns data with a header recording the format version, its
+// length and its checksum, for an application to write to a file.
+func EncodeFile(data []byte) []byte {
+	buf := make([]byte, fileHeaderSize+len(data))
+	copy(buf, fileMagic)
+	binary.LittleEndian.PutUint32(buf[4:8], formatVersion)
+	binary.LittleEndian.PutUint32(buf[8:12], uint32(len(data)))
+	binary.LittleEndian.PutUint32(buf[12:16], crc32.Checksum(data, walTable))
+	copy(buf[fileHeaderSize:], data)
+	return buf
+}
+
+// DecodeFile returns the data in content written by EncodeFile, or an error
+// wrapping ErrCorrupt if the header or checksum do not match.
+func DecodeFile(content []byte) ([]byte, error) {
+	if len(content) < fileHeaderSize || !bytes.Equal(content[0:4], fileMagic) {
+		return nil, fmt.Errorf("%w: no header", ErrCorrupt)
+	}
+	if v := binary.LittleEndian.Uint32(content[4:8]); v != formatVersion {
+		return nil, fmt.Errorf("%w: format version %v, expected %v", ErrCorrupt, v, formatVersion)
+	}
+	data := content[fileHeaderSize:]
+	if n := binary.LittleEndian.Uint32(content[8:12]); int(n) != len(data) {
+		return nil, fmt.Errorf("%w: %v bytes, expected %v", ErrCorrupt, len(data), n)
+	}
+	if crc32.Checksum(data, walTable) != binary.LittleEndian.Uint32(content[12:16]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorrupt)
+	}
+	return data, nil
+}
@@ -0,0 +1,52 @@
+package paxos
+
+// Offline inspection of a peer's write-ahead log.
+//
+// ReadState replays the log in a directory the way a restarting peer would,
+// but leaves the files alone and reports where replay stopped early instead
+// of carrying on silently. main/paxosinspect uses it to look at the state of
+// a replica that will not come back.
+
+import (
+	"fmt"
+	"os"
+)
+
+// State is what a peer's write-ahead log holds: the state the peer would
+// recover on restart.
+type State struct {
+	Instances map[int]PaxosInstance
+	Promised  Ballot   // Promise to a leader for every instance, or NoBallot
+	Forgotten int      // Instances below this have been forgotten
+	Fence     int      // Fence of a peer that lost its state, or -1 (see recover.go)
+	Recovered bool     // Whether such a peer has learned its fence
+	Segments  []string // Segment files read, oldest first
+	Problems  []string // Why replay stopped early in a segment, per segment it did
+}
+
+// ReadState reads the write-ahead log in dir without changing it. Instance
+// values are decoded with gob, so their types must be registered first, as
+// the services' StartServer functions do; a value of an unregistered type
+// ends replay of its segment and shows up in Problems.
+func ReadState(dir string) (State, error) {
+	if fi, err := os.Stat(dir); err != nil {
+		return State{}, err
+	} else if !fi.IsDir() {
+		return State{}, fmt.Errorf("%v is not a directory", dir)
+	}
+	registerTypes()
+
+	w := &wal{dir: dir, promised: NoBallot, fence: -1, floor: NoBallot}
+	st := State{Instances: map[int]PaxosInstance{}}
+	for _, index := range w.list() {
+		st.Segments = append(st.Segments, w.path(index))
+		if err := w.replay(index, st.Instances); err != nil {
+			st.Problems = append(st.Problems, fmt.Sprintf("%v: %v", w.path(index), err))
+		}
+	}
+	st.Promised = w.promised
+	st.Forgotten = w.forgotten
+	st.Fence = w.fence
+	st.Recovered = w.fence != unknownFence
+	return st, nil
+}
@@ -0,0 +1,535 @@
+package paxos
+
+// Multi-Paxos leader mode.
+//
+// Peers run in leader mode unless made WithoutLeaderMode, in which case every
+// Start() runs a full prepare/accept/decide round for its instance. In leader
+// mode a distinguished proposer runs a single PrepareAll for every instance
+// from Min() onwards; once a majority has promised, each new instance only
+// needs the Accept and Decided phases.
+//
+// Followers forward Start() calls to the leader. The leader sends periodic
+// heartbeats, and a follower that has not heard from it for LeaderTimeout, or
+// has not been able to reach it for as long, takes over by running PrepareAll
+// with a higher ballot. Followers only talk to the leader, so it relays every
+// peer's Done() value to the others. All peers of a group must agree on
+// whether leader mode is enabled.
+
+import (
+	"sort"
+	"time"
+)
+
+// HeartbeatInterval is how often a leader announces itself to its followers.
+const HeartbeatInterval = 100 * time.Millisecond
+
+// LeaderTimeout is how long followers wait without hearing from the leader
+// before one of them tries to take over.
+const LeaderTimeout = 1 * time.Second
+
+// PrepareAllArgs contains arguments for a leader's prepare over all instances
+type PrepareAllArgs struct {
+	From int    // First instance the promise is requested for
+	N    Ballot // Leader ballot
+}
+
+// PrepareAllReply contains the response to a PrepareAll request
+type PrepareAllReply struct {
+	Reject   bool                  // Whether the promise was refused
+	N        Ballot                // Highest ballot promised (set on reject)
+	Accepted map[int]PaxosInstance // Instances >= From that hold an accepted value
+	Done     int                   // Highest Done() value from this peer
+}
+
+// HeartbeatArgs contains arguments for a leader heartbeat
+type HeartbeatArgs struct {
+	N      Ballot      // Ballot the leader holds
+	Leader int         // Index of the leader
+	Done   map[int]int // Highest Done() value the leader knows of from each peer
+}
+
+// HeartbeatReply contains the response to a heartbeat
+type HeartbeatReply struct {
+	Reject bool   // Whether the follower has promised a higher ballot
+	N      Ballot // Highest ballot promised by the follower
+	Done   int    // Highest Done() value from this peer
+}
+
+// ForwardArgs carries a follower's proposal to the leader
+type ForwardArgs struct {
+	Seq int         // Sequence number of the instance
+	V   interface{} // Proposed value
+}
+
+// ForwardReply contains the response to a forwarded proposal
+type ForwardReply struct {
+	Reject  bool        // Whether the receiver is not the leader
+	Leader  int         // Leader the receiver knows about, or -1
+	Decided bool        // Whether the instance is already decided
+	N       Ballot      // Ballot of the decided value
+	V       interface{} // Decided value, so a lagging follower can catch up
+	Min     int         // Highest Min() the receiver knows of
+}
+
+// WithoutLeaderMode makes every Start() run a full Paxos round instead of
+// going through a stable leader.
+func WithoutLeaderMode() Option {
+	return func(px *Paxos) {
+		px.leaderMode = false
+	}
+}
+
+// promise returns the effective n_p of an instance, taking the promise made
+// to the leader for every instance into account. Caller must hold px.mu.
+func (px *Paxos) promise(pi PaxosInstance) Ballot {
+	return maxBallot(maxBallot(px.promised, px.floor), pi.N_p)
+}
+
+// nextBallot returns the smallest ballot owned by this peer that is greater
+// than every ballot it has heard of. Caller must hold px.mu.
+func (px *Paxos) nextBallot() Ballot {
+	return px.ballot.Next(px.me)
+}
+
+// observeBallot records a ballot seen in a rejection. Caller must hold px.mu.
+func (px *Paxos) observeBallot(n Ballot) {
+	if px.ballot.Less(n) {
+		px.ballot = n
+	}
+}
+
+// stepDown gives up leadership after learning of a higher ballot.
+func (px *Paxos) stepDown(n Ballot) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	px.observeBallot(n)
+	px.leading = false
+	if px.leader == px.me {
+		px.leader = -1
+	}
+}
+
+// leaderPropose drives an instance to a decision in leader mode.
+// The leader accepts directly; followers forward to the leader and
+// take over if it stops responding.
+func (px *Paxos) leaderPropose(seq int, v interface{}) {
+	if !px.awaitRecovery() {
+		return
+	}
+	backoff := 10 * time.Millisecond
+	var failing time.Time // Since when the leader could not be reached, if it cannot
+	for !px.dead {
+		if px.isDecided(seq) {
+			return
+		}
+
+		px.mu.Lock()
+		leading, n, from := px.leading, px.leaderN, px.leaderFrom
+		leader, heard := px.leader, px.heard
+		px.mu.Unlock()
+
+		switch {
+		case leading && seq >= from && !px.sameConfig(seq):
+			// The promises cover another configuration; run a full round
+			px.propose(seq, v)
+			return
+		case leading && seq >= from:
+			if px.leaderAccept(seq, px.leaderValue(seq, v), n) {
+				return
+			}
+			// Lost messages; retry promptly like the classic proposer
+			px.clock.Sleep(10 * time.Millisecond)
+			continue
+		case leading:
+			// Below the leadership window; fall back to a full round
+			px.propose(seq, v)
+			return
+		case leader >= 0 && leader != px.me && px.clock.Now().Sub(heard) < LeaderTimeout &&
+			(failing.IsZero() || px.clock.Now().Sub(failing) < LeaderTimeout):
+			// A leader that cannot hear us may still send heartbeats, so
+			// give up on it once forwarding has failed for as long
+			var reply ForwardReply
+			args := ForwardArgs{Seq: seq, V: v}
+			if px.send(leader, "Paxos.Forward", args, &reply) && !reply.Reject {
+				failing = time.Time{}
+				// The leader starts no proposal for an instance it has
+				// forgotten; learn that it is gone instead of waiting
+				px.updateGroupMin(reply.Min)
+				if reply.Decided {
+					// We missed the Decided message; learn it from the leader
+					var dreply DecideReply
+					px.Decided(DecideArgs{Seq: seq, N: reply.N, V: reply.V}, &dreply)
+					return
+				}
+				// The leader owns the proposal now; keep watching in case
+				// it fails or its Decided message to us is lost
+				px.waitDecided(seq, 5*backoff)
+			} else {
+				if failing.IsZero() {
+					failing = px.clock.Now()
+				}
+				px.clock.Sleep(backoff)
+			}
+		case px.IsLearner():
+			// Learners cannot collect promises; run a full round
+			px.propose(seq, v)
+			return
+		default:
+			if px.elect() {
+				continue
+			}
+			// Randomize to avoid duelling candidates
+			px.mu.Lock()
+			delay := backoff + time.Duration(px.jitter.Int63n(int64(backoff)))
+			px.mu.Unlock()
+			px.clock.Sleep(delay)
+		}
+
+		if backoff < LeaderTimeout/4 {
+			backoff *= 2
+		}
+	}
+}
+
+// leaderValue returns the value the leader proposes for an instance. A leader
+// must never propose two different values for the same instance under one
+// ballot, so the first value it picks sticks until leadership changes.
+func (px *Paxos) leaderValue(seq int, v interface{}) interface{} {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if pv, ok := px.leaderVals[seq]; ok {
+		return pv
+	}
+	px.leaderVals[seq] = v
+	return v
+}
+
+// sameConfig reports whether seq has the configuration this peer was
+// elected under.
+func (px *Paxos) sameConfig(seq int) bool {
+	px.mu.Lock()
+	peers := px.leaderPeers
+	px.mu.Unlock()
+	return px.sameConfigAs(seq, peers)
+}
+
+// sameConfigAs reports whether peers vote on seq. A leader's promises only
+// hold for instances with the configuration it was elected under.
+func (px *Paxos) sameConfigAs(seq int, peers []string) bool {
+	config, _, _ := px.voters(seq)
+	if len(config) != len(peers) {
+		return false
+	}
+	for i := range config {
+		if config[i] != peers[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// waitDecided waits up to timeout for an instance to be decided.
+func (px *Paxos) waitDecided(seq int, timeout time.Duration) bool {
+	to := 10 * time.Millisecond
+	for start := px.clock.Now(); px.clock.Now().Sub(start) < timeout && !px.dead; {
+		if px.isDecided(seq) {
+			return true
+		}
+		px.clock.Sleep(to)
+		if to < timeout/4 {
+			to *= 2
+		}
+	}
+	return px.isDecided(seq)
+}
+
+// leaderAccept runs the accept and decide phases for one instance under the
+// leader ballot n. It returns true once the value is decided.
+func (px *Paxos) leaderAccept(seq int, v interface{}, n Ballot) bool {
+	peers, _, q2 := px.voters(seq)
+	if peers == nil {
+		return false
+	}
+	nacceptOK := 0
+	for peer, addr := range peers {
+		if !px.votes(peer, addr) {
+			continue
+		}
+		args := AcceptArgs{Seq: seq, N: n, V: v}
+		var reply AcceptReply
+		if px.send(peer, "Paxos.Accept", args, &reply) {
+			px.updateGroupMin(reply.Min)
+			px.updateDone(peer, reply.Done)
+			if !reply.Reject {
+				nacceptOK += px.weight(peer, addr)
+			} else if n.Less(reply.N) {
+				px.stepDown(reply.N)
+				return false
+			}
+		}
+	}
+	if nacceptOK < q2 {
+		return false
+	}
+
+	px.mu.Lock()
+	done := px.doneViewLocked()
+	px.mu.Unlock()
+	for peer, addr := range peers {
+		if addr == "" {
+			continue
+		}
+		args := DecideArgs{Seq: seq, N: n, V: v, Done: done}
+		var reply DecideReply
+		if px.send(peer, "Paxos.Decided", args, &reply) && !reply.Reject {
+			px.updateDone(peer, reply.Done)
+		}
+	}
+	return true
+}
+
+// elect tries to become leader by asking every peer to promise a new ballot
+// for all instances from Min() onwards. Values a majority may already have
+// accepted are re-proposed before the new leader takes on fresh work. It
+// returns false right away if another proposer of this peer is electing.
+func (px *Paxos) elect() bool {
+	px.mu.Lock()
+	// Only one election at a time: concurrent ones would pre-empt each
+	// other's ballots and none would win
+	if px.electing {
+		px.mu.Unlock()
+		return false
+	}
+	px.electing = true
+	defer func() {
+		px.mu.Lock()
+		px.electing = false
+		px.mu.Unlock()
+	}()
+	n := px.nextBallot()
+	px.ballot = n
+	from := px.minLocked()
+	if px.fenced(from) {
+		// We may not vote at or below the fence, so our own promise could
+		// never count; leave those instances to full rounds
+		from = px.fence + 1
+	}
+	peers := px.configFor(from)
+	px.mu.Unlock()
+
+	nprepareOK := 0
+	accepted := make(map[int]PaxosInstance)
+	promised := make([]int, 0, len(peers)) // Peers that promised n
+	informed := make(map[int]map[int]bool) // Peers that reported each instance decided
+	for peer, addr := range peers {
+		if !px.votes(peer, addr) {
+			continue
+		}
+		args := PrepareAllArgs{From: from, N: n}
+		var reply PrepareAllReply
+		if !px.send(peer, "Paxos.PrepareAll", args, &reply) {
+			continue
+		}
+		if reply.Reject {
+			px.stepDown(reply.N)
+			continue
+		}
+		nprepareOK += px.weight(peer, addr)
+		promised = append(promised, peer)
+		px.updateDone(peer, reply.Done)
+		for seq, pi := range reply.Accepted {
+			if pi.Decided {
+				if informed[seq] == nil {
+					informed[seq] = make(map[int]bool)
+				}
+				informed[seq][peer] = true
+			}
+			prev, ok := accepted[seq]
+			if !ok || (!prev.Decided && (pi.Decided || prev.N_a.Less(pi.N_a))) {
+				accepted[seq] = pi
+			}
+		}
+	}
+	if q1, _ := px.quorums(peers); q1 == 0 || nprepareOK < q1 {
+		return false
+	}
+
+	DPrintf("Paxos(%d) elected with ballot %v from seq %d", px.me, n, from)
+
+	// Re-propose in order, so that the outcome does not depend on map order
+	seqs := make([]int, 0, len(accepted))
+	for seq := range accepted {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	for _, seq := range seqs {
+		pi := accepted[seq]
+		if pi.Decided {
+			// Nobody else may tell the peers that missed the decision
+			for _, peer := range promised {
+				if !informed[seq][peer] {
+					var reply DecideReply
+					px.send(peer, "Paxos.Decided", DecideArgs{Seq: seq, N: pi.N_a, V: pi.V_a}, &reply)
+				}
+			}
+			continue
+		}
+		if px.isDecided(seq) {
+			continue
+		}
+		if !px.sameConfigAs(seq, peers) {
+			px.propose(seq, pi.V_a)
+			continue
+		}
+		if !px.leaderAccept(seq, pi.V_a, n) {
+			return false
+		}
+	}
+
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if px.promised != n {
+		// Someone else got promises while we were re-proposing
+		return false
+	}
+	px.leading = true
+	px.leader = px.me
+	px.leaderN = n
+	px.leaderFrom = from
+	px.leaderPeers = peers
+	px.leaderVals = make(map[int]interface{})
+	return true
+}
+
+// heartbeats keeps followers aware of the leader while this peer leads.
+func (px *Paxos) heartbeats() {
+	for !px.dead {
+		px.mu.Lock()
+		leading, n, done := px.leading, px.leaderN, px.doneViewLocked()
+		peers := px.latestConfig()
+		px.mu.Unlock()
+
+		if leading {
+			for peer, addr := range peers {
+				if peer == px.me || addr == "" {
+					continue
+				}
+				args := HeartbeatArgs{N: n, Leader: px.me, Done: done}
+				var reply HeartbeatReply
+				if px.send(peer, "Paxos.Heartbeat", args, &reply) {
+					if reply.Reject {
+						px.stepDown(reply.N)
+						break
+					}
+					px.updateDone(peer, reply.Done)
+				}
+			}
+		}
+		px.clock.Sleep(HeartbeatInterval)
+	}
+}
+
+// PrepareAll handles a candidate leader's request to promise its ballot for
+// every instance from args.From onwards. It replies with every accepted value
+// the leader must take into account. A peer that lost its state refuses if
+// the promise would cover instances it may have voted on before.
+func (px *Paxos) PrepareAll(args PrepareAllArgs, reply *PrepareAllReply) error {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	if maxBallot(px.promised, px.floor).Less(args.N) && !px.IsLearner() && !px.fenced(args.From) {
+		px.updatePromise(args.N)
+		px.observeBallot(args.N)
+		if px.leading && args.N != px.leaderN {
+			px.leading = false
+		}
+		px.leader = args.N.ID
+		px.heard = px.clock.Now()
+
+		reply.Accepted = make(map[int]PaxosInstance)
+		for seq, pi := range px.instances {
+			if seq >= args.From && pi.N_a != NoBallot {
+				reply.Accepted[seq] = pi
+			}
+		}
+		reply.Reject = false
+	} else {
+		reply.Reject = true
+		reply.N = maxBallot(px.promised, px.floor)
+	}
+
+	reply.Done = px.done[px.me]
+	return nil
+}
+
+// Heartbeat handles a leader's periodic announcement.
+func (px *Paxos) Heartbeat(args HeartbeatArgs, reply *HeartbeatReply) error {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	if !args.N.Less(px.promised) {
+		px.leader = args.Leader
+		px.heard = px.clock.Now()
+		reply.Reject = false
+	} else {
+		reply.Reject = true
+	}
+	reply.N = px.promised
+	px.mergeDoneLocked(args.Done)
+	reply.Done = px.done[px.me]
+	return nil
+}
+
+// Forward handles a proposal a follower hands to the leader.
+func (px *Paxos) Forward(args ForwardArgs, reply *ForwardReply) error {
+	px.mu.Lock()
+	leading := px.leading
+	reply.Leader = px.leader
+	reply.Min = px.minLocked()
+	if px.groupMin > reply.Min {
+		reply.Min = px.groupMin
+	}
+	pi, known := px.instances[args.Seq]
+	px.mu.Unlock()
+
+	if known && pi.Decided {
+		reply.Decided = true
+		reply.N = pi.N_a
+		reply.V = pi.V_a
+		return nil
+	}
+	if !leading {
+		reply.Reject = true
+		return nil
+	}
+	reply.Reject = false
+
+	// A follower retries until the instance is decided; one proposal
+	// per instance is enough
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if px.forwarded == nil {
+		px.forwarded = make(map[int]bool)
+	}
+	if px.forwarded[args.Seq] {
+		return nil
+	}
+	px.forwarded[args.Seq] = true
+	go func() {
+		px.leaderPropose(args.Seq, args.V)
+		px.mu.Lock()
+		delete(px.forwarded, args.Seq)
+		px.mu.Unlock()
+	}()
+	return nil
+}
+
+// updatePromise records the ballot promised for every instance, first
+// appending it to the write-ahead log when persisting to disk. Caller must
+// hold px.mu.
+func (px *Paxos) updatePromise(n Ballot) {
+	if px.saveToDisk {
+		px.wal.appendPromise(n)
+	}
+	px.promised = n
+}
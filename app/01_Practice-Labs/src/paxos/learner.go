@@ -0,0 +1,35 @@
+package paxos
+
+// Learner peers.
+//
+// A learner is a peer that is sent every Decided message but does not accept
+// proposals, so it never counts towards a quorum and a slow or failed learner
+// never holds up agreement. It keeps a full copy of the decided log, which
+// Status, Wait and Decisions serve as on any other peer, and it may still
+// Start instances: voters accept its proposals like anyone else's. A learner
+// that missed Decided messages fills the gaps with CatchUp.
+//
+// Learners take part in forgetting like voters: their Done values piggyback
+// on Decided replies, and no peer forgets an instance a learner has not
+// called Done for.
+
+// WithLearners makes the peers numbered ids learners. Every peer of the
+// group, learners included, must be started with the same ids.
+func WithLearners(ids ...int) Option {
+	return func(px *Paxos) {
+		px.learners = make(map[int]bool)
+		for _, id := range ids {
+			px.learners[id] = true
+		}
+	}
+}
+
+// IsLearner reports whether this peer is a learner.
+func (px *Paxos) IsLearner() bool {
+	return px.learners[px.me]
+}
+
+// votes reports whether the peer numbered peer, at addr, votes on instances.
+func (px *Paxos) votes(peer int, addr string) bool {
+	return addr != "" && !px.learners[peer]
+}
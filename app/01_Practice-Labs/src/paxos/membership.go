@@ -0,0 +1,223 @@
+package paxos
+
+// Dynamic membership.
+//
+// With WithReconfiguration, the set of peers that vote on an instance is
+// agreed through the log itself. An application proposes a ConfigChange like
+// any other value; once it is decided at instance i, the peers it lists vote
+// on every instance from i+Alpha onwards. A peer may therefore only propose
+// instance seq once it knows every instance up to seq-Alpha, so the
+// application must not leave instances undecided: a hole holds up every
+// proposal Alpha or more instances past it. All peers of a group must agree
+// on whether reconfiguration is enabled; without it ConfigChange values are
+// ordinary values and the peers given to Make vote on every instance.
+//
+// Peers are numbered by their position in ConfigChange.Peers. A change may
+// append new peers or blank out (remove) existing ones, but never renumbers
+// them, so a peer number always names the same peer. A change that does not
+// follow these rules is decided like any other value but has no effect.
+//
+// A new peer is started with WithJoin and the Peers of the change that added
+// it. It votes from the change's instance plus Alpha onwards, and fills in
+// the earlier instances with CatchUp, installing a snapshot if they have been
+// forgotten.
+
+import (
+	"sort"
+)
+
+// Alpha is how many instances after its own a ConfigChange takes effect.
+const Alpha = 10
+
+// MaxPeers bounds the number of peers ever added to a group.
+const MaxPeers = 64
+
+// ConfigChange is a value that changes the voting peers. Peers[i] is the
+// address of peer i, or "" if peer i has been removed.
+type ConfigChange struct {
+	Peers []string
+}
+
+// configEntry is a decided ConfigChange and the instance it was decided at.
+type configEntry struct {
+	Seq   int
+	Peers []string
+}
+
+// membership is the configuration history a peer keeps: the peers voting
+// from Base onwards and the changes decided after that.
+type membership struct {
+	Base    int
+	Peers   []string
+	Changes []configEntry // Sorted by Seq
+}
+
+// WithReconfiguration lets decided ConfigChange values change the peers.
+func WithReconfiguration() Option {
+	return func(px *Paxos) {
+		px.reconfig = true
+	}
+}
+
+// WithJoin starts a peer that was added to a running group by the
+// ConfigChange decided at instance seq; Make's peers must be that change's
+// Peers. It implies WithReconfiguration.
+func WithJoin(seq int) Option {
+	return func(px *Paxos) {
+		px.reconfig = true
+		px.members.Base = seq + Alpha
+	}
+}
+
+// Members returns the peers voting on instance seq as far as this peer
+// knows, indexed by peer number with "" for removed peers.
+func (px *Paxos) Members(seq int) []string {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	return px.configFor(seq)
+}
+
+// recordChange notes a ConfigChange decided at seq. Caller must hold px.mu.
+func (px *Paxos) recordChange(seq int, v interface{}) {
+	cc, ok := v.(ConfigChange)
+	if !ok || !px.reconfig || seq+Alpha <= px.members.Base {
+		return
+	}
+	changes := px.members.Changes
+	i := sort.Search(len(changes), func(i int) bool { return changes[i].Seq >= seq })
+	if i < len(changes) && changes[i].Seq == seq {
+		return
+	}
+	changes = append(changes, configEntry{})
+	copy(changes[i+1:], changes[i:])
+	changes[i] = configEntry{Seq: seq, Peers: cc.Peers}
+	px.members.Changes = changes
+}
+
+// configFor returns the peers voting on instance seq, applying every valid
+// change that has taken effect by then. Caller must hold px.mu.
+func (px *Paxos) configFor(seq int) []string {
+	peers := px.members.Peers
+	for _, c := range px.members.Changes {
+		if c.Seq+Alpha > seq {
+			break
+		}
+		if px.validChange(peers, c.Peers) {
+			peers = c.Peers
+			px.addPeers(peers)
+		}
+	}
+	return peers
+}
+
+// latestConfig returns the peers named by the newest change this peer knows
+// of, whether or not it has taken effect yet. Caller must hold px.mu.
+func (px *Paxos) latestConfig() []string {
+	if n := len(px.members.Changes); n > 0 {
+		return px.configFor(px.members.Changes[n-1].Seq + Alpha)
+	}
+	return px.members.Peers
+}
+
+// validChange reports whether next keeps the numbering of cur: it may only
+// blank out or append peers, and must leave voters that can form quorums.
+func (px *Paxos) validChange(cur []string, next []string) bool {
+	if len(next) < len(cur) || len(next) > MaxPeers {
+		return false
+	}
+	for i := range cur {
+		if next[i] != cur[i] && next[i] != "" {
+			return false
+		}
+	}
+	q1, _ := px.quorums(next)
+	return q1 > 0
+}
+
+// addPeers learns the addresses of peers added by a change. Caller must
+// hold px.mu.
+func (px *Paxos) addPeers(peers []string) {
+	for i := len(px.peers); i < len(peers); i++ {
+		px.peers = append(px.peers, peers[i])
+		if _, ok := px.done[i]; !ok {
+			px.done[i] = -1
+		}
+	}
+}
+
+// voters returns the peers voting on seq and the votes needed among them in
+// each phase, once this peer knows enough of the log to tell. It returns nil
+// if the peer was killed first or the peers cannot form quorums.
+func (px *Paxos) voters(seq int) ([]string, int, int) {
+	if !px.awaitConfig(seq) {
+		return nil, 0, 0
+	}
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	peers := px.configFor(seq)
+	q1, q2 := px.quorums(peers)
+	if q1 == 0 {
+		return nil, 0, 0
+	}
+	return peers, q1, q2
+}
+
+// awaitConfig waits until every instance up to seq-Alpha is known here,
+// fetching missing ones from the other peers.
+func (px *Paxos) awaitConfig(seq int) bool {
+	if !px.reconfig {
+		return !px.dead
+	}
+	for !px.dead {
+		next := px.settle()
+		if next > seq-Alpha {
+			return true
+		}
+		px.catchUp(next, seq-Alpha, false)
+		if px.settle() > seq-Alpha {
+			return true
+		}
+		// Nobody has decided next yet; wait for its proposer
+		ctx, cancel := withTimeout(px.clock, GCInterval)
+		px.Wait(ctx, next)
+		cancel()
+	}
+	return false
+}
+
+// settle advances px.settled past every instance known to be decided and
+// returns the first one that is not.
+func (px *Paxos) settle() int {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	min := px.minLocked()
+	for {
+		seq := px.settled + 1
+		pi, ok := px.instances[seq]
+		if !(ok && pi.Decided) && seq >= min && seq >= px.groupMin && seq >= px.members.Base {
+			break
+		}
+		px.settled = seq
+	}
+	return px.settled + 1
+}
+
+// fold moves the base configuration up to min, dropping changes that have
+// taken effect by then, so instances below min can be forgotten. Caller must
+// hold px.mu.
+func (px *Paxos) fold(min int) {
+	if !px.reconfig || min <= px.members.Base {
+		return
+	}
+	peers := px.configFor(min)
+	changes := []configEntry{}
+	for _, c := range px.members.Changes {
+		if c.Seq+Alpha > min {
+			changes = append(changes, c)
+		}
+	}
+	px.members = membership{Base: min, Peers: peers, Changes: changes}
+	if px.saveToDisk {
+		px.wal.appendMembership(px.members)
+	}
+}
@@ -17,29 +17,33 @@
 // - Provides both in-memory and persistent storage options
 //
 // The application interface:
-//   px = paxos.Make(peers []string, me int, rpcs *rpc.Server, saveToDisk bool, dir string, restart bool)
+//   px = paxos.Make(peers []string, me int, rpcs *rpc.Server, saveToDisk bool, dir string, restart bool, opts ...Option)
 //   px.Start(seq int, v interface{}) -- start agreement on new instance
 //   px.Status(seq int) (decided bool, v interface{}) -- get info about an instance
 //   px.Done(seq int) -- ok to forget all instances <= seq
 //   px.Max() int -- highest instance seq known, or -1
 //   px.Min() int -- instances before this seq have been forgotten
+//   px.Wait(ctx context.Context, seq int) (v interface{}, err error) -- block until an instance is decided
+//   px.Decisions(ctx context.Context, from int) <-chan Decision -- decided instances in order
+//   px.CatchUp(from int, to int) error -- fetch decided instances from other peers
+//   px.SetSnapshotter(s Snapshotter) -- let lagging peers install application snapshots
+//   px.Members(seq int) []string -- peers voting on an instance; Start a ConfigChange to change them
+//   px.IsLearner() bool -- whether this peer only learns decisions (see WithLearners)
+//   px.ReadIndex(ctx context.Context) (int, error) -- an instance covering every earlier decision (see readindex.go)
 package paxos
 
 import (
-	"bytes"
+	crand "crypto/rand"
 	"encoding/gob"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"math"
 	"math/rand"
 	"net"
 	"net/rpc"
-	"os"
-	"strconv"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
 )
 
@@ -67,62 +71,101 @@ type Paxos struct {
 	dead       bool              // Flag indicating if peer should shut down
 	unreliable bool              // Flag for unreliable network simulation (testing)
 	rpcCount   int               // Counter for RPC calls (testing)
-	peers      []string          // List of all peer addresses
+	peers      []string          // Addresses of every peer ever added, by peer number
 	me         int               // Index of this peer in the peers array
+	transport  Transport         // How peers reach each other (see transport.go)
+	clock      Clock             // How peers tell the time (see clock.go)
+	random     io.Reader         // Where random numbers come from
 
 	// Paxos state
-	instances map[int]PaxosInstance // Map of sequence number to instance state
-	done      map[int]int           // Map of peer index to highest Done() value
-	nseq      int                   // Highest sequence number seen
-	nmajority int                   // Number of peers required for majority
+	instances   map[int]PaxosInstance // Map of sequence number to instance state
+	done        map[int]int           // Map of peer index to highest Done() value
+	nseq        int                   // Highest sequence number seen
+	changed     chan struct{}         // Closed when an instance is decided or Min() may advance (see wait.go)
+	snapshotter Snapshotter           // Application state provider and installer, or nil (see snapshot.go)
+	installing  int                   // Snapshots being fetched for installation; none are served meanwhile
+	window      chan struct{}         // One slot per proposal in flight, or nil if unbounded (see batch.go)
+	groupMin    int                   // Highest Min() reported by another peer
+	reconfig    bool                  // Whether ConfigChange values change the peers (see membership.go)
+	members     membership            // Who votes on which instances
+	settled     int                   // Every instance <= settled is known to be decided
 
 	// Persistence
 	dir        string // Directory for persistent storage
 	saveToDisk bool   // Whether to save state to disk
+	wal        *wal   // Write-ahead log in dir (see wal.go)
+	fence      int    // Never vote on instances <= fence after losing state (see recover.go)
+	floor      Ballot // Never promise a ballot below floor after losing state
+
+	learners map[int]bool // Peers that learn decisions but do not vote (see learner.go)
+	flex     *Quorums     // Flexible quorum sizes, or nil for majorities (see quorum.go)
+
+	// Multi-Paxos leader mode (see leader.go)
+	leaderMode  bool                // Whether a stable leader skips Prepare for new instances
+	promised    Ballot              // Ballot promised to a leader for every instance (NoBallot if none)
+	ballot      Ballot              // Highest ballot this peer has heard of
+	leader      int                 // Index of the peer believed to be leader, or -1
+	leading     bool                // Whether this peer holds a majority promise for leaderN
+	leaderN     Ballot              // Ballot under which this peer leads
+	leaderFrom  int                 // First instance covered by this peer's leadership
+	leaderPeers []string            // Configuration this peer was elected under
+	leaderVals  map[int]interface{} // Value proposed per instance under leaderN
+	heard       time.Time           // When the leader was last heard from
+	electing    bool                // Whether an election is under way
+	forwarded   map[int]bool        // Instances a follower handed over, being proposed
+	jitter      *rand.Rand          // Randomizes election backoff
 }
 
+// Option configures optional behaviour of a Paxos peer at construction time.
+type Option func(px *Paxos)
+
 // PaxosInstance represents the state of a single Paxos agreement instance.
 // Each instance tracks the proposal numbers and values for the three phases
 // of the Paxos algorithm: prepare, accept, and decide.
 type PaxosInstance struct {
-	N_p     int         // Highest prepare request number seen
-	N_a     int         // Highest accept request number seen
+	N_p     Ballot      // Highest prepare ballot seen
+	N_a     Ballot      // Highest accept ballot seen
+	N_o     Ballot      // Highest ballot this peer has proposed under
 	V_a     interface{} // Value from the highest accept request
 	Decided bool        // Whether this instance has been decided
 }
 
 // PrepareArgs contains arguments for the prepare phase of Paxos
 type PrepareArgs struct {
-	Seq int // Sequence number of the instance
-	N   int // Proposal number
+	Seq int    // Sequence number of the instance
+	N   Ballot // Proposal ballot
 }
 
 // PrepareReply contains the response to a prepare request
 type PrepareReply struct {
-	N      int         // Highest accept number seen
+	N      Ballot      // Highest accept ballot seen (promise on reject)
 	V      interface{} // Value from the highest accept
 	Reject bool        // Whether the prepare was rejected
 	Done   int         // Highest Done() value from this peer
+	Min    int         // This peer's Min()
 }
 
 // AcceptArgs contains arguments for the accept phase of Paxos
 type AcceptArgs struct {
 	Seq int         // Sequence number of the instance
-	N   int         // Proposal number
+	N   Ballot      // Proposal ballot
 	V   interface{} // Proposed value
 }
 
 // AcceptReply contains the response to an accept request
 type AcceptReply struct {
-	Reject bool // Whether the accept was rejected
-	Done   int  // Highest Done() value from this peer
+	Reject bool   // Whether the accept was rejected
+	N      Ballot // Highest ballot promised (set on reject)
+	Done   int    // Highest Done() value from this peer
+	Min    int    // This peer's Min()
 }
 
 // DecideArgs contains arguments for the decide phase of Paxos
 type DecideArgs struct {
-	Seq int         // Sequence number of the instance
-	N   int         // Proposal number
-	V   interface{} // Decided value
+	Seq  int         // Sequence number of the instance
+	N    Ballot      // Proposal ballot
+	V    interface{} // Decided value
+	Done map[int]int // Highest Done() value a leader knows of from each peer, or nil
 }
 
 // DecideReply contains the response to a decide request
@@ -135,15 +178,15 @@ type DecideReply struct {
 // It returns true if the server responded successfully, false otherwise.
 // The reply argument should be a pointer to a reply structure.
 // This function handles connection establishment, RPC call, and cleanup.
-func call(srv string, name string, args interface{}, reply interface{}) bool {
-	c, err := rpc.Dial("unix", srv)
+func call(t Transport, srv string, name string, args interface{}, reply interface{}) bool {
+	conn, err := t.Dial(srv)
 	if err != nil {
-		err1 := err.(*net.OpError)
-		if err1.Err != syscall.ENOENT && err1.Err != syscall.ECONNREFUSED {
-			fmt.Printf("paxos Dial() failed: %v\n", err1)
+		if !quietDialError(err) {
+			fmt.Printf("paxos Dial() failed: %v\n", err)
 		}
 		return false
 	}
+	c := rpc.NewClient(conn)
 	defer c.Close()
 
 	err = c.Call(name, args, reply)
@@ -155,144 +198,144 @@ func call(srv string, name string, args interface{}, reply interface{}) bool {
 	return false
 }
 
-// updatePaxos updates the Paxos instance state, optionally persisting to disk
-func (px *Paxos) updatePaxos(seq int, instance PaxosInstance) {
-	if px.saveToDisk {
-		px.fileUpdatePaxos(seq, instance)
+// instance returns the state of instance seq, with no ballots seen if this
+// peer has never heard of it. Caller must hold px.mu.
+func (px *Paxos) instance(seq int) PaxosInstance {
+	if pi, ok := px.instances[seq]; ok {
+		return pi
 	}
-	px.instances[seq] = instance
+	return PaxosInstance{N_p: NoBallot, N_a: NoBallot, N_o: NoBallot}
 }
 
-// fileUpdatePaxos saves a Paxos instance to disk using atomic file operations
-func (px *Paxos) fileUpdatePaxos(seq int, op PaxosInstance) error {
-	DPrintf("Saving paxos sequence %d: %v on server %d", seq, op, px.me)
-	fullname := px.dir + "/paxos-" + strconv.Itoa(seq)
-	tempname := px.dir + "/temp-" + strconv.Itoa(seq)
-
-	// Encode the instance to bytes
-	w := new(bytes.Buffer)
-	e := gob.NewEncoder(w)
-	if err := e.Encode(op); err != nil {
-		return err
-	}
+// claimBallot picks a ballot for proposing instance seq that is higher than
+// floor and than every ballot this peer has seen or proposed under, and
+// records it with the instance so it is never reused, even after a restart.
+func (px *Paxos) claimBallot(seq int, floor Ballot) Ballot {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	pi := px.instance(seq)
+	n := maxBallot(floor, px.promise(pi))
+	n = maxBallot(n, maxBallot(pi.N_o, px.ballot)).Next(px.me)
+	pi.N_o = n
+	px.updatePaxos(seq, pi)
+	px.observeBallot(n)
+	return n
+}
 
-	// Write to temporary file first, then rename atomically
-	if err := ioutil.WriteFile(tempname, w.Bytes(), 0666); err != nil {
-		return err
+// updatePaxos updates the Paxos instance state, first appending it to the
+// write-ahead log when persisting to disk
+func (px *Paxos) updatePaxos(seq int, instance PaxosInstance) {
+	if px.saveToDisk {
+		px.wal.append(seq, instance)
 	}
-	if err := os.Rename(tempname, fullname); err != nil {
-		return err
+	if instance.Decided && !px.instances[seq].Decided {
+		px.recordChange(seq, instance.V_a)
+		defer px.notifyLocked()
 	}
-	return nil
-}
-
-// fileRetrievePaxos loads all Paxos instances from disk
-func (px *Paxos) fileRetrievePaxos() map[int]PaxosInstance {
-	m := map[int]PaxosInstance{}
-	d := px.dir
-	files, err := ioutil.ReadDir(d)
-	if err != nil {
-		log.Fatalf("fileRetrievePaxos could not read %v: %v", d, err)
-	}
-	
-	for _, fi := range files {
-		n1 := fi.Name()
-		if len(n1) >= 6 && n1[0:6] == "paxos-" {
-			key, err := strconv.Atoi(n1[6:])
-			if err != nil {
-				log.Fatalf("fileRetrievePaxos bad file name %v: %v", n1, err)
-			}
-			fullname := px.dir + "/" + n1
-			content, err := ioutil.ReadFile(fullname)
-			if err != nil {
-				log.Fatalf("fileRetrievePaxos fileGet failed for %v: %v", key, err)
-			}
-			buf := bytes.NewBuffer(content)
-			g := gob.NewDecoder(buf)
-			var inst PaxosInstance
-			if err := g.Decode(&inst); err != nil {
-				log.Fatalf("fileRetrievePaxos decode failed for %v: %v", key, err)
-			}
-			DPrintf("Retrieved paxos sequence %d: %v on server %d", key, inst, px.me)
-			m[key] = inst
-		}
+	if seq > px.nseq {
+		px.nseq = seq
 	}
-	return m
+	px.instances[seq] = instance
 }
 
 // propose implements the proposer side of the Paxos algorithm.
 // It attempts to get a majority of peers to agree on the proposed value
 // for the given sequence number.
 func (px *Paxos) propose(seq int, value interface{}) {
-	// Initialize proposal number to ensure uniqueness across peers
-	// Each peer uses a different starting point based on its index
-	initProposalNum := (px.me + seq) % len(px.peers)
-	n := initProposalNum
+	// Only the peers configured for this instance vote on it
+	peers, q1, q2 := px.voters(seq)
+	if peers == nil {
+		return
+	}
+
+	// A peer that lost its state cannot tell which ballots it used
+	if !px.awaitRecovery() {
+		return
+	}
+
+	// Ballots carry the proposer's index so they are unique across peers
+	n := px.claimBallot(seq, NoBallot)
 
 	// Continue until agreement is reached or peer is killed
 	for !px.dead {
 		// Check if this instance has already been decided
-		if inst, ok := px.instances[seq]; ok && inst.Decided {
+		if px.isDecided(seq) {
 			return
 		}
 
 		// Phase 1: Prepare
-		nseen := -1
+		nseen := NoBallot // Highest accepted ballot among the replies
+		top := NoBallot   // Highest ballot a rejecting peer has promised
 		nprepareOK := 0
 		servPrepareOK := make([]int, 0)
 		
-		// Send prepare(n) to all servers including self
-		for peer := 0; peer < len(px.peers); peer++ {
+		// Send prepare(n) to all voters including self
+		for peer, addr := range peers {
+			if !px.votes(peer, addr) {
+				continue
+			}
 			args := PrepareArgs{Seq: seq, N: n}
 			var reply PrepareReply
 
-			if px.send(peer, "Paxos.Prepare", args, &reply) && !reply.Reject {
-				nprepareOK++
+			ok := px.send(peer, "Paxos.Prepare", args, &reply)
+			if ok {
+				px.updateGroupMin(reply.Min)
+			}
+			if ok && !reply.Reject {
+				nprepareOK += px.weight(peer, addr)
 				servPrepareOK = append(servPrepareOK, peer)
 				// Choose value with highest proposal number seen
-				if reply.N > nseen {
+				if nseen.Less(reply.N) {
 					nseen = reply.N
 					value = reply.V
 				}
+			} else if ok {
+				top = maxBallot(top, reply.N)
 			}
 		}
 
-		// If we didn't get majority approval, try with higher proposal number
-		if nprepareOK < px.nmajority {
-			if n < nseen {
-				n = (nseen/len(px.peers))*len(px.peers) + initProposalNum
-			}
-			n += len(px.peers)
+		// If we didn't get a phase-1 quorum, try with higher proposal number
+		if nprepareOK < q1 {
+			n = px.claimBallot(seq, maxBallot(nseen, top))
 			continue
 		}
 
 		// Phase 2: Accept
 		nacceptOK := 0
 		servAcceptOK := make([]int, 0)
-		for peer := 0; peer < len(px.peers); peer++ {
+		for peer, addr := range peers {
+			if !px.votes(peer, addr) {
+				continue
+			}
 			args := AcceptArgs{Seq: seq, N: n, V: value}
 			var reply AcceptReply
-			if px.send(peer, "Paxos.Accept", args, &reply) && !reply.Reject {
-				nacceptOK++
+			ok := px.send(peer, "Paxos.Accept", args, &reply)
+			if ok {
+				px.updateGroupMin(reply.Min)
+			}
+			if ok && !reply.Reject {
+				nacceptOK += px.weight(peer, addr)
 				servAcceptOK = append(servAcceptOK, peer)
+			} else if ok {
+				top = maxBallot(top, reply.N)
 			}
 		}
 
-		// If we didn't get majority approval, try with higher proposal number
-		if nacceptOK < px.nmajority {
-			if n < nseen {
-				n = (nseen/len(px.peers))*len(px.peers) + initProposalNum
-			}
-			n += len(px.peers)
+		// If we didn't get a phase-2 quorum, try with higher proposal number
+		if nacceptOK < q2 {
+			n = px.claimBallot(seq, maxBallot(nseen, top))
 			continue
 		}
 
 		// Phase 3: Decide - send decided value to all peers
-		for peer := 0; peer < len(px.peers); peer++ {
+		for peer, addr := range peers {
+			if addr == "" {
+				continue
+			}
 			args := DecideArgs{Seq: seq, N: n, V: value}
 			var reply DecideReply
 			if px.send(peer, "Paxos.Decided", args, &reply) && !reply.Reject {
-				px.done[peer] = reply.Done
+				px.updateDone(peer, reply.Done)
 			}
 		}
 
@@ -301,12 +344,77 @@ func (px *Paxos) propose(seq int, value interface{}) {
 	}
 }
 
+// isDecided reports whether this peer already knows the outcome of an instance.
+// Instances below Min(), or below another peer's Min(), have been forgotten
+// and count as decided.
+func (px *Paxos) isDecided(seq int) bool {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if seq < px.minLocked() || seq < px.groupMin {
+		return true
+	}
+	inst, ok := px.instances[seq]
+	return ok && inst.Decided
+}
+
+// updateDone records the highest Done() value piggybacked by a peer.
+func (px *Paxos) updateDone(peer int, done int) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if done > px.done[peer] {
+		px.done[peer] = done
+		px.notifyLocked()
+	}
+}
+
+// doneViewLocked returns a copy of the highest Done() value this peer knows
+// of from each peer. Caller must hold px.mu.
+func (px *Paxos) doneViewLocked() map[int]int {
+	done := make(map[int]int, len(px.done))
+	for peer, d := range px.done {
+		done[peer] = d
+	}
+	return done
+}
+
+// mergeDoneLocked records the Done() values a leader relays. Followers only
+// talk to the leader, so they learn each other's Done() values, and with
+// them Min(), through it. Caller must hold px.mu.
+func (px *Paxos) mergeDoneLocked(done map[int]int) {
+	changed := false
+	for peer, d := range done {
+		if d > px.done[peer] {
+			px.done[peer] = d
+			changed = true
+		}
+	}
+	if changed {
+		px.notifyLocked()
+	}
+}
+
+// updateGroupMin records a Min() reported by another peer. Instances below it
+// were decided and applied everywhere, this peer included, before they were
+// forgotten; a peer that still needs them has lost its state and must install
+// a snapshot (see snapshot.go).
+func (px *Paxos) updateGroupMin(min int) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if min > px.groupMin {
+		px.groupMin = min
+		px.notifyLocked()
+	}
+}
+
 // send makes either a local procedure call (LPC) to self or an RPC to other peers.
 // This abstraction allows the proposer to treat local and remote calls uniformly.
 func (px *Paxos) send(peer int, pc string, args interface{}, reply interface{}) bool {
 	// Make RPC call to remote peer
 	if peer != px.me {
-		return call(px.peers[peer], pc, args, reply)
+		px.mu.Lock()
+		addr := px.peers[peer]
+		px.mu.Unlock()
+		return call(px.transport, addr, pc, args, reply)
 	}
 
 	// Make local procedure call to self
@@ -318,6 +426,14 @@ func (px *Paxos) send(peer int, pc string, args interface{}, reply interface{})
 		px.Accept(args.(AcceptArgs), reply.(*AcceptReply))
 	case "Decided":
 		px.Decided(args.(DecideArgs), reply.(*DecideReply))
+	case "PrepareAll":
+		px.PrepareAll(args.(PrepareAllArgs), reply.(*PrepareAllReply))
+	case "Heartbeat":
+		px.Heartbeat(args.(HeartbeatArgs), reply.(*HeartbeatReply))
+	case "Forward":
+		px.Forward(args.(ForwardArgs), reply.(*ForwardReply))
+	case "LastAccepted":
+		px.LastAccepted(args.(LastAcceptedArgs), reply.(*LastAcceptedReply))
 	default:
 		return false
 	}
@@ -332,21 +448,27 @@ func (px *Paxos) Prepare(args PrepareArgs, reply *PrepareReply) error {
 	px.mu.Lock()
 	defer px.mu.Unlock()
 
-	// Get or create instance for this sequence number
-	var pi PaxosInstance
-	if pii, ok := px.instances[args.Seq]; ok {
-		pi = pii
-	} else {
-		pi = PaxosInstance{N_p: -1, N_a: -1, V_a: nil, Decided: false}
+	reply.Done = px.done[px.me]
+	reply.Min = px.minLocked()
+	if args.Seq < reply.Min || px.IsLearner() || px.fenced(args.Seq) {
+		// Forgotten instances were decided; never decide them again.
+		// Learners do not vote at all, nor do peers on instances they
+		// may have voted on before losing their state.
+		reply.Reject = true
+		return nil
 	}
 
+	// Get or create instance for this sequence number
+	pi := px.instance(args.Seq)
+
 	// Acceptor's prepare(n) handler:
 	// If n > n_p, promise not to accept proposals with lower numbers
-	if args.N > pi.N_p {
+	if px.promise(pi).Less(args.N) {
 		// Update n_p to the new proposal number
 		instance := PaxosInstance{
 			N_p:     args.N,
 			N_a:     pi.N_a,
+			N_o:     pi.N_o,
 			V_a:     pi.V_a,
 			Decided: pi.Decided,
 		}
@@ -359,10 +481,8 @@ func (px *Paxos) Prepare(args PrepareArgs, reply *PrepareReply) error {
 	} else {
 		// Reject prepare request with lower proposal number
 		reply.Reject = true
+		reply.N = px.promise(pi)
 	}
-
-	// Piggyback Done value
-	reply.Done = px.done[px.me]
 	return nil
 }
 
@@ -373,16 +493,28 @@ func (px *Paxos) Accept(args AcceptArgs, reply *AcceptReply) error {
 	px.mu.Lock()
 	defer px.mu.Unlock()
 
+	reply.Done = px.done[px.me]
+	reply.Min = px.minLocked()
+	if args.Seq < reply.Min || px.IsLearner() || px.fenced(args.Seq) {
+		reply.Reject = true
+		return nil
+	}
+
 	// Get instance for this sequence number
-	pi := px.instances[args.Seq]
+	pi := px.instance(args.Seq)
 
 	// Acceptor's accept(n, v) handler:
 	// If n >= n_p, accept the proposal
-	if args.N >= pi.N_p {
+	if !args.N.Less(px.promise(pi)) {
+		if px.leaderMode && args.N == px.promised {
+			// An accept under the promised ballot comes from the leader
+			px.heard = px.clock.Now()
+		}
 		// Update n_p, n_a, and v_a
 		instance := PaxosInstance{
 			N_p:     args.N,
 			N_a:     args.N,
+			N_o:     pi.N_o,
 			V_a:     args.V,
 			Decided: pi.Decided,
 		}
@@ -391,10 +523,8 @@ func (px *Paxos) Accept(args AcceptArgs, reply *AcceptReply) error {
 	} else {
 		// Reject accept request with lower proposal number
 		reply.Reject = true
+		reply.N = px.promise(pi)
 	}
-
-	// Piggyback Done value
-	reply.Done = px.done[px.me]
 	return nil
 }
 
@@ -408,10 +538,12 @@ func (px *Paxos) Decided(args DecideArgs, reply *DecideReply) error {
 	instance := PaxosInstance{
 		N_p:     args.N,
 		N_a:     args.N,
+		N_o:     px.instance(args.Seq).N_o,
 		V_a:     args.V,
 		Decided: true,
 	}
 	px.updatePaxos(args.Seq, instance)
+	px.mergeDoneLocked(args.Done)
 
 	// Piggyback the Done value
 	reply.Done = px.done[px.me]
@@ -423,8 +555,17 @@ func (px *Paxos) Decided(args DecideArgs, reply *DecideReply) error {
 // It returns immediately without waiting for agreement to complete.
 // The application should call Status() to check if/when agreement is reached.
 func (px *Paxos) Start(seq int, v interface{}) {
+	if px.window != nil {
+		go px.pipelined(seq, v)
+		return
+	}
+
 	// Start the proposer in a separate goroutine
-	go px.propose(seq, v)
+	if px.leaderMode {
+		go px.leaderPropose(seq, v)
+	} else {
+		go px.propose(seq, v)
+	}
 }
 
 // Done indicates that the application on this machine is done with all instances <= seq.
@@ -434,6 +575,7 @@ func (px *Paxos) Done(seq int) {
 	px.mu.Lock()
 	defer px.mu.Unlock()
 	px.done[px.me] = seq
+	px.notifyLocked()
 }
 
 // Max returns the highest instance sequence number known to this peer.
@@ -463,11 +605,16 @@ func (px *Paxos) Max() int {
 func (px *Paxos) Min() int {
 	px.mu.Lock()
 	defer px.mu.Unlock()
+	return px.minLocked()
+}
 
+// minLocked computes Min() over the peers of the newest configuration;
+// the caller must hold px.mu.
+func (px *Paxos) minLocked() int {
 	min := math.MaxInt64
-	for _, seq := range px.done {
-		if seq < min {
-			min = seq
+	for peer, addr := range px.latestConfig() {
+		if addr != "" && px.done[peer] < min {
+			min = px.done[peer]
 		}
 	}
 	return min + 1
@@ -496,29 +643,56 @@ func (px *Paxos) Status(seq int) (bool, interface{}) {
 // Kill tells the peer to shut itself down.
 // This method is used for testing and graceful shutdown.
 func (px *Paxos) Kill() {
+	px.mu.Lock()
 	px.dead = true
+	px.notifyLocked()
+	px.mu.Unlock()
 	if px.l != nil {
 		px.l.Close()
 	}
 }
 
+// registerTypes registers the types Paxos stores in interface values with
+// gob, for RPCs and the write-ahead log.
+func registerTypes() {
+	gob.Register(PaxosInstance{})
+	gob.Register(ConfigChange{})
+	gob.Register(Batch{})
+}
+
 // Make creates a new Paxos peer that participates in consensus decisions.
-// peers contains the addresses of all Paxos peers (including this one).
+// peers contains the addresses of all Paxos peers (including this one);
+// ConfigChange values can change them later (see membership.go).
 // me is the index of this peer in the peers array.
-// rpcs is the RPC server to register with (nil to create a new one).
+// rpcs is the RPC server to register with (nil to create a new one that
+// listens on peers[me] through the transport).
 // saveToDisk determines whether to persist state to disk.
 // dir is the directory for persistent storage.
 // restart indicates whether this is a restart from a crash.
-func Make(peers []string, me int, rpcs *rpc.Server, saveToDisk bool, dir string, restart bool) *Paxos {
+// opts change optional behaviour; see WithoutLeaderMode.
+func Make(peers []string, me int, rpcs *rpc.Server, saveToDisk bool, dir string, restart bool, opts ...Option) *Paxos {
 	px := &Paxos{
-		peers:      peers,
+		peers:      append([]string(nil), peers...),
 		me:         me,
 		dir:        dir,
 		saveToDisk: saveToDisk,
+		transport:  UnixTransport{},
+		clock:      RealClock{},
+		random:     crand.Reader,
+		fence:      -1,
+		floor:      NoBallot,
+		promised:   NoBallot,
+		ballot:     NoBallot,
+		leader:     -1,
+		leaderMode: true,
+	}
+	for _, opt := range opts {
+		opt(px)
 	}
+	px.checkQuorums()
+	px.jitter = rand.New(rand.NewSource(Int63(px.random)))
 
-	// Register PaxosInstance for gob encoding
-	gob.Register(PaxosInstance{})
+	registerTypes()
 
 	// Initialize Paxos state
 	px.instances = make(map[int]PaxosInstance)
@@ -527,12 +701,38 @@ func Make(peers []string, me int, rpcs *rpc.Server, saveToDisk bool, dir string,
 		// A peer's z_i is -1 if it has never called Done()
 		px.done[peer] = -1
 	}
+	px.changed = make(chan struct{})
 	px.nseq = -1
-	px.nmajority = len(px.peers)/2 + 1
-
-	// Load state from disk if restarting
-	if saveToDisk && restart {
-		px.instances = px.fileRetrievePaxos()
+	px.members.Peers = peers
+	px.settled = px.members.Base - 1
+
+	// Open the write-ahead log, recovering state from it if restarting
+	if saveToDisk {
+		var lost bool
+		px.wal, px.instances, px.promised, lost = openWAL(dir, restart)
+		px.fence, px.floor = px.wal.fence, px.wal.floor
+		if lost {
+			px.fence = unknownFence
+			px.wal.appendFence(px.fence, px.floor)
+		}
+		px.ballot = maxBallot(px.promised, px.floor)
+		for _, pi := range px.instances {
+			px.observeBallot(pi.N_o)
+		}
+		if px.wal.members != nil {
+			px.members = *px.wal.members
+			px.addPeers(px.members.Peers)
+		} else if px.reconfig {
+			px.wal.appendMembership(px.members)
+		}
+		for seq, pi := range px.instances {
+			if seq > px.nseq {
+				px.nseq = seq
+			}
+			if pi.Decided {
+				px.recordChange(seq, pi.V_a)
+			}
+		}
 	}
 
 	// Set up RPC server
@@ -543,10 +743,14 @@ func Make(peers []string, me int, rpcs *rpc.Server, saveToDisk bool, dir string,
 		rpcs = rpc.NewServer()
 		rpcs.Register(px)
 
-		// Prepare to receive connections from clients
-		// Change "unix" to "tcp" to use over a network
-		os.Remove(peers[me]) // Only needed for "unix"
-		l, err := net.Listen("unix", peers[me])
+		// Prepare to receive connections from clients, dropping
+		// some of them while the unreliable flag is set
+		listener := &UnreliableTransport{
+			Transport:  px.transport,
+			Unreliable: func() bool { return px.unreliable },
+			Served:     func() { px.rpcCount++ },
+		}
+		l, err := listener.Listen(peers[me])
 		if err != nil {
 			log.Fatal("listen error: ", err)
 		}
@@ -557,24 +761,7 @@ func Make(peers []string, me int, rpcs *rpc.Server, saveToDisk bool, dir string,
 			for !px.dead {
 				conn, err := px.l.Accept()
 				if err == nil && !px.dead {
-					if px.unreliable && (rand.Int63()%1000) < 100 {
-						// Discard the request (simulate network failure)
-						conn.Close()
-					} else if px.unreliable && (rand.Int63()%1000) < 200 {
-						// Process the request but force discard of reply
-						c1 := conn.(*net.UnixConn)
-						f, _ := c1.File()
-						err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
-						if err != nil {
-							fmt.Printf("shutdown: %v\n", err)
-						}
-						px.rpcCount++
-						go rpcs.ServeConn(conn)
-					} else {
-						// Normal processing
-						px.rpcCount++
-						go rpcs.ServeConn(conn)
-					}
+					go rpcs.ServeConn(conn)
 				} else if err == nil {
 					conn.Close()
 				}
@@ -585,22 +772,34 @@ func Make(peers []string, me int, rpcs *rpc.Server, saveToDisk bool, dir string,
 		}()
 	}
 
+	if px.recovering() {
+		go px.rejoin()
+	}
+	if px.leaderMode {
+		go px.heartbeats()
+	}
+
 	// Start garbage collector to clean up forgotten instances
 	go func() {
 		for !px.dead {
 			px.mu.Lock()
-			min := px.Min()
+			min := px.minLocked()
+			for ninst := range px.leaderVals {
+				if ninst < min {
+					delete(px.leaderVals, ninst)
+				}
+			}
 			for ninst := range px.instances {
 				if ninst < min {
 					delete(px.instances, ninst)
-					if px.saveToDisk {
-						fullname := px.dir + "/paxos-" + strconv.Itoa(ninst)
-						os.Remove(fullname)
-					}
 				}
 			}
+			px.fold(min)
+			if px.saveToDisk && !px.dead {
+				px.wal.truncate(min, px.instances)
+			}
 			px.mu.Unlock()
-			time.Sleep(GCInterval)
+			px.clock.Sleep(GCInterval)
 		}
 	}()
 
@@ -0,0 +1,117 @@
+package paxos
+
+// Flexible quorums.
+//
+// Paxos only needs every phase-1 (Prepare) quorum to intersect every phase-2
+// (Accept) quorum; two phase-2 quorums need not intersect. WithQuorums trades
+// a larger phase-1 quorum, needed only when a new proposer or leader takes
+// over, for a smaller phase-2 quorum on every instance. Peers may also carry
+// different weights, and a quorum is any set of peers whose weights add up to
+// the quorum size. Without WithQuorums every voter has weight 1 and both
+// phases need a majority.
+//
+// With total weight W, any set weighing at least Phase1 and any set weighing
+// at least Phase2 intersect exactly when Phase1+Phase2 > W. Learners weigh
+// nothing, and a ConfigChange that would break the rule is ignored.
+
+import (
+	"fmt"
+	"log"
+)
+
+// Quorums configures the quorum sizes of the two phases, in votes.
+type Quorums struct {
+	Phase1  int   // Votes needed to Prepare
+	Phase2  int   // Votes needed to Accept
+	Weights []int // Votes of each peer by peer number; missing peers have 1
+}
+
+// WithQuorums sets flexible quorum sizes. Make fails if q.Validate fails for
+// the initial peers.
+func WithQuorums(q Quorums) Option {
+	return func(px *Paxos) {
+		px.flex = &q
+	}
+}
+
+// Validate checks that with npeers peers each phase-1 quorum intersects each
+// phase-2 quorum and that both can be reached.
+func (q Quorums) Validate(npeers int) error {
+	total := 0
+	for i := 0; i < npeers; i++ {
+		if q.weight(i) < 0 {
+			return fmt.Errorf("peer %v has negative weight %v", i, q.weight(i))
+		}
+		total += q.weight(i)
+	}
+	return q.check(total)
+}
+
+// check validates the quorum sizes against a total weight.
+func (q Quorums) check(total int) error {
+	if q.Phase1 < 1 || q.Phase2 < 1 {
+		return fmt.Errorf("quorums %v/%v must be positive", q.Phase1, q.Phase2)
+	}
+	if q.Phase1 > total || q.Phase2 > total {
+		return fmt.Errorf("quorums %v/%v exceed total weight %v", q.Phase1, q.Phase2, total)
+	}
+	if q.Phase1+q.Phase2 <= total {
+		return fmt.Errorf("quorums %v/%v do not intersect with total weight %v", q.Phase1, q.Phase2, total)
+	}
+	return nil
+}
+
+// weight returns the configured votes of peer.
+func (q Quorums) weight(peer int) int {
+	if peer < len(q.Weights) {
+		return q.Weights[peer]
+	}
+	return 1
+}
+
+// weight returns the votes the peer numbered peer, at addr, holds.
+func (px *Paxos) weight(peer int, addr string) int {
+	if !px.votes(peer, addr) {
+		return 0
+	}
+	if px.flex == nil {
+		return 1
+	}
+	return px.flex.weight(peer)
+}
+
+// quorums returns the votes needed among peers for phase 1 and phase 2, or
+// 0 and 0 if the peers cannot form valid quorums.
+func (px *Paxos) quorums(peers []string) (int, int) {
+	total := 0
+	for peer, addr := range peers {
+		total += px.weight(peer, addr)
+	}
+	if px.flex == nil {
+		if total == 0 {
+			return 0, 0
+		}
+		return total/2 + 1, total/2 + 1
+	}
+	if px.flex.check(total) != nil {
+		return 0, 0
+	}
+	return px.flex.Phase1, px.flex.Phase2
+}
+
+// checkQuorums fails if the initial peers cannot form valid quorums.
+func (px *Paxos) checkQuorums() {
+	if px.flex == nil {
+		return
+	}
+	if err := px.flex.Validate(len(px.peers)); err != nil {
+		log.Fatalf("paxos: %v", err)
+	}
+	total := 0
+	for peer, addr := range px.peers {
+		total += px.weight(peer, addr)
+	}
+	if err := px.flex.check(total); err != nil {
+		log.Fatalf("paxos: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package paxos
+
+// Read index.
+//
+// An application can serve a read from its own state, without agreeing on
+// an instance, once it has applied every instance that was decided before
+// the read began. ReadIndex finds an instance that covers them all: it asks
+// a phase-1 quorum of voters for the highest instance each has accepted a
+// value for. A decided instance was accepted by a phase-2 quorum, which
+// shares a peer with every phase-1 quorum, so the highest answer is at least
+// as high as any instance decided before the call. The application applies
+// every instance through the returned one, filling any gaps with no-ops as
+// it would for a write, and then reads.
+//
+// A peer answers with the highest instance it holds an accepted value for,
+// raised to cover instances it has forgotten (all of which every peer has
+// applied) and its fence. A peer that is still recovering does not know what
+// it accepted before losing its state, so it does not answer.
+
+import (
+	"context"
+	"time"
+)
+
+// ReadIndexInterval is how long ReadIndex waits before asking again when
+// too few peers answered.
+const ReadIndexInterval = 100 * time.Millisecond
+
+// LastAcceptedArgs asks a peer for the highest instance it has accepted.
+type LastAcceptedArgs struct {
+}
+
+// LastAcceptedReply contains the response to a LastAccepted request.
+type LastAcceptedReply struct {
+	Seq    int  // Highest instance accepted, forgotten or fenced, or -1
+	Reject bool // Whether the peer is recovering and cannot tell
+}
+
+// ReadIndex returns an instance at or above every instance decided before
+// the call, by asking a phase-1 quorum of voters. It keeps asking until
+// enough voters answer, and returns ctx.Err() if ctx is done first or
+// ErrKilled if the peer is killed.
+func (px *Paxos) ReadIndex(ctx context.Context) (int, error) {
+	for !px.dead {
+		px.mu.Lock()
+		peers := px.latestConfig()
+		q1, _ := px.quorums(peers)
+		px.mu.Unlock()
+
+		index := -1
+		votes := 0
+		for peer, addr := range peers {
+			if !px.votes(peer, addr) {
+				continue
+			}
+			var reply LastAcceptedReply
+			if !px.send(peer, "Paxos.LastAccepted", LastAcceptedArgs{}, &reply) || reply.Reject {
+				continue
+			}
+			votes += px.weight(peer, addr)
+			if reply.Seq > index {
+				index = reply.Seq
+			}
+		}
+		if q1 > 0 && votes >= q1 {
+			return index, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return -1, ctx.Err()
+		default:
+		}
+		px.clock.Sleep(ReadIndexInterval)
+	}
+	return -1, ErrKilled
+}
+
+// LastAccepted handles a request for the highest instance this peer has
+// accepted a value for.
+func (px *Paxos) LastAccepted(args LastAcceptedArgs, reply *LastAcceptedReply) error {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	if px.recovering() {
+		reply.Reject = true
+		return nil
+	}
+	reply.Seq = px.minLocked() - 1
+	if px.fence > reply.Seq {
+		reply.Seq = px.fence
+	}
+	for seq, pi := range px.instances {
+		if seq > reply.Seq && pi.N_a != NoBallot {
+			reply.Seq = seq
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package paxos
+
+// Recovery from a lost log.
+//
+// An acceptor's promises and acceptances are what make Paxos safe, so a peer
+// whose log is missing or damaged (see format.go) must not simply carry on
+// with whatever it could read. It may have accepted a value that was chosen
+// with its vote, and answering a later Prepare as if it had not could let a
+// different value be chosen; and it may have promised a ballot to a proposer
+// that has yet to send its Accepts.
+//
+// Such a peer starts out recovering: it votes on nothing and proposes
+// nothing, but still learns decided values. It asks every other peer for the
+// highest instance it holds any record of and the highest ballot it has seen.
+// Once all have answered, the highest instance is its fence and the highest
+// ballot its floor. It never votes on an instance at or below the fence,
+// which covers every instance it might have voted on before, and never
+// promises a ballot below the floor, which covers every ballot a proposer
+// might have claimed before. Every peer must answer because any of them may
+// hold such a ballot; until they do, the recovering peer counts as down. The
+// fence and floor are logged so a crash during recovery starts it over.
+//
+// This is only live while a majority keeps its state. An instance at or
+// below the fence that was undecided when its voters lost their state can
+// collect votes only from peers that kept theirs, since the lost votes may
+// have chosen a value that nobody remembers. If those peers are fewer than a
+// quorum, the instance is never decided and the group stalls; an application
+// waiting on it should give up after a while rather than block forever.
+//
+// The application recovers its own state the usual way, with CatchUp and,
+// for instances the other peers have forgotten, its Snapshotter.
+
+import (
+	"math"
+	"time"
+)
+
+// RecoverInterval is how long a recovering peer waits before asking the
+// peers that have not answered again.
+const RecoverInterval = 100 * time.Millisecond
+
+// unknownFence is the fence of a peer that has not yet recovered.
+const unknownFence = math.MaxInt64
+
+// RecoverArgs asks a peer what a recovering peer must stay clear of.
+type RecoverArgs struct {
+	Peer int // The recovering peer
+}
+
+// RecoverReply contains the response to a recovery request.
+type RecoverReply struct {
+	Max    int    // Highest instance the peer holds any record of
+	Ballot Ballot // Highest ballot the peer has seen or proposed under
+}
+
+// recovering reports whether this peer lost its state and has not yet
+// recovered. Caller must hold px.mu.
+func (px *Paxos) recovering() bool {
+	return px.fence == unknownFence
+}
+
+// fenced reports whether this peer must not vote on instance seq. Caller
+// must hold px.mu.
+func (px *Paxos) fenced(seq int) bool {
+	return seq <= px.fence
+}
+
+// awaitRecovery blocks until this peer may propose, and reports whether it
+// may; it may not once killed.
+func (px *Paxos) awaitRecovery() bool {
+	for !px.dead {
+		px.mu.Lock()
+		recovering := px.recovering()
+		px.mu.Unlock()
+		if !recovering {
+			return true
+		}
+		px.clock.Sleep(RecoverInterval)
+	}
+	return false
+}
+
+// rejoin asks the other peers for the fence and floor until all of them
+// have answered, then starts voting again.
+func (px *Paxos) rejoin() {
+	fence := -1
+	floor := NoBallot
+	answered := map[int]bool{}
+	for !px.dead {
+		px.mu.Lock()
+		peers := px.latestConfig()
+		px.mu.Unlock()
+
+		all := true
+		for peer, addr := range peers {
+			if peer == px.me || addr == "" || answered[peer] {
+				continue
+			}
+			var reply RecoverReply
+			if !px.send(peer, "Paxos.Recover", RecoverArgs{Peer: px.me}, &reply) {
+				all = false
+				continue
+			}
+			answered[peer] = true
+			if reply.Max > fence {
+				fence = reply.Max
+			}
+			floor = maxBallot(floor, reply.Ballot)
+		}
+
+		if all {
+			px.mu.Lock()
+			if px.saveToDisk {
+				px.wal.appendFence(fence, floor)
+			}
+			px.fence = fence
+			px.floor = floor
+			px.observeBallot(floor)
+			px.mu.Unlock()
+			DPrintf("paxos %v recovered: fence %v floor %v", px.me, fence, floor)
+			return
+		}
+		px.clock.Sleep(RecoverInterval)
+	}
+}
+
+// Recover handles a recovering peer's request for the highest instance and
+// ballot this peer knows of. A peer that is recovering itself answers with
+// what it has, which covers whatever it voted on since losing its state.
+func (px *Paxos) Recover(args RecoverArgs, reply *RecoverReply) error {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	reply.Max = px.nseq
+	if px.fence > reply.Max && !px.recovering() {
+		reply.Max = px.fence
+	}
+	n := maxBallot(px.ballot, maxBallot(px.promised, px.floor))
+	for _, pi := range px.instances {
+		n = maxBallot(n, maxBallot(pi.N_p, maxBallot(pi.N_a, pi.N_o)))
+	}
+	reply.Ballot = n
+	return nil
+}
@@ -0,0 +1,117 @@
+package paxos
+
+// Snapshot transfer.
+//
+// Once every peer has called Done(), the instances below Min() are forgotten
+// and a peer that still needs them (one that lost its state, say) cannot get
+// them through CatchUp. An application that registers a Snapshotter lets
+// CatchUp fill such a gap instead: it fetches the application state from a
+// peer that has applied the forgotten instances and installs it locally.
+//
+// Acceptors refuse to prepare or accept an instance below their Min() and
+// report Min() in every reply. A peer that lost its state therefore cannot
+// get a forgotten instance decided afresh; Wait returns ErrForgotten instead,
+// telling the application to CatchUp.
+//
+// An application typically holds its own lock across CatchUp, and Snapshot
+// takes the same lock. Two peers that each fetch a snapshot from the other
+// would then wait for each other forever, so a peer does not serve snapshots
+// while it is fetching one; the requester tries another peer.
+
+// Snapshotter captures and installs application state on behalf of Paxos.
+type Snapshotter interface {
+	// Snapshot returns the application state after applying every
+	// instance up to and including seq. It is called from an RPC handler.
+	Snapshot() (seq int, data []byte)
+	// Restore replaces the application state with a snapshot taken at seq.
+	// It is called from the goroutine that called CatchUp.
+	Restore(seq int, data []byte)
+}
+
+// SnapshotArgs asks a peer for its application's latest snapshot.
+type SnapshotArgs struct {
+}
+
+// SnapshotReply carries an application snapshot.
+type SnapshotReply struct {
+	OK      bool       // Whether the peer has a Snapshotter and is not fetching a snapshot itself
+	Seq     int        // Last instance reflected in Data
+	Data    []byte     // Application state
+	Members membership // The peer's configuration history
+}
+
+// SetSnapshotter registers the application's snapshot provider and installer.
+func (px *Paxos) SetSnapshotter(s Snapshotter) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	px.snapshotter = s
+}
+
+// installSnapshot fetches a snapshot from peer and, if it covers every
+// instance below min, installs it. It returns the snapshot's seq and whether
+// one was installed.
+func (px *Paxos) installSnapshot(peer int, min int) (int, bool) {
+	px.mu.Lock()
+	s := px.snapshotter
+	if s == nil {
+		px.mu.Unlock()
+		return 0, false
+	}
+	px.installing++
+	px.mu.Unlock()
+
+	var reply SnapshotReply
+	ok := px.send(peer, "Paxos.FetchSnapshot", SnapshotArgs{}, &reply)
+	px.mu.Lock()
+	px.installing--
+	px.mu.Unlock()
+	if !ok || !reply.OK || reply.Seq < min-1 {
+		return 0, false
+	}
+	s.Restore(reply.Seq, reply.Data)
+
+	// The snapshot replaces every instance it covers, including any
+	// configuration changes among them
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if reply.Members.Base > px.members.Base {
+		changes := px.members.Changes
+		px.members = reply.Members
+		for _, c := range changes {
+			px.recordChange(c.Seq, ConfigChange{Peers: c.Peers})
+		}
+		px.addPeers(px.latestConfig())
+		if px.saveToDisk {
+			px.wal.appendMembership(px.members)
+		}
+	}
+	if reply.Seq > px.settled {
+		px.settled = reply.Seq
+	}
+	if reply.Seq > px.done[px.me] {
+		px.done[px.me] = reply.Seq
+		px.notifyLocked()
+	}
+	return reply.Seq, true
+}
+
+// FetchSnapshot handles a lagging peer's request for a snapshot.
+func (px *Paxos) FetchSnapshot(args SnapshotArgs, reply *SnapshotReply) error {
+	px.mu.Lock()
+	s := px.snapshotter
+	installing := px.installing > 0
+	px.mu.Unlock()
+	if s == nil || installing {
+		reply.OK = false
+		return nil
+	}
+
+	// Not under px.mu: the application takes its own locks
+	reply.Seq, reply.Data = s.Snapshot()
+	reply.OK = true
+
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	reply.Members = px.members
+	return nil
+}
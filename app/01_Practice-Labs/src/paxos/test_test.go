@@ -4,13 +4,19 @@
 package paxos
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math/rand"
+	"net"
 	"os"
 	"runtime"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
+
+	"distributed-systems/app/01_Practice-Labs/src/sim"
 )
 
 // port generates a unique Unix socket path for testing.
@@ -453,8 +459,9 @@ func TestRPCCount(t *testing.T) {
 	for i := 0; i < npaxos; i++ {
 		pxh[i] = port("count", i)
 	}
+	// the counts are for full rounds; TestLeader counts leader mode's
 	for i := 0; i < npaxos; i++ {
-		pxa[i] = Make(pxh, i, nil, false, "", false)
+		pxa[i] = Make(pxh, i, nil, false, "", false, WithoutLeaderMode())
 	}
 
 	ninst1 := 5
@@ -894,3 +901,1434 @@ func TestLots(t *testing.T) {
 
 	fmt.Printf("  ... Passed\n")
 }
+
+// leaderOf returns the index of the peer that currently leads, or -1.
+func leaderOf(pxa []*Paxos) int {
+	for i := 0; i < len(pxa); i++ {
+		if pxa[i] != nil && !pxa[i].dead {
+			pxa[i].mu.Lock()
+			leading := pxa[i].leading
+			pxa[i].mu.Unlock()
+			if leading {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func TestLeader(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const npaxos = 3
+	var pxa []*Paxos = make([]*Paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("leader", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nil, false, "", false)
+	}
+
+	fmt.Printf("Test: Leader mode, single proposer ...\n")
+
+	seq := 0
+	for ; seq < 5; seq++ {
+		pxa[0].Start(seq, seq*10)
+		waitn(t, pxa, seq, npaxos)
+	}
+	if leaderOf(pxa) != 0 {
+		t.Fatalf("expected peer 0 to lead, got %v", leaderOf(pxa))
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Leader mode, followers forward to leader ...\n")
+
+	for i := 0; i < npaxos; i++ {
+		pxa[i].Start(seq, 100+i)
+	}
+	waitn(t, pxa, seq, npaxos)
+	seq++
+	pxa[2].Start(seq, "from follower")
+	waitn(t, pxa, seq, npaxos)
+	seq++
+	if leaderOf(pxa) != 0 {
+		t.Fatalf("leadership moved without a failure")
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Leader mode skips Prepare ...\n")
+
+	total0 := 0
+	for j := 0; j < npaxos; j++ {
+		total0 += pxa[j].rpcCount
+	}
+	t0 := time.Now()
+	const ninst = 10
+	for i := 0; i < ninst; i++ {
+		pxa[0].Start(seq, "x")
+		waitn(t, pxa, seq, npaxos)
+		seq++
+	}
+	elapsed := time.Since(t0)
+
+	total1 := 0
+	for j := 0; j < npaxos; j++ {
+		total1 += pxa[j].rpcCount
+	}
+
+	// per agreement: 2 remote accepts, 2 remote decides,
+	// plus heartbeats sent while we were waiting.
+	heartbeats := (int(elapsed/HeartbeatInterval) + 2) * (npaxos - 1)
+	expected := ninst*(npaxos-1)*2 + heartbeats
+	if total1-total0 > expected {
+		t.Fatalf("too many RPCs in leader mode; got %v, expected at most %v",
+			total1-total0, expected)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Leader takeover ...\n")
+
+	old := leaderOf(pxa)
+	pxa[old].Kill()
+	next := (old + 1) % npaxos
+	pxa[next].Start(seq, "after takeover")
+	waitn(t, pxa, seq, npaxos-1)
+	if leaderOf(pxa) < 0 {
+		t.Fatalf("no peer took over leadership")
+	}
+	seq++
+	pxa[(old+2)%npaxos].Start(seq, "again")
+	waitn(t, pxa, seq, npaxos-1)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// tcpport picks a free TCP address on the loopback interface.
+func tcpport(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestTransport(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const npaxos = 3
+
+	fmt.Printf("Test: TCP transport ...\n")
+
+	tcpa := make([]*Paxos, npaxos)
+	tcph := make([]string, npaxos)
+	defer cleanup(tcpa)
+	for i := 0; i < npaxos; i++ {
+		tcph[i] = tcpport(t)
+	}
+	for i := 0; i < npaxos; i++ {
+		tcpa[i] = Make(tcph, i, nil, false, "", false, WithTransport(TCPTransport{}))
+	}
+	for seq := 0; seq < 5; seq++ {
+		tcpa[seq%npaxos].Start(seq, seq*10)
+		waitn(t, tcpa, seq, npaxos)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: In-memory transport ...\n")
+
+	mn := NewMemNetwork()
+	mema := make([]*Paxos, npaxos)
+	memh := make([]string, npaxos)
+	defer cleanup(mema)
+	for i := 0; i < npaxos; i++ {
+		memh[i] = "mem-" + strconv.Itoa(i)
+	}
+	for i := 0; i < npaxos; i++ {
+		mema[i] = Make(memh, i, nil, false, "", false, WithTransport(mn))
+	}
+	for seq := 0; seq < 5; seq++ {
+		for i := 0; i < npaxos; i++ {
+			mema[i].Start(seq, (seq*10)+i)
+		}
+		waitn(t, mema, seq, npaxos)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: In-memory transport, deaf peer ...\n")
+
+	mn.Remove(memh[0])
+	mema[1].Start(5, "deaf")
+	waitmajority(t, mema, 5)
+	time.Sleep(1 * time.Second)
+	if ndecided(t, mema, 5) != npaxos-1 {
+		t.Fatalf("a deaf peer heard about a decision")
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: In-memory transport, unreliable ...\n")
+
+	for i := 0; i < npaxos; i++ {
+		mema[i].unreliable = true
+	}
+	for seq := 6; seq < 26; seq++ {
+		for i := 1; i < npaxos; i++ {
+			mema[i].Start(seq, (seq*10)+i)
+		}
+	}
+	for seq := 6; seq < 26; seq++ {
+		waitmajority(t, mema, seq)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// pxdir creates an empty state directory for a persistent test peer.
+func pxdir(tag string, host int) string {
+	dir := port(tag, host) + "-dir"
+	os.RemoveAll(dir)
+	os.Mkdir(dir, 0777)
+	return dir
+}
+
+// walsize returns the number of log segments in dir and their total size.
+func walsize(dir string) (int, int64) {
+	files, _ := os.ReadDir(dir)
+	n := 0
+	var bytes int64
+	for _, f := range files {
+		if info, err := f.Info(); err == nil && len(f.Name()) > 4 && f.Name()[:4] == "wal-" {
+			n++
+			bytes += info.Size()
+		}
+	}
+	return n, bytes
+}
+
+func TestPersistence(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const npaxos = 3
+	pxa := make([]*Paxos, npaxos)
+	pxh := make([]string, npaxos)
+	dirs := make([]string, npaxos)
+	defer cleanup(pxa)
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("persist", i)
+		dirs[i] = pxdir("persist", i)
+		defer os.RemoveAll(dirs[i])
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nil, true, dirs[i], false)
+	}
+
+	fmt.Printf("Test: Decisions survive a restart ...\n")
+
+	for seq := 0; seq < 10; seq++ {
+		pxa[seq%npaxos].Start(seq, seq*10)
+		waitn(t, pxa, seq, npaxos)
+	}
+	pxa[0].Kill()
+	pxa[0] = Make(pxh, 0, nil, true, dirs[0], true)
+	for seq := 0; seq < 10; seq++ {
+		decided, v := pxa[0].Status(seq)
+		if !decided || v != seq*10 {
+			t.Fatalf("restarted peer lost seq=%v decided=%v v=%v", seq, decided, v)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Torn log tail is ignored ...\n")
+
+	pxa[1].Kill()
+	files, _ := os.ReadDir(dirs[1])
+	f, err := os.OpenFile(dirs[1]+"/"+files[len(files)-1].Name(), os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatalf("open segment: %v", err)
+	}
+	f.Write([]byte{200, 0, 0, 0, 1, 2, 3, 4, 5, 6})
+	f.Close()
+	pxa[1] = Make(pxh, 1, nil, true, dirs[1], true)
+	for seq := 0; seq < 10; seq++ {
+		if decided, v := pxa[1].Status(seq); !decided || v != seq*10 {
+			t.Fatalf("restarted peer lost seq=%v decided=%v v=%v", seq, decided, v)
+		}
+	}
+	pxa[1].Start(10, 100)
+	waitn(t, pxa, 10, npaxos)
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Log is truncated after Done ...\n")
+
+	saved := walSegmentSize
+	walSegmentSize = 1024
+	defer func() { walSegmentSize = saved }()
+
+	for seq := 11; seq < 60; seq++ {
+		pxa[seq%npaxos].Start(seq, fmt.Sprintf("%0100d", seq))
+		waitn(t, pxa, seq, npaxos)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i].Done(58)
+	}
+	// each peer proposes once more to hear the others' Done values
+	for i := 0; i < npaxos; i++ {
+		pxa[i].Start(60+i, "last")
+		waitn(t, pxa, 60+i, npaxos)
+	}
+	time.Sleep(3 * GCInterval)
+
+	for i := 0; i < npaxos; i++ {
+		if pxa[i].Min() != 59 {
+			t.Fatalf("wrong Min() %v; expected 59", pxa[i].Min())
+		}
+		n, nb := walsize(dirs[i])
+		if n > 2 || nb > 4*walSegmentSize {
+			t.Fatalf("peer %v log not truncated: %v segments, %v bytes", i, n, nb)
+		}
+	}
+	pxa[2].Kill()
+	pxa[2] = Make(pxh, 2, nil, true, dirs[2], true)
+	if decided, _ := pxa[2].Status(30); decided {
+		t.Fatalf("forgotten instance came back after restart")
+	}
+	if decided, v := pxa[2].Status(60); !decided || v != "last" {
+		t.Fatalf("restarted peer lost seq=60 decided=%v v=%v", decided, v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: ReadState sees what a restart would ...\n")
+
+	for i := 0; i < npaxos; i++ {
+		pxa[i].Kill()
+	}
+	for i := 0; i < npaxos; i++ {
+		st, err := ReadState(dirs[i])
+		if err != nil || len(st.Problems) > 0 {
+			t.Fatalf("ReadState(%v): %v %v", dirs[i], err, st.Problems)
+		}
+		if st.Forgotten != 59 || len(st.Segments) == 0 {
+			t.Fatalf("peer %v: forgotten below %v in %v segments; expected 59", i, st.Forgotten, len(st.Segments))
+		}
+		for seq := 60; seq < 63; seq++ {
+			if inst := st.Instances[seq]; !inst.Decided || inst.V_a != "last" {
+				t.Fatalf("peer %v: seq %v is %+v", i, seq, inst)
+			}
+		}
+		if _, ok := st.Instances[30]; ok {
+			t.Fatalf("peer %v: forgotten instance in state", i)
+		}
+		if n, _ := walsize(dirs[i]); n != len(st.Segments) {
+			t.Fatalf("peer %v: read %v of %v segments", i, len(st.Segments), n)
+		}
+	}
+	if _, err := ReadState(dirs[0] + "-missing"); err == nil {
+		t.Fatalf("ReadState of a missing directory succeeded")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// recovered waits for a peer that lost its log to learn its fence.
+func recovered(t *testing.T, px *Paxos) int {
+	for iters := 0; iters < 50; iters++ {
+		px.mu.Lock()
+		fence, recovering := px.fence, px.recovering()
+		px.mu.Unlock()
+		if !recovering {
+			return fence
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("peer did not recover")
+	return -1
+}
+
+func TestRecovery(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Damaged files are detected ...\n")
+
+	data := []byte("some application state")
+	if got, err := DecodeFile(EncodeFile(data)); err != nil || string(got) != string(data) {
+		t.Fatalf("DecodeFile(EncodeFile(%q)) = %q, %v", data, got, err)
+	}
+	for i := 0; i < len(EncodeFile(data)); i++ {
+		bad := EncodeFile(data)
+		bad[i] ^= 0x10
+		if _, err := DecodeFile(bad); !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("flipped byte %v not detected: %v", i, err)
+		}
+	}
+	if _, err := DecodeFile(EncodeFile(data)[:10]); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("short file not detected: %v", err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	const npaxos = 3
+	pxa := make([]*Paxos, npaxos)
+	pxh := make([]string, npaxos)
+	dirs := make([]string, npaxos)
+	defer cleanup(pxa)
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("recover", i)
+		dirs[i] = pxdir("recover", i)
+		defer os.RemoveAll(dirs[i])
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nil, true, dirs[i], false)
+	}
+	for seq := 0; seq < 5; seq++ {
+		pxa[seq%npaxos].Start(seq, seq*10)
+		waitn(t, pxa, seq, npaxos)
+	}
+
+	fmt.Printf("Test: Peer with a damaged log does not vote ...\n")
+
+	pxa[1].Kill()
+	pxa[2].Kill()
+	files, _ := os.ReadDir(dirs[2])
+	name := dirs[2] + "/" + files[0].Name()
+	content, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("read segment: %v", err)
+	}
+	content[0] ^= 1
+	os.WriteFile(name, content, 0666)
+	pxa[2] = Make(pxh, 2, nil, true, dirs[2], true)
+
+	// peer 1 is still down, so peer 2 cannot learn its fence
+	time.Sleep(3 * RecoverInterval)
+	var preply PrepareReply
+	pxa[2].Prepare(PrepareArgs{Seq: 100, N: Ballot{Round: 1000}}, &preply)
+	if !preply.Reject {
+		t.Fatalf("recovering peer promised a ballot")
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Peer with a damaged log recovers from peers ...\n")
+
+	pxa[1] = Make(pxh, 1, nil, true, dirs[1], true)
+	fence := recovered(t, pxa[2])
+	if fence < 4 {
+		t.Fatalf("fence %v below the last decided instance", fence)
+	}
+	pxa[2].Prepare(PrepareArgs{Seq: 3, N: Ballot{Round: 1000}}, &preply)
+	if !preply.Reject {
+		t.Fatalf("recovered peer promised a ballot at or below its fence")
+	}
+	preply = PrepareReply{}
+	pxa[2].Prepare(PrepareArgs{Seq: fence + 1, N: Ballot{Round: 1000}}, &preply)
+	if preply.Reject {
+		t.Fatalf("recovered peer refused a ballot above its fence")
+	}
+
+	if err := pxa[2].CatchUp(0, 4); err != nil {
+		t.Fatalf("CatchUp: %v", err)
+	}
+	for seq := 0; seq < 5; seq++ {
+		if decided, v := pxa[2].Status(seq); !decided || v != seq*10 {
+			t.Fatalf("recovered peer has seq=%v decided=%v v=%v", seq, decided, v)
+		}
+	}
+
+	// the recovered peer now counts towards a majority
+	pxa[0].Kill()
+	pxa[2].Start(fence+2, "new")
+	waitn(t, pxa[1:], fence+2, 2)
+
+	// and a restart keeps the fence
+	pxa[2].Kill()
+	pxa[2] = Make(pxh, 2, nil, true, dirs[2], true)
+	if got := recovered(t, pxa[2]); got != fence {
+		t.Fatalf("fence %v after restart; expected %v", got, fence)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestBallot(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Ballots are totally ordered and unique ...\n")
+
+	seen := map[Ballot]bool{}
+	b := NoBallot
+	for i := 0; i < 20; i++ {
+		id := (i * 7) % 5
+		next := b.Next(id)
+		if !b.Less(next) || next.ID != id || seen[next] {
+			t.Fatalf("%v.Next(%v) = %v", b, id, next)
+		}
+		if next.Less(b) || next.Less(next) {
+			t.Fatalf("ballots %v and %v misordered", b, next)
+		}
+		seen[next] = true
+		b = next
+	}
+	if (Ballot{Round: 3, ID: 4}).Next(2) != (Ballot{Round: 4, ID: 2}) {
+		t.Fatalf("Next does not move to a higher round")
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Ballots are not reused after a restart ...\n")
+
+	const npaxos = 3
+	pxa := make([]*Paxos, npaxos)
+	pxh := make([]string, npaxos)
+	dirs := make([]string, npaxos)
+	defer cleanup(pxa)
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("ballot", i)
+		dirs[i] = pxdir("ballot", i)
+		defer os.RemoveAll(dirs[i])
+	}
+	// Full rounds, so that each retry by peer 0 claims a new ballot
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nil, true, dirs[i], false, WithoutLeaderMode())
+	}
+
+	// peer 0 keeps raising its ballot while it cannot reach a majority
+	pxa[1].Kill()
+	pxa[2].Kill()
+	pxa[0].Start(0, "x")
+	time.Sleep(time.Second)
+	pxa[0].Kill()
+	pxa[0].mu.Lock()
+	used := pxa[0].instances[0].N_o
+	pxa[0].mu.Unlock()
+	if used.ID != 0 || used.Round < 1 {
+		t.Fatalf("peer 0 proposed under %v; expected several rounds", used)
+	}
+
+	pxa[0] = Make(pxh, 0, nil, true, dirs[0], true, WithoutLeaderMode())
+	pxa[0].mu.Lock()
+	restored := pxa[0].instances[0].N_o
+	pxa[0].mu.Unlock()
+	if restored != used {
+		t.Fatalf("restarted peer remembers ballot %v; expected %v", restored, used)
+	}
+	if n := pxa[0].claimBallot(0, NoBallot); !used.Less(n) {
+		t.Fatalf("restarted peer reused ballot %v after %v", n, used)
+	}
+
+	for i := 1; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nil, true, dirs[i], true, WithoutLeaderMode())
+	}
+	pxa[0].Start(0, "x")
+	pxa[1].Start(0, "y")
+	waitn(t, pxa, 0, npaxos)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestWait(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const npaxos = 3
+	pxa := make([]*Paxos, npaxos)
+	pxh := make([]string, npaxos)
+	defer cleanup(pxa)
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("wait", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nil, false, "", false)
+	}
+
+	fmt.Printf("Test: Wait returns decided value ...\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	if _, err := pxa[1].Wait(ctx, 0); err != context.DeadlineExceeded {
+		t.Fatalf("Wait on undecided instance returned %v", err)
+	}
+	cancel()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		pxa[0].Start(0, "hello")
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < npaxos; i++ {
+		v, err := pxa[i].Wait(ctx, 0)
+		if err != nil || v != "hello" {
+			t.Fatalf("Wait returned %v, %v; expected hello", v, err)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Decisions are delivered in order ...\n")
+
+	const ninst = 20
+	ch := pxa[2].Decisions(ctx, 0)
+	for seq := ninst - 1; seq > 0; seq-- {
+		pxa[seq%npaxos].Start(seq, seq*10)
+	}
+	if d := <-ch; d.Seq != 0 || d.Value != "hello" {
+		t.Fatalf("first decision %v; expected 0 hello", d)
+	}
+	for seq := 1; seq < ninst; seq++ {
+		d := <-ch
+		if d.Seq != seq || d.Value != seq*10 {
+			t.Fatalf("decision %v; expected seq=%v value=%v", d, seq, seq*10)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Wait on forgotten instance ...\n")
+
+	for i := 0; i < npaxos; i++ {
+		pxa[i].Done(ninst - 1)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i].Start(ninst+i, "x")
+		waitn(t, pxa, ninst+i, npaxos)
+	}
+	time.Sleep(2 * GCInterval)
+	if _, err := pxa[0].Wait(ctx, 5); err != ErrForgotten {
+		t.Fatalf("Wait on forgotten instance returned %v", err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Kill wakes Wait ...\n")
+
+	done := make(chan error)
+	go func() {
+		_, err := pxa[2].Wait(context.Background(), 100)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	pxa[2].Kill()
+	select {
+	case err := <-done:
+		if err != ErrKilled {
+			t.Fatalf("Wait on killed peer returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Wait did not return after Kill")
+	}
+	if _, err := pxa[2].Wait(context.Background(), 101); err != ErrKilled {
+		t.Fatalf("Wait after Kill returned %v", err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestReadIndex(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const npaxos = 3
+	pxa := make([]*Paxos, npaxos)
+	pxh := make([]string, npaxos)
+	defer cleanup(pxa)
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("readindex", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nil, false, "", false)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	readIndex := func(px *Paxos) int {
+		index, err := px.ReadIndex(ctx)
+		if err != nil {
+			t.Fatalf("ReadIndex failed: %v", err)
+		}
+		return index
+	}
+
+	fmt.Printf("Test: ReadIndex covers decided instances ...\n")
+
+	if index := readIndex(pxa[0]); index != -1 {
+		t.Fatalf("ReadIndex with nothing decided returned %v", index)
+	}
+	for seq := 0; seq < 5; seq++ {
+		pxa[seq%npaxos].Start(seq, seq*10)
+		waitn(t, pxa, seq, npaxos)
+	}
+	for i := 0; i < npaxos; i++ {
+		if index := readIndex(pxa[i]); index != 4 {
+			t.Fatalf("ReadIndex on peer %v returned %v; expected 4", i, index)
+		}
+	}
+
+	// an instance a majority accepted may have been decided without peer 0
+	// hearing of it
+	for i := 1; i < npaxos; i++ {
+		var reply AcceptReply
+		pxa[i].Accept(AcceptArgs{Seq: 8, N: Ballot{Round: 1000, ID: 1}, V: "x"}, &reply)
+	}
+	if index := readIndex(pxa[0]); index != 8 {
+		t.Fatalf("ReadIndex returned %v; expected accepted instance 8", index)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: ReadIndex covers forgotten instances ...\n")
+
+	pxa[0].Start(8, "x")
+	waitn(t, pxa, 8, npaxos)
+	for i := 0; i < npaxos; i++ {
+		pxa[i].Done(8)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i].Start(9+i, "y")
+		waitn(t, pxa, 9+i, npaxos)
+	}
+	time.Sleep(2 * GCInterval)
+	if index := readIndex(pxa[1]); index != 11 {
+		t.Fatalf("ReadIndex returned %v; expected 11", index)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: ReadIndex needs a quorum ...\n")
+
+	pxa[2].Kill()
+	if index := readIndex(pxa[0]); index != 11 {
+		t.Fatalf("ReadIndex with one peer down returned %v; expected 11", index)
+	}
+	pxa[1].Kill()
+	short, cancelShort := context.WithTimeout(context.Background(), 3*ReadIndexInterval)
+	defer cancelShort()
+	if _, err := pxa[0].ReadIndex(short); err != context.DeadlineExceeded {
+		t.Fatalf("ReadIndex without a quorum returned %v", err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestCatchUp(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const npaxos = 3
+	pxa := make([]*Paxos, npaxos)
+	pxh := make([]string, npaxos)
+	defer cleanup(pxa)
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("catchup", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nil, false, "", false)
+	}
+
+	fmt.Printf("Test: Deaf peer catches up in one batch ...\n")
+
+	const ninst = 50
+	os.Remove(pxh[2])
+	for seq := 0; seq < ninst; seq++ {
+		pxa[seq%2].Start(seq, seq*10)
+	}
+	for seq := 0; seq < ninst; seq++ {
+		waitn(t, pxa, seq, npaxos-1)
+	}
+	if ndecided(t, pxa, 0) != npaxos-1 {
+		t.Fatalf("a deaf peer heard about a decision")
+	}
+
+	rpcs := pxa[0].rpcCount + pxa[1].rpcCount
+	if err := pxa[2].CatchUp(0, ninst-1); err != nil {
+		t.Fatalf("CatchUp: %v", err)
+	}
+	for seq := 0; seq < ninst; seq++ {
+		if decided, v := pxa[2].Status(seq); !decided || v != seq*10 {
+			t.Fatalf("seq=%v not caught up: decided=%v v=%v", seq, decided, v)
+		}
+	}
+	if n := pxa[0].rpcCount + pxa[1].rpcCount - rpcs; n > 1 {
+		t.Fatalf("catching up took %v RPCs; expected 1", n)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Forgotten range needs a snapshot ...\n")
+
+	for i := 0; i < npaxos; i++ {
+		pxa[i].Done(ninst - 1)
+	}
+	for i := 0; i < npaxos-1; i++ {
+		pxa[i].Start(ninst+i, "x")
+		waitn(t, pxa, ninst+i, npaxos-1)
+	}
+	// fetching an undecided instance asks every peer, which tells
+	// them about peer 2's Done
+	pxa[2].CatchUp(ninst+10, ninst+10)
+	pxa[0].Start(ninst+2, "y")
+	waitn(t, pxa, ninst+2, npaxos-1)
+	time.Sleep(2 * GCInterval)
+
+	pxa[2].Kill()
+	pxa[2] = Make(pxh, 2, nil, false, "", false)
+	os.Remove(pxh[2])
+	if err := pxa[2].CatchUp(0, ninst+2); err != ErrSnapshotNeeded {
+		t.Fatalf("CatchUp over forgotten range returned %v", err)
+	}
+	for seq := ninst; seq < ninst+3; seq++ {
+		if decided, _ := pxa[2].Status(seq); !decided {
+			t.Fatalf("seq=%v above Min() not caught up", seq)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// snapApp is a minimal Paxos application for TestSnapshot: it sums the
+// values of the instances it applies.
+type snapApp struct {
+	seq int
+	sum int
+}
+
+func (a *snapApp) apply(px *Paxos, through int) {
+	for ; a.seq < through; a.seq++ {
+		_, v := px.Status(a.seq + 1)
+		a.sum += v.(int)
+	}
+	px.Done(a.seq)
+}
+
+func (a *snapApp) Snapshot() (int, []byte) {
+	return a.seq, []byte(strconv.Itoa(a.sum))
+}
+
+func (a *snapApp) Restore(seq int, data []byte) {
+	a.seq = seq
+	a.sum, _ = strconv.Atoi(string(data))
+}
+
+// lockedApp is a snapApp whose Snapshot waits for mu, as an application's
+// does while it holds its own lock across CatchUp.
+type lockedApp struct {
+	*snapApp
+	mu sync.Mutex
+}
+
+func (a *lockedApp) Snapshot() (int, []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.snapApp.Snapshot()
+}
+
+func TestSnapshot(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const npaxos = 3
+	pxa := make([]*Paxos, npaxos)
+	pxh := make([]string, npaxos)
+	apps := make([]*snapApp, npaxos)
+	defer cleanup(pxa)
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("snapshot", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nil, false, "", false)
+		apps[i] = &snapApp{seq: -1}
+		pxa[i].SetSnapshotter(apps[i])
+	}
+
+	fmt.Printf("Test: Fresh peer installs a snapshot ...\n")
+
+	const ninst = 20
+	sum := 0
+	for seq := 0; seq < ninst; seq++ {
+		pxa[seq%npaxos].Start(seq, seq)
+		sum += seq
+	}
+	for seq := 0; seq < ninst; seq++ {
+		waitn(t, pxa, seq, npaxos)
+	}
+	for i := 0; i < npaxos; i++ {
+		apps[i].apply(pxa[i], ninst-1)
+	}
+	// spread everyone's Done, then let the GC forget
+	for seq := ninst; seq < ninst+3; seq++ {
+		pxa[0].Start(seq, seq)
+		waitn(t, pxa, seq, npaxos)
+	}
+	time.Sleep(2 * GCInterval)
+	if pxa[0].Min() != ninst {
+		t.Fatalf("wrong Min() %v; expected %v", pxa[0].Min(), ninst)
+	}
+
+	pxa[2].Kill()
+	pxa[2] = Make(pxh, 2, nil, false, "", false)
+	apps[2] = &snapApp{seq: -1}
+	pxa[2].SetSnapshotter(apps[2])
+
+	// the others must not agree to decide a forgotten instance again
+	pxa[2].Start(0, 100)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := pxa[2].Wait(ctx, 0); err != ErrForgotten {
+		t.Fatalf("Wait on instance forgotten by the others returned %v", err)
+	}
+
+	// a follower forwarding instance 0 to peer 2 must learn that it is
+	// gone, though peer 2's own Min() is still 0
+	if pxa[2].Min() >= ninst {
+		t.Fatalf("restarted peer has Min() %v before installing a snapshot", pxa[2].Min())
+	}
+	var freply ForwardReply
+	pxa[2].Forward(ForwardArgs{Seq: 0, V: 100}, &freply)
+	if freply.Min < ninst {
+		t.Fatalf("Forward reported Min() %v; expected at least %v", freply.Min, ninst)
+	}
+
+	if err := pxa[2].CatchUp(0, ninst+2); err != nil {
+		t.Fatalf("CatchUp: %v", err)
+	}
+	if apps[2].seq != ninst-1 || apps[2].sum != sum {
+		t.Fatalf("restored seq=%v sum=%v; expected seq=%v sum=%v", apps[2].seq, apps[2].sum, ninst-1, sum)
+	}
+	for seq := ninst; seq < ninst+3; seq++ {
+		if decided, v := pxa[2].Status(seq); !decided || v != seq {
+			t.Fatalf("seq=%v above the snapshot not caught up: decided=%v v=%v", seq, decided, v)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Peer fetching a snapshot serves none ...\n")
+
+	// peer 0 waits on peer 1's busy application; were peer 1 to ask
+	// peer 0 in turn, neither would ever answer
+	busy := &lockedApp{snapApp: apps[1]}
+	pxa[1].SetSnapshotter(busy)
+	busy.mu.Lock()
+	installed := make(chan bool)
+	go func() {
+		_, ok := pxa[0].installSnapshot(1, 0)
+		installed <- ok
+	}()
+	for iters := 0; ; iters++ {
+		pxa[0].mu.Lock()
+		installing := pxa[0].installing
+		pxa[0].mu.Unlock()
+		if installing > 0 {
+			break
+		}
+		if iters > 50 {
+			t.Fatalf("peer 0 is not fetching a snapshot")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var reply SnapshotReply
+	pxa[0].FetchSnapshot(SnapshotArgs{}, &reply)
+	if reply.OK {
+		t.Fatalf("peer served a snapshot while fetching one")
+	}
+	busy.mu.Unlock()
+	if !<-installed {
+		t.Fatalf("peer 0 did not install peer 1's snapshot")
+	}
+	pxa[0].FetchSnapshot(SnapshotArgs{}, &reply)
+	if !reply.OK {
+		t.Fatalf("peer serves no snapshot after fetching one")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// waitconfig waits for peer px to learn that instance seq is decided,
+// without comparing values the way ndecided does.
+func waitconfig(t *testing.T, px *Paxos, seq int) {
+	for iters := 0; iters < 50; iters++ {
+		if decided, _ := px.Status(seq); decided {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("configuration change at seq=%v not decided", seq)
+}
+
+func TestMembership(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const npaxos = 4
+	pxa := make([]*Paxos, npaxos)
+	pxh := make([]string, npaxos)
+	defer cleanup(pxa)
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("member", i)
+	}
+	for i := 0; i < npaxos-1; i++ {
+		pxa[i] = Make(pxh[:npaxos-1], i, nil, false, "", false, WithReconfiguration())
+	}
+
+	fmt.Printf("Test: Add a peer ...\n")
+
+	seq := 0
+	for ; seq < 5; seq++ {
+		pxa[seq%3].Start(seq, seq*10)
+		waitn(t, pxa, seq, npaxos-1)
+	}
+	add := seq
+	pxa[0].Start(add, ConfigChange{Peers: pxh})
+	waitconfig(t, pxa[0], add)
+	pxa[3] = Make(pxh, 3, nil, false, "", false, WithJoin(add))
+	for seq++; seq < add+Alpha+5; seq++ {
+		pxa[seq%npaxos].Start(seq, seq*10)
+		waitn(t, pxa, seq, npaxos-1)
+	}
+	if n := len(pxa[0].Members(add + Alpha - 1)); n != npaxos-1 {
+		t.Fatalf("change took effect early; %v peers", n)
+	}
+	if n := len(pxa[0].Members(add + Alpha)); n != npaxos {
+		t.Fatalf("change did not take effect; %v peers", n)
+	}
+	if ndecided(t, pxa, add+Alpha) != npaxos {
+		t.Fatalf("new peer did not learn an instance it voted on")
+	}
+
+	// the new peer fetches what it missed
+	if err := pxa[3].CatchUp(0, add+Alpha); err != nil {
+		t.Fatalf("CatchUp: %v", err)
+	}
+	if decided, v := pxa[3].Status(0); !decided || v != 0 {
+		t.Fatalf("new peer did not catch up; decided=%v v=%v", decided, v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Remove peers ...\n")
+
+	remove := seq
+	pxa[3].Start(remove, ConfigChange{Peers: []string{pxh[0], "", "", pxh[3]}})
+	waitconfig(t, pxa[0], remove)
+	for seq++; seq < remove+Alpha; seq++ {
+		pxa[0].Start(seq, seq*10)
+		waitn(t, pxa, seq, npaxos)
+	}
+
+	// two of the original three are gone, but they no longer vote
+	pxa[1].Kill()
+	pxa[2].Kill()
+	pxa[1], pxa[2] = nil, nil
+	for ; seq < remove+Alpha+5; seq++ {
+		pxa[seq%2*3].Start(seq, seq*10)
+		waitn(t, pxa, seq, 2)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestBatcher(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const npaxos = 3
+	pxa := make([]*Paxos, npaxos)
+	pxh := make([]string, npaxos)
+	defer cleanup(pxa)
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("batch", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nil, false, "", false, WithPipeline(4))
+	}
+
+	fmt.Printf("Test: Concurrent values share instances ...\n")
+
+	const nvalues = 60
+	type landed struct{ seq, index int }
+	where := make([]landed, nvalues)
+	var wg sync.WaitGroup
+	for i := 0; i < npaxos; i++ {
+		b := NewBatcher(pxa[i], 0, 16)
+		for v := i; v < nvalues; v += npaxos {
+			wg.Add(1)
+			go func(v int) {
+				defer wg.Done()
+				seq, index, ok := b.Propose(v)
+				if !ok {
+					t.Errorf("Propose(%v) failed", v)
+				}
+				where[v] = landed{seq, index}
+			}(v)
+		}
+	}
+	wg.Wait()
+
+	max := 0
+	for v := 0; v < nvalues; v++ {
+		decided, val := pxa[0].Status(where[v].seq)
+		if !decided {
+			pxa[0].Wait(context.Background(), where[v].seq)
+			decided, val = pxa[0].Status(where[v].seq)
+		}
+		if got := val.(Batch).Values[where[v].index]; got != v {
+			t.Fatalf("value %v landed at seq=%v index=%v, which holds %v", v, where[v].seq, where[v].index, got)
+		}
+		if where[v].seq > max {
+			max = where[v].seq
+		}
+	}
+	if max >= nvalues-1 {
+		t.Fatalf("%v values took %v instances; expected batching", nvalues, max+1)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestLearners(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const nvoters = 3
+	const npaxos = nvoters + 2
+	pxa := make([]*Paxos, npaxos)
+	pxh := make([]string, npaxos)
+	defer cleanup(pxa)
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("learn", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nil, false, "", false, WithLearners(3, 4))
+	}
+
+	fmt.Printf("Test: Learners learn decided values ...\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := pxa[4].Decisions(ctx, 0)
+
+	pxa[0].Start(0, "v0")
+	waitn(t, pxa, 0, npaxos)
+	if !pxa[3].IsLearner() || pxa[0].IsLearner() {
+		t.Fatalf("wrong IsLearner()")
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Learners can propose ...\n")
+
+	pxa[3].Start(1, "v1")
+	waitn(t, pxa, 1, npaxos)
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Learners do not count towards a quorum ...\n")
+
+	pxa[2].Kill()
+	pxa[3].Kill()
+	pxa[4].Kill()
+	for seq := 2; seq < 5; seq++ {
+		pxa[seq%2].Start(seq, seq*100)
+		waitn(t, pxa[:2], seq, 2)
+	}
+	pxa[0].Kill()
+	pxa[1].Start(5, 500)
+	time.Sleep(time.Second)
+	if ndecided(t, pxa, 5) != 0 {
+		t.Fatalf("decided with one voter and no learners")
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Learners serve the ordered stream ...\n")
+
+	want := []interface{}{"v0", "v1"}
+	for i, v := range want {
+		select {
+		case d := <-ch:
+			if d.Seq != i || d.Value != v {
+				t.Fatalf("learner streamed %v; expected seq=%v v=%v", d, i, v)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("learner did not stream seq=%v", i)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestQuorums(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Quorums are validated ...\n")
+
+	bad := []Quorums{
+		{Phase1: 3, Phase2: 2},
+		{Phase1: 6, Phase2: 1},
+		{Phase1: 5, Phase2: 0},
+		{Phase1: 4, Phase2: 2, Weights: []int{1, 1, 1, 1, 2}},
+	}
+	for _, q := range bad {
+		if q.Validate(5) == nil {
+			t.Fatalf("%v accepted for 5 peers", q)
+		}
+	}
+	good := []Quorums{
+		{Phase1: 3, Phase2: 3},
+		{Phase1: 4, Phase2: 2},
+		{Phase1: 5, Phase2: 1},
+		{Phase1: 4, Phase2: 3, Weights: []int{1, 1, 1, 1, 2}},
+	}
+	for _, q := range good {
+		if err := q.Validate(5); err != nil {
+			t.Fatalf("%v rejected for 5 peers: %v", q, err)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Stable leader commits with a small phase-2 quorum ...\n")
+
+	const npaxos = 5
+	pxa := make([]*Paxos, npaxos)
+	pxh := make([]string, npaxos)
+	defer cleanup(pxa)
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("flex", i)
+	}
+	q := Quorums{Phase1: 4, Phase2: 2}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nil, false, "", false, WithQuorums(q))
+	}
+
+	pxa[0].Start(0, "x")
+	waitn(t, pxa, 0, npaxos)
+	if l := leaderOf(pxa); l != 0 {
+		t.Fatalf("expected peer 0 to lead, got %v", l)
+	}
+	for i := 2; i < npaxos; i++ {
+		pxa[i].Kill()
+	}
+	for seq := 1; seq < 5; seq++ {
+		pxa[seq%2].Start(seq, seq)
+		waitn(t, pxa[:2], seq, 2)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: No new leader without a phase-1 quorum ...\n")
+
+	pxa[0].Kill()
+	pxa[1].Start(5, 5)
+	time.Sleep(2 * LeaderTimeout)
+	if ndecided(t, pxa, 5) != 0 {
+		t.Fatalf("decided without a phase-1 quorum")
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Weighted votes ...\n")
+
+	const nweighted = 3
+	pxw := make([]*Paxos, nweighted)
+	pwh := make([]string, nweighted)
+	defer cleanup(pxw)
+	for i := 0; i < nweighted; i++ {
+		pwh[i] = port("weighted", i)
+	}
+	w := Quorums{Phase1: 3, Phase2: 3, Weights: []int{3, 1, 1}}
+	for i := 0; i < nweighted; i++ {
+		pxw[i] = Make(pwh, i, nil, false, "", false, WithQuorums(w))
+	}
+	pxw[1].Start(0, "y")
+	waitn(t, pxw, 0, nweighted)
+
+	// peer 0 holds a quorum by itself; peers 1 and 2 together do not
+	pxw[1].Kill()
+	pxw[2].Kill()
+	pxw[0].Start(1, "z")
+	waitn(t, pxw[:1], 1, 1)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// simwaitn is waitn on the clock of a simulated World.
+func simwaitn(t *testing.T, w *sim.World, pxa []*Paxos, seq int, wanted int) {
+	for iters := 0; iters < 100 && ndecided(t, pxa, seq) < wanted; iters++ {
+		w.Sleep(100 * time.Millisecond)
+	}
+	if nd := ndecided(t, pxa, seq); nd < wanted {
+		t.Fatalf("too few decided; seq=%v ndecided=%v wanted=%v", seq, nd, wanted)
+	}
+}
+
+// simAgree proposes random values from random peers while the network of a
+// simulated World loses messages and partitions at random, checks that
+// every peer agrees in the end, and returns the World's trace.
+func simAgree(t *testing.T, seed int64, opts ...Option) (int, uint64) {
+	const npaxos = 5
+	const ninst = 20
+
+	w := sim.New(seed)
+	defer w.Stop()
+	w.SetLoss(0.05)
+	r := w.Rand()
+
+	pxh := make([]string, npaxos)
+	for i := range pxh {
+		pxh[i] = "px" + strconv.Itoa(i)
+	}
+	pxa := make([]*Paxos, npaxos)
+	defer cleanup(pxa)
+	for i := range pxa {
+		h := w.Host(pxh[i])
+		pxa[i] = Make(pxh, i, nil, false, "", false, append([]Option{WithTransport(h), WithClock(h), WithRand(h)}, opts...)...)
+	}
+
+	for seq := 0; seq < ninst; seq++ {
+		switch r.Intn(4) {
+		case 0:
+			cut := 1 + r.Intn(npaxos-1)
+			perm := r.Perm(npaxos)
+			var p1, p2 []string
+			for i, peer := range perm {
+				if i < cut {
+					p1 = append(p1, pxh[peer])
+				} else {
+					p2 = append(p2, pxh[peer])
+				}
+			}
+			w.Partition(p1, p2)
+		case 1:
+			w.Heal()
+		}
+		for i := 0; i <= r.Intn(3); i++ {
+			pxa[r.Intn(npaxos)].Start(seq, seq*100+i)
+			// Let the proposer claim a ballot before the next one
+			// starts, or their ballots would depend on which ran first
+			w.Sleep(0)
+		}
+		w.Sleep(time.Duration(r.Intn(100)) * time.Millisecond)
+	}
+
+	// Every peer proposes every instance once the network heals, so that
+	// each learns the outcomes whose Decided messages it lost
+	w.Heal()
+	for seq := 0; seq < ninst; seq++ {
+		for i := range pxa {
+			pxa[i].Start(seq, -1)
+			w.Sleep(0)
+		}
+	}
+	for seq := 0; seq < ninst; seq++ {
+		simwaitn(t, w, pxa, seq, npaxos)
+	}
+	return w.Trace()
+}
+
+// simSeeds are the seeds TestSimulation runs unless SIM_SEED names another.
+// 3 and 1792230899926069591 once locked up leader mode.
+var simSeeds = []int64{1, 2, 3, 1792230899926069591}
+
+func TestSimulation(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	for _, seed := range sim.Seeds(simSeeds...) {
+		fmt.Printf("Test: Simulated partitions and lost messages, seed %v ...\n", seed)
+		simReplay(t, seed)
+		fmt.Printf("  ... Passed\n")
+
+		fmt.Printf("Test: Simulated full rounds, seed %v ...\n", seed)
+		simReplay(t, seed, WithoutLeaderMode())
+		fmt.Printf("  ... Passed\n")
+	}
+}
+
+// simReplay runs simAgree twice and checks that both runs are the same.
+func simReplay(t *testing.T, seed int64, opts ...Option) {
+	var steps [2]int
+	var trace [2]uint64
+	for run := range steps {
+		steps[run], trace[run] = simAgree(t, seed, opts...)
+	}
+	if steps[0] != steps[1] || trace[0] != trace[1] {
+		t.Fatalf("seed %v took %v steps (trace %x), then %v steps (trace %x)",
+			seed, steps[0], trace[0], steps[1], trace[1])
+	}
+}
+
+// benchAgree sets up npaxos peers with opts and calls propose from nclients
+// goroutines until b.N values are decided, reporting values per second.
+func benchAgree(b *testing.B, tag string, nclients int, opts []Option, propose func(pxa []*Paxos, next func() int)) {
+	const npaxos = 3
+	pxa := make([]*Paxos, npaxos)
+	pxh := make([]string, npaxos)
+	defer cleanup(pxa)
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port(tag, i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nil, false, "", false, opts...)
+	}
+
+	var mu sync.Mutex
+	n := 0
+	next := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		if n == b.N {
+			return -1
+		}
+		n++
+		return n - 1
+	}
+
+	b.ResetTimer()
+	t0 := time.Now()
+	var wg sync.WaitGroup
+	for c := 0; c < nclients; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			propose(pxa, next)
+		}()
+	}
+	wg.Wait()
+	b.ReportMetric(float64(b.N)/time.Since(t0).Seconds(), "values/s")
+}
+
+// BenchmarkSerial decides one value per instance, one at a time.
+func BenchmarkSerial(b *testing.B) {
+	benchAgree(b, "bserial", 1, nil, func(pxa []*Paxos, next func() int) {
+		for v := next(); v >= 0; v = next() {
+			pxa[0].Start(v, v)
+			pxa[0].Wait(context.Background(), v)
+		}
+	})
+}
+
+// BenchmarkPipelined decides one value per instance, with 16 clients
+// keeping up to 8 instances in flight.
+func BenchmarkPipelined(b *testing.B) {
+	benchAgree(b, "bpipe", 16, []Option{WithPipeline(8)}, func(pxa []*Paxos, next func() int) {
+		for v := next(); v >= 0; v = next() {
+			pxa[0].Start(v, v)
+			pxa[0].Wait(context.Background(), v)
+		}
+	})
+}
+
+// BenchmarkBatched decides values from 16 clients in batches.
+func BenchmarkBatched(b *testing.B) {
+	var batcher *Batcher
+	var once sync.Once
+	benchAgree(b, "bbatch", 16, nil, func(pxa []*Paxos, next func() int) {
+		once.Do(func() { batcher = NewBatcher(pxa[0], 0, 64) })
+		for v := next(); v >= 0; v = next() {
+			batcher.Propose(v)
+		}
+	})
+}
@@ -0,0 +1,237 @@
+package paxos
+
+// Transports carry Paxos RPCs between peers.
+//
+// Make listens and call dials through a Transport, so the same peer code runs
+// over unix-domain sockets (the default), TCP between machines, or an
+// in-memory network inside a single test process. UnreliableTransport wraps
+// any of them to inject the message loss the tests rely on.
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Transport abstracts how peers reach each other.
+type Transport interface {
+	// Listen returns a listener for connections addressed to addr.
+	Listen(addr string) (net.Listener, error)
+	// Dial opens a connection to the peer listening on addr.
+	Dial(addr string) (net.Conn, error)
+}
+
+// WithTransport makes the peer listen and dial through t instead of
+// unix-domain sockets.
+func WithTransport(t Transport) Option {
+	return func(px *Paxos) {
+		px.transport = t
+	}
+}
+
+// UnixTransport connects peers through unix-domain sockets named by their
+// file system paths.
+type UnixTransport struct{}
+
+// Listen creates the socket at addr, replacing any stale socket file.
+func (UnixTransport) Listen(addr string) (net.Listener, error) {
+	os.Remove(addr)
+	return net.Listen("unix", addr)
+}
+
+// Dial connects to the socket at addr.
+func (UnixTransport) Dial(addr string) (net.Conn, error) {
+	return net.Dial("unix", addr)
+}
+
+// TCPTransport connects peers through TCP using host:port addresses.
+type TCPTransport struct {
+	DialTimeout time.Duration // Zero means one second
+}
+
+// Listen listens on the host:port addr.
+func (t TCPTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// Dial connects to the host:port addr.
+func (t TCPTransport) Dial(addr string) (net.Conn, error) {
+	timeout := t.DialTimeout
+	if timeout == 0 {
+		timeout = time.Second
+	}
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+// errNoListener is returned when dialing an in-memory address nobody listens on.
+var errNoListener = errors.New("paxos: no listener at address")
+
+// MemNetwork is an in-memory Transport. Connections are synchronous pipes, so
+// many peers can run inside one process without touching the file system.
+type MemNetwork struct {
+	mu        sync.Mutex
+	listeners map[string]*memListener
+}
+
+// NewMemNetwork creates an empty in-memory network.
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{listeners: make(map[string]*memListener)}
+}
+
+// Listen registers a listener under addr.
+func (mn *MemNetwork) Listen(addr string) (net.Listener, error) {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	if _, ok := mn.listeners[addr]; ok {
+		return nil, &net.OpError{Op: "listen", Net: "mem", Addr: memAddr(addr), Err: syscall.EADDRINUSE}
+	}
+	l := &memListener{
+		network: mn,
+		addr:    addr,
+		conns:   make(chan net.Conn),
+		closed:  make(chan struct{}),
+	}
+	mn.listeners[addr] = l
+	return l, nil
+}
+
+// Dial connects to the listener registered under addr.
+func (mn *MemNetwork) Dial(addr string) (net.Conn, error) {
+	mn.mu.Lock()
+	l, ok := mn.listeners[addr]
+	mn.mu.Unlock()
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: "mem", Addr: memAddr(addr), Err: errNoListener}
+	}
+
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		client.Close()
+		server.Close()
+		return nil, &net.OpError{Op: "dial", Net: "mem", Addr: memAddr(addr), Err: errNoListener}
+	}
+}
+
+// Remove unregisters addr without closing its listener, like deleting a unix
+// socket file: the peer keeps running but can no longer be reached.
+func (mn *MemNetwork) Remove(addr string) {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	delete(mn.listeners, addr)
+}
+
+// memAddr is the net.Addr of an in-memory listener.
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+// memListener hands out the server ends of pipes created by Dial.
+type memListener struct {
+	network *MemNetwork
+	addr    string
+	conns   chan net.Conn
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, &net.OpError{Op: "accept", Net: "mem", Addr: memAddr(l.addr), Err: net.ErrClosed}
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.network.mu.Lock()
+		if l.network.listeners[l.addr] == l {
+			delete(l.network.listeners, l.addr)
+		}
+		l.network.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return memAddr(l.addr)
+}
+
+// UnreliableTransport wraps another Transport and, while Unreliable reports
+// true, discards 10% of incoming requests and the replies of a further 20%
+// of the rest.
+type UnreliableTransport struct {
+	Transport
+	Unreliable func() bool // Whether to inject failures; nil means never
+	Served     func()      // Called for every request that is processed; may be nil
+}
+
+// Listen wraps the underlying listener with failure injection.
+func (ut *UnreliableTransport) Listen(addr string) (net.Listener, error) {
+	l, err := ut.Transport.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &unreliableListener{Listener: l, ut: ut}, nil
+}
+
+// unreliableListener drops or muzzles connections as they are accepted.
+type unreliableListener struct {
+	net.Listener
+	ut *UnreliableTransport
+}
+
+func (l *unreliableListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		unreliable := l.ut.Unreliable != nil && l.ut.Unreliable()
+		if unreliable && (rand.Int63()%1000) < 100 {
+			// Discard the request (simulate network failure)
+			conn.Close()
+			continue
+		}
+		if unreliable && (rand.Int63()%1000) < 200 {
+			// Process the request but force discard of reply
+			if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+				cw.CloseWrite()
+			} else {
+				conn = &replylessConn{Conn: conn}
+			}
+		}
+		if l.ut.Served != nil {
+			l.ut.Served()
+		}
+		return conn, nil
+	}
+}
+
+// replylessConn processes a request but closes the connection instead of
+// writing the reply, for transports without half-close.
+type replylessConn struct {
+	net.Conn
+}
+
+func (c *replylessConn) Write(b []byte) (int, error) {
+	c.Conn.Close()
+	return 0, net.ErrClosed
+}
+
+// quietDialError reports whether a dial error just means the peer is down.
+func quietDialError(err error) bool {
+	return errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, errNoListener)
+}
@@ -0,0 +1,90 @@
+package paxos
+
+// Decision notification.
+//
+// Rather than polling Status(), an application can block in Wait() until an
+// instance is decided, or read decided instances in order from the channel
+// returned by Decisions(). Both are woken through px.changed, a channel that
+// is closed and replaced whenever an instance is decided or Min() advances.
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrForgotten is returned by Wait for an instance below Min(), this peer's
+// or another peer's, that this peer never learned the value of. An
+// application seeing it for an instance it has not applied has fallen behind
+// and should CatchUp() to install a snapshot.
+var ErrForgotten = errors.New("paxos: instance forgotten")
+
+// ErrKilled is returned by Wait and ReadIndex once the peer has been killed,
+// since it will learn of no more decisions.
+var ErrKilled = errors.New("paxos: peer killed")
+
+// Decision is a decided instance delivered by Decisions.
+type Decision struct {
+	Seq   int         // Sequence number of the instance
+	Value interface{} // Decided value
+}
+
+// Wait blocks until this peer knows instance seq is decided and returns the
+// decided value. It returns ErrForgotten if the instance was forgotten
+// without being decided here, ErrKilled if the peer is killed first, or
+// ctx.Err() if ctx is done first.
+func (px *Paxos) Wait(ctx context.Context, seq int) (interface{}, error) {
+	for {
+		px.mu.Lock()
+		if pi, ok := px.instances[seq]; ok && pi.Decided {
+			px.mu.Unlock()
+			return pi.V_a, nil
+		}
+		if px.dead {
+			px.mu.Unlock()
+			return nil, ErrKilled
+		}
+		if seq < px.minLocked() || seq < px.groupMin {
+			px.mu.Unlock()
+			return nil, ErrForgotten
+		}
+		changed := px.changed
+		px.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Decisions returns a channel that delivers every instance from seq from
+// onwards, in order, as this peer learns it has been decided. The channel is
+// closed when ctx is done or when the next instance has been forgotten.
+//
+// An instance nobody proposes is never decided, so the application must
+// still Start() a no-op to fill a gap that holds up the stream.
+func (px *Paxos) Decisions(ctx context.Context, from int) <-chan Decision {
+	ch := make(chan Decision)
+	go func() {
+		defer close(ch)
+		for seq := from; ; seq++ {
+			v, err := px.Wait(ctx, seq)
+			if err != nil {
+				return
+			}
+			select {
+			case ch <- Decision{Seq: seq, Value: v}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// notifyLocked wakes everyone blocked in Wait. Caller must hold px.mu.
+func (px *Paxos) notifyLocked() {
+	close(px.changed)
+	px.changed = make(chan struct{})
+}
@@ -0,0 +1,448 @@
+package paxos
+
+// Write-ahead log for persistent Paxos state.
+//
+// With saveToDisk, every change to an acceptor's state is appended to a log
+// in px.dir and fsynced before the acceptor replies. Each record carries the
+// full new state of one instance, so replaying the log in order and keeping
+// the last record per instance rebuilds the state exactly. Other kinds of
+// record hold the leader-mode promise, the point below which instances have
+// been forgotten, the membership history those instances no longer carry,
+// and the fence of a peer that lost its log (see recover.go).
+//
+// The log is split into segment files named wal-<index>. A segment is sealed
+// once it grows past walSegmentSize and a new one is started with the current
+// promise. The GC loop calls truncate with Min(): it records Min() as the
+// forget point, deletes sealed segments holding only forgotten instances, and
+// once most of the log is stale copies the live instances into a fresh
+// segment so the old ones can go too.
+//
+// Each segment starts with a header naming the format version (see
+// format.go), then holds one gob stream of walRecords, so type information is
+// written once per segment rather than once per record. Every record's part
+// of the stream is framed by a 4-byte little-endian length and its CRC-32C.
+// Recovery stops reading a segment at the first short or corrupt frame. A
+// write torn by a crash shows up as a short frame at the end of the last
+// segment and is expected; anything else means the log was damaged, and the
+// peer's state is treated as lost.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// walSegmentSize is the size past which the active segment is sealed.
+var walSegmentSize int64 = 1 << 20
+
+// walMaxRecord bounds the payload length accepted during recovery, so a
+// corrupt length field is not mistaken for a huge record.
+const walMaxRecord = 64 << 20
+
+const walHeaderSize = 8
+
+var walTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errTorn is returned by replay for a segment that ends part way through a
+// header or record, as one does after a crash during a write.
+var errTorn = errors.New("torn write")
+
+// Kinds of log record.
+const (
+	walInstance   = iota // Instance is the new state of instance Seq
+	walPromise           // Promised is the ballot promised for every instance
+	walForget            // Instances below Seq have been forgotten
+	walMembership        // Members is the configuration history
+	walFence             // Seq is the fence and Promised the ballot floor
+)
+
+// walRecord is one entry of the log.
+type walRecord struct {
+	Kind     int
+	Seq      int
+	Instance PaxosInstance
+	Promised Ballot
+	Members  membership
+}
+
+// walSegment describes one segment file.
+type walSegment struct {
+	index  int   // Position in the log; segments are replayed in index order
+	size   int64 // Bytes written to the segment
+	maxSeq int   // Highest instance recorded in the segment, or -1
+}
+
+// wal is the write-ahead log of one Paxos peer. Callers must hold px.mu.
+type wal struct {
+	dir         string
+	segments    []*walSegment // Oldest first; the last one is active
+	f           *os.File      // Active segment
+	enc         *gob.Encoder  // Encoder for the active segment's gob stream
+	buf         *bytes.Buffer // Output of enc for the record being written
+	promised    Ballot        // Last promise appended
+	forgotten   int           // Last forget point appended
+	members     *membership   // Last membership appended, or nil
+	fence       int           // Last fence appended, or -1
+	floor       Ballot        // Ballot floor appended with the fence
+	promiseSize int64         // Size of the newest promise record
+	forgetSize  int64         // Size of the newest forget record
+	memberSize  int64         // Size of the newest membership record
+	fenceSize   int64         // Size of the newest fence record
+	latest      map[int]int64 // Size of the newest record of each instance
+	total       int64         // Bytes in all segments
+}
+
+// openWAL opens the log in dir. On restart it replays the existing segments
+// and returns the recovered instances and promise, and whether the log was
+// missing or damaged so that some of the state is lost; otherwise it
+// discards them. Either way it starts a fresh active segment.
+func openWAL(dir string, restart bool) (*wal, map[int]PaxosInstance, Ballot, bool) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		log.Fatalf("openWAL could not create %v: %v", dir, err)
+	}
+	w := &wal{dir: dir, promised: NoBallot, fence: -1, floor: NoBallot}
+	instances := map[int]PaxosInstance{}
+
+	old := w.list()
+	lost := false
+	if restart {
+		if len(old) == 0 {
+			fmt.Printf("paxos wal %v: no log, state lost\n", dir)
+			lost = true
+		}
+		for i, index := range old {
+			err := w.replay(index, instances)
+			if err == nil || (errors.Is(err, errTorn) && i == len(old)-1) {
+				DPrintf("wal %v: stopped at %v", w.path(index), err)
+				continue
+			}
+			// Keep reading: what the rest of the log holds is still
+			// true of this peer, just not all of it
+			fmt.Printf("paxos wal %v: %v, state lost\n", w.path(index), err)
+			lost = true
+		}
+	}
+
+	// Rewrite the recovered state into a new segment rather than appending
+	// after a possibly torn tail, then drop the old segments.
+	next := 0
+	if len(old) > 0 {
+		next = old[len(old)-1] + 1
+	}
+	w.checkpoint(next, instances, w.forgotten)
+	for _, index := range old {
+		os.Remove(w.path(index))
+	}
+	w.syncDir()
+	return w, instances, w.promised, lost
+}
+
+// append durably records the new state of instance seq.
+func (w *wal) append(seq int, instance PaxosInstance) {
+	w.write(walRecord{Kind: walInstance, Seq: seq, Instance: instance})
+	w.sync()
+	if w.active().size >= walSegmentSize {
+		w.rotate()
+	}
+}
+
+// appendPromise durably records a ballot promised for every instance.
+func (w *wal) appendPromise(n Ballot) {
+	w.write(walRecord{Kind: walPromise, Promised: n})
+	w.sync()
+}
+
+// appendMembership durably records the configuration history.
+func (w *wal) appendMembership(m membership) {
+	w.write(walRecord{Kind: walMembership, Members: m})
+	w.sync()
+}
+
+// appendFence durably records the fence and ballot floor of a peer that lost
+// its state.
+func (w *wal) appendFence(fence int, floor Ballot) {
+	w.write(walRecord{Kind: walFence, Seq: fence, Promised: floor})
+	w.sync()
+}
+
+// truncate discards log space used only by instances below min. instances
+// is the peer's current state, used to rewrite the live part of the log.
+func (w *wal) truncate(min int, instances map[int]PaxosInstance) {
+	if min > w.forgotten {
+		// Not synced: losing it only means replaying instances that
+		// are forgotten again once Min() catches up.
+		w.write(walRecord{Kind: walForget, Seq: min})
+	}
+	min = w.forgotten
+
+	removed := false
+	for len(w.segments) > 1 && w.segments[0].maxSeq < min {
+		w.total -= w.segments[0].size
+		os.Remove(w.path(w.segments[0].index))
+		w.segments = w.segments[1:]
+		removed = true
+	}
+	if removed {
+		w.syncDir()
+	}
+
+	live := w.promiseSize + w.forgetSize + w.memberSize + w.fenceSize
+	for seq, size := range w.latest {
+		if seq >= min {
+			live += size
+		}
+	}
+	if w.total-live <= live {
+		return
+	}
+
+	// Most of the log is stale: copy the live state to a new segment.
+	old := w.segments
+	w.f.Close()
+	w.checkpoint(w.active().index+1, instances, min)
+	for _, s := range old {
+		os.Remove(w.path(s.index))
+	}
+	w.syncDir()
+}
+
+// rotate seals the active segment and starts a new one with the promise,
+// forget point, membership and fence.
+func (w *wal) rotate() {
+	w.f.Close()
+	w.create(w.active().index + 1)
+	w.writeMeta()
+	w.sync()
+	w.syncDir()
+}
+
+// checkpoint starts segment index holding the promise, the forget point,
+// the membership, the fence and every instance >= min, replacing all earlier
+// segments in the bookkeeping.
+func (w *wal) checkpoint(index int, instances map[int]PaxosInstance, min int) {
+	w.segments = nil
+	w.latest = map[int]int64{}
+	w.total = 0
+	w.promiseSize = 0
+	w.forgetSize = 0
+	w.memberSize = 0
+	w.fenceSize = 0
+	w.create(index)
+	w.writeMeta()
+	for seq, instance := range instances {
+		if seq >= min {
+			w.write(walRecord{Kind: walInstance, Seq: seq, Instance: instance})
+		}
+	}
+	w.sync()
+}
+
+// writeMeta repeats the promise, forget point, membership and fence at the
+// start of a segment, so they survive the removal of the segments that first
+// recorded them.
+func (w *wal) writeMeta() {
+	if w.promised != NoBallot {
+		w.write(walRecord{Kind: walPromise, Promised: w.promised})
+	}
+	if w.forgotten > 0 {
+		w.write(walRecord{Kind: walForget, Seq: w.forgotten})
+	}
+	if w.members != nil {
+		w.write(walRecord{Kind: walMembership, Members: *w.members})
+	}
+	if w.fence >= 0 {
+		w.write(walRecord{Kind: walFence, Seq: w.fence, Promised: w.floor})
+	}
+}
+
+// create makes segment index the active segment, starting with its header.
+func (w *wal) create(index int) {
+	f, err := os.OpenFile(w.path(index), os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		log.Fatalf("wal create %v: %v", w.path(index), err)
+	}
+	if _, err := f.Write(segmentHeader()); err != nil {
+		log.Fatalf("wal write %v: %v", f.Name(), err)
+	}
+	w.f = f
+	w.buf = new(bytes.Buffer)
+	w.enc = gob.NewEncoder(w.buf)
+	w.segments = append(w.segments, &walSegment{index: index, size: walHeaderSize, maxSeq: -1})
+	w.total += walHeaderSize
+}
+
+// write appends rec to the active segment without syncing it.
+func (w *wal) write(rec walRecord) {
+	w.buf.Reset()
+	if err := w.enc.Encode(rec); err != nil {
+		log.Fatalf("wal encode seq %v: %v", rec.Seq, err)
+	}
+	payload := w.buf.Bytes()
+	buf := make([]byte, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.Checksum(payload, walTable))
+	copy(buf[walHeaderSize:], payload)
+	if _, err := w.f.Write(buf); err != nil {
+		log.Fatalf("wal write %v: %v", w.f.Name(), err)
+	}
+	w.account(rec, int64(len(buf)))
+}
+
+// account updates the bookkeeping for a record of size bytes just added to
+// the active segment.
+func (w *wal) account(rec walRecord, size int64) {
+	s := w.active()
+	s.size += size
+	w.total += size
+	switch rec.Kind {
+	case walPromise:
+		w.promised = rec.Promised
+		w.promiseSize = size
+	case walForget:
+		w.forgotten = rec.Seq
+		w.forgetSize = size
+	case walMembership:
+		w.members = &rec.Members
+		w.memberSize = size
+	case walFence:
+		w.fence = rec.Seq
+		w.floor = rec.Promised
+		w.fenceSize = size
+	default:
+		w.latest[rec.Seq] = size
+		if rec.Seq > s.maxSeq {
+			s.maxSeq = rec.Seq
+		}
+	}
+}
+
+// replay applies the records of segment index to instances. A bad header
+// or record ends the segment, and is returned; errTorn if the segment ends
+// part way through it.
+func (w *wal) replay(index int, instances map[int]PaxosInstance) error {
+	content, err := ioutil.ReadFile(w.path(index))
+	if err != nil {
+		return err
+	}
+	if len(content) < walHeaderSize {
+		return fmt.Errorf("%w: short segment header", errTorn)
+	}
+	if err := checkSegmentHeader(content); err != nil {
+		return err
+	}
+	r := bytes.NewReader(content[walHeaderSize:])
+	stream := new(bytes.Buffer)
+	dec := gob.NewDecoder(stream)
+	for r.Len() > 0 {
+		var rec walRecord
+		payload, err := readFrame(r)
+		if err == nil {
+			stream.Write(payload)
+			err = dec.Decode(&rec)
+		}
+		if err != nil {
+			return err
+		}
+		switch rec.Kind {
+		case walPromise:
+			w.promised = rec.Promised
+		case walForget:
+			w.forgotten = rec.Seq
+			for seq := range instances {
+				if seq < rec.Seq {
+					delete(instances, seq)
+				}
+			}
+		case walMembership:
+			w.members = &rec.Members
+		case walFence:
+			w.fence = rec.Seq
+			w.floor = rec.Promised
+		default:
+			if rec.Seq >= w.forgotten {
+				instances[rec.Seq] = rec.Instance
+			}
+		}
+	}
+	return nil
+}
+
+// readFrame returns the payload of the next frame in r, checking its
+// checksum. A frame cut short, or a bad last frame, is a torn write.
+func readFrame(r *bytes.Reader) ([]byte, error) {
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: short header: %v", errTorn, err)
+	}
+	n := binary.LittleEndian.Uint32(header[0:4])
+	if n > walMaxRecord {
+		return nil, fmt.Errorf("bad record length %v", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("%w: short record: %v", errTorn, err)
+	}
+	if crc32.Checksum(payload, walTable) != binary.LittleEndian.Uint32(header[4:8]) {
+		if r.Len() == 0 {
+			return nil, fmt.Errorf("%w: checksum mismatch", errTorn)
+		}
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+	return payload, nil
+}
+
+// list returns the indexes of the segments in the log directory, in order.
+func (w *wal) list() []int {
+	files, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		log.Fatalf("wal could not read %v: %v", w.dir, err)
+	}
+	indexes := []int{}
+	for _, fi := range files {
+		name := fi.Name()
+		if !strings.HasPrefix(name, "wal-") {
+			continue
+		}
+		index, err := strconv.Atoi(name[4:])
+		if err != nil {
+			continue
+		}
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// sync flushes the active segment to stable storage. A peer that cannot
+// make its state durable must not reply, so failure is fatal.
+func (w *wal) sync() {
+	if err := w.f.Sync(); err != nil {
+		log.Fatalf("wal sync %v: %v", w.f.Name(), err)
+	}
+}
+
+// syncDir makes segment creation and removal durable.
+func (w *wal) syncDir() {
+	if d, err := os.Open(w.dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+func (w *wal) active() *walSegment {
+	return w.segments[len(w.segments)-1]
+}
+
+func (w *wal) path(index int) string {
+	return fmt.Sprintf("%v/wal-%016d", w.dir, index)
+}
@@ -1,6 +1,7 @@
 package pbservice
 
 import (
+	"distributed-systems/app/01_Practice-Labs/src/linearizability"
 	"distributed-systems/app/01_Practice-Labs/src/viewservice"
 	"fmt"
 	"io"
@@ -336,13 +337,14 @@ func TestConcurrentSame(t *testing.T) {
 	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
 
 	done := false
+	h := linearizability.NewHistory()
 
 	view1, _ := vck.Get()
 	const nclients = 3
 	const nkeys = 2
 	for xi := 0; xi < nclients; xi++ {
 		go func(i int) {
-			ck := MakeClerk(vshost, "")
+			ck := h.KV(i, MakeClerk(vshost, ""))
 			rr := rand.New(rand.NewSource(int64(os.Getpid() + i)))
 			for done == false {
 				k := strconv.Itoa(rr.Int() % nkeys)
@@ -357,7 +359,7 @@ func TestConcurrentSame(t *testing.T) {
 	time.Sleep(time.Second)
 
 	// read from primary
-	ck := MakeClerk(vshost, "")
+	ck := h.KV(nclients, MakeClerk(vshost, ""))
 	var vals [nkeys]string
 	for i := 0; i < nkeys; i++ {
 		vals[i] = ck.Get(strconv.Itoa(i))
@@ -393,6 +395,10 @@ func TestConcurrentSame(t *testing.T) {
 		}
 	}
 
+	if res := linearizability.Check(linearizability.KVModel, h.Operations()); !res.Ok {
+		t.Fatalf("history is not linearizable:\n%v", res)
+	}
+
 	fmt.Printf("  ... Passed\n")
 
 	for i := 0; i < nservers; i++ {
@@ -433,13 +439,14 @@ func TestConcurrentSameUnreliable(t *testing.T) {
 	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
 
 	done := false
+	h := linearizability.NewHistory()
 
 	view1, _ := vck.Get()
 	const nclients = 3
 	const nkeys = 2
 	for xi := 0; xi < nclients; xi++ {
 		go func(i int) {
-			ck := MakeClerk(vshost, "")
+			ck := h.KV(i, MakeClerk(vshost, ""))
 			rr := rand.New(rand.NewSource(int64(os.Getpid() + i)))
 			for done == false {
 				k := strconv.Itoa(rr.Int() % nkeys)
@@ -454,7 +461,7 @@ func TestConcurrentSameUnreliable(t *testing.T) {
 	time.Sleep(time.Second)
 
 	// read from primary
-	ck := MakeClerk(vshost, "")
+	ck := h.KV(nclients, MakeClerk(vshost, ""))
 	var vals [nkeys]string
 	for i := 0; i < nkeys; i++ {
 		vals[i] = ck.Get(strconv.Itoa(i))
@@ -490,6 +497,10 @@ func TestConcurrentSameUnreliable(t *testing.T) {
 		}
 	}
 
+	if res := linearizability.Check(linearizability.KVModel, h.Operations()); !res.Ok {
+		t.Fatalf("history is not linearizable:\n%v", res)
+	}
+
 	fmt.Printf("  ... Passed\n")
 
 	for i := 0; i < nservers; i++ {
@@ -4,7 +4,8 @@ package shardkv
 // Tracks shardmaster config, routes to correct replica group, and retries on reconfig/errors.
 // Uses a per-client unique id and monotonically increasing sequence numbers for deduplication.
 
-import "shardmaster"
+import "distributed-systems/app/01_Practice-Labs/src/shardmaster"
+import "distributed-systems/app/01_Practice-Labs/src/paxos"
 import "net/rpc"
 import "time"
 import "sync"
@@ -20,14 +21,19 @@ type Clerk struct {
 	// You'll have to modify Clerk.
 	seq    int64 // keep track of record seq number (monotonic per client)
   	client int64 // unique client identifier (for deduplication)
+	env    paxos.Env // how to reach the servers, wait and draw ids
 }
 
-func MakeClerk(shardmasters []string) *Clerk {
+// MakeClerk creates a clerk for the service whose shardmasters are given.
+// opts are the paxos options the servers were started with, so that
+// the clerk dials through the same transport and waits on the same clock.
+func MakeClerk(shardmasters []string, opts ...paxos.Option) *Clerk {
 	ck := new(Clerk)
-	ck.sm = shardmaster.MakeClerk(shardmasters)
+	ck.sm = shardmaster.MakeClerk(shardmasters, opts...)
+	ck.env = paxos.Environment(opts...)
 	// You'll have to modify MakeClerk.
 	ck.seq = -1 // first operation will increment to 0
-  	ck.client = uuid() // defined in common.go
+  	ck.client = uuid(ck.env.Rand) // defined in common.go
 	return ck
 }
 
@@ -45,14 +51,15 @@ func MakeClerk(shardmasters []string) *Clerk {
 // error after a while if it doesn't get a reply from the server.
 //
 // please use call() to send all RPCs, in client.go and server.go.
-// please don't change this function.
+// it dials through t, the transport of the servers.
 //
-func call(srv string, rpcname string,
+func call(t paxos.Transport, srv string, rpcname string,
 	args interface{}, reply interface{}) bool {
-	c, errx := rpc.Dial("unix", srv)
+	conn, errx := t.Dial(srv)
 	if errx != nil {
 		return false
 	}
+	c := rpc.NewClient(conn)
 	defer c.Close()
 
 	err := c.Call(rpcname, args, reply)
@@ -97,7 +104,7 @@ func (ck *Clerk) Get(key string) string {
 			for _, srv := range servers {
 				args := GetArgs{key, ck.seq, ck.client}
 				var reply GetReply
-				if ok := call(srv, "ShardKV.Get", &args, &reply); ok {
+				if ok := call(ck.env.Transport, srv, "ShardKV.Get", &args, &reply); ok {
 					if reply.Err == OK || reply.Err == ErrNoKey {
 						return reply.Value
 					} else if reply.Err == ErrWrongGroup {
@@ -107,9 +114,8 @@ func (ck *Clerk) Get(key string) string {
 			}
 		}
 
-		time.Sleep(100 * time.Millisecond) // brief backoff to avoid tight loops
+		ck.env.Clock.Sleep(100 * time.Millisecond) // brief backoff to avoid tight loops
 	}
-	return ""
 }
 
 // PutExt sends a Put or PutHash based on dohash and returns the prior value for PutHash.
@@ -127,7 +133,7 @@ func (ck *Clerk) PutExt(key string, value string, dohash bool) string {
 			for _, srv := range servers {
 				args := PutArgs{key, value, dohash, ck.seq, ck.client}
 				var reply PutReply
-				if ok := call(srv, "ShardKV.Put", &args, &reply); ok {
+				if ok := call(ck.env.Transport, srv, "ShardKV.Put", &args, &reply); ok {
 					if reply.Err == OK || reply.Err == ErrNoKey {
 						return reply.PreviousValue
 					} else if reply.Err == ErrWrongGroup {
@@ -137,7 +143,7 @@ func (ck *Clerk) PutExt(key string, value string, dohash bool) string {
 			}
 		}
 
-		time.Sleep(100 * time.Millisecond) // brief backoff to avoid tight loops
+		ck.env.Clock.Sleep(100 * time.Millisecond) // brief backoff to avoid tight loops
 	}
 }
 
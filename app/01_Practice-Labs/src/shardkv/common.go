@@ -2,7 +2,7 @@ package shardkv
 
 import "hash/fnv"
 
-import "crypto/rand"
+import "io"
 import "bytes"
 import "encoding/binary"
 
@@ -22,6 +22,7 @@ const (
 	ErrNoKey      = "ErrNoKey"
 	ErrWrongGroup = "ErrWrongGroup"
 	ErrNoConfig   = "ErrNoConfig"
+	ErrKilled     = "ErrKilled"
 	Nil 		  = ""
 )
 
@@ -63,14 +64,14 @@ func hash(s string) uint32 {
 }
 
 //
-// Generates a 64-bit UUID
+// Generates a 64-bit UUID from the random bytes of r
 //
-func uuid() int64 {
+func uuid(r io.Reader) int64 {
     // get 8 random bytes
     rbytes := make([]byte, 8)
-    n, err := rand.Read(rbytes)
+    n, err := io.ReadFull(r, rbytes)
     for n < 8 || err != nil {
-        n, err = rand.Read(rbytes)
+        n, err = io.ReadFull(r, rbytes)
     }
 
     // read those bytes into a variable
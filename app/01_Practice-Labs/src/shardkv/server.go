@@ -5,17 +5,16 @@ package shardkv
 // linearizable application of client requests and configuration changes.
 
 import "net"
+import "bytes"
+import "context"
 import "fmt"
 import "net/rpc"
 import "log"
 import "time"
-import "paxos"
+import "distributed-systems/app/01_Practice-Labs/src/paxos"
 import "sync"
-import "os"
-import "syscall"
 import "encoding/gob"
-import "math/rand"
-import "shardmaster"
+import "distributed-systems/app/01_Practice-Labs/src/shardmaster"
 import "strconv"
 
 const Debug = true
@@ -53,6 +52,7 @@ type ShardKV struct {
     unreliable bool // for testing
     sm         *shardmaster.Clerk
     px         *paxos.Paxos
+    env        paxos.Env // how the peer reaches the world, shared with it
 
     gid        int64 // my replica group ID
 
@@ -62,6 +62,7 @@ type ShardKV struct {
     ids        map[int64] int64     // client => highest_seq for at-most-once semantics
     seq        int                  // highest operation made on the store
     config     shardmaster.Config   // our current configuration
+    restores   int                  // snapshots installed so far
 }
 
 // InquireArgs requests the state of a shard from another group during reconfig.
@@ -90,7 +91,7 @@ func (kv *ShardKV) Get(args *GetArgs, reply *GetReply) error {
     defer kv.mu.Unlock()
 
     // execute and reply
-    op := Op{Get, uuid(), *args}
+    op := Op{Get, uuid(kv.env.Rand), *args}
     reply.Err, reply.Value = kv.execute(op)
 
     return nil
@@ -102,7 +103,7 @@ func (kv *ShardKV) Put(args *PutArgs, reply *PutReply) error {
     defer kv.mu.Unlock()
 
     // execute and reply
-    op := Op{Put, uuid(), *args}
+    op := Op{Put, uuid(kv.env.Rand), *args}
     reply.Err, reply.PreviousValue = kv.execute(op)
 
     return nil
@@ -120,8 +121,11 @@ func (kv *ShardKV) Inquire(args *InquireArgs, reply *InquireReply) error {
     defer kv.mu.Unlock()
 
     // mark this op in the log
-    op := Op{Inquire, uuid(), nil}
-    kv.execute(op)
+    op := Op{Inquire, uuid(kv.env.Rand), nil}
+    if err, _ := kv.execute(op); err == ErrKilled {
+        reply.Err = err
+        return nil
+    }
 
     reply.Store = map[string]string{}
     reply.Seen = map[int64]int64{}
@@ -155,7 +159,7 @@ func (kv *ShardKV) Reconfigure(config shardmaster.Config) bool {
             args := InquireArgs{i, kv.config}
             var reply InquireReply
             for _, srv := range kv.config.Groups[gid] {
-                if ok := call(srv, "ShardKV.Inquire", &args, &reply); ok {
+                if ok := call(kv.env.Transport, srv, "ShardKV.Inquire", &args, &reply); ok {
                     if reply.Err == OK {
                         // copy reply information into our field
                         for key := range reply.Store {
@@ -179,22 +183,34 @@ func (kv *ShardKV) Reconfigure(config shardmaster.Config) bool {
     }
 
     args := ReconfigArgs{config, state}
-    op := Op{Reconfigure, uuid(), args}
-    kv.execute(op)
+    op := Op{Reconfigure, uuid(kv.env.Rand), args}
+    if err, _ := kv.execute(op); err == ErrKilled {
+        return false
+    }
 
     return true
 }
 
 // waitForPaxos waits until Paxos has decided a value for the sequence number
-// and returns the chosen Op.
-func (kv *ShardKV) waitForPaxos(seq int) Op {
-    for to := 10 * time.Millisecond;; {
-        if decided, val := kv.px.Status(seq); decided {
-            return val.(Op)
+// and returns the chosen Op, or false if the server is killed first.
+func (kv *ShardKV) waitForPaxos(seq int) (Op, bool) {
+    for {
+        val, err := kv.px.Wait(context.Background(), seq)
+        if err == paxos.ErrKilled {
+            return Op{Nil, -1, nil}, false
         }
-        if time.Sleep(to); to < 10 * time.Second {
-            to *= 2
+        if err != paxos.ErrForgotten {
+            return val.(Op), true
         }
+        // the rest of the group has moved past seq without us;
+        // fetch it, or install a snapshot, which advances kv.seq.
+        // retry until one succeeds, or seq would be skipped.
+        restores := kv.restores
+        kv.px.CatchUp(seq, seq)
+        if kv.restores != restores {
+            return Op{Nil, -1, nil}, true
+        }
+        kv.env.Clock.Sleep(10 * time.Millisecond)
     }
 }
 
@@ -245,7 +261,10 @@ func (kv *ShardKV) execute(op Op) (Err,string) {
             res = t.(Op)
         } else {
             kv.px.Start(kv.seq, op)
-            res = kv.waitForPaxos(kv.seq)
+            var ok bool
+            if res, ok = kv.waitForPaxos(kv.seq); !ok {
+                return ErrKilled, ""
+            }
         }
 
         switch res.Name {
@@ -290,6 +309,49 @@ func (kv *ShardKV) execute(op Op) (Err,string) {
     return OK, kv.ret[client]
 }
 
+// shardSnapshot is the group state a lagging replica installs in place
+// of the operations it can no longer fetch.
+type shardSnapshot struct {
+    Store  map[string]string
+    Ret    map[int64]string
+    Ids    map[int64]int64
+    Config shardmaster.Config
+}
+
+// Snapshot returns the store, at-most-once tables and configuration
+// after every operation up to and including the returned sequence number.
+// Paxos calls it on behalf of a lagging replica.
+func (kv *ShardKV) Snapshot() (int, []byte) {
+    kv.mu.Lock()
+    defer kv.mu.Unlock()
+
+    w := new(bytes.Buffer)
+    snap := shardSnapshot{Store: kv.store, Ret: kv.ret, Ids: kv.ids, Config: kv.config}
+    if err := gob.NewEncoder(w).Encode(snap); err != nil {
+        log.Fatalf("snapshot encode failed: %v", err)
+    }
+    return kv.seq, w.Bytes()
+}
+
+// Restore replaces the replica's state with a snapshot taken at seq.
+// Paxos calls it from execute's CatchUp, so kv.mu is already held.
+func (kv *ShardKV) Restore(seq int, data []byte) {
+    snap := shardSnapshot{
+        Store: map[string]string{},
+        Ret:   map[int64]string{},
+        Ids:   map[int64]int64{},
+    }
+    if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&snap); err != nil {
+        log.Fatalf("snapshot decode failed: %v", err)
+    }
+    kv.store = snap.Store
+    kv.ret = snap.Ret
+    kv.ids = snap.Ids
+    kv.config = snap.Config
+    kv.seq = seq
+    kv.restores++
+}
+
 //
 // Ask the shardmaster if there's a new configuration;
 // if so, re-configure.
@@ -321,9 +383,11 @@ func (kv *ShardKV) kill() {
 // servers[] contains the ports of the servers
 //   in this replica group.
 // Me is the index of this server in servers[].
+// opts are passed on to paxos, and the server and its
+//   shardmaster clerk use the same transport and clock.
 //
 func StartServer(gid int64, shardmasters []string,
-    servers []string, me int) *ShardKV {
+    servers []string, me int, opts ...paxos.Option) *ShardKV {
     gob.Register(Op{})
 
     // needed to marshal these structs into RPCs
@@ -334,7 +398,8 @@ func StartServer(gid int64, shardmasters []string,
     kv := new(ShardKV)
     kv.me = me
     kv.gid = gid
-    kv.sm = shardmaster.MakeClerk(shardmasters)
+    kv.env = paxos.Environment(opts...)
+    kv.sm = shardmaster.MakeClerk(shardmasters, opts...)
 
     // Your initialization code here.
     // Don't call Join().
@@ -347,10 +412,15 @@ func StartServer(gid int64, shardmasters []string,
     rpcs := rpc.NewServer()
     rpcs.Register(kv)
 
-    kv.px = paxos.Make(servers, me, rpcs, false, "", false)
+    kv.px = paxos.Make(servers, me, rpcs, false, "", false, opts...)
+    kv.px.SetSnapshotter(kv)
 
-    os.Remove(servers[me])
-    l, e := net.Listen("unix", servers[me])
+    // drop some connections while the unreliable flag is set
+    listener := &paxos.UnreliableTransport{
+        Transport:  kv.env.Transport,
+        Unreliable: func() bool { return kv.unreliable },
+    }
+    l, e := listener.Listen(servers[me])
     if e != nil {
         log.Fatal("listen error: ", e)
     }
@@ -363,21 +433,7 @@ func StartServer(gid int64, shardmasters []string,
         for kv.dead == false {
             conn, err := kv.l.Accept()
             if err == nil && kv.dead == false {
-                if kv.unreliable && (rand.Int63()%1000) < 100 {
-                    // discard the request.
-                    conn.Close()
-                } else if kv.unreliable && (rand.Int63()%1000) < 200 {
-                    // process the request but force discard of reply.
-                    c1 := conn.(*net.UnixConn)
-                    f, _ := c1.File()
-                    err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
-                    if err != nil {
-                        fmt.Printf("shutdown: %v\n", err)
-                    }
-                    go rpcs.ServeConn(conn)
-                } else {
-                    go rpcs.ServeConn(conn)
-                }
+                go rpcs.ServeConn(conn)
             } else if err == nil {
                 conn.Close()
             }
@@ -391,7 +447,7 @@ func StartServer(gid int64, shardmasters []string,
     go func() {
         for kv.dead == false {
             kv.tick()
-            time.Sleep(250 * time.Millisecond)
+            kv.env.Clock.Sleep(250 * time.Millisecond)
         }
     }()
 
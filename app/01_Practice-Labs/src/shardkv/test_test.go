@@ -1,7 +1,7 @@
 package shardkv
 
 import "testing"
-import "shardmaster"
+import "distributed-systems/app/01_Practice-Labs/src/shardmaster"
 import "runtime"
 import "strconv"
 import "os"
@@ -9,6 +9,9 @@ import "time"
 import "fmt"
 import "sync"
 import "math/rand"
+import "distributed-systems/app/01_Practice-Labs/src/paxos"
+import "distributed-systems/app/01_Practice-Labs/src/sim"
+import "distributed-systems/app/01_Practice-Labs/src/linearizability"
 
 func port(tag string, host int) string {
 	s := "/var/tmp/824-"
@@ -154,7 +157,7 @@ func TestMove(t *testing.T) {
 
 	// insert one key per shard
 	for i := 0; i < shardmaster.NShards; i++ {
-		ck.Put(string('0'+i), string('0'+i))
+		ck.Put(string(rune('0'+i)), string(rune('0'+i)))
 	}
 
 	// add group 1.
@@ -163,7 +166,7 @@ func TestMove(t *testing.T) {
 
 	// check that keys are still there.
 	for i := 0; i < shardmaster.NShards; i++ {
-		if ck.Get(string('0'+i)) != string('0'+i) {
+		if ck.Get(string(rune('0'+i))) != string(rune('0'+i)) {
 			t.Fatalf("missing key/value")
 		}
 	}
@@ -178,8 +181,8 @@ func TestMove(t *testing.T) {
 	for i := 0; i < shardmaster.NShards; i++ {
 		go func(me int) {
 			myck := MakeClerk(smh)
-			v := myck.Get(string('0' + me))
-			if v == string('0'+me) {
+			v := myck.Get(string(rune('0'+me)))
+			if v == string(rune('0'+me)) {
 				mu.Lock()
 				count++
 				mu.Unlock()
@@ -272,6 +275,7 @@ func doConcurrent(t *testing.T, unreliable bool) {
 		mck.Join(gids[i], ha[i])
 	}
 
+	h := linearizability.NewHistory()
 	const npara = 11
 	var ca [npara]chan bool
 	for i := 0; i < npara; i++ {
@@ -279,7 +283,7 @@ func doConcurrent(t *testing.T, unreliable bool) {
 		go func(me int) {
 			ok := true
 			defer func() { ca[me] <- ok }()
-			ck := MakeClerk(smh)
+			ck := h.KV(me, MakeClerk(smh))
 			mymck := shardmaster.MakeClerk(smh)
 			key := strconv.Itoa(me)
 			last := ""
@@ -311,6 +315,9 @@ func doConcurrent(t *testing.T, unreliable bool) {
 			t.Fatalf("something is wrong")
 		}
 	}
+	if res := linearizability.Check(linearizability.KVModel, h.Operations()); !res.Ok {
+		t.Fatalf("history is not linearizable:\n%v", res)
+	}
 }
 
 func TestConcurrent(t *testing.T) {
@@ -324,3 +331,196 @@ func TestConcurrentUnreliable(t *testing.T) {
 	doConcurrent(t, true)
 	fmt.Printf("  ... Passed\n")
 }
+
+// TestSnapshot restarts a replica with empty state after the rest of its
+// group has forgotten every operation. The others serve no snapshots at
+// first, so the replica's first tries to catch up fail; skipping the
+// forgotten instances instead of retrying would leave it without the puts.
+func TestSnapshot(t *testing.T) {
+	smh, gids, ha, sa, clean := setup("snapshot", false)
+	defer clean()
+
+	fmt.Printf("Test: Restarted replica recovers from a snapshot ...\n")
+
+	mck := shardmaster.MakeClerk(smh)
+	mck.Join(gids[0], ha[0])
+	ck := MakeClerk(smh)
+	ck.Put("a", "x")
+	ck.PutHash("h", "1")
+
+	last := 0
+	for _, kv := range sa[0] {
+		kv.mu.Lock()
+		if kv.seq > last {
+			last = kv.seq
+		}
+		kv.mu.Unlock()
+	}
+
+	// replicas only run the log on a new configuration, so every replica
+	// applies the puts and calls Done once the group is handed a shard
+	mck.Move(0, gids[0])
+	time.Sleep(2 * time.Second)
+	if min := sa[0][0].px.Min(); min <= last {
+		t.Fatalf("Min() = %v; the puts up to %v were not forgotten", min, last)
+	}
+
+	for _, kv := range sa[0][:2] {
+		kv.px.SetSnapshotter(nil)
+	}
+	sa[0][2].kill()
+	sa[0][2] = StartServer(gids[0], smh, ha[0], 2)
+	time.Sleep(2 * time.Second)
+	for _, kv := range sa[0][:2] {
+		kv.px.SetSnapshotter(kv)
+	}
+
+	// ask the restarted replica itself, once it has caught up with the configuration
+	client := rand.Int63()
+	get := func(seq int64, key string) string {
+		for {
+			var reply GetReply
+			sa[0][2].Get(&GetArgs{key, seq, client}, &reply)
+			if reply.Err == OK {
+				return reply.Value
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	if v := get(1, "a"); v != "x" {
+		t.Fatalf("restarted replica: Get(a) -> %v, expected x", v)
+	}
+	if v := get(2, "h"); v != NextValue("", "1") {
+		t.Fatalf("restarted replica: Get(h) -> %v, expected %v", v, NextValue("", "1"))
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// simOptions runs a server or clerk on simulated host h.
+func simOptions(h *sim.Host) []paxos.Option {
+	return []paxos.Option{paxos.WithTransport(h), paxos.WithClock(h), paxos.WithRand(h)}
+}
+
+// simClients runs clients against two replica groups in a simulated World
+// that loses messages, moves shards and partitions groups at random,
+// checks the values the clients leave behind, and returns the World's
+// trace.
+func simClients(t *testing.T, seed int64) (int, uint64) {
+	const nmasters = 3
+	const ngroups = 2
+	const nreplicas = 3
+	const nclients = 2
+	const nops = 6
+
+	w := sim.New(seed)
+	defer w.Stop()
+	w.SetLoss(0.05)
+	r := w.Rand()
+
+	smh := make([]string, nmasters)
+	sma := make([]*shardmaster.ShardMaster, nmasters)
+	defer mcleanup(sma)
+	for i := range smh {
+		smh[i] = "sm" + strconv.Itoa(i)
+	}
+	for i := range sma {
+		sma[i] = shardmaster.StartServer(smh, i, simOptions(w.Host(smh[i]))...)
+	}
+
+	gids := make([]int64, ngroups)
+	ha := make([][]string, ngroups)
+	sa := make([][]*ShardKV, ngroups)
+	defer cleanup(sa)
+	for i := range sa {
+		gids[i] = int64(i + 100)
+		ha[i] = make([]string, nreplicas)
+		sa[i] = make([]*ShardKV, nreplicas)
+		for j := range ha[i] {
+			ha[i][j] = "g" + strconv.Itoa(i) + "s" + strconv.Itoa(j)
+		}
+		for j := range sa[i] {
+			sa[i][j] = StartServer(gids[i], smh, ha[i], j, simOptions(w.Host(ha[i][j]))...)
+		}
+	}
+
+	mck := shardmaster.MakeClerk(smh, simOptions(w.Host("admin"))...)
+	mck.Join(gids[0], ha[0])
+	joined := 1
+
+	// Each client hashes a chain of values into its own key, so the
+	// outcome is known whatever order the clients run in
+	var wg sync.WaitGroup
+	want := make([]string, nclients)
+	for c := 0; c < nclients; c++ {
+		ck := MakeClerk(smh, simOptions(w.Host("ck"+strconv.Itoa(c)))...)
+		cr := w.Rand()
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			key := string(rune('a' + c))
+			prev := ""
+			for i := 0; i < nops; i++ {
+				v := strconv.Itoa(cr.Int())
+				if pv := ck.PutHash(key, v); pv != prev {
+					t.Errorf("PutHash(%v) returned %v, expected %v", key, pv, prev)
+				}
+				prev = NextValue(prev, v)
+			}
+			want[c] = prev
+		}(c)
+	}
+
+	for i := 0; i < 8; i++ {
+		switch r.Intn(4) {
+		case 0:
+			g := r.Intn(ngroups)
+			p := r.Perm(nreplicas)
+			w.Partition([]string{ha[g][p[0]]}, []string{ha[g][p[1]], ha[g][p[2]]})
+		case 1:
+			w.Heal()
+		case 2:
+			mck.Join(gids[1], ha[1])
+			joined = ngroups
+		case 3:
+			// A shard moved to a group that has not joined has no servers
+			mck.Move(r.Intn(shardmaster.NShards), gids[r.Intn(joined)])
+		}
+		w.Sleep(time.Duration(r.Intn(500)) * time.Millisecond)
+	}
+	w.Heal()
+	wg.Wait()
+
+	ck := MakeClerk(smh, simOptions(w.Host("ck"))...)
+	for c := 0; c < nclients; c++ {
+		key := string(rune('a' + c))
+		if v := ck.Get(key); v != want[c] {
+			t.Fatalf("Get(%v) -> %v, expected %v", key, v, want[c])
+		}
+	}
+	return w.Trace()
+}
+
+// simSeeds are the seeds TestSimulation runs unless SIM_SEED names another.
+// 3 once moved a shard to a group that had not joined yet.
+var simSeeds = []int64{1, 2, 3, 1792230899926069591}
+
+func TestSimulation(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	for _, seed := range sim.Seeds(simSeeds...) {
+		fmt.Printf("Test: Simulated reconfiguration, partitions and lost messages, seed %v ...\n", seed)
+
+		var steps [2]int
+		var trace [2]uint64
+		for run := range steps {
+			steps[run], trace[run] = simClients(t, seed)
+		}
+		if steps[0] != steps[1] || trace[0] != trace[1] {
+			t.Fatalf("seed %v took %v steps (trace %x), then %v steps (trace %x)",
+				seed, steps[0], trace[0], steps[1], trace[1])
+		}
+
+		fmt.Printf("  ... Passed\n")
+	}
+}
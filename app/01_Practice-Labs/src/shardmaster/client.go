@@ -4,32 +4,39 @@ import (
 	"fmt"
 	"net/rpc"
 	"time"
+
+	"distributed-systems/app/01_Practice-Labs/src/paxos"
 )
 
 // Clerk represents a client for the shard master service.
 // It provides methods to interact with the shard master and handles
 // automatic retry logic and server failover.
 type Clerk struct {
-	servers []string // List of shard master server addresses
+	servers []string  // List of shard master server addresses
+	env     paxos.Env // How to reach the servers and wait between retries
 }
 
 // MakeClerk creates a new client for the shard master service.
 // servers is a list of shard master server addresses that the client can connect to.
-func MakeClerk(servers []string) *Clerk {
+// opts are the paxos options the servers were started with, so that the
+// client dials through the same transport and waits on the same clock.
+func MakeClerk(servers []string, opts ...paxos.Option) *Clerk {
 	return &Clerk{
 		servers: servers,
+		env:     paxos.Environment(opts...),
 	}
 }
 
 // call sends an RPC to the specified server and waits for a reply.
 // It returns true if the server responded successfully, false otherwise.
 // The reply argument should be a pointer to a reply structure.
-// This function handles connection establishment, RPC call, and cleanup.
-func call(srv string, rpcname string, args interface{}, reply interface{}) bool {
-	c, err := rpc.Dial("unix", srv)
+// This function handles connection establishment through t, RPC call, and cleanup.
+func call(t paxos.Transport, srv string, rpcname string, args interface{}, reply interface{}) bool {
+	conn, err := t.Dial(srv)
 	if err != nil {
 		return false
 	}
+	c := rpc.NewClient(conn)
 	defer c.Close()
 
 	err = c.Call(rpcname, args, reply)
@@ -50,12 +57,12 @@ func (ck *Clerk) Query(num int) Config {
 		for _, srv := range ck.servers {
 			args := &QueryArgs{Num: num}
 			var reply QueryReply
-			ok := call(srv, "ShardMaster.Query", args, &reply)
+			ok := call(ck.env.Transport, srv, "ShardMaster.Query", args, &reply)
 			if ok {
 				return reply.Config
 			}
 		}
-		time.Sleep(100 * time.Millisecond)
+		ck.env.Clock.Sleep(100 * time.Millisecond)
 	}
 }
 
@@ -68,12 +75,12 @@ func (ck *Clerk) Join(gid int64, servers []string) {
 		for _, srv := range ck.servers {
 			args := &JoinArgs{GID: gid, Servers: servers}
 			var reply JoinReply
-			ok := call(srv, "ShardMaster.Join", args, &reply)
+			ok := call(ck.env.Transport, srv, "ShardMaster.Join", args, &reply)
 			if ok {
 				return
 			}
 		}
-		time.Sleep(100 * time.Millisecond)
+		ck.env.Clock.Sleep(100 * time.Millisecond)
 	}
 }
 
@@ -87,12 +94,12 @@ func (ck *Clerk) Leave(gid int64) {
 		for _, srv := range ck.servers {
 			args := &LeaveArgs{GID: gid}
 			var reply LeaveReply
-			ok := call(srv, "ShardMaster.Leave", args, &reply)
+			ok := call(ck.env.Transport, srv, "ShardMaster.Leave", args, &reply)
 			if ok {
 				return
 			}
 		}
-		time.Sleep(100 * time.Millisecond)
+		ck.env.Clock.Sleep(100 * time.Millisecond)
 	}
 }
 
@@ -105,11 +112,11 @@ func (ck *Clerk) Move(shard int, gid int64) {
 		for _, srv := range ck.servers {
 			args := &MoveArgs{Shard: shard, GID: gid}
 			var reply MoveReply
-			ok := call(srv, "ShardMaster.Move", args, &reply)
+			ok := call(ck.env.Transport, srv, "ShardMaster.Move", args, &reply)
 			if ok {
 				return
 			}
 		}
-		time.Sleep(100 * time.Millisecond)
+		ck.env.Clock.Sleep(100 * time.Millisecond)
 	}
 }
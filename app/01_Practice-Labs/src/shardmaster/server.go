@@ -2,18 +2,16 @@ package shardmaster
 
 import (
 	"bytes"
-	crand "crypto/rand"
+	"context"
 	"encoding/binary"
 	"encoding/gob"
 	"fmt"
+	"io"
 	"log"
-	"math/rand"
 	"net"
 	"net/rpc"
-	"os"
+	"sort"
 	"sync"
-	"syscall"
-	"time"
 
 	"distributed-systems/app/01_Practice-Labs/src/paxos"
 )
@@ -41,6 +39,7 @@ type ShardMaster struct {
 	dead       bool              // Flag indicating if server should shut down (for testing)
 	unreliable bool              // Flag for unreliable network simulation (for testing)
 	px         *paxos.Paxos      // Paxos peer for consensus
+	env        paxos.Env         // How the peer reaches the world, shared with it
 
 	configs  []Config // Array of configurations indexed by configuration number
 	seqTried int      // Next sequence number to try for Paxos operations
@@ -67,13 +66,14 @@ type Op struct {
 }
 
 // uuid generates a 64-bit unique identifier for operation identification.
-// It uses cryptographically secure random number generation to ensure uniqueness.
+// It uses cryptographically secure random number generation to ensure uniqueness,
+// unless the server was given another source of randomness.
 func (sm *ShardMaster) uuid() uint64 {
 	// Generate 8 random bytes
 	rbytes := make([]byte, 8)
-	n, err := crand.Read(rbytes)
+	n, err := io.ReadFull(sm.env.Rand, rbytes)
 	for n < 8 || err != nil {
-		n, err = crand.Read(rbytes)
+		n, err = io.ReadFull(sm.env.Rand, rbytes)
 	}
 
 	// Convert bytes to uint64 using little-endian encoding
@@ -84,26 +84,21 @@ func (sm *ShardMaster) uuid() uint64 {
 }
 
 // waitForPaxos waits for a Paxos instance to be decided.
-// It uses exponential backoff to avoid busy waiting.
-// Returns true if the instance was decided, false if it was already done.
-func (sm *ShardMaster) waitForPaxos(seq int) bool {
-	for to := 10 * time.Millisecond; ; {
-		if decided, _ := sm.px.Status(seq); decided {
-			return true
-		}
-		time.Sleep(to)
-		if to < 10*time.Second {
-			to *= 2
-		}
-
-		DPrintf("Waiting for paxos (seq %d) on server %d.", seq, sm.me)
+// Returns paxos.ErrKilled if the server is killed first, and nil otherwise,
+// also when the instance was already forgotten.
+func (sm *ShardMaster) waitForPaxos(seq int) error {
+	DPrintf("Waiting for paxos (seq %d) on server %d.", seq, sm.me)
+	if _, err := sm.px.Wait(context.Background(), seq); err == paxos.ErrKilled {
+		return err
 	}
+	return nil
 }
 
 // decide attempts to assign a Paxos sequence number to the given operation.
 // It tries different sequence numbers until it successfully gets agreement on the operation.
-// Returns the sequence number where the operation was agreed upon.
-func (sm *ShardMaster) decide(op Op) int {
+// Returns the sequence number where the operation was agreed upon, or
+// paxos.ErrKilled if the server is killed first.
+func (sm *ShardMaster) decide(op Op) (int, error) {
 	for {
 		DPrintf("Waiting for lock (to decide) on server %d.", sm.me)
 
@@ -113,11 +108,13 @@ func (sm *ShardMaster) decide(op Op) int {
 		sm.mu.Unlock()
 
 		sm.px.Start(seq, op)
-		sm.waitForPaxos(seq)
+		if err := sm.waitForPaxos(seq); err != nil {
+			return -1, err
+		}
 
 		if decided, val := sm.px.Status(seq); decided {
 			if op.OpId == val.(Op).OpId {
-				return seq
+				return seq, nil
 			}
 		}
 	}
@@ -127,6 +124,12 @@ func (sm *ShardMaster) decide(op Op) int {
 // It redistributes shards evenly among replica groups to balance load.
 // Returns a new configuration with balanced shard assignments.
 func (sm *ShardMaster) loadBalance(config Config) Config {
+	// with no groups left, shards go back to the invalid group 0
+	if len(config.Groups) == 0 {
+		config.Shards = [NShards]int64{}
+		return config
+	}
+
 	// the number of shards per server; since shards might not distribute exactly evenly, we need two numbers
 	q1 := NShards / len(config.Groups)
 	q2 := q1 + 1
@@ -166,8 +169,15 @@ func (sm *ShardMaster) loadBalance(config Config) Config {
 
 	// second pass: add the unassigned shards to groups without enough shards
 	// we had better reach the end of our unassigned list and the end of our groups list at the same time
+	// groups are visited in order, so that every replica computes the same configuration
+	gids := make([]int64, 0, len(assign))
+	for gid := range assign {
+		gids = append(gids, gid)
+	}
+	sort.Slice(gids, func(i, j int) bool { return gids[i] < gids[j] })
 	shard_idx := 0
-	for gid, count := range assign {
+	for _, gid := range gids {
+		count := assign[gid]
 		// check if group is full
 		if count >= q2 || (count >= q1 && n2 == 0) {
 			continue
@@ -195,14 +205,9 @@ func (sm *ShardMaster) loadBalance(config Config) Config {
 
 	if shard_idx < len(unassign) {
 		DPrintf("Error: Load-balancer did not reassign all shards.")
-		// the remaining shards get distributed over whichever gid comes up
-		// (iterating over a map is not guaranteed to be consistent for the same
-		// set of <key/value>s so this may distribute to more than one group)
+		// the remaining shards go to the lowest gid, like on every other replica
 		for ; shard_idx < len(unassign); shard_idx++ {
-			for gid, _ := range config.Groups {
-				config.Shards[unassign[shard_idx]] = gid
-				break;
-			}
+			config.Shards[unassign[shard_idx]] = gids[0]
 		}
 	}
 
@@ -232,8 +237,9 @@ func (sm *ShardMaster) duplicateLast() Config {
 
 // doOps executes all operations up to and including the given sequence number.
 // Since configurations are immutable, we don't need to cache versions for Query requests,
-// but we do return the number of the last configuration.
-func (sm *ShardMaster) doOps(seqEnd int) int {
+// but we do return the number of the last configuration. It returns
+// paxos.ErrKilled if the server is killed first.
+func (sm *ShardMaster) doOps(seqEnd int) (int, error) {
 	DPrintf("Waiting for lock (to do) on server %d.", sm.me)
 
 	sm.mu.Lock()
@@ -243,7 +249,7 @@ func (sm *ShardMaster) doOps(seqEnd int) int {
 
 	// if we've already done this op, just return
 	if seqEnd <= sm.seqDone {
-		return len(sm.configs) - 1
+		return len(sm.configs) - 1, nil
 	}
 
 	// jump-start all Paxos sequences between our Done() one and this one
@@ -257,7 +263,10 @@ func (sm *ShardMaster) doOps(seqEnd int) int {
 	for seq := sm.seqDone + 1; seq <= seqEnd; seq++ {
 		decided, val := sm.px.Status(seq)
 		if !decided {
-			sm.waitForPaxos(seq)
+			if err := sm.waitForPaxos(seq); err != nil {
+				sm.seqDone = seq - 1
+				return -1, err
+			}
 			decided, val = sm.px.Status(seq)
 		}
 
@@ -283,7 +292,7 @@ func (sm *ShardMaster) doOps(seqEnd int) int {
 	sm.seqDone = seqEnd
 	sm.px.Done(sm.seqDone)
 
-	return len(sm.configs) - 1
+	return len(sm.configs) - 1, nil
 }
 
 // Join handles Join RPC requests from clients.
@@ -292,10 +301,12 @@ func (sm *ShardMaster) Join(args *JoinArgs, reply *JoinReply) error {
 	DPrintf("Join %d on server %d.\n", args.GID, sm.me)
 
 	op := Op{Name: Join, OpId: sm.uuid(), GID: args.GID, Shard: 0, Num: 0, Servers: args.Servers}
-	seq := sm.decide(op)
-	sm.doOps(seq)
-
-	return nil
+	seq, err := sm.decide(op)
+	if err != nil {
+		return err
+	}
+	_, err = sm.doOps(seq)
+	return err
 }
 
 // Leave handles Leave RPC requests from clients.
@@ -304,10 +315,12 @@ func (sm *ShardMaster) Leave(args *LeaveArgs, reply *LeaveReply) error {
 	DPrintf("Leave %d on server %d.\n", args.GID, sm.me)
 
 	op := Op{Name: Leave, OpId: sm.uuid(), GID: args.GID, Shard: 0, Num: 0, Servers: nil}
-	seq := sm.decide(op)
-	sm.doOps(seq)
-
-	return nil
+	seq, err := sm.decide(op)
+	if err != nil {
+		return err
+	}
+	_, err = sm.doOps(seq)
+	return err
 }
 
 // Move handles Move RPC requests from clients.
@@ -317,10 +330,12 @@ func (sm *ShardMaster) Move(args *MoveArgs, reply *MoveReply) error {
 	DPrintf("Move %d on server %d.\n", args.GID, sm.me)
 
 	op := Op{Name: Move, OpId: sm.uuid(), GID: args.GID, Shard: args.Shard, Num: 0, Servers: nil}
-	seq := sm.decide(op)
-	sm.doOps(seq)
-
-	return nil
+	seq, err := sm.decide(op)
+	if err != nil {
+		return err
+	}
+	_, err = sm.doOps(seq)
+	return err
 }
 
 // Query handles Query RPC requests from clients.
@@ -331,8 +346,14 @@ func (sm *ShardMaster) Query(args *QueryArgs, reply *QueryReply) error {
 	DPrintf("Query %d on server %d.\n", args.Num, sm.me)
 
 	op := Op{Name: Query, OpId: sm.uuid(), GID: 0, Shard: 0, Num: args.Num, Servers: nil}
-	seq := sm.decide(op)
-	con := sm.doOps(seq)
+	seq, err := sm.decide(op)
+	if err != nil {
+		return err
+	}
+	con, err := sm.doOps(seq)
+	if err != nil {
+		return err
+	}
 
 	DPrintf("Waiting for lock (to query) on server %d.", sm.me)
 
@@ -358,7 +379,8 @@ func (sm *ShardMaster) Kill() {
 // StartServer creates and starts a new ShardMaster server.
 // servers contains the ports of all servers that will cooperate via Paxos.
 // me is the index of the current server in the servers array.
-func StartServer(servers []string, me int) *ShardMaster {
+// opts are passed on to Paxos, and the server listens the same way its peer does.
+func StartServer(servers []string, me int, opts ...paxos.Option) *ShardMaster {
 	// Register Op struct for RPC marshalling/unmarshalling
 	gob.Register(Op{})
 
@@ -367,6 +389,7 @@ func StartServer(servers []string, me int) *ShardMaster {
 		seqTried:   0,
 		seqDone:    -1,
 		configs:    make([]Config, 1),
+		env:        paxos.Environment(opts...),
 	}
 
 	// Initialize the first configuration (configuration 0)
@@ -375,11 +398,15 @@ func StartServer(servers []string, me int) *ShardMaster {
 	rpcs := rpc.NewServer()
 	rpcs.Register(sm)
 
-	sm.px = paxos.Make(servers, me, rpcs, false, "", false)
+	sm.px = paxos.Make(servers, me, rpcs, false, "", false, opts...)
 
-	// Set up Unix socket listener
-	os.Remove(servers[me])
-	l, err := net.Listen("unix", servers[me])
+	// Listen the same way the Paxos peer does, dropping some
+	// connections while the unreliable flag is set
+	listener := &paxos.UnreliableTransport{
+		Transport:  sm.env.Transport,
+		Unreliable: func() bool { return sm.unreliable },
+	}
+	l, err := listener.Listen(servers[me])
 	if err != nil {
 		log.Fatal("listen error: ", err)
 	}
@@ -390,22 +417,7 @@ func StartServer(servers []string, me int) *ShardMaster {
 		for !sm.dead {
 			conn, err := sm.l.Accept()
 			if err == nil && !sm.dead {
-				if sm.unreliable && (rand.Int63()%1000) < 100 {
-					// Discard the request (simulate network failure)
-					conn.Close()
-				} else if sm.unreliable && (rand.Int63()%1000) < 200 {
-					// Process the request but force discard of reply
-					c1 := conn.(*net.UnixConn)
-					f, _ := c1.File()
-					err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
-					if err != nil {
-						fmt.Printf("shutdown: %v\n", err)
-					}
-					go rpcs.ServeConn(conn)
-				} else {
-					// Normal processing
-					go rpcs.ServeConn(conn)
-				}
+				go rpcs.ServeConn(conn)
 			} else if err == nil {
 				conn.Close()
 			}
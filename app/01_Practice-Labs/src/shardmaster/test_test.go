@@ -9,7 +9,12 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"sync"
 	"testing"
+	"time"
+
+	"distributed-systems/app/01_Practice-Labs/src/paxos"
+	"distributed-systems/app/01_Practice-Labs/src/sim"
 )
 
 // port generates a unique Unix socket path for testing.
@@ -402,3 +407,104 @@ func TestFreshQuery(t *testing.T) {
 	fmt.Printf("  ... Passed\n")
 	os.Remove(portx)
 }
+
+// simOptions runs a server or clerk on simulated host h.
+func simOptions(h *sim.Host) []paxos.Option {
+	return []paxos.Option{paxos.WithTransport(h), paxos.WithClock(h), paxos.WithRand(h)}
+}
+
+// simClients has clients join and leave groups in a simulated World that
+// loses messages and partitions the servers at random, checks the final
+// configuration, and returns the World's trace.
+func simClients(t *testing.T, seed int64) (int, uint64) {
+	const nservers = 3
+	const nclients = 2
+	const nops = 8
+
+	w := sim.New(seed)
+	defer w.Stop()
+	w.SetLoss(0.05)
+	r := w.Rand()
+
+	smh := make([]string, nservers)
+	for i := range smh {
+		smh[i] = "sm" + strconv.Itoa(i)
+	}
+	sma := make([]*ShardMaster, nservers)
+	defer cleanup(sma)
+	for i := range sma {
+		sma[i] = StartServer(smh, i, simOptions(w.Host(smh[i]))...)
+	}
+
+	// Each client toggles groups of its own, so the final set of groups
+	// is known whatever order the clients run in
+	var wg sync.WaitGroup
+	joined := make([]map[int64]bool, nclients)
+	for c := 0; c < nclients; c++ {
+		ck := MakeClerk(smh, simOptions(w.Host("ck"+strconv.Itoa(c)))...)
+		cr := w.Rand()
+		joined[c] = make(map[int64]bool)
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; i < nops; i++ {
+				gid := int64(100*(c+1) + cr.Intn(4))
+				if joined[c][gid] {
+					ck.Leave(gid)
+				} else {
+					ck.Join(gid, []string{"a", "b", "c"})
+				}
+				joined[c][gid] = !joined[c][gid]
+			}
+		}(c)
+	}
+
+	for i := 0; i < 10; i++ {
+		switch r.Intn(3) {
+		case 0:
+			p := r.Perm(nservers)
+			w.Partition([]string{smh[p[0]]}, []string{smh[p[1]], smh[p[2]]})
+		case 1:
+			w.Heal()
+		}
+		w.Sleep(time.Duration(r.Intn(500)) * time.Millisecond)
+	}
+	w.Heal()
+	wg.Wait()
+
+	var groups []int64
+	for c := range joined {
+		for gid, in := range joined[c] {
+			if in {
+				groups = append(groups, gid)
+			}
+		}
+	}
+	for i := range smh {
+		check(t, groups, MakeClerk([]string{smh[i]}, simOptions(w.Host("ck"))...))
+	}
+	return w.Trace()
+}
+
+// simSeeds are the seeds TestSimulation runs unless SIM_SEED names another.
+var simSeeds = []int64{1, 2, 3, 1792230899926069591}
+
+func TestSimulation(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	for _, seed := range sim.Seeds(simSeeds...) {
+		fmt.Printf("Test: Simulated joins and leaves, partitions and lost messages, seed %v ...\n", seed)
+
+		var steps [2]int
+		var trace [2]uint64
+		for run := range steps {
+			steps[run], trace[run] = simClients(t, seed)
+		}
+		if steps[0] != steps[1] || trace[0] != trace[1] {
+			t.Fatalf("seed %v took %v steps (trace %x), then %v steps (trace %x)",
+				seed, steps[0], trace[0], steps[1], trace[1])
+		}
+
+		fmt.Printf("  ... Passed\n")
+	}
+}
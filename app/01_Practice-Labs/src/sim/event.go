@@ -0,0 +1,112 @@
+package sim
+
+// Events.
+//
+// Everything that happens in a World is an event: a timer firing, a
+// connection attempt arriving, or a chunk of a connection's byte stream
+// arriving. The key of an event says who created it where; the scheduler
+// sorts the events created between two steps by key before it draws
+// anything random for them, which is what makes a run repeatable.
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	timerEvent = iota
+	packetEvent
+)
+
+// event is something that happens at a point in virtual time.
+type event struct {
+	kind int
+	key  string    // Canonical identity among the events of one step
+	name string    // What the trace calls it
+	seq  uint64    // Order of admission, breaking ties in at
+	at   time.Time // When it happens
+
+	fire chan time.Time // timerEvent: receives the time it fired
+
+	pipe  *pipe  // packetEvent: the connection
+	dir   int    // packetEvent: 0 from the dialer, 1 towards it
+	index int    // packetEvent: position in its direction, from 1
+	data  []byte // packetEvent: the bytes, or nil for the end of the stream
+	lost  bool   // packetEvent: whether it gets lost
+}
+
+// packetKey names a packet event at admission. Indexes are padded so that
+// the packets of a connection sort in the order they were sent.
+func (e *event) packetKey() string {
+	p := e.pipe
+	if p.id == 0 {
+		return fmt.Sprintf("%s>%s%s %x %d %010d", p.hosts[0], p.addr, p.site, p.first, e.dir, e.index)
+	}
+	return fmt.Sprintf("conn %d %d %010d", p.id, e.dir, e.index)
+}
+
+// String describes e for the trace, leaving out call sites so that the
+// trace of a run does not change with unrelated edits to the code.
+func (e *event) String() string {
+	if e.kind == timerEvent {
+		return e.name
+	}
+	p := e.pipe
+	return fmt.Sprintf("conn %d %s>%s %d %d", p.id, p.hosts[0], p.addr, e.dir, e.index)
+}
+
+// sortEvents puts the events created in one step in canonical order. Events
+// with equal keys keep the order they were created in.
+func sortEvents(events []*event) {
+	for _, e := range events {
+		if e.kind == packetEvent {
+			e.key = e.packetKey()
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].key < events[j].key
+	})
+}
+
+// callsite describes the code that created an event, to tell apart events
+// the same host creates in the same step.
+func callsite() string {
+	var pcs [8]uintptr
+	n := runtime.Callers(3, pcs[:])
+	frames := runtime.CallersFrames(pcs[:n])
+	var b strings.Builder
+	for {
+		f, more := frames.Next()
+		fmt.Fprintf(&b, " %s:%d", f.Function, f.Line)
+		if !more {
+			break
+		}
+	}
+	return b.String()
+}
+
+// eventQueue is a heap of admitted events ordered by time of occurrence.
+type eventQueue []*event
+
+func (q eventQueue) Len() int { return len(q) }
+
+func (q eventQueue) Less(i, j int) bool {
+	if !q[i].at.Equal(q[j].at) {
+		return q[i].at.Before(q[j].at)
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q eventQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *eventQueue) Push(x interface{}) { *q = append(*q, x.(*event)) }
+
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
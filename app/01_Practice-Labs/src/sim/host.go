@@ -0,0 +1,352 @@
+package sim
+
+// Hosts and the simulated network.
+//
+// A connection is a pair of ends joined by a pipe. Writing to an end never
+// blocks: the bytes become a packet event, and reach the other end when the
+// scheduler delivers it. Closing an end sends the end of the stream the same
+// way. A lost or partitioned packet resets the whole connection, so both
+// ends see an error, like a TCP connection that times out.
+//
+// Dialing does not take an event of its own; the connection reaches the
+// listener with its first packet. The events of a connection are known by
+// who dialed it where and what it sent first until that packet is admitted,
+// and by the packet's admission number after.
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+)
+
+// errRefused is returned when dialing after the World has stopped.
+var errRefused = &net.OpError{Op: "dial", Net: "sim", Err: syscall.ECONNREFUSED}
+
+// errReset is returned by connections that lost a message or were refused.
+var errReset = &net.OpError{Op: "read", Net: "sim", Err: syscall.ECONNRESET}
+
+// Host is a simulated machine. It implements paxos.Transport and
+// paxos.Clock, and as an io.Reader it is the machine's source of randomness.
+type Host struct {
+	w    *World
+	name string
+	rng  *rand.Rand // Seeded from the World's seed and the host's name
+}
+
+// Name returns the host's name.
+func (h *Host) Name() string {
+	return h.name
+}
+
+// Now returns the virtual time.
+func (h *Host) Now() time.Time {
+	h.w.mu.Lock()
+	defer h.w.mu.Unlock()
+	return h.w.now
+}
+
+// Sleep blocks the calling goroutine for d of virtual time.
+func (h *Host) Sleep(d time.Duration) {
+	<-h.After(d)
+}
+
+// After returns a channel that receives the virtual time once d has passed.
+func (h *Host) After(d time.Duration) <-chan time.Time {
+	w := h.w
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped {
+		return time.After(d)
+	}
+	if d < 0 {
+		d = 0
+	}
+	e := &event{
+		kind: timerEvent,
+		name: fmt.Sprintf("%s sleep %v", h.name, d),
+		at:   w.now.Add(d),
+		fire: make(chan time.Time, 1),
+	}
+	e.key = e.name + callsite()
+	w.addLocked(e)
+	return e.fire
+}
+
+// Read fills b with random bytes. Each host draws from its own generator, so
+// what one host draws does not depend on how busy the others are.
+func (h *Host) Read(b []byte) (int, error) {
+	h.w.mu.Lock()
+	defer h.w.mu.Unlock()
+	return h.rng.Read(b)
+}
+
+// Listen accepts connections to addr on this host.
+func (h *Host) Listen(addr string) (net.Listener, error) {
+	w := h.w
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.listeners[addr]; ok {
+		return nil, &net.OpError{Op: "listen", Net: "sim", Addr: simAddr(addr), Err: syscall.EADDRINUSE}
+	}
+	l := &listener{host: h, addr: addr, ready: make(chan struct{})}
+	w.listeners[addr] = l
+	return l, nil
+}
+
+// Dial opens a connection to addr. Like a TCP connection, it turns out to
+// be refused or unreachable when the first bytes sent on it arrive.
+func (h *Host) Dial(addr string) (net.Conn, error) {
+	w := h.w
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped {
+		return nil, errRefused
+	}
+	p := &pipe{w: w, hosts: [2]string{h.name, ""}, addr: addr, site: callsite()}
+	for side := range p.ends {
+		p.ends[side] = &end{pipe: p, side: side, ready: make(chan struct{})}
+	}
+	return p.ends[0], nil
+}
+
+// connect hands p to the listener at its address when the first bytes sent
+// on it arrive, and reports whether it could. Caller must hold w.mu.
+func (w *World) connect(p *pipe) bool {
+	l, ok := w.listeners[p.addr]
+	if !ok || !w.reachable(p.hosts[0], l.host.name) {
+		return false
+	}
+	p.hosts[1] = l.host.name
+	p.connected = true
+	l.pending = append(l.pending, p.ends[1])
+	l.notifyLocked()
+	return true
+}
+
+// deliver makes a packetEvent happen. Caller must hold w.mu.
+func (w *World) deliver(e *event) string {
+	p := e.pipe
+	dst := p.ends[1-e.dir]
+	switch {
+	case p.reset || dst.closed:
+		return "discarded"
+	case !p.connected && !w.connect(p):
+		p.resetLocked()
+		return "refused"
+	case e.lost || !w.reachable(p.hosts[e.dir], p.hosts[1-e.dir]):
+		p.resetLocked()
+		return "lost"
+	case e.data == nil:
+		dst.eof = true
+		dst.notifyLocked()
+		return "eof"
+	default:
+		dst.buf = append(dst.buf, e.data...)
+		dst.notifyLocked()
+		return fmt.Sprintf("%d bytes", len(e.data))
+	}
+}
+
+// simAddr is the net.Addr of a simulated listener.
+type simAddr string
+
+func (a simAddr) Network() string { return "sim" }
+func (a simAddr) String() string  { return string(a) }
+
+// listener hands out the accepting ends of connections.
+type listener struct {
+	host    *Host
+	addr    string
+	pending []*end
+	closed  bool
+	ready   chan struct{} // Closed and replaced when pending or closed change
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	w := l.host.w
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for {
+		if l.closed {
+			return nil, &net.OpError{Op: "accept", Net: "sim", Addr: simAddr(l.addr), Err: net.ErrClosed}
+		}
+		if len(l.pending) > 0 {
+			conn := l.pending[0]
+			l.pending = l.pending[1:]
+			return conn, nil
+		}
+		ready := l.ready
+		w.mu.Unlock()
+		<-ready
+		w.mu.Lock()
+	}
+}
+
+func (l *listener) Close() error {
+	l.host.w.mu.Lock()
+	defer l.host.w.mu.Unlock()
+	l.closeLocked()
+	return nil
+}
+
+// closeLocked stops accepting, resetting connections nobody accepted.
+// Caller must hold w.mu.
+func (l *listener) closeLocked() {
+	if l.closed {
+		return
+	}
+	l.closed = true
+	w := l.host.w
+	if w.listeners[l.addr] == l {
+		delete(w.listeners, l.addr)
+	}
+	for _, conn := range l.pending {
+		conn.pipe.resetLocked()
+	}
+	l.pending = nil
+	l.notifyLocked()
+}
+
+// notifyLocked wakes Accept. Caller must hold w.mu.
+func (l *listener) notifyLocked() {
+	close(l.ready)
+	l.ready = make(chan struct{})
+}
+
+func (l *listener) Addr() net.Addr {
+	return simAddr(l.addr)
+}
+
+// pipe is a connection between two hosts.
+type pipe struct {
+	w         *World
+	id        uint64       // Admission number of its first packet, or 0
+	site      string       // Where it was dialed
+	first     []byte       // The first bytes sent on it
+	hosts     [2]string    // The dialing host and, once connected, the listening host
+	addr      string       // The address dialed
+	connected bool         // Whether the listener has it
+	ends      [2]*end      // The dialing end and the accepting end
+	sent      [2]int       // Packets sent in each direction
+	last      [2]time.Time // Arrival of the last packet in each direction
+	reset     bool         // Whether a packet was lost or the connection refused
+}
+
+// resetLocked breaks the connection. Caller must hold w.mu.
+func (p *pipe) resetLocked() {
+	p.reset = true
+	for _, e := range p.ends {
+		e.notifyLocked()
+	}
+}
+
+// end is one end of a connection.
+type end struct {
+	pipe   *pipe
+	side   int           // 0 for the dialer, 1 for the acceptor
+	buf    []byte        // Delivered bytes not read yet
+	eof    bool          // Whether the other end closed
+	closed bool          // Whether this end closed
+	ready  chan struct{} // Closed and replaced when any of the above change
+}
+
+// notifyLocked wakes Read. Caller must hold w.mu.
+func (c *end) notifyLocked() {
+	close(c.ready)
+	c.ready = make(chan struct{})
+}
+
+func (c *end) Read(b []byte) (int, error) {
+	w := c.pipe.w
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for {
+		switch {
+		case c.closed:
+			return 0, net.ErrClosed
+		case len(c.buf) > 0:
+			n := copy(b, c.buf)
+			c.buf = c.buf[n:]
+			return n, nil
+		case c.pipe.reset:
+			return 0, errReset
+		case c.eof:
+			return 0, io.EOF
+		}
+		ready := c.ready
+		w.mu.Unlock()
+		<-ready
+		w.mu.Lock()
+	}
+}
+
+func (c *end) Write(b []byte) (int, error) {
+	w := c.pipe.w
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch {
+	case c.closed:
+		return 0, net.ErrClosed
+	case c.pipe.reset:
+		return 0, errReset
+	case w.stopped:
+		c.pipe.resetLocked()
+		return 0, errReset
+	}
+	c.sendLocked(append([]byte(nil), b...))
+	return len(b), nil
+}
+
+// sendLocked puts data, or the end of the stream if nil, on its way to the
+// other end. Caller must hold w.mu.
+func (c *end) sendLocked(data []byte) {
+	p := c.pipe
+	if p.sent[0] == 0 && c.side == 0 {
+		p.first = data
+	}
+	p.sent[c.side]++
+	p.w.addLocked(&event{
+		kind:  packetEvent,
+		pipe:  p,
+		dir:   c.side,
+		index: p.sent[c.side],
+		data:  data,
+	})
+}
+
+func (c *end) Close() error {
+	w := c.pipe.w
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.notifyLocked()
+	if !c.pipe.reset && !w.stopped {
+		c.sendLocked(nil)
+	}
+	return nil
+}
+
+func (c *end) LocalAddr() net.Addr {
+	if c.side == 1 {
+		return simAddr(c.pipe.addr)
+	}
+	return simAddr(c.pipe.hosts[0])
+}
+
+func (c *end) RemoteAddr() net.Addr {
+	if c.side == 0 {
+		return simAddr(c.pipe.addr)
+	}
+	return simAddr(c.pipe.hosts[0])
+}
+
+// Deadlines are not simulated; nothing in this tree sets them.
+func (c *end) SetDeadline(t time.Time) error      { return nil }
+func (c *end) SetReadDeadline(t time.Time) error  { return nil }
+func (c *end) SetWriteDeadline(t time.Time) error { return nil }
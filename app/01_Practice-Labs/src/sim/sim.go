@@ -0,0 +1,394 @@
+// Package sim runs Paxos and the services built on it in a deterministic
+// simulation, so that a failing test can be replayed exactly from its seed.
+//
+// A World owns a virtual clock, an in-memory network and a random number
+// generator seeded by the caller. Each simulated machine is a Host, which is
+// the paxos.Transport, the paxos.Clock and the source of randomness of the
+// peers, servers and clerks that run on it:
+//
+//	w := sim.New(seed)
+//	defer w.Stop()
+//	h := w.Host("kv0")
+//	kv := kvpaxos.StartServer(servers, 0,
+//		paxos.WithTransport(h), paxos.WithClock(h), paxos.WithRand(h))
+//
+// Nothing happens in a World on its own. Its scheduler waits until every
+// goroutine in the process is blocked, then fires the next timer or delivers
+// the next message, in virtual time order. Messages take a random latency,
+// may be lost, and are cut off by partitions; a lost message resets its
+// connection, so the RPC it belongs to fails. The events created between two
+// steps are put in a canonical order before anything random is drawn for
+// them, so the run depends only on the seed and not on how the Go scheduler
+// interleaved the goroutines. Trace summarizes a run for comparison.
+//
+// Replay is exact as long as the simulated code only waits on the World: it
+// must not use the wall clock, real sockets or files, and goroutines woken
+// by the same event must not race to create otherwise identical events (for
+// example two connections from one host to one address, dialed at the same
+// call site and starting with the same bytes).
+package sim
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Epoch is the virtual time every World starts at.
+var Epoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// StallTimeout is how long the scheduler waits for the process to go idle
+// before it gives up on exact replay and carries on.
+const StallTimeout = 5 * time.Second
+
+// Seeds returns the seeds a simulation test should run: the one named by
+// the SIM_SEED environment variable, a fresh one if it is "random", or else
+// defaults, so that a plain test run is the same every time.
+func Seeds(defaults ...int64) []int64 {
+	env := os.Getenv("SIM_SEED")
+	if env == "random" {
+		return []int64{time.Now().UnixNano()}
+	}
+	if s, err := strconv.ParseInt(env, 10, 64); err == nil {
+		return []int64{s}
+	}
+	return defaults
+}
+
+// World is a simulated network of hosts sharing one virtual clock.
+type World struct {
+	mu        sync.Mutex
+	seed      int64
+	rng       *rand.Rand           // Only drawn from while the process is idle
+	now       time.Time            // Virtual time
+	queue     eventQueue           // Admitted events, in the order they happen
+	fresh     []*event             // Events created since the last step
+	nevents   uint64               // Events admitted so far
+	hosts     map[string]*Host     // By name
+	listeners map[string]*listener // By address
+	group     map[string]int       // Partition of each host; 0 reaches everyone
+	minDelay  time.Duration        // Least latency of a message
+	maxDelay  time.Duration        // Greatest latency of a message
+	loss      float64              // Probability that a message is lost
+	trace     hash.Hash64          // Hash of every step taken
+	steps     int                  // Steps taken
+	log       io.Writer            // Receives a line per step, or nil
+	idle      chan struct{}        // Closed when an event is created while the queue is empty
+	procs     int                  // GOMAXPROCS before New
+	stopped   bool
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// New creates a World and starts its scheduler. Until Stop, the process runs
+// one goroutine at a time, so that goroutines woken by the same event run in
+// the order they were woken rather than racing each other.
+func New(seed int64) *World {
+	w := &World{
+		seed:      seed,
+		rng:       rand.New(rand.NewSource(seed)),
+		now:       Epoch,
+		hosts:     make(map[string]*Host),
+		listeners: make(map[string]*listener),
+		group:     make(map[string]int),
+		minDelay:  time.Millisecond,
+		maxDelay:  10 * time.Millisecond,
+		trace:     fnv.New64a(),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		procs:     runtime.GOMAXPROCS(1),
+	}
+	go w.run()
+	return w
+}
+
+// Seed returns the seed the World was created with.
+func (w *World) Seed() int64 {
+	return w.seed
+}
+
+// Host returns the host called name, creating it if needed.
+func (w *World) Host(name string) *Host {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	h, ok := w.hosts[name]
+	if !ok {
+		f := fnv.New64a()
+		io.WriteString(f, name)
+		h = &Host{w: w, name: name, rng: rand.New(rand.NewSource(w.seed ^ int64(f.Sum64())))}
+		w.hosts[name] = h
+	}
+	return h
+}
+
+// Now returns the virtual time.
+func (w *World) Now() time.Time {
+	return w.Host("").Now()
+}
+
+// Sleep blocks the calling goroutine for d of virtual time.
+func (w *World) Sleep(d time.Duration) {
+	w.Host("").Sleep(d)
+}
+
+// After returns a channel that receives the virtual time once d has passed.
+func (w *World) After(d time.Duration) <-chan time.Time {
+	return w.Host("").After(d)
+}
+
+// Rand returns a generator seeded from the World, for tests that need
+// random workloads. It must be called from one goroutine at a time.
+func (w *World) Rand() *rand.Rand {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return rand.New(rand.NewSource(w.rng.Int63()))
+}
+
+// SetLatency makes every message take between min and max to arrive.
+func (w *World) SetLatency(min, max time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.minDelay, w.maxDelay = min, max
+}
+
+// SetLoss makes every message get lost with probability p.
+func (w *World) SetLoss(p float64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.loss = p
+}
+
+// Partition splits the named hosts into groups that cannot reach each
+// other. Hosts not named in any group can still reach every host.
+func (w *World) Partition(groups ...[]string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.group = make(map[string]int)
+	for i, g := range groups {
+		for _, name := range g {
+			w.group[name] = i + 1
+		}
+	}
+}
+
+// Heal undoes Partition.
+func (w *World) Heal() {
+	w.Partition()
+}
+
+// SetLog makes the World write a line to out for every step it takes, so
+// two runs can be compared event by event.
+func (w *World) SetLog(out io.Writer) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.log = out
+}
+
+// Trace returns the number of steps taken so far and a hash of all of them.
+// Two runs of the same test with the same seed have the same trace.
+func (w *World) Trace() (int, uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.steps, w.trace.Sum64()
+}
+
+// Stop halts the scheduler. Pending timers fire at once and hosts fall back
+// to the wall clock and refuse connections, so goroutines still running in
+// the World wind down like they would outside it.
+func (w *World) Stop() {
+	w.mu.Lock()
+	if w.stopped {
+		w.mu.Unlock()
+		return
+	}
+	w.stopped = true
+	close(w.stop)
+	w.mu.Unlock()
+	<-w.done
+	runtime.GOMAXPROCS(w.procs)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.admit()
+	for _, e := range w.queue {
+		switch e.kind {
+		case timerEvent:
+			e.fire <- w.now
+		case packetEvent:
+			e.pipe.resetLocked()
+		}
+	}
+	w.queue = nil
+	for _, l := range w.listeners {
+		l.closeLocked()
+	}
+}
+
+// run is the scheduler: whenever the process is idle it admits the events
+// created since the last step and takes the next one.
+func (w *World) run() {
+	defer close(w.done)
+	var stacks []byte
+	for {
+		stacks = w.quiesce(stacks)
+
+		w.mu.Lock()
+		if w.stopped {
+			w.mu.Unlock()
+			return
+		}
+		w.admit()
+		if len(w.queue) == 0 {
+			idle := make(chan struct{})
+			w.idle = idle
+			w.mu.Unlock()
+			select {
+			case <-idle:
+			case <-w.stop:
+				return
+			}
+			continue
+		}
+		w.step(heap.Pop(&w.queue).(*event))
+		w.mu.Unlock()
+	}
+}
+
+// quiesce waits until every other goroutine is blocked.
+func (w *World) quiesce(stacks []byte) []byte {
+	if stacks == nil {
+		stacks = make([]byte, 64<<10)
+	}
+	start := time.Now()
+	for spins := 0; ; spins++ {
+		runtime.Gosched()
+		n := runtime.Stack(stacks, true)
+		if n == len(stacks) {
+			stacks = make([]byte, 2*len(stacks))
+			continue
+		}
+		g := busy(stacks[:n])
+		if g == nil {
+			return stacks
+		}
+		if time.Since(start) > StallTimeout {
+			fmt.Printf("sim: still busy after %v, so seed %d may not replay exactly:\n%s\n", StallTimeout, w.seed, g)
+			return stacks
+		}
+		if spins > 100 {
+			time.Sleep(10 * time.Microsecond)
+		}
+	}
+}
+
+// busy returns the stack of a goroutine other than the first, the caller,
+// that is not blocked, given a dump from runtime.Stack, or nil if there is
+// none. The profiler's goroutine lives in a system call and is not part of
+// any World, so it does not count.
+func busy(stacks []byte) []byte {
+	for i, g := range bytes.Split(stacks, []byte("\n\n")) {
+		header := g
+		if j := bytes.IndexByte(g, '\n'); j >= 0 {
+			header = g[:j]
+		}
+		open, end := bytes.IndexByte(header, '['), bytes.LastIndexByte(header, ']')
+		if i == 0 || open < 0 || end < open {
+			continue
+		}
+		state := header[open+1 : end]
+		if j := bytes.IndexByte(state, ','); j >= 0 {
+			state = state[:j]
+		}
+		switch string(state) {
+		case "syscall":
+			if !bytes.Contains(g, []byte("runtime/pprof.")) {
+				return g
+			}
+		case "running", "runnable", "GC assist wait", "GC assist marking", "preempted":
+			return g
+		}
+	}
+	return nil
+}
+
+// addLocked records a newly created event. Caller must hold w.mu.
+func (w *World) addLocked(e *event) {
+	w.fresh = append(w.fresh, e)
+	if w.idle != nil {
+		close(w.idle)
+		w.idle = nil
+	}
+}
+
+// admit orders the events created since the last step canonically, draws
+// their latencies and losses, and queues them. Caller must hold w.mu.
+func (w *World) admit() {
+	sortEvents(w.fresh)
+	for _, e := range w.fresh {
+		w.nevents++
+		e.seq = w.nevents
+		switch e.kind {
+		case packetEvent:
+			if e.pipe.id == 0 {
+				e.pipe.id = e.seq
+			}
+			e.at = w.now.Add(w.delay())
+			if last := e.pipe.last[e.dir]; e.at.Before(last) {
+				// Connections deliver in order
+				e.at = last
+			}
+			e.pipe.last[e.dir] = e.at
+			e.lost = w.lose()
+		}
+		heap.Push(&w.queue, e)
+	}
+	w.fresh = w.fresh[:0]
+}
+
+// delay draws the latency of a message. Caller must hold w.mu.
+func (w *World) delay() time.Duration {
+	return w.minDelay + time.Duration(w.rng.Int63n(int64(w.maxDelay-w.minDelay)+1))
+}
+
+// lose draws whether a message is lost. Caller must hold w.mu.
+func (w *World) lose() bool {
+	return w.loss > 0 && w.rng.Float64() < w.loss
+}
+
+// reachable reports whether host a can currently reach host b. Caller must
+// hold w.mu.
+func (w *World) reachable(a, b string) bool {
+	ga, gb := w.group[a], w.group[b]
+	return ga == 0 || gb == 0 || ga == gb
+}
+
+// step advances the clock to e and makes it happen. Caller must hold w.mu.
+func (w *World) step(e *event) {
+	if e.at.After(w.now) {
+		w.now = e.at
+	}
+	var outcome string
+	switch e.kind {
+	case timerEvent:
+		e.fire <- w.now
+		outcome = "fired"
+	case packetEvent:
+		outcome = w.deliver(e)
+	}
+
+	w.steps++
+	line := fmt.Sprintf("%v %v %s\n", w.now.Sub(Epoch), e, outcome)
+	w.trace.Write([]byte(line))
+	if w.log != nil {
+		io.WriteString(w.log, line)
+	}
+}
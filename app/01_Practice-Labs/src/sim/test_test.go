@@ -0,0 +1,154 @@
+package sim
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTimers(t *testing.T) {
+	fmt.Printf("Test: Timers fire in virtual time order ...\n")
+
+	w := New(1)
+	defer w.Stop()
+
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for _, ms := range []int{30, 10, 20} {
+		wg.Add(1)
+		go func(ms int) {
+			defer wg.Done()
+			w.Host(fmt.Sprint(ms)).Sleep(time.Duration(ms) * time.Millisecond)
+			mu.Lock()
+			order = append(order, ms)
+			mu.Unlock()
+		}(ms)
+	}
+	wg.Wait()
+
+	if fmt.Sprint(order) != "[10 20 30]" {
+		t.Fatalf("timers fired in order %v", order)
+	}
+	if d := w.Now().Sub(Epoch); d != 30*time.Millisecond {
+		t.Fatalf("virtual time is %v after sleeping 30ms", d)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// echo serves connections on l, writing back what it reads.
+func echo(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(conn, conn)
+			conn.Close()
+		}()
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	w := New(2)
+	defer w.Stop()
+
+	l, err := w.Host("server").Listen("echo")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go echo(l)
+	client := w.Host("client")
+
+	fmt.Printf("Test: Connections deliver in order ...\n")
+
+	conn, err := client.Dial("echo")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(conn, "%d,", i)
+	}
+	want := "0,1,2,3,4,5,6,7,8,9,"
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != want {
+		t.Fatalf("read %q, %v; expected %q", got, err, want)
+	}
+	conn.Close()
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Partitions and missing listeners reset connections ...\n")
+
+	w.Partition([]string{"server"}, []string{"client"})
+	conn, _ = client.Dial("echo")
+	conn.Write([]byte("x"))
+	if _, err := conn.Read(got); err == nil {
+		t.Fatalf("read across a partition")
+	}
+	w.Heal()
+
+	conn, _ = client.Dial("nowhere")
+	conn.Write([]byte("x"))
+	if _, err := conn.Read(got); err == nil {
+		t.Fatalf("read from an address nobody listens on")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// chatter has hosts exchange random messages and sleep for random times,
+// and returns the World's trace and everything it logged.
+func chatter(seed int64) (int, uint64, string) {
+	w := New(seed)
+	defer w.Stop()
+	var log bytes.Buffer
+	w.SetLog(&log)
+	w.SetLoss(0.1)
+
+	l, _ := w.Host("server").Listen("echo")
+	go echo(l)
+
+	var wg sync.WaitGroup
+	for c := 0; c < 3; c++ {
+		h := w.Host(fmt.Sprint("client", c))
+		r := w.Rand()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				if conn, err := h.Dial("echo"); err == nil {
+					fmt.Fprintf(conn, "%d", r.Int())
+					conn.Read(make([]byte, 64))
+					conn.Close()
+				}
+				h.Sleep(time.Duration(r.Intn(20)) * time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	steps, trace := w.Trace()
+	return steps, trace, log.String()
+}
+
+func TestReplay(t *testing.T) {
+	fmt.Printf("Test: Same seed, same run ...\n")
+
+	steps1, trace1, log1 := chatter(3)
+	steps2, trace2, log2 := chatter(3)
+	if steps1 != steps2 || trace1 != trace2 || log1 != log2 {
+		t.Fatalf("took %v steps (trace %x), then %v steps (trace %x)", steps1, trace1, steps2, trace2)
+	}
+	if _, trace3, _ := chatter(4); trace3 == trace1 {
+		t.Fatalf("another seed made the same run")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}